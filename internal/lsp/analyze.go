@@ -1,8 +1,8 @@
 package lsp
 
 import (
+	"context"
 	"fmt"
-	"regexp"
 	"strconv"
 	"strings"
 
@@ -17,6 +17,7 @@ type ForwardReference struct {
 	PC           int64  // Program counter where this reference occurs (for branch distance calculation)
 	IsMultiLabel bool   // True if this is a multi-label reference
 	Direction    rune   // '+' for forward, '-' for backward (only for multi-labels)
+	Namespace    string // Namespace the reference was made in
 }
 
 // MacroDefinition represents a macro with enhanced analysis
@@ -26,6 +27,10 @@ type MacroDefinition struct {
 	LocalLabels []string
 	Body        []Statement
 	UsageCount  int
+	Definition  *DirectiveStatement // The .macro directive
+	URI         string              // Document the macro is defined in
+	Source      string              // Source text between the braces of the body
+	SourceLine  int                 // 0-based line Source starts in
 }
 
 // MemoryMap represents C64/6502 memory layout for assembler context
@@ -62,12 +67,26 @@ type AnalysisContext struct {
 	CPUFlags           *CPUFlags                   // Processor flags state
 	CurrentNamespace   string                      // Current namespace context for label resolution
 	NamespaceStack     []string                    // Stack for nested namespaces
+	ImportedLabels     map[string]*Symbol          // Labels/constants from #import'ed files
+	ImportedFiles      []string                    // URIs of files pulled in via #import (direct imports only)
+	ImportOnce         bool                        // The file has #importonce
+	Timings            []InstructionTiming         // Cycle timing per instruction, in source order
+	Incomplete         bool                        // Analysis was stopped early (time budget or nesting depth)
+	MacroExpansions    []*MacroExpansion           // Macro calls expanded in Pass 1, in order
+	InactiveRanges     []InactiveRange             // #if and .if branches that aren't assembled, in source order
+	EncodedTexts       []EncodedText               // Strings of .text directives with their bytes
+	Segments           []*Segment                  // Segments in the order they were defined, Default first
+
+	expansions     map[string]*MacroExpansion // MacroExpansions by label namespace
+	encodedTexts   map[Position]int           // EncodedTexts by start of the string
+	currentSegment *Segment                   // Segment Pass 1 is in
+	currentBlock   *SegmentBlock              // Memory block Pass 1 is in, added to its segment when it ends
 }
 
 // NewAnalysisContext creates a new enhanced analysis context
 func NewAnalysisContext() *AnalysisContext {
 	return &AnalysisContext{
-		CurrentPC:          0x1000, // Default start address
+		CurrentPC:          defaultStartAddress,
 		DefinedLabels:      make(map[string]*Symbol),
 		DefinedMultiLabels: make(map[string][]*Symbol),
 		DefinedSymbols:     make(map[string]bool),
@@ -77,6 +96,11 @@ func NewAnalysisContext() *AnalysisContext {
 		CPUFlags:           &CPUFlags{},
 		CurrentNamespace:   "",
 		NamespaceStack:     []string{},
+		ImportedLabels:     make(map[string]*Symbol),
+		ImportedFiles:      []string{},
+		Timings:            []InstructionTiming{},
+		expansions:         make(map[string]*MacroExpansion),
+		encodedTexts:       make(map[Position]int),
 	}
 }
 
@@ -90,10 +114,9 @@ func (ctx *AnalysisContext) getQualifiedLabelName(label string) string {
 
 // lookupLabel searches for a label in the current namespace first, then globally
 func (ctx *AnalysisContext) lookupLabel(label string) (*Symbol, bool) {
-	// First try with namespace prefix (current namespace)
-	if ctx.CurrentNamespace != "" {
-		qualifiedName := ctx.CurrentNamespace + "." + label
-		if symbol, found := ctx.DefinedLabels[qualifiedName]; found {
+	// First try with namespace prefix (current namespace, then the namespaces around it)
+	for namespace := ctx.CurrentNamespace; namespace != ""; namespace = parentNamespace(namespace) {
+		if symbol, found := ctx.DefinedLabels[namespace+"."+label]; found {
 			return symbol, true
 		}
 	}
@@ -103,18 +126,40 @@ func (ctx *AnalysisContext) lookupLabel(label string) (*Symbol, bool) {
 		return symbol, true
 	}
 
+	// Finally try symbols from imported files
+	if symbol, found := ctx.ImportedLabels[label]; found {
+		return symbol, true
+	}
+
 	return nil, false
 }
 
+// parentNamespace returns the namespace around a nested one, "" at the top level
+func parentNamespace(namespace string) string {
+	if dot := strings.LastIndex(namespace, "."); dot >= 0 {
+		return namespace[:dot]
+	}
+	return ""
+}
+
+// isImportedLabel reports whether a symbol was pulled in from an #import'ed file
+func (ctx *AnalysisContext) isImportedLabel(symbol *Symbol) bool {
+	for _, imported := range ctx.ImportedLabels {
+		if imported == symbol {
+			return true
+		}
+	}
+	return false
+}
+
 // lookupMultiLabel searches for a multi-label instance based on direction and position
 // direction: '+' for forward (next instance after fromPC), '-' for backward (previous instance before fromPC)
 // Returns the appropriate instance or nil if not found
 func (ctx *AnalysisContext) lookupMultiLabel(label string, direction rune, fromPC int64) (*Symbol, bool) {
-	// Try with namespace prefix first
+	// Try with namespace prefix first, the innermost namespace that has the label
 	var instances []*Symbol
-	if ctx.CurrentNamespace != "" {
-		qualifiedName := ctx.CurrentNamespace + "." + label
-		if inst, found := ctx.DefinedMultiLabels[qualifiedName]; found {
+	for namespace := ctx.CurrentNamespace; namespace != "" && instances == nil; namespace = parentNamespace(namespace) {
+		if inst, found := ctx.DefinedMultiLabels[namespace+"."+label]; found {
 			instances = inst
 		}
 	}
@@ -211,16 +256,91 @@ type SemanticAnalyzer struct {
 	context *AnalysisContext
 	// Track if we're inside a macro or function template (for skipping PC-based validations)
 	inMacroOrFunction bool
+	// URIs of the files currently being imported (guards against #import cycles)
+	importChain []string
+	// Program counter the document starts at: the address of the #import for an imported file
+	startAddress int64
+	// Files included so far by the root document's analysis, see includedFiles
+	included *includedFiles
+	// Set by a label so the next instruction starts a new cycle-count block
+	pendingTimingBlock bool
+	// Addressing modes chosen in Pass 1, see instructionMode
+	instructionModes map[*InstructionStatement]string
+	// Analysis budget, see ParseDocumentContext. stopped is set once it ran out.
+	ctx     context.Context
+	stopped bool
+	// Settings for this document, including its .kickass_ls.json files
+	config LSPConfiguration
+	// Symbols defined by the build configuration rather than by #define
+	buildDefines map[string]bool
+	// Encoding of .text strings, set by .encoding in Pass 1, and the strings whose
+	// characters were checked
+	encoding     string
+	checkedTexts map[Position]bool
+	// Label in front of each .for/.while loop, which names its iterations (loop[2].label)
+	loopLabels map[*DirectiveStatement]string
+	// Innermost macro expansion Pass 1 is in, nil outside of macros
+	expansion *MacroExpansion
+	// Macro arguments to evaluate again once all labels are known, see resolveMacroArguments
+	pendingArguments []macroArgument
+	// .if/else chains Pass 1 evaluated, and the blocks it assembled at least once
+	conditionals          []*DirectiveStatement
+	evaluatedConditionals map[*DirectiveStatement]bool
+	assembledBlocks       map[*BlockStatement]bool
+	// Segments named by .segment and by parameters, checked once Pass 1 is done
+	segmentRefs []segmentRef
 }
 
 // NewSemanticAnalyzer creates a new analyzer.
 func NewSemanticAnalyzer(scope *Scope, text string) *SemanticAnalyzer {
-	return &SemanticAnalyzer{
+	a := &SemanticAnalyzer{
 		scope:         scope,
 		diagnostics:   GetPooledDiagnostics(), // Use pooled diagnostics slice
 		documentLines: strings.Split(text, "\n"),
 		context:       NewAnalysisContext(),
+		startAddress:  defaultStartAddress,
+		included:      newIncludedFiles(),
+
+		instructionModes: make(map[*InstructionStatement]string),
+		ctx:              context.Background(),
+		config:           GetDocumentConfig(scope.Uri),
+		loopLabels:       make(map[*DirectiveStatement]string),
+
+		evaluatedConditionals: make(map[*DirectiveStatement]bool),
+		assembledBlocks:       make(map[*BlockStatement]bool),
+
+		encoding:     defaultTextEncoding,
+		checkedTexts: make(map[Position]bool),
+	}
+
+	// The build's defines hold from the first line on, like Kick Assembler's -define
+	a.buildDefines = make(map[string]bool)
+	for _, name := range a.config.activeDefines() {
+		a.buildDefines[normalizeLabel(name)] = true
+		a.context.DefinedSymbols[normalizeLabel(name)] = true
+	}
+	return a
+}
+
+// shouldStop reports whether the analysis budget ran out. The first time it does, a warning
+// at stmt tells the user that the results after it are incomplete.
+func (a *SemanticAnalyzer) shouldStop(stmt Statement) bool {
+	if a.stopped {
+		return true
+	}
+	if a.ctx == nil || a.ctx.Err() == nil {
+		return false
+	}
+	a.stopped = true
+	a.context.Incomplete = true
+
+	reason := "the analysis was cancelled"
+	if a.ctx.Err() == context.DeadlineExceeded {
+		reason = fmt.Sprintf("the time budget of %dms ran out", a.config.AnalysisLimits.TimeoutMs)
 	}
+	a.addWarning(statementToken(stmt), "Analysis stopped here, %s - results below are incomplete", reason)
+	log.Warn("SemanticAnalyzer: stopped at line %d, %s", statementToken(stmt).Line, reason)
+	return true
 }
 
 // GetContext returns the analysis context (for use by Goto Definition, etc.)
@@ -234,26 +354,42 @@ func (a *SemanticAnalyzer) Analyze(program *Program) []Diagnostic {
 		return a.diagnostics
 	}
 
-	// Pass 1: Address calculation and label collection
+	// Macros can be called above their definition
+	a.collectMacroDefinitions(program.Statements, "")
+
+	// Pass 1: Address calculation and label collection, with a program counter per segment
+	a.beginSegments()
 	a.pass1AddressCalculation(program.Statements)
+	a.finishSegments()
+
+	// Pass 1 decided which .if branches are assembled
+	a.collectInactiveRanges(program)
 
 	// Workaround: Token-level analysis for .byte/.word range validation
 	// This bypasses the parser issue where comma-separated data directives don't create AST nodes
 	a.performTokenLevelRangeValidation()
 
-	// Pass 2: Forward reference resolution
+	// Pass 2: Forward reference resolution, with macro arguments that referred to labels further down
+	a.resolveMacroArguments()
 	a.pass2ForwardReferenceResolution()
 
+	// Cycle timings need the branch targets resolved in Pass 2
+	a.resolveInstructionTimings()
+	a.checkCycleBudgets()
+
+	// Label addresses from the last real build, if there is one
+	a.checkAssemblerSymbols()
+
 	// Pass 3: Traditional usage analysis (existing)
 	// Reset PC to start address for Pass 3 (PC was modified during Pass 1)
-	a.context.CurrentPC = 0x1000
+	a.context.CurrentPC = a.startAddress
 	a.walkStatements(program.Statements, a.scope)
 
 	// Pass 4: Dead code detection
 	a.pass4DeadCodeDetection(program.Statements)
 
 	// After walking the whole tree, check for unused symbols.
-	config := GetLSPConfig()
+	config := a.config
 	if config.WarnUnusedLabels {
 		a.diagnostics = append(a.diagnostics, a.checkForUnusedSymbols(a.scope)...)
 	}
@@ -263,20 +399,32 @@ func (a *SemanticAnalyzer) Analyze(program *Program) []Diagnostic {
 
 // Pass 1: Address calculation and label collection
 func (a *SemanticAnalyzer) pass1AddressCalculation(statements []Statement) {
-	// First, handle unparsed .for directives by scanning document lines
-	a.handleUnparsedForDirectives()
 	if statements == nil {
 		return
 	}
 
+	loopLabel := ""
 	for _, statement := range statements {
 		if statement == nil {
 			continue
 		}
+		if a.shouldStop(statement) {
+			return
+		}
+		label := loopLabel
+		loopLabel = ""
+		if a.expansion != nil {
+			a.expansion.recordAddress(statementToken(statement).Line-1, a.context.CurrentPC)
+		}
 
 		switch stmt := statement.(type) {
 		case *LabelStatement:
 			if stmt != nil && stmt.Name != nil {
+				a.pendingTimingBlock = true
+				if stmt.Token.Type != TOKEN_MULTILABEL {
+					loopLabel = stmt.Name.Value
+				}
+
 				// Skip label registration inside macro/function templates
 				// Labels in templates are local to the template, not global
 				if !a.inMacroOrFunction {
@@ -295,6 +443,7 @@ func (a *SemanticAnalyzer) pass1AddressCalculation(statements []Statement) {
 					}
 
 					qualifiedName := a.context.getQualifiedLabelName(normalizeLabel(stmt.Name.Value))
+					a.recordSegmentLabel(symbol)
 
 					if isMultiLabel {
 						symbol.Kind = MultiLabel
@@ -309,15 +458,35 @@ func (a *SemanticAnalyzer) pass1AddressCalculation(statements []Statement) {
 					}
 				}
 			}
+		case *ExpressionStatement:
+			// Macro calls emit the code of the macro body, templates only run when called
+			if stmt != nil && !a.inMacroOrFunction {
+				a.expandMacroCall(stmt, label)
+			}
 		case *InstructionStatement:
 			if stmt != nil {
 				// Pass 1: Only calculate address, no enhanced analysis (to avoid duplicate diagnostics)
+				a.recordInstructionTiming(stmt, strings.ToUpper(stmt.Token.Literal))
+				start := a.context.CurrentPC
 				a.calculateInstructionAddress(stmt)
+				a.recordEmission(stmt.Token, start)
 			}
 		case *DirectiveStatement:
 			if stmt != nil {
+				start := a.context.CurrentPC
 				a.processDirectivePass1(stmt) // Use Pass 1 version
-				if stmt.Block != nil && stmt.Block.Statements != nil {
+				if emittingDirectives[strings.ToLower(stmt.Token.Literal)] {
+					a.recordEmission(stmt.Token, start)
+				}
+				if isLoopDirective(stmt) && !a.inMacroOrFunction && stmt.Block != nil {
+					a.loopLabels[stmt] = label
+					a.runLoop(stmt, true, func() { a.pass1AddressCalculation(stmt.Block.Statements) })
+				} else if isIfDirective(stmt) {
+					// Only the branch the condition selects takes space
+					for _, block := range a.assembleConditional(stmt) {
+						a.pass1AddressCalculation(block.Statements)
+					}
+				} else if stmt.Block != nil && stmt.Block.Statements != nil {
 					// Check if this is a macro, function, or pseudocommand (templates, not executable code)
 					directiveName := strings.ToLower(stmt.Token.Literal)
 					isMacroOrFunction := directiveName == ".macro" || directiveName == ".function" || directiveName == ".pseudocommand"
@@ -326,6 +495,7 @@ func (a *SemanticAnalyzer) pass1AddressCalculation(statements []Statement) {
 					// Set flag to skip PC-based validations in templates
 					if isMacroOrFunction {
 						a.inMacroOrFunction = true
+						a.pendingTimingBlock = true
 					}
 
 					// Handle namespace: push namespace context
@@ -343,6 +513,7 @@ func (a *SemanticAnalyzer) pass1AddressCalculation(statements []Statement) {
 					// Reset flag after processing block
 					if isMacroOrFunction {
 						a.inMacroOrFunction = false
+						a.pendingTimingBlock = true
 					}
 
 					// Pop namespace context
@@ -358,7 +529,17 @@ func (a *SemanticAnalyzer) pass1AddressCalculation(statements []Statement) {
 
 // Pass 2: Forward reference resolution
 func (a *SemanticAnalyzer) pass2ForwardReferenceResolution() {
+	savedNamespace := a.context.CurrentNamespace
+	defer func() { a.context.CurrentNamespace = savedNamespace }()
+
+	// A reference inside a loop is made once per iteration, report it once
+	reported := make(map[Position]bool)
 	for _, ref := range a.context.ForwardRefs {
+		if reported[ref.Position] {
+			continue
+		}
+		a.context.CurrentNamespace = ref.Namespace
+
 		var symbol *Symbol
 		var found bool
 
@@ -370,7 +551,8 @@ func (a *SemanticAnalyzer) pass2ForwardReferenceResolution() {
 		}
 
 		if found {
-			if ref.Context == "branch" {
+			// The distance to the target of a macro argument that couldn't be evaluated is unknown
+			if ref.Context == "branch" && (symbol.Evaluated == nil || symbol.Evaluated.Known()) {
 				// Validate branch distance now that we know the label address
 				// Use the stored PC from when the branch instruction was processed
 				distance := symbol.Address - (ref.PC + 2) // +2 because branches are relative to PC+2
@@ -384,8 +566,10 @@ func (a *SemanticAnalyzer) pass2ForwardReferenceResolution() {
 						},
 						Message: fmt.Sprintf("Forward reference: Branch distance %d out of range (-128 to +127)", distance),
 						Source:  "enhanced-analyzer",
+						Code:    codeBranchOutOfRange,
 					}
 					a.diagnostics = append(a.diagnostics, diagnostic)
+					reported[ref.Position] = true
 				}
 			}
 		} else {
@@ -398,8 +582,11 @@ func (a *SemanticAnalyzer) pass2ForwardReferenceResolution() {
 				},
 				Message: fmt.Sprintf("Undefined symbol '%s'", ref.SymbolName),
 				Source:  "enhanced-analyzer",
+				Code:    codeUndefinedSymbol,
+				Data:    map[string]interface{}{"name": ref.SymbolName},
 			}
 			a.diagnostics = append(a.diagnostics, diagnostic)
+			reported[ref.Position] = true
 		}
 	}
 }
@@ -411,7 +598,7 @@ func (a *SemanticAnalyzer) walkStatements(statements []Statement, currentScope *
 }
 
 func (a *SemanticAnalyzer) walkStatement(stmt Statement, currentScope *Scope) {
-	if stmt == nil {
+	if stmt == nil || a.shouldStop(stmt) {
 		return
 	}
 	switch node := stmt.(type) {
@@ -432,7 +619,30 @@ func (a *SemanticAnalyzer) walkStatement(stmt Statement, currentScope *Scope) {
 			if node.Value != nil {
 				a.walkExpression(node.Value, currentScope)
 			}
-			if node.Block != nil {
+			if node.Options != nil {
+				for _, parameter := range node.Options.Parameters {
+					if parameter.Value != nil {
+						a.walkExpression(parameter.Value, currentScope)
+					}
+				}
+			}
+			if node.Block != nil && isLoopDirective(node) && !a.inMacroOrFunction {
+				loopScope := currentScope.findChildScopeAt(Position{Line: node.Token.Line - 1, Character: node.Token.Column - 1})
+				if loopScope == nil {
+					loopScope = currentScope
+				}
+				a.runLoop(node, false, func() { a.walkStatements(node.Block.Statements, loopScope) })
+			} else if isIfDirective(node) {
+				for alternative, ok := node.Alternative.(*DirectiveStatement); ok; alternative, ok = alternative.Alternative.(*DirectiveStatement) {
+					if alternative.Value != nil {
+						a.walkExpression(alternative.Value, currentScope)
+					}
+				}
+				// Code that isn't assembled has no usages and isn't checked
+				for _, block := range a.activeConditionalBlocks(node) {
+					a.walkStatements(block.Statements, currentScope)
+				}
+			} else if node.Block != nil {
 				// Check if this is a macro, function, or pseudocommand (templates, not executable code)
 				directiveName := strings.ToLower(node.Token.Literal)
 				isMacroOrFunction := directiveName == ".macro" || directiveName == ".function" || directiveName == ".pseudocommand"
@@ -477,14 +687,32 @@ func (a *SemanticAnalyzer) walkExpression(expr Expression, currentScope *Scope)
 			}
 		}
 
-		if symbol, found := currentScope.FindSymbol(node.Value); found {
-			symbol.UsageCount++
+		symbol, found := currentScope.FindSymbol(node.Value)
+		if dot := strings.Index(node.Value, "."); !found && dot > 0 {
+			// Method call on a list, hashtable or string: list.add
+			symbol, found = currentScope.FindSymbol(node.Value[:dot])
+		}
+		if found {
+			// Symbols from imported files belong to their own document
+			if symbol.Scope == nil || symbol.Scope.Uri == currentScope.Uri {
+				symbol.UsageCount++
+			}
 		}
 	case *PrefixExpression:
 		if node.Right != nil {
 			a.walkExpression(node.Right, currentScope)
 		}
 	case *InfixExpression:
+		if path, indexes, ok := loopLabelPath(node); ok {
+			// loop[2].label uses the label in the body of the loop
+			for _, symbol := range currentScope.findLoopLabels(path) {
+				symbol.UsageCount++
+			}
+			for _, index := range indexes {
+				a.walkExpression(index, currentScope)
+			}
+			return
+		}
 		if node.Left != nil {
 			a.walkExpression(node.Left, currentScope)
 		}
@@ -495,6 +723,17 @@ func (a *SemanticAnalyzer) walkExpression(expr Expression, currentScope *Scope)
 		if node.Expression != nil {
 			a.walkExpression(node.Expression, currentScope)
 		}
+	case *IndexExpression:
+		a.walkExpression(node.Left, currentScope)
+		a.walkExpression(node.Index, currentScope)
+	case *ForExpression:
+		for _, init := range node.Init {
+			a.walkExpression(init, currentScope)
+		}
+		a.walkExpression(node.Condition, currentScope)
+		for _, step := range node.Step {
+			a.walkExpression(step, currentScope)
+		}
 	case *CallExpression:
 		// First, walk the function identifier itself to mark it as used
 		a.walkExpression(node.Function, currentScope)
@@ -586,6 +825,14 @@ func (a *SemanticAnalyzer) addDiagnostic(severity DiagnosticSeverity, token Toke
 	a.diagnostics = append(a.diagnostics, diagnostic)
 }
 
+// addCodedDiagnostic adds a diagnostic with a code and the data its quick fix needs
+func (a *SemanticAnalyzer) addCodedDiagnostic(severity DiagnosticSeverity, token Token, code string, data map[string]interface{}, format string, args ...interface{}) {
+	a.addDiagnostic(severity, token, fmt.Sprintf(format, args...))
+	diagnostic := &a.diagnostics[len(a.diagnostics)-1]
+	diagnostic.Code = code
+	diagnostic.Data = data
+}
+
 // addError adds an error diagnostic
 func (a *SemanticAnalyzer) addError(token Token, format string, args ...interface{}) {
 	a.addDiagnostic(SeverityError, token, fmt.Sprintf(format, args...))
@@ -608,43 +855,34 @@ func (a *SemanticAnalyzer) addInfo(token Token, format string, args ...interface
 
 // Address calculation and PC tracking methods
 
-// getInstructionLength returns the byte length of an instruction
-func (a *SemanticAnalyzer) getInstructionLength(mnemonic string, operand Expression) int {
-	// 6502 instruction lengths based on addressing mode
-	switch mnemonic {
-	case "BRK", "RTI", "RTS":
-		return 1 // Implied
-	case "PHP", "PLP", "PHA", "PLA", "DEY", "TAY", "INY", "INX",
-		"CLC", "SEC", "CLI", "SEI", "CLV", "CLD", "SED", "TXA",
-		"TYA", "TXS", "TSX", "DEX", "NOP":
-		return 1 // Implied
+// getInstructionLength returns the byte length of an instruction in the addressing mode
+// chosen in Pass 1, as listed in mnemonic.json
+func (a *SemanticAnalyzer) getInstructionLength(mnemonic string, node *InstructionStatement) int {
+	ctx := GetProcessorContext()
+	if ctx == nil {
+		return 1
 	}
-
-	if operand == nil {
-		return 1 // Implied addressing
+	info := ctx.GetMnemonicInfo(mnemonic)
+	if info == nil {
+		return 1
 	}
 
-	// Analyze operand to determine addressing mode
-	switch expr := operand.(type) {
-	case *PrefixExpression:
-		if expr.Operator == "#" {
-			return 2 // Immediate mode (#$nn)
+	mode := a.instructionMode(info, node)
+	for _, m := range info.AddressingModes {
+		if m.Mode == mode && m.Length > 0 {
+			return m.Length
 		}
-		if expr.Operator == "<" || expr.Operator == ">" {
-			return 2 // Zero page or high byte
-		}
-	case *IntegerLiteral:
-		// Absolute or zero page
-		if expr.Value >= 0 && expr.Value <= 255 {
-			return 2 // Could be zero page
-		}
-		return 3 // Absolute
-	case *Identifier:
-		// Label reference - assume absolute for now
-		return 3
 	}
 
-	return 3 // Default to absolute addressing
+	// The mnemonic doesn't support the mode (reported in Pass 3) - size it by the operand form
+	switch {
+	case mode == "Implied" || mode == "Accumulator":
+		return 1
+	case mode == "Immediate" || mode == "Relative" || strings.HasPrefix(mode, "Zeropage") ||
+		mode == "Indexed-indirect" || mode == "Indirect-indexed":
+		return 2
+	}
+	return 3
 }
 
 // isBranchInstruction checks if a mnemonic is a branch instruction
@@ -678,10 +916,11 @@ func (a *SemanticAnalyzer) calculateInstructionAddress(node *InstructionStatemen
 	}
 
 	mnemonic := strings.ToUpper(node.Token.Literal)
-	length := a.getInstructionLength(mnemonic, node.Operand)
+	length := a.getInstructionLength(mnemonic, node)
 
-	// Check for zero page optimization opportunities (doesn't create duplicates)
-	if node.Operand != nil {
+	// Check for zero page optimization opportunities (doesn't create duplicates). In a macro
+	// the operand changes with the arguments.
+	if node.Operand != nil && a.expansion == nil {
 		a.checkZeroPageOptimization(mnemonic, node.Operand, node.Token)
 	}
 
@@ -726,6 +965,9 @@ func (a *SemanticAnalyzer) processInstruction(node *InstructionStatement) {
 	// Check for illegal opcodes
 	a.checkIllegalOpcode(mnemonic, node.Token)
 
+	// Check that the mnemonic supports the addressing mode of the operand
+	a.checkAddressingMode(node, mnemonic)
+
 	// Check for magic numbers (Zero Page optimization is handled in Pass 1)
 	if node.Operand != nil {
 		a.checkMagicNumbers(node.Operand, node.Token)
@@ -743,7 +985,7 @@ func (a *SemanticAnalyzer) processInstruction(node *InstructionStatement) {
 // validateBranchDistancePass1 checks if branch distance is within 6502 limits (Pass 1)
 // This validates backward branches and creates forward references for forward branches
 func (a *SemanticAnalyzer) validateBranchDistancePass1(operand Expression, token Token) {
-	config := GetLSPConfig()
+	config := a.config
 
 	// Check if branch distance validation is enabled
 	if !config.BranchDistanceValidation.Enabled || !config.BranchDistanceValidation.ShowWarnings {
@@ -778,7 +1020,7 @@ func (a *SemanticAnalyzer) validateBranchDistancePass1(operand Expression, token
 				// Calculate branch distance
 				distance := symbol.Address - (a.context.CurrentPC + 2)
 				if distance < -128 || distance > 127 {
-					a.addError(token, "Branch distance %d out of range (-128 to +127)", distance)
+					a.addCodedDiagnostic(SeverityError, token, codeBranchOutOfRange, nil, "Branch distance %d out of range (-128 to +127)", distance)
 				}
 			} else {
 				// Add forward reference for later resolution (only for forward multi-labels)
@@ -788,6 +1030,7 @@ func (a *SemanticAnalyzer) validateBranchDistancePass1(operand Expression, token
 						Position:     Position{Line: token.Line - 1, Character: token.Column - 1},
 						Context:      "branch",
 						PC:           a.context.CurrentPC,
+						Namespace:    a.context.CurrentNamespace,
 						IsMultiLabel: true,
 						Direction:    direction,
 					})
@@ -797,12 +1040,17 @@ func (a *SemanticAnalyzer) validateBranchDistancePass1(operand Expression, token
 				}
 			}
 		} else {
-			// Regular label lookup
-			if symbol, found := a.context.lookupLabel(normalizeLabel(ident.Value)); found {
+			// Regular label lookup. A macro argument referring to a label further down is only
+			// known in Pass 2.
+			symbol, found := a.context.lookupLabel(normalizeLabel(ident.Value))
+			if found && symbol.Evaluated != nil && !symbol.Evaluated.Known() {
+				found = false
+			}
+			if found {
 				// Calculate branch distance (branch instruction PC + 2 is the base)
 				distance := symbol.Address - (a.context.CurrentPC + 2)
 				if distance < -128 || distance > 127 {
-					a.addError(token, "Branch distance %d out of range (-128 to +127)", distance)
+					a.addCodedDiagnostic(SeverityError, token, codeBranchOutOfRange, nil, "Branch distance %d out of range (-128 to +127)", distance)
 				}
 			} else {
 				// Add forward reference for later resolution
@@ -811,6 +1059,7 @@ func (a *SemanticAnalyzer) validateBranchDistancePass1(operand Expression, token
 					Position:   Position{Line: token.Line - 1, Character: token.Column - 1},
 					Context:    "branch",
 					PC:         a.context.CurrentPC, // Store the PC where the branch instruction is
+					Namespace:  a.context.CurrentNamespace,
 				})
 			}
 		}
@@ -829,6 +1078,7 @@ func (a *SemanticAnalyzer) validateJumpTarget(operand Expression, token Token) {
 				Position:   Position{Line: token.Line - 1, Character: token.Column - 1},
 				Context:    "jump",
 				PC:         a.context.CurrentPC,
+				Namespace:  a.context.CurrentNamespace,
 			})
 		}
 	}
@@ -860,6 +1110,7 @@ func (a *SemanticAnalyzer) validateSymbolsInExpression(expr Expression, token To
 				Position:   Position{Line: token.Line - 1, Character: token.Column - 1},
 				Context:    "operand",
 				PC:         a.context.CurrentPC,
+				Namespace:  a.context.CurrentNamespace,
 			})
 		}
 	case *PrefixExpression:
@@ -905,6 +1156,12 @@ func (a *SemanticAnalyzer) processDirectiveWithPass(node *DirectiveStatement, is
 				a.processDataDirective(node)
 			}
 		}
+		if directive == "#import" && isPass1 {
+			a.processImportDirective(node)
+		}
+		if directive == "#importonce" && isPass1 {
+			a.context.ImportOnce = true
+		}
 		return
 	}
 	if a.context == nil {
@@ -923,7 +1180,11 @@ func (a *SemanticAnalyzer) processDirectiveWithPass(node *DirectiveStatement, is
 
 			// Check if already defined
 			if _, exists := a.context.DefinedSymbols[symbolName]; exists {
-				a.addWarning(node.Token, "Symbol '%s' is already defined", node.Name.Value)
+				if a.buildDefines[symbolName] {
+					a.addWarning(node.Token, "Symbol '%s' is already defined by the build configuration", node.Name.Value)
+				} else {
+					a.addWarning(node.Token, "Symbol '%s' is already defined", node.Name.Value)
+				}
 			} else {
 				// Add to defined symbols table
 				a.context.DefinedSymbols[symbolName] = true
@@ -944,30 +1205,25 @@ func (a *SemanticAnalyzer) processDirectiveWithPass(node *DirectiveStatement, is
 				log.Debug("processDirective #undef: undefined symbol '%s'", node.Name.Value)
 			}
 		}
+	case "#importif":
+		// Conditional import - only follow the file if the symbol is defined (Pass 1 only)
+		if isPass1 && a.context.DefinedSymbols[normalizeLabel(node.Name.Value)] {
+			a.processImportDirective(node)
+		}
 	case ".encoding":
-		// Encoding directive - validate encoding name (ONLY in Pass 1 to avoid duplicate warnings)
+		// Encoding directive - validate encoding name and encode the following .text strings
+		// with it (ONLY in Pass 1 to avoid duplicate warnings)
 		if !isPass1 {
 			return
 		}
 		if node.Value != nil {
 			if strLit, ok := node.Value.(*StringLiteral); ok {
 				encodingName := strings.ToLower(strLit.Value)
-				validEncodings := []string{
-					"petscii", "petscii_upper", "petscii_mixed", "petscii_lower",
-					"screencode", "screencode_upper", "screencode_mixed", "screencode_lower",
-					"ascii",
-				}
-
-				isValid := false
-				for _, valid := range validEncodings {
-					if encodingName == valid {
-						isValid = true
-						break
-					}
-				}
-
+				isValid := textEncodings[encodingName] != nil
 				if !isValid {
-					a.addWarning(node.Token, "Unknown encoding '%s'. Valid encodings: petscii, petscii_upper, petscii_mixed, screencode, screencode_upper, screencode_mixed, ascii", strLit.Value)
+					a.addWarning(node.Token, "Unknown encoding '%s'. Valid encodings: %s", strLit.Value, strings.Join(textEncodingNames(), ", "))
+				} else if !a.inMacroOrFunction {
+					a.encoding = encodingName
 				}
 				log.Debug("processDirective .encoding: name=%s, valid=%v", encodingName, isValid)
 			}
@@ -991,11 +1247,12 @@ func (a *SemanticAnalyzer) processDirectiveWithPass(node *DirectiveStatement, is
 
 				// Import type validation is already done in parser, no need to duplicate here
 
-				// Check if file exists (relative to workspace root or absolute)
+				// The file is looked up like #import files, its bytes take space (ONLY in Pass 1)
 				if filename != "" {
-					// TODO: In future, add file existence check
-					// For now, just log the import
 					log.Debug("processDirective .import: type=%s, file=%s", importType, filename)
+					if isPass1 && !a.inMacroOrFunction && (importType == "binary" || importType == "c64" || importType == "text") {
+						a.importData(importType, arrayExpr.Elements[1].(*StringLiteral), arrayExpr.Elements[2:])
+					}
 				}
 			}
 		}
@@ -1014,78 +1271,42 @@ func (a *SemanticAnalyzer) processDirectiveWithPass(node *DirectiveStatement, is
 			log.Debug("processDirective .macro: name=%s, params=%d", node.Name.Value, len(node.Parameters))
 		}
 	case ".pc", "*", "*=":
-		// Set program counter (ONLY in Pass 1)
+		// Set program counter (ONLY in Pass 1), which starts a new memory block
 		if isPass1 && node.Value != nil {
 			if addr := a.evaluateExpression(node.Value); addr != -1 {
-				a.context.CurrentPC = addr
+				if a.inMacroOrFunction {
+					a.context.CurrentPC = addr
+				} else {
+					a.setProgramCounter(node, addr)
+				}
 			}
 		}
+	case ".segmentdef":
+		if isPass1 && !a.inMacroOrFunction {
+			a.defineSegment(node, directive)
+		}
+	case ".segment":
+		// Code goes to the segment, at its own program counter
+		if isPass1 && !a.inMacroOrFunction {
+			a.enterSegment(node)
+		}
+	case ".memblock":
+		if isPass1 && !a.inMacroOrFunction {
+			a.startMemoryBlock(node)
+		}
+	case ".file", ".segmentout":
+		if isPass1 && !a.inMacroOrFunction && node.Options != nil {
+			a.checkFileDirective(node, directive)
+		}
 	case ".const", "const":
 		// Constant definition - add to symbol table
-		if node.Name != nil && node.Value != nil {
-			symbol := &Symbol{
-				Name:     node.Name.Value,
-				Kind:     Constant,
-				Position: Position{Line: node.Name.Token.Line - 1, Character: node.Name.Token.Column - 1},
-			}
-
-			// Try to evaluate the constant value
-			addr := a.evaluateExpression(node.Value)
-			log.Debug("processDirective .const: name=%s, addr=%d", node.Name.Value, addr)
-			if addr != -1 {
-				symbol.Address = addr
-				symbol.Value = fmt.Sprintf("$%04X", addr)
-
-				// Check for potential range issues based on variable name
-				name := strings.ToLower(node.Name.Value)
-				if strings.Contains(name, "byte") && (addr < 0 || addr > 255) {
-					log.Debug("processDirective .const: ADDING BYTE WARNING for %s, addr=%d", node.Name.Value, addr)
-					a.addWarning(node.Token, "Constant '%s' value $%X out of byte range ($0-$FF)", node.Name.Value, addr)
-				} else if strings.Contains(name, "word") && (addr < 0 || addr > 65535) {
-					log.Debug("processDirective .const: ADDING WORD WARNING for %s, addr=%d", node.Name.Value, addr)
-					a.addWarning(node.Token, "Constant '%s' value $%X out of word range ($0-$FFFF)", node.Name.Value, addr)
-				}
-			} else {
-				log.Debug("processDirective .const: evaluateExpression returned -1 for %s", node.Name.Value)
-			}
-
-			// Add to symbol table with namespace prefix
-			qualifiedName := a.context.getQualifiedLabelName(normalizeLabel(node.Name.Value))
-			a.context.DefinedLabels[qualifiedName] = symbol
-		}
+		a.defineValueSymbol(node, Constant, isPass1)
 	case ".var", "var":
 		// Variable definition - add to symbol table
-		if node.Name != nil && node.Value != nil {
-			symbol := &Symbol{
-				Name:     node.Name.Value,
-				Kind:     Variable,
-				Position: Position{Line: node.Name.Token.Line - 1, Character: node.Name.Token.Column - 1},
-			}
-
-			// Try to evaluate the variable value
-			addr := a.evaluateExpression(node.Value)
-			log.Debug("processDirective .const: name=%s, addr=%d", node.Name.Value, addr)
-			if addr != -1 {
-				symbol.Address = addr
-				symbol.Value = fmt.Sprintf("$%04X", addr)
-
-				// Check for potential range issues based on variable name
-				name := strings.ToLower(node.Name.Value)
-				if strings.Contains(name, "byte") && (addr < 0 || addr > 255) {
-					log.Debug("processDirective .const: ADDING BYTE WARNING for %s, addr=%d", node.Name.Value, addr)
-					a.addWarning(node.Token, "Constant '%s' value $%X out of byte range ($0-$FF)", node.Name.Value, addr)
-				} else if strings.Contains(name, "word") && (addr < 0 || addr > 65535) {
-					log.Debug("processDirective .const: ADDING WORD WARNING for %s, addr=%d", node.Name.Value, addr)
-					a.addWarning(node.Token, "Constant '%s' value $%X out of word range ($0-$FFFF)", node.Name.Value, addr)
-				}
-			} else {
-				log.Debug("processDirective .const: evaluateExpression returned -1 for %s", node.Name.Value)
-			}
-
-			// Add to symbol table with namespace prefix
-			qualifiedName := a.context.getQualifiedLabelName(normalizeLabel(node.Name.Value))
-			a.context.DefinedLabels[qualifiedName] = symbol
-		}
+		a.defineValueSymbol(node, Variable, isPass1)
+	case ".eval":
+		// Assignment to a variable or a call made for its side effect
+		a.processEvalDirective(node, isPass1)
 	case ".byte", ".byt":
 		// Single byte data
 		log.Debug("processDirective .byte: node.Value type=%T, value=%+v", node.Value, node.Value)
@@ -1094,7 +1315,7 @@ func (a *SemanticAnalyzer) processDirectiveWithPass(node *DirectiveStatement, is
 		}
 		// Update PC only in Pass 1 and not inside templates
 		if isPass1 && !a.inMacroOrFunction {
-			a.context.CurrentPC++
+			a.context.CurrentPC += int64(len(directiveElements(node.Value)))
 		}
 	case ".word", ".wo":
 		// Two byte data
@@ -1104,266 +1325,288 @@ func (a *SemanticAnalyzer) processDirectiveWithPass(node *DirectiveStatement, is
 		}
 		// Update PC only in Pass 1 and not inside templates
 		if isPass1 && !a.inMacroOrFunction {
-			a.context.CurrentPC += 2
+			a.context.CurrentPC += 2 * int64(len(directiveElements(node.Value)))
+		}
+	case ".dword":
+		// Four byte data
+		if isPass1 && !a.inMacroOrFunction {
+			a.context.CurrentPC += 4 * int64(len(directiveElements(node.Value)))
 		}
 	case ".text", ".tx":
-		// String data - estimate length based on token type
-		if node.Value != nil {
-			// For text directives, estimate 1 byte per character
-			// This is a simplified estimation since we don't have StringLiteral type
-			// Update PC only in Pass 1 and not inside templates
-			if isPass1 && !a.inMacroOrFunction {
-				a.context.CurrentPC += 8 // Default text size estimate
+		// String data, encoded with the current encoding
+		// Update PC only in Pass 1 and not inside templates
+		if isPass1 && !a.inMacroOrFunction {
+			for _, element := range directiveElements(node.Value) {
+				a.context.CurrentPC += int64(len(a.textBytes(node.Token, element)))
 			}
 		}
 	case ".fill":
 		// Fill directive: .fill count, value
-		// Syntax: .fill <count>, <value>
 		// Updates PC by count bytes (ONLY in Pass 1)
 		if isPass1 && node.Value != nil {
-			// node.Value should be an expression or array with count and value
-			// For now, try to evaluate it as count
-			if arrayExpr, ok := node.Value.(*ArrayExpression); ok && len(arrayExpr.Elements) > 0 {
-				// First element is the count
-				count := a.evaluateExpression(arrayExpr.Elements[0])
-				if count > 0 && !a.inMacroOrFunction {
-					log.Debug("processDirective .fill: count=%d, updating PC from %d to %d",
-						count, a.context.CurrentPC, a.context.CurrentPC+count)
-					a.context.CurrentPC += count
-				}
-			} else {
-				// Try to evaluate as single expression (count only)
-				count := a.evaluateExpression(node.Value)
-				if count > 0 && !a.inMacroOrFunction {
-					log.Debug("processDirective .fill: count=%d, updating PC from %d to %d",
-						count, a.context.CurrentPC, a.context.CurrentPC+count)
-					a.context.CurrentPC += count
-				}
-			}
+			a.processFillDirective(node)
 		}
 	case ".if":
-		// Conditional compilation directive
-		a.processIfDirective(node)
-	case ".ifdef":
-		// Ifdef directive
-		log.Debug("processDirective: .ifdef not implemented yet")
-	case ".ifndef":
-		// Ifndef directive
-		log.Debug("processDirective: .ifndef not implemented yet")
+		// The condition is evaluated with the branches in Pass 1, see assembleConditional
 	}
 }
 
+// processImportDirective resolves a #import/#importif source file through the workspace index
+// and makes its symbols visible to the importing document. The file is analysed at the
+// program counter of the #import, and the importing document continues after its code.
+// A file with #importonce that the root document already included only adds its symbols.
+func (a *SemanticAnalyzer) processImportDirective(node *DirectiveStatement) {
+	strLit, ok := node.Value.(*StringLiteral)
+	if !ok || strLit.Value == "" || a.scope == nil {
+		return
+	}
 
-// handleUnparsedForDirectives scans document lines for .for directives that weren't parsed correctly
-func (a *SemanticAnalyzer) handleUnparsedForDirectives() {
-	if a.documentLines == nil || a.context == nil {
+	path, found := resolveImportPath(a.scope.Uri, strLit.Value)
+	if !found {
+		a.addError(strLit.Token, "Cannot find imported file '%s'", strLit.Value)
 		return
 	}
 
-	for lineNum, line := range a.documentLines {
-		trimmed := strings.TrimSpace(line)
-		if strings.HasPrefix(trimmed, ".for") {
-			// Found a .for directive - try to extract iteration count
-			iterCount := a.extractIterationCountFromText(trimmed)
-			if iterCount > 0 {
-				// Look for the content between braces in following lines
-				contentLines := a.extractForLoopContent(lineNum)
-				byteSize := int64(len(contentLines)) // Assume each line is ~1 byte (e.g., nop)
-				if byteSize == 0 {
-					byteSize = 1 // Default: at least one instruction like nop
-				}
-				totalSize := byteSize * int64(iterCount)
-				if !a.inMacroOrFunction {
-					a.context.CurrentPC += totalSize
-				}
-			}
-		}
+	if first := a.included.lookup(pathToURI(path)); first != nil && first.Context != nil && first.Context.ImportOnce {
+		log.Debug("processImportDirective: '%s' has #importonce and is already included", strLit.Value)
+		a.importSymbols(first, nil)
+		return
 	}
-}
 
-// extractIterationCountFromText extracts iteration count from .for directive text
-func (a *SemanticAnalyzer) extractIterationCountFromText(forLine string) int {
-	// Look for patterns like "i<100" or "i < 100"
-	re := regexp.MustCompile(`i\s*<\s*(\d+)`)
-	matches := re.FindStringSubmatch(forLine)
-	if len(matches) >= 2 {
-		if count, err := strconv.Atoi(matches[1]); err == nil {
-			return count
-		}
+	file := loadImportedFile(a.ctx, path, a.importChain, a.context.CurrentPC, a.included)
+	if file == nil {
+		return
 	}
-	return 0
-}
 
-// extractForLoopContent extracts the content lines inside a .for loop
-func (a *SemanticAnalyzer) extractForLoopContent(startLine int) []string {
-	if a.documentLines == nil || startLine >= len(a.documentLines) {
-		return nil
+	var included map[*Symbol]*Symbol
+	if file.Context != nil {
+		included = a.includeImportedCode(file.Context, node.Token)
 	}
+	a.importSymbols(file, included)
 
-	var content []string
-	braceDepth := 0
-	inLoop := false
+	log.Debug("processImportDirective: imported '%s' (%s) into %s", strLit.Value, file.URI, a.scope.Uri)
+}
 
-	for i := startLine; i < len(a.documentLines); i++ {
-		line := strings.TrimSpace(a.documentLines[i])
-		if strings.Contains(line, "{") {
-			braceDepth++
-			inLoop = true
+// importSymbols makes the symbols of an imported file visible. included maps the file's
+// labels to the copies includeImportedCode made of them.
+func (a *SemanticAnalyzer) importSymbols(file *IndexedFile, included map[*Symbol]*Symbol) {
+	if !containsFile(a.context.ImportedFiles, file.URI) {
+		a.context.ImportedFiles = append(a.context.ImportedFiles, file.URI)
+		a.scope.Imports = append(a.scope.Imports, file.Scope)
+	}
+	if file.Context == nil {
+		return
+	}
+
+	// Definitions in the importing file win over imported ones
+	for name, symbol := range file.Context.DefinedLabels {
+		if file.Context.inMacroExpansion(name) {
+			continue
 		}
-		if inLoop && braceDepth > 0 {
-			// Count non-empty lines as content
-			if line != "" && !strings.Contains(line, "{") && !strings.Contains(line, "}") {
-				content = append(content, line)
+		if _, exists := a.context.ImportedLabels[name]; !exists {
+			if copied, ok := included[symbol]; ok {
+				symbol = copied
 			}
+			a.context.ImportedLabels[name] = symbol
 		}
-		if strings.Contains(line, "}") {
-			braceDepth--
-			if braceDepth <= 0 {
-				break
+	}
+	for name, symbol := range file.Context.ImportedLabels {
+		if _, exists := a.context.ImportedLabels[name]; !exists {
+			if copied, ok := included[symbol]; ok {
+				symbol = copied
 			}
+			a.context.ImportedLabels[name] = symbol
 		}
 	}
-
-	return content
+	for name, macro := range file.Context.MacroDefinitions {
+		if _, exists := a.context.MacroDefinitions[name]; !exists {
+			a.context.MacroDefinitions[name] = macro
+		}
+	}
+	a.importSegments(file.Context)
 }
 
+// defineValueSymbol evaluates the value of a .const or .var and adds the symbol to the table
+func (a *SemanticAnalyzer) defineValueSymbol(node *DirectiveStatement, kind SymbolKind, isPass1 bool) {
+	if node.Name == nil || node.Value == nil {
+		return
+	}
+	symbol := &Symbol{
+		Name:     node.Name.Value,
+		Kind:     kind,
+		Position: Position{Line: node.Name.Token.Line - 1, Character: node.Name.Token.Column - 1},
+	}
 
-// evaluateExpression attempts to evaluate an expression to a numeric value
-func (a *SemanticAnalyzer) evaluateExpression(expr Expression) int64 {
-	if expr == nil || a.context == nil {
-		return -1
+	value := a.evaluateValue(node.Value)
+	log.Debug("processDirective %s: name=%s, value=%s", node.Token.Literal, node.Name.Value, value)
+	if isPass1 {
+		a.reportValueError(value)
 	}
+	a.setSymbolValue(symbol, value)
 
-	switch e := expr.(type) {
-	case *IntegerLiteral:
-		if e != nil {
-			return e.Value
+	// Check for potential range issues based on variable name
+	if addr, ok := value.Int(); ok {
+		name := strings.ToLower(node.Name.Value)
+		if strings.Contains(name, "byte") && (addr < 0 || addr > 255) {
+			log.Debug("processDirective .const: ADDING BYTE WARNING for %s, addr=%d", node.Name.Value, addr)
+			a.addWarning(node.Token, "Constant '%s' value $%X out of byte range ($0-$FF)", node.Name.Value, addr)
+		} else if strings.Contains(name, "word") && (addr < 0 || addr > 65535) {
+			log.Debug("processDirective .const: ADDING WORD WARNING for %s, addr=%d", node.Name.Value, addr)
+			a.addWarning(node.Token, "Constant '%s' value $%X out of word range ($0-$FFFF)", node.Name.Value, addr)
 		}
-	case *Identifier:
-		if e != nil && a.context.DefinedLabels != nil {
-			// Use namespace-aware label lookup
-			if symbol, found := a.context.lookupLabel(normalizeLabel(e.Value)); found {
-				return symbol.Address
-			}
+	}
+
+	// Add to symbol table with namespace prefix
+	qualifiedName := a.context.getQualifiedLabelName(normalizeLabel(node.Name.Value))
+	a.context.DefinedLabels[qualifiedName] = symbol
+}
+
+// setSymbolValue stores the value of a constant or variable. Whole numbers are also its address.
+func (a *SemanticAnalyzer) setSymbolValue(symbol *Symbol, value Value) {
+	symbol.Evaluated = &value
+	symbol.Address = 0
+	symbol.Value = ""
+	if addr, ok := value.Int(); ok {
+		symbol.Address = addr
+	}
+	if addr, ok := value.Int(); ok && addr >= 0 && float64(addr) == value.Number {
+		symbol.Value = fmt.Sprintf("$%04X", addr)
+	} else if value.Known() {
+		symbol.Value = value.String()
+	}
+}
+
+// processEvalDirective runs .eval: an assignment to a variable (x = 1, x += 2, x++) or a call
+// made for its side effect (list.add(1))
+func (a *SemanticAnalyzer) processEvalDirective(node *DirectiveStatement, isPass1 bool) {
+	// Templates only run when they are called
+	if node.Value == nil || a.inMacroOrFunction {
+		return
+	}
+	a.evaluateEffect(node.Value, isPass1)
+}
+
+// evaluateEffect runs an expression for its effect, in .eval and the steps of .for loops
+func (a *SemanticAnalyzer) evaluateEffect(expr Expression, isPass1 bool) {
+	assignment, isAssignment := expr.(*InfixExpression)
+	if isAssignment {
+		_, isAssignment = assignmentOperators[assignment.Operator]
+	}
+	if !isAssignment {
+		value := a.evaluateValue(expr)
+		if isPass1 {
+			a.reportValueError(value)
 		}
-	case *PrefixExpression:
-		if e != nil {
-			// CRITICAL: Return -1 for immediate addressing to prevent zero-page hints
-			if e.Operator == "#" {
-				return -1 // Immediate addressing - not a memory address!
-			}
-			if e.Operator == "<" {
-				// Low byte
-				if val := a.evaluateExpression(e.Right); val != -1 {
-					return val & 0xFF
-				}
-			}
-			if e.Operator == ">" {
-				// High byte
-				if val := a.evaluateExpression(e.Right); val != -1 {
-					return (val >> 8) & 0xFF
-				}
-			}
+		return
+	}
+
+	target, isIdentifier := assignment.Left.(*Identifier)
+	if !isIdentifier {
+		return
+	}
+	symbol, found := a.context.lookupLabel(normalizeLabel(target.Value))
+	if !found || a.context.isImportedLabel(symbol) {
+		// Parameters aren't in the symbol table
+		return
+	}
+	if symbol.Kind != Variable {
+		if isPass1 {
+			a.addError(target.Token, "Can't assign to %s '%s', only .var variables can be changed", symbol.Kind.String(), target.Value)
 		}
-	case *InfixExpression:
-		if e != nil {
-			left := a.evaluateExpression(e.Left)
-			right := a.evaluateExpression(e.Right)
-			// Only proceed if both operands are evaluable
-			if left != -1 && right != -1 {
-				switch e.Operator {
-				case "+":
-					return left + right
-				case "-":
-					return left - right
-				case "*":
-					return left * right
-				case "/":
-					if right != 0 {
-						return left / right
-					}
-					// Division by zero - return -1 to indicate cannot evaluate
-					return -1
-				case "%":
-					if right != 0 {
-						return left % right
-					}
-					return -1
-				case "<<":
-					return left << right
-				case ">>":
-					return left >> right
-				case "&":
-					return left & right
-				case "|":
-					return left | right
-				case "^":
-					return left ^ right
-				}
-			}
+		return
+	}
+
+	value := a.evaluateAssignment(assignment, a.symbolValue(symbol))
+	log.Debug("evaluateEffect: %s %s -> %s", target.Value, assignment.Operator, value)
+	if isPass1 {
+		a.reportValueError(value)
+	}
+	a.setSymbolValue(symbol, value)
+}
+
+// evaluateAssignment computes the new value of an assignment's target
+func (a *SemanticAnalyzer) evaluateAssignment(assignment *InfixExpression, current Value) Value {
+	var right Value
+	if assignment.Operator == "++" || assignment.Operator == "--" {
+		right = numberValue(1)
+	} else {
+		right = a.evaluateValue(assignment.Right)
+	}
+	operator := assignmentOperators[assignment.Operator]
+	if operator == "" {
+		return right
+	}
+	return binaryValue(operator, assignment.Token, current, right)
+}
+
+// processFillDirective advances the PC by the size of .fill count, value. The value may use
+// the index i; a list value fills one byte per element.
+func (a *SemanticAnalyzer) processFillDirective(node *DirectiveStatement) {
+	countExpr, valueExpr := node.Value, Expression(nil)
+	if arrayExpr, ok := node.Value.(*ArrayExpression); ok && len(arrayExpr.Elements) > 0 {
+		countExpr = arrayExpr.Elements[0]
+		if len(arrayExpr.Elements) > 1 {
+			valueExpr = arrayExpr.Elements[1]
 		}
-	case *GroupedExpression:
-		if e != nil && e.Expression != nil {
-			// Evaluate the grouped expression
-			return a.evaluateExpression(e.Expression)
+	}
+
+	count := a.evaluateValue(countExpr)
+	a.reportValueError(count)
+	if count.Known() && count.Kind != ValueNumber && !a.inMacroOrFunction {
+		a.addError(node.Token, ".fill count must be a Number, got %s", count.TypeName())
+	}
+
+	bytesPerEntry := int64(1)
+	if valueExpr != nil {
+		// i is the index of the byte being filled, not known while checking the value
+		saved, hadIndex := a.context.DefinedLabels["i"]
+		a.context.DefinedLabels["i"] = &Symbol{Name: "i", Kind: Variable, Evaluated: &Value{}}
+		value := a.evaluateValue(valueExpr)
+		if hadIndex {
+			a.context.DefinedLabels["i"] = saved
+		} else {
+			delete(a.context.DefinedLabels, "i")
 		}
-	case *CallExpression:
-		if e != nil {
-			// Basic builtin function evaluation
-			if ident, ok := e.Function.(*Identifier); ok {
-				return a.evaluateBuiltinFunction(ident.Value, e.Arguments)
+
+		a.reportValueError(value)
+		switch value.Kind {
+		case ValueList:
+			bytesPerEntry = int64(len(value.list.items))
+		case ValueBoolean, ValueString, ValueHashtable, ValueNull:
+			if !a.inMacroOrFunction {
+				a.addError(node.Token, ".fill value must be a Number, got %s", value.TypeName())
 			}
 		}
 	}
+
+	if n, ok := count.Int(); ok && n > 0 && !a.inMacroOrFunction {
+		log.Debug("processDirective .fill: count=%d, updating PC from %d to %d",
+			n, a.context.CurrentPC, a.context.CurrentPC+n*bytesPerEntry)
+		a.context.CurrentPC += n * bytesPerEntry
+	}
+}
+
+// reportValueError reports the type error of an evaluated value. Templates aren't checked,
+// their parameters have no values.
+func (a *SemanticAnalyzer) reportValueError(value Value) {
+	if value.Kind == ValueInvalid && !a.inMacroOrFunction {
+		a.addError(value.err.token, "%s", value.err.message)
+	}
+}
+
+// evaluateExpression evaluates an expression to an integer, -1 if it isn't a known number.
+// evaluateValue has the full value model.
+func (a *SemanticAnalyzer) evaluateExpression(expr Expression) int64 {
+	if value, ok := a.evaluateValue(expr).Int(); ok {
+		return value
+	}
 	return -1 // Cannot evaluate
 }
 
-// evaluateBuiltinFunction attempts to evaluate a builtin function call
+// evaluateBuiltinFunction evaluates a builtin function call to an integer, -1 if it can't be
 func (a *SemanticAnalyzer) evaluateBuiltinFunction(name string, args []Expression) int64 {
-	// Phase 1: Basic math function evaluation
-	switch name {
-	case "abs":
-		if len(args) == 1 {
-			val := a.evaluateExpression(args[0])
-			if val != -1 {
-				if val < 0 {
-					return -val
-				}
-				return val
-			}
-		}
-	case "min":
-		if len(args) == 2 {
-			val1 := a.evaluateExpression(args[0])
-			val2 := a.evaluateExpression(args[1])
-			if val1 != -1 && val2 != -1 {
-				if val1 < val2 {
-					return val1
-				}
-				return val2
-			}
-		}
-	case "max":
-		if len(args) == 2 {
-			val1 := a.evaluateExpression(args[0])
-			val2 := a.evaluateExpression(args[1])
-			if val1 != -1 && val2 != -1 {
-				if val1 > val2 {
-					return val1
-				}
-				return val2
-			}
-		}
-	case "floor":
-		if len(args) == 1 {
-			val := a.evaluateExpression(args[0])
-			if val != -1 {
-				// For integer values, floor is identity
-				return val
-			}
-		}
-		// More complex functions like sin, cos, sqrt cannot be evaluated at compile time
-		// without proper floating point support, so return -1 to indicate cannot evaluate
+	if value, ok := a.builtinFunctionValue(name, args, Token{}).Int(); ok {
+		return value
 	}
 	return -1 // Cannot evaluate this function
 }
@@ -1421,7 +1664,7 @@ func (a *SemanticAnalyzer) parseBuiltinFunctionSignature(signature string) int {
 
 // checkIllegalOpcode warns about illegal 6502 opcodes
 func (a *SemanticAnalyzer) checkIllegalOpcode(mnemonic string, token Token) {
-	config := GetLSPConfig()
+	config := a.config
 
 	// Check if illegal opcode detection is enabled
 	if !config.IllegalOpcodeDetection.Enabled || !config.IllegalOpcodeDetection.ShowWarnings {
@@ -1434,9 +1677,137 @@ func (a *SemanticAnalyzer) checkIllegalOpcode(mnemonic string, token Token) {
 	}
 }
 
+// operandForms groups the addressing modes that are written the same way. Zero page or
+// absolute is picked by the assembler from the operand value.
+var operandForms = map[string][]string{
+	"Implied":          {"Implied", "Accumulator"},
+	"Accumulator":      {"Accumulator"},
+	"Immediate":        {"Immediate"},
+	"Address":          {"Zeropage", "Absolute", "Relative"},
+	"Address,X":        {"Zeropage,X", "Absolute,X"},
+	"Address,Y":        {"Zeropage,Y", "Absolute,Y"},
+	"Indirect":         {"Indirect"},
+	"Indexed-indirect": {"Indexed-indirect"},
+	"Indirect-indexed": {"Indirect-indexed"},
+}
+
+// operandFormNames are the operand forms as named in diagnostics
+var operandFormNames = map[string]string{
+	"Accumulator":      "accumulator",
+	"Immediate":        "immediate",
+	"Address":          "absolute",
+	"Address,X":        "X-indexed",
+	"Address,Y":        "Y-indexed",
+	"Indirect":         "indirect",
+	"Indexed-indirect": "indexed-indirect",
+	"Indirect-indexed": "indirect-indexed",
+}
+
+// operandFormOf returns the operand form of an addressing mode from mnemonic.json
+func operandFormOf(mode string) string {
+	switch mode {
+	case "Zeropage", "Absolute", "Relative":
+		return "Address"
+	case "Zeropage,X", "Absolute,X":
+		return "Address,X"
+	case "Zeropage,Y", "Absolute,Y":
+		return "Address,Y"
+	}
+	return mode
+}
+
+// supportsOperandForm reports whether the mnemonic has any addressing mode of the form
+func supportsOperandForm(info *EnhancedMnemonicInfo, form string) bool {
+	for _, mode := range operandForms[form] {
+		if hasAddressingMode(info, mode) {
+			return true
+		}
+	}
+	return false
+}
+
+// validAddressingForms lists the assembler formats of a mnemonic, e.g. "STX nn, STX nn,Y, STX nnnn"
+func validAddressingForms(info *EnhancedMnemonicInfo) string {
+	var forms []string
+	seen := make(map[string]bool)
+	for _, mode := range info.AddressingModes {
+		if mode.AssemblerFormat != "" && !seen[mode.AssemblerFormat] {
+			seen[mode.AssemblerFormat] = true
+			forms = append(forms, mode.AssemblerFormat)
+		}
+	}
+	return strings.Join(forms, ", ")
+}
+
+// checkAddressingMode reports an error if the mnemonic has no addressing mode for the operand,
+// e.g. "stx $1000,x", "jmp #$10" or "inc a"
+func (a *SemanticAnalyzer) checkAddressingMode(node *InstructionStatement, mnemonic string) {
+	ctx := GetProcessorContext()
+	if ctx == nil {
+		return
+	}
+	info := ctx.GetMnemonicInfo(mnemonic)
+	if info == nil || len(info.AddressingModes) == 0 {
+		return
+	}
+
+	mode := a.instructionMode(info, node)
+	if info.Type == "Branch" {
+		// addressingMode always answers Relative for branches
+		switch op := node.Operand.(type) {
+		case nil:
+			mode = "Implied"
+		case *PrefixExpression:
+			if op.Operator == "#" {
+				mode = "Immediate"
+			}
+		case *InfixExpression:
+			if register, ok := op.Right.(*Identifier); ok && op.Operator == "," {
+				mode = "Absolute," + strings.ToUpper(register.Value)
+			}
+		}
+		if form := indirectOperandForm(a.operandText(node)); form != "" {
+			mode = form
+		}
+	}
+	form := operandFormOf(mode)
+	if !hasAddressingMode(info, mode) {
+		switch {
+		case node.Suffix != "":
+			a.addError(node.Token, "%s does not support %s addressing forced by .%s (valid: %s)",
+				mnemonic, mode, node.Suffix, validAddressingForms(info))
+			return
+		case form == "Implied" && !supportsOperandForm(info, form):
+			a.addError(node.Token, "%s requires an operand (valid: %s)", mnemonic, validAddressingForms(info))
+			return
+		case !supportsOperandForm(info, form):
+			a.addCodedDiagnostic(SeverityError, node.Token, codeUnsupportedOperand, map[string]interface{}{"mnemonic": mnemonic, "form": form},
+				"%s does not support %s addressing (valid: %s)", mnemonic, operandFormNames[form], validAddressingForms(info))
+			return
+		}
+	} else if !strings.HasPrefix(mode, "Zeropage") {
+		return
+	}
+
+	// A zero-page mode - forced with .zp or the only variant, e.g. "stx nn,y" - needs a byte
+	value := a.evaluateExpression(node.Operand)
+	if infix, ok := node.Operand.(*InfixExpression); ok && infix.Operator == "," {
+		value = a.evaluateExpression(infix.Left)
+	}
+	if value <= 0xFF {
+		return
+	}
+	if node.Suffix != "" {
+		a.addError(node.Token, "%s.%s needs a zero-page operand, $%04X is out of range", mnemonic, node.Suffix, value)
+		return
+	}
+	a.addError(node.Token, "%s supports %s addressing only in zero page, $%04X is out of range (valid: %s)",
+		mnemonic, operandFormNames[form], value, validAddressingForms(info))
+}
+
 // isIllegalMnemonic checks if a mnemonic is marked as "Illegal" type in the loaded mnemonic data
 func isIllegalMnemonic(mnemonic string) bool {
-	for _, m := range mnemonics {
+	for _, m := range currentData().mnemonics {
 		if m.Mnemonic == mnemonic && m.Type == "Illegal" {
 			return true
 		}
@@ -1446,7 +1817,7 @@ func isIllegalMnemonic(mnemonic string) bool {
 
 // checkZeroPageOptimization suggests zero page addressing optimizations
 func (a *SemanticAnalyzer) checkZeroPageOptimization(mnemonic string, operand Expression, token Token) {
-	config := GetLSPConfig()
+	config := a.config
 	log.Debug("checkZeroPageOptimization: mnemonic=%s, token=%s", mnemonic, token.Literal)
 
 	// Check if zero page optimization is enabled
@@ -1515,13 +1886,14 @@ func (a *SemanticAnalyzer) checkZeroPageOptimization(mnemonic string, operand Ex
 			}
 		}
 
-		a.addHint(token, "Consider zero-page addressing for $%02X (saves 1 byte, 1 cycle)", addr)
+		a.addCodedDiagnostic(SeverityHint, token, codeZeroPageAddress, map[string]interface{}{"address": addr},
+			"Consider zero-page addressing for $%02X (saves 1 byte, 1 cycle)", addr)
 	}
 }
 
 // checkStyleViolations checks for assembly style guide violations
 func (a *SemanticAnalyzer) checkStyleViolations(symbol *Symbol, token Token) {
-	config := GetLSPConfig()
+	config := a.config
 
 	// Check if style guide enforcement is enabled
 	if !config.StyleGuideEnforcement.Enabled || !config.StyleGuideEnforcement.ShowHints {
@@ -1542,7 +1914,7 @@ func (a *SemanticAnalyzer) checkStyleViolations(symbol *Symbol, token Token) {
 
 // checkMagicNumbers identifies potential magic numbers
 func (a *SemanticAnalyzer) checkMagicNumbers(expr Expression, token Token) {
-	config := GetLSPConfig()
+	config := a.config
 
 	// Check if magic number detection is enabled
 	if !config.MagicNumberDetection.Enabled || !config.MagicNumberDetection.ShowHints {
@@ -1563,10 +1935,12 @@ func (a *SemanticAnalyzer) checkMagicNumbers(expr Expression, token Token) {
 		if literal.Value > 255 && literal.Value < 65536 {
 			// Check if this looks like an address that should be a constant
 			if desc, isMagic := magicNumbers[literal.Value]; isMagic {
-				a.addHint(token, "Consider defining constant for %s ($%04X)", desc, literal.Value)
+				a.addCodedDiagnostic(SeverityHint, token, codeMagicNumber, map[string]interface{}{"address": literal.Value, "description": desc},
+					"Consider defining constant for %s ($%04X)", desc, literal.Value)
 			} else if literal.Value > 0x8000 {
 				// High memory addresses should probably be constants
-				a.addHint(token, "Consider defining constant for address $%04X", literal.Value)
+				a.addCodedDiagnostic(SeverityHint, token, codeMagicNumber, map[string]interface{}{"address": literal.Value, "description": ""},
+					"Consider defining constant for address $%04X", literal.Value)
 			}
 		}
 	}
@@ -1588,7 +1962,7 @@ func isUpperCase(s string) bool {
 
 // check6502HardwareBugs detects famous 6502 hardware bugs
 func (a *SemanticAnalyzer) check6502HardwareBugs(mnemonic string, operand Expression, token Token) {
-	config := GetLSPConfig()
+	config := a.config
 
 	// Check if hardware bug detection is enabled
 	if !config.HardwareBugDetection.Enabled || !config.HardwareBugDetection.ShowWarnings {
@@ -1635,7 +2009,7 @@ func (a *SemanticAnalyzer) checkJMPIndirectBug(operand Expression, token Token)
 
 // checkMemoryAccess analyzes memory access patterns for instructions
 func (a *SemanticAnalyzer) checkMemoryAccess(mnemonic string, operand Expression, token Token) {
-	config := GetLSPConfig()
+	config := a.config
 
 	// Check if memory layout analysis is enabled
 	if !config.MemoryLayoutAnalysis.Enabled {
@@ -1679,7 +2053,7 @@ func (a *SemanticAnalyzer) isWriteInstruction(mnemonic string) bool {
 
 // Memory access pattern analysis
 func (a *SemanticAnalyzer) analyzeMemoryAccess(addr int64, isWrite bool, token Token) {
-	config := GetLSPConfig()
+	config := a.config
 
 	if isWrite && a.context.MemoryMap.IsROMArea(addr) && config.MemoryLayoutAnalysis.ShowROMWriteWarnings {
 		a.addWarning(token, "Writing to ROM area $%04X - this will have no effect", addr)
@@ -1704,7 +2078,7 @@ func (a *SemanticAnalyzer) analyzeMemoryAccess(addr int64, isWrite bool, token T
 
 // pass4DeadCodeDetection analyzes control flow to find unreachable code
 func (a *SemanticAnalyzer) pass4DeadCodeDetection(statements []Statement) {
-	config := GetLSPConfig()
+	config := a.config
 
 	// Check if dead code detection is enabled
 	if !config.DeadCodeDetection.Enabled || !config.DeadCodeDetection.ShowWarnings {
@@ -1726,6 +2100,9 @@ func (a *SemanticAnalyzer) analyzeControlFlowWithVisited(statements []Statement,
 		if stmt == nil {
 			continue
 		}
+		if a.shouldStop(stmt) {
+			return
+		}
 
 		// Skip if already visited to prevent duplicates
 		if visited[stmt] {
@@ -1740,7 +2117,11 @@ func (a *SemanticAnalyzer) analyzeControlFlowWithVisited(statements []Statement,
 				a.checkForDeadCodeAfterJumpWithVisited(statements, i+1, visited)
 			}
 		case *DirectiveStatement:
-			if statement != nil && statement.Block != nil && statement.Block.Statements != nil {
+			if isIfDirective(statement) {
+				for _, block := range a.activeConditionalBlocks(statement) {
+					a.analyzeControlFlowWithVisited(block.Statements, visited)
+				}
+			} else if statement != nil && statement.Block != nil && statement.Block.Statements != nil {
 				a.analyzeControlFlowWithVisited(statement.Block.Statements, visited)
 			}
 		}
@@ -1806,10 +2187,14 @@ func (a *SemanticAnalyzer) checkForDeadCodeAfterJumpWithVisited(statements []Sta
 			// Check if this is a PC directive (*= or .pc) - these start new code sections
 			if statement != nil && statement.Token.Literal != "" {
 				tokenLiteral := strings.ToLower(statement.Token.Literal)
-				if tokenLiteral == "*=" || tokenLiteral == ".pc" {
+				if tokenLiteral == "*=" || tokenLiteral == ".pc" || tokenLiteral == ".segment" || tokenLiteral == ".memblock" {
 					// PC directive starts a new code section - code after it is reachable
 					return
 				}
+				if tokenLiteral == ".segmentdef" || tokenLiteral == ".file" || tokenLiteral == ".segmentout" {
+					// Segment definitions and output files don't assemble to code
+					continue
+				}
 			}
 			// Most directives in dead code are also unreachable
 			if statement != nil && statement.Name != nil && statement.Token.Literal != "" {
@@ -1864,9 +2249,9 @@ func (a *SemanticAnalyzer) processDataDirective(node *DirectiveStatement) {
 	if !a.inMacroOrFunction {
 		switch directive {
 		case ".byte":
-			a.context.CurrentPC++
+			a.context.CurrentPC += int64(len(directiveElements(node.Value)))
 		case ".word":
-			a.context.CurrentPC += 2
+			a.context.CurrentPC += 2 * int64(len(directiveElements(node.Value)))
 		}
 	}
 }
@@ -1924,6 +2309,12 @@ func (a *SemanticAnalyzer) performTokenLevelRangeValidation() {
 			continue
 		}
 
+		// Code that isn't assembled may hold anything
+		indent := len(a.documentLines[lineNum]) - len(strings.TrimLeft(a.documentLines[lineNum], " \t"))
+		if a.context.isInactive(Position{Line: lineNum, Character: indent}) {
+			continue
+		}
+
 		// Check for .byte directives
 		if strings.HasPrefix(strings.ToLower(line), ".byte") {
 			a.validateTokenLevelDataDirective(line, lineNum, "byte", 0, 255)
@@ -2039,75 +2430,6 @@ func (a *SemanticAnalyzer) parseTokenLevelValue(valueStr string) int64 {
 	return -1
 }
 
-// processIfDirective handles .if conditional compilation directives with dead code detection
-func (a *SemanticAnalyzer) processIfDirective(node *DirectiveStatement) {
-	if node == nil || node.Value == nil {
-		log.Debug("processIfDirective: node or value is nil")
-		return
-	}
-
-	log.Debug("processIfDirective: evaluating .if condition")
-
-	// Evaluate the condition expression
-	conditionValue := a.evaluateExpression(node.Value)
-	log.Debug("processIfDirective: condition value=%d", conditionValue)
-
-	// Check for dead code: .if (0) or .if (false)
-	if conditionValue == 0 {
-		log.Debug("processIfDirective: detected dead code block (.if condition is false)")
-		a.addDeadCodeWarningsForIfBlock(node)
-	}
-
-	// For other condition values, we could add additional analysis
-	// For example, .if (1) is always true, .if (variable) depends on runtime
-}
-
-// addDeadCodeWarningsForIfBlock adds warnings for statements inside a dead .if block
-func (a *SemanticAnalyzer) addDeadCodeWarningsForIfBlock(node *DirectiveStatement) {
-	if node == nil || node.Block == nil || node.Block.Statements == nil {
-		log.Debug("addDeadCodeWarningsForIfBlock: no block or statements")
-		return
-	}
-
-	log.Debug("addDeadCodeWarningsForIfBlock: processing %d statements in dead block", len(node.Block.Statements))
-
-	// Warn about each statement in the dead code block
-	for _, stmt := range node.Block.Statements {
-		if stmt == nil {
-			continue
-		}
-
-		switch statement := stmt.(type) {
-		case *InstructionStatement:
-			if statement != nil && statement.Token.Literal != "" {
-				log.Debug("addDeadCodeWarningsForIfBlock: adding warning for instruction %s", statement.Token.Literal)
-				a.addWarning(statement.Token, "Dead code: instruction '%s' will never be executed (.if condition is always false)", statement.Token.Literal)
-			}
-		case *DirectiveStatement:
-			if statement != nil && statement.Token.Literal != "" {
-				log.Debug("addDeadCodeWarningsForIfBlock: adding warning for directive %s", statement.Token.Literal)
-				a.addWarning(statement.Token, "Dead code: directive '%s' will never be executed (.if condition is always false)", statement.Token.Literal)
-			}
-		case *LabelStatement:
-			if statement != nil && statement.Name != nil {
-				log.Debug("addDeadCodeWarningsForIfBlock: adding warning for label %s", statement.Name.Value)
-				a.addWarning(statement.Token, "Dead code: label '%s' is in unreachable block (.if condition is always false)", statement.Name.Value)
-			}
-		default:
-			// For other statement types, add a generic warning
-			log.Debug("addDeadCodeWarningsForIfBlock: adding generic warning for statement type %T", statement)
-			// Create a generic token for the warning
-			token := Token{
-				Type:    TOKEN_COMMENT, // Generic type for unidentified statements
-				Literal: "unknown",
-				Line:    1, // We'll use a default position
-				Column:  1,
-			}
-			a.addWarning(token, "Dead code: statement will never be executed (.if condition is always false)")
-		}
-	}
-}
-
 // blockHasReturnStatement checks if a block contains a .return directive
 func (a *SemanticAnalyzer) blockHasReturnStatement(block *BlockStatement) bool {
 	if block == nil {
@@ -0,0 +1,189 @@
+package lsp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestFiles writes the files of a test project into a new directory and returns it.
+// Names may contain subdirectories, like "src/main.asm".
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, text := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// analyzeTestFile analyses a file written by writeTestFiles
+func analyzeTestFile(t *testing.T, dir, name string) (*AnalysisContext, []Diagnostic) {
+	t.Helper()
+	text, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, context, diagnostics := ParseDocument(pathToURI(filepath.Join(dir, name)), string(text))
+	if context == nil {
+		t.Fatalf("%s was not analysed: %v", name, diagnostics)
+	}
+	return context, diagnostics
+}
+
+// openTestDocument analyses a document and adds it to the open documents, as didOpen does
+func openTestDocument(t *testing.T, uri, text string) []Diagnostic {
+	t.Helper()
+	tree, context, diagnostics := ParseDocument(uri, text)
+	documentStore.Lock()
+	documentStore.documents[uri] = text
+	documentStore.Unlock()
+	symbolStore.Lock()
+	symbolStore.trees[uri] = tree
+	symbolStore.contexts[uri] = context
+	symbolStore.Unlock()
+	t.Cleanup(func() {
+		documentStore.Lock()
+		delete(documentStore.documents, uri)
+		documentStore.Unlock()
+		symbolStore.Lock()
+		delete(symbolStore.trees, uri)
+		delete(symbolStore.contexts, uri)
+		symbolStore.Unlock()
+	})
+	return diagnostics
+}
+
+// lookupTestLabel returns the address of a label defined in or imported into a document
+func lookupTestLabel(t *testing.T, context *AnalysisContext, name string) int64 {
+	t.Helper()
+	symbol, found := context.lookupLabel(normalizeLabel(name))
+	if !found {
+		t.Fatalf("label %s is not defined", name)
+	}
+	return symbol.Address
+}
+
+// hasDiagnostic reports whether a diagnostic message contains text
+func hasDiagnostic(diagnostics []Diagnostic, text string) bool {
+	for _, diagnostic := range diagnostics {
+		if strings.Contains(diagnostic.Message, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestImportIsAssembledInPlace(t *testing.T) {
+	loadTestData(t)
+	tests := []struct {
+		name   string
+		main   string
+		lib    string
+		labels map[string]int64
+		error  string
+	}{
+		{
+			name:   "labels at the import",
+			main:   "*=$1000\n    jsr sub\n    nop\n#import \"lib.asm\"\nafter: jmp after\n",
+			lib:    "sub: rts\n",
+			labels: map[string]int64{"sub": 0x1004, "after": 0x1005},
+		},
+		{
+			name:   "import with its own program counter",
+			main:   "*=$0810\n#import \"lib.asm\"\nafter: rts\n",
+			lib:    "    nop\n*=$2000\ntable: .byte 1, 2, 3\n",
+			labels: map[string]int64{"table": 0x2000, "after": 0x2003},
+		},
+		{
+			name:  "branch to an imported label",
+			main:  "*=$1000\nloop: bne far\n#import \"lib.asm\"\n",
+			lib:   ".fill 200, 0\nfar: rts\n",
+			error: "Branch distance 200 out of range",
+		},
+		{
+			name:  "overlap with imported code",
+			main:  "*=$1000\n#import \"lib.asm\"\n*=$1002\n    nop\n",
+			lib:   "    jmp $1000\n",
+			error: "Memory overlap: $1002 is also assembled in line 2",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeTestFiles(t, map[string]string{"main.asm": test.main, "lib.asm": test.lib})
+			context, diagnostics := analyzeTestFile(t, dir, "main.asm")
+			for label, want := range test.labels {
+				if got := lookupTestLabel(t, context, label); got != want {
+					t.Errorf("%s = $%04X, want $%04X", label, got, want)
+				}
+			}
+			if test.error != "" && !hasDiagnostic(diagnostics, test.error) {
+				t.Errorf("no diagnostic %q in %v", test.error, diagnostics)
+			}
+		})
+	}
+}
+
+func TestImportOnce(t *testing.T) {
+	loadTestData(t)
+	tests := []struct {
+		name   string
+		files  map[string]string
+		labels map[string]int64
+	}{
+		{
+			name: "shared file with #importonce",
+			files: map[string]string{
+				"main.asm":   "*=$1000\n#import \"a.asm\"\n#import \"b.asm\"\nafter: rts\n",
+				"a.asm":      "#import \"common.asm\"\na: nop\n",
+				"b.asm":      "#import \"common.asm\"\nb: jsr common\n",
+				"common.asm": "#importonce\ncommon: rts\n",
+			},
+			labels: map[string]int64{"common": 0x1000, "a": 0x1001, "b": 0x1002, "after": 0x1005},
+		},
+		{
+			name: "shared file without #importonce",
+			files: map[string]string{
+				"main.asm":   "*=$1000\n#import \"a.asm\"\n#import \"b.asm\"\nafter: rts\n",
+				"a.asm":      "#import \"common.asm\"\na: nop\n",
+				"b.asm":      "#import \"common.asm\"\nb: nop\n",
+				"common.asm": "common: rts\n",
+			},
+			labels: map[string]int64{"a": 0x1001, "b": 0x1003, "after": 0x1004},
+		},
+		{
+			name: "same file twice",
+			files: map[string]string{
+				"main.asm":   "*=$1000\n#import \"common.asm\"\n#import \"common.asm\"\nafter: rts\n",
+				"common.asm": "#importonce\ncommon: rts\n",
+			},
+			labels: map[string]int64{"common": 0x1000, "after": 0x1001},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeTestFiles(t, test.files)
+			// The second analysis takes the imported files from the workspace index
+			for run := 1; run <= 2; run++ {
+				context, diagnostics := analyzeTestFile(t, dir, "main.asm")
+				for label, want := range test.labels {
+					if got := lookupTestLabel(t, context, label); got != want {
+						t.Errorf("run %d: %s = $%04X, want $%04X", run, label, got, want)
+					}
+				}
+				for _, diagnostic := range diagnostics {
+					if diagnostic.Severity == SeverityError {
+						t.Errorf("run %d: unexpected error: %s", run, diagnostic.Message)
+					}
+				}
+			}
+		})
+	}
+}
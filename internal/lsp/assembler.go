@@ -0,0 +1,775 @@
+package lsp
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	log "c64.nvim/internal/log"
+)
+
+// maxAssemblerPasses limits the passes spent waiting for label addresses to settle
+const maxAssemblerPasses = 10
+
+// AssemblyError is an error reported by the assembler at a source position (1-based)
+type AssemblyError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e AssemblyError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+}
+
+// MemoryBlock is a run of consecutive bytes emitted by the assembler
+type MemoryBlock struct {
+	Start int64
+	Bytes []byte
+}
+
+// AssembledProgram is the machine code produced by Assemble
+type AssembledProgram struct {
+	Blocks []MemoryBlock
+}
+
+// PRG returns the program as a C64 .prg file: the load address followed by the memory from
+// the lowest to the highest emitted address, gaps filled with zeros
+func (p *AssembledProgram) PRG() ([]byte, error) {
+	if len(p.Blocks) == 0 {
+		return nil, fmt.Errorf("no code or data was emitted")
+	}
+
+	start, end := int64(0x10000), int64(0)
+	for _, block := range p.Blocks {
+		if block.Start < start {
+			start = block.Start
+		}
+		if blockEnd := block.Start + int64(len(block.Bytes)); blockEnd > end {
+			end = blockEnd
+		}
+	}
+
+	prg := make([]byte, 2+end-start)
+	prg[0], prg[1] = byte(start), byte(start>>8)
+	for _, block := range p.Blocks {
+		copy(prg[2+block.Start-start:], block.Bytes)
+	}
+	return prg, nil
+}
+
+// assemblerFile is a source file taking part in an assembly (the main file or an #import)
+type assemblerFile struct {
+	path       string
+	program    *Program
+	analyzer   *SemanticAnalyzer // shares the assembler's context; provides the file's lines
+	importOnce bool              // the file has #importonce
+}
+
+// assembler encodes a parsed program in several passes until all label addresses settle
+type assembler struct {
+	context    *AnalysisContext
+	files      map[string]*assemblerFile
+	chain      []string        // files currently being assembled, guards against #import cycles
+	included   map[string]bool // files assembled in this pass, for #importonce
+	pc         int64
+	pass       int
+	changed    bool                             // a label or addressing mode changed in this pass
+	modes      map[*InstructionStatement]string // addressing modes fixed when first assembled
+	multiIndex map[string]int                   // multi-label instances seen in this pass
+	encoding   string
+	blocks     []MemoryBlock
+	errors     []AssemblyError
+}
+
+// Assemble assembles a source file into machine code. Instructions are encoded with the
+// opcodes from mnemonic.json; an operand that is unknown when an instruction is first
+// assembled selects absolute addressing, as in KickAssembler.
+func Assemble(filename, text string) (*AssembledProgram, []AssemblyError) {
+	if GetProcessorContext() == nil {
+		return nil, []AssemblyError{{File: filename, Line: 1, Column: 1, Message: "processor context not initialized"}}
+	}
+
+	as := &assembler{
+		context: NewAnalysisContext(),
+		files:   make(map[string]*assemblerFile),
+		modes:   make(map[*InstructionStatement]string),
+	}
+	main, errors := as.loadFile(filename, text)
+	if len(errors) > 0 {
+		return nil, errors
+	}
+
+	for as.pass = 1; ; as.pass++ {
+		as.pc = 0
+		as.changed = false
+		as.multiIndex = make(map[string]int)
+		as.encoding = defaultTextEncoding
+		as.blocks = nil
+		as.errors = nil
+		as.context.CurrentNamespace = ""
+		as.context.NamespaceStack = []string{}
+
+		as.chain = []string{main.path}
+		as.included = map[string]bool{main.path: true}
+		as.assembleStatements(main, main.program.Statements)
+
+		log.Debug("Assemble: pass %d of %s, changed=%v, %d errors", as.pass, filename, as.changed, len(as.errors))
+		if !as.changed {
+			break
+		}
+		if as.pass == maxAssemblerPasses {
+			as.errors = append(as.errors, AssemblyError{File: filename, Line: 1, Column: 1,
+				Message: fmt.Sprintf("label addresses did not settle after %d passes", maxAssemblerPasses)})
+			break
+		}
+	}
+
+	return &AssembledProgram{Blocks: as.blocks}, as.errors
+}
+
+// loadFile parses a source file once; parser errors are reported as assembly errors
+func (as *assembler) loadFile(path, text string) (*assemblerFile, []AssemblyError) {
+	processorCtx := GetProcessorContext()
+	parser := NewContextAwareParser(NewContextAwareLexer(text, processorCtx), processorCtx)
+	config := GetDocumentConfig(pathToURI(path))
+	for _, name := range config.activeDefines() {
+		parser.defines[name] = true
+	}
+	program := parser.ParseProgram()
+
+	var errors []AssemblyError
+	for _, diagnostic := range parser.Errors() {
+		if diagnostic.Severity == SeverityError {
+			errors = append(errors, AssemblyError{
+				File:    path,
+				Line:    diagnostic.Range.Start.Line + 1,
+				Column:  diagnostic.Range.Start.Character + 1,
+				Message: diagnostic.Message,
+			})
+		}
+	}
+
+	file := &assemblerFile{
+		path:    path,
+		program: program,
+		analyzer: &SemanticAnalyzer{
+			scope:         NewRootScope(pathToURI(path)),
+			documentLines: strings.Split(text, "\n"),
+			context:       as.context,
+		},
+	}
+	if len(errors) == 0 {
+		as.files[path] = file
+	}
+	return file, errors
+}
+
+// errorAt records an error at a token of a file
+func (as *assembler) errorAt(file *assemblerFile, token Token, format string, args ...interface{}) {
+	as.errors = append(as.errors, AssemblyError{
+		File:    file.path,
+		Line:    token.Line,
+		Column:  token.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// emit appends bytes at the current PC, starting a new block when the PC moved
+func (as *assembler) emit(file *assemblerFile, token Token, bytes ...byte) {
+	if as.pc+int64(len(bytes)) > 0x10000 {
+		as.errorAt(file, token, "Program counter $%X is beyond $FFFF", as.pc+int64(len(bytes)))
+		return
+	}
+	if n := len(as.blocks); n == 0 || as.blocks[n-1].Start+int64(len(as.blocks[n-1].Bytes)) != as.pc {
+		as.blocks = append(as.blocks, MemoryBlock{Start: as.pc})
+	}
+	last := &as.blocks[len(as.blocks)-1]
+	last.Bytes = append(last.Bytes, bytes...)
+	as.pc += int64(len(bytes))
+}
+
+// defineSymbol sets a label or constant, noting a change from the previous pass
+func (as *assembler) defineSymbol(name string, kind SymbolKind, value int64) {
+	qualified := as.context.getQualifiedLabelName(normalizeLabel(name))
+	symbol, exists := as.context.DefinedLabels[qualified]
+	if !exists {
+		as.context.DefinedLabels[qualified] = &Symbol{Name: name, Kind: kind, Address: value}
+		as.changed = true
+		return
+	}
+	if symbol.Address != value && kind != Variable {
+		as.changed = true
+	}
+	symbol.Address = value
+}
+
+// defineMultiLabel sets the address of the next instance of a multi-label
+func (as *assembler) defineMultiLabel(name string) {
+	qualified := as.context.getQualifiedLabelName(normalizeLabel(name))
+	index := as.multiIndex[qualified]
+	as.multiIndex[qualified] = index + 1
+
+	instances := as.context.DefinedMultiLabels[qualified]
+	if index < len(instances) {
+		if instances[index].Address != as.pc {
+			instances[index].Address = as.pc
+			as.changed = true
+		}
+		return
+	}
+	as.context.DefinedMultiLabels[qualified] = append(instances, &Symbol{Name: name, Kind: MultiLabel, Address: as.pc})
+	as.changed = true
+}
+
+// assembleStatements assembles a statement list of a file
+func (as *assembler) assembleStatements(file *assemblerFile, statements []Statement) {
+	for _, statement := range statements {
+		switch stmt := statement.(type) {
+		case *LabelStatement:
+			if stmt.Name == nil {
+				continue
+			}
+			if stmt.Token.Type == TOKEN_MULTILABEL {
+				as.defineMultiLabel(stmt.Name.Value)
+			} else {
+				as.defineSymbol(stmt.Name.Value, Label, as.pc)
+			}
+		case *InstructionStatement:
+			as.assembleInstruction(file, stmt)
+		case *DirectiveStatement:
+			as.assembleDirective(file, stmt)
+		case *ExpressionStatement:
+			as.assembleCall(file, stmt)
+		case *BlockStatement:
+			as.assembleStatements(file, stmt.Statements)
+		}
+	}
+}
+
+// assembleInstruction encodes one instruction
+func (as *assembler) assembleInstruction(file *assemblerFile, node *InstructionStatement) {
+	mnemonic := strings.ToUpper(node.Token.Literal)
+	info := GetProcessorContext().GetMnemonicInfo(mnemonic)
+	if info == nil {
+		as.errorAt(file, node.Token, "Unknown mnemonic '%s'", node.Token.Literal)
+		return
+	}
+
+	mode, fixed := as.modes[node]
+	if !fixed {
+		mode = file.analyzer.addressingMode(info, node)
+		as.modes[node] = mode
+	}
+	value, known := as.operandValue(node, mode)
+
+	// A zero-page operand whose value grew beyond $FF needs the absolute form, unless the
+	// mnemonic extension asks for zero page
+	if known && (value < 0 || value > 0xFF) && strings.HasPrefix(mode, "Zeropage") {
+		if node.Suffix != "" {
+			as.errorAt(file, node.Token, "%s.%s needs a zero-page operand, $%04X is out of range", mnemonic, node.Suffix, value)
+			return
+		}
+		mode = "Absolute" + strings.TrimPrefix(mode, "Zeropage")
+		as.modes[node] = mode
+		as.changed = true
+	}
+
+	var modeInfo *AddressingModeInfo
+	for _, m := range info.AddressingModes {
+		if m.Mode == mode {
+			modeInfo = m
+			break
+		}
+	}
+	if modeInfo == nil {
+		as.errorAt(file, node.Token, "%s does not support %s addressing", mnemonic, mode)
+		return
+	}
+	opcode, err := parseInt(modeInfo.Opcode, 16)
+	if err != nil {
+		as.errorAt(file, node.Token, "Invalid opcode '%s' for %s %s in mnemonic.json", modeInfo.Opcode, mnemonic, mode)
+		return
+	}
+
+	bytes := []byte{byte(opcode)}
+	if modeInfo.Length > 1 {
+		if !known {
+			as.errorAt(file, node.Token, "Cannot evaluate operand of %s", mnemonic)
+		}
+		switch {
+		case mode == "Relative":
+			offset := value - (as.pc + 2)
+			if known && (offset < -128 || offset > 127) {
+				as.errorAt(file, node.Token, "Branch target $%04X is out of range (%d bytes)", value, offset)
+			}
+			value = offset
+		case mode == "Immediate":
+			if known && (value < -128 || value > 0xFF) {
+				as.errorAt(file, node.Token, "Immediate value %d doesn't fit in a byte", value)
+			}
+		case known && modeInfo.Length == 3 && (value < 0 || value > 0xFFFF):
+			as.errorAt(file, node.Token, "Address $%X is beyond $FFFF", value)
+		}
+		bytes = append(bytes, byte(value))
+		if modeInfo.Length == 3 {
+			bytes = append(bytes, byte(value>>8))
+		}
+	}
+	as.emit(file, node.Token, bytes...)
+}
+
+// operandValue evaluates an instruction operand: the immediate value, the (base) address or
+// the branch target
+func (as *assembler) operandValue(node *InstructionStatement, mode string) (int64, bool) {
+	switch op := node.Operand.(type) {
+	case nil:
+		return 0, true
+	case *Identifier:
+		if mode == "Accumulator" {
+			return 0, true
+		}
+	case *PrefixExpression:
+		if op.Operator == "#" {
+			return as.evaluate(op.Right)
+		}
+	case *InfixExpression:
+		if op.Operator == "," {
+			return as.evaluate(op.Left)
+		}
+	}
+	return as.evaluate(node.Operand)
+}
+
+// evaluate computes the integer value of an expression. Unlike evaluateExpression it knows
+// the current PC and negative values; the second result is false for unknown symbols.
+func (as *assembler) evaluate(expr Expression) (int64, bool) {
+	switch e := expr.(type) {
+	case *IntegerLiteral:
+		return e.Value, true
+	case *ProgramCounterExpression:
+		return as.pc, true
+	case *GroupedExpression:
+		return as.evaluate(e.Expression)
+	case *Identifier:
+		name := normalizeLabel(e.Value)
+		switch e.Token.Type {
+		case TOKEN_MULTILABEL_FWD:
+			if symbol, found := as.context.lookupMultiLabel(name, '+', as.pc); found {
+				return symbol.Address, true
+			}
+			return 0, false
+		case TOKEN_MULTILABEL_BACK:
+			if symbol, found := as.context.lookupMultiLabel(name, '-', as.pc); found {
+				return symbol.Address, true
+			}
+			return 0, false
+		}
+		if symbol, found := as.context.lookupLabel(name); found {
+			return symbol.Address, true
+		}
+		return 0, false
+	case *PrefixExpression:
+		value, ok := as.evaluate(e.Right)
+		switch e.Operator {
+		case "-":
+			return -value, ok
+		case "+", "#":
+			return value, ok
+		case "<":
+			return value & 0xFF, ok
+		case ">":
+			return (value >> 8) & 0xFF, ok
+		case "~":
+			return ^value, ok
+		case "!":
+			return boolValue(value == 0), ok
+		}
+	case *InfixExpression:
+		left, okLeft := as.evaluate(e.Left)
+		right, okRight := as.evaluate(e.Right)
+		if !okLeft || !okRight {
+			return 0, false
+		}
+		switch e.Operator {
+		case "+":
+			return left + right, true
+		case "-":
+			return left - right, true
+		case "*":
+			return left * right, true
+		case "/":
+			if right != 0 {
+				return left / right, true
+			}
+		case "%":
+			if right != 0 {
+				return left % right, true
+			}
+		case "<<":
+			return left << uint(right), true
+		case ">>":
+			return left >> uint(right), true
+		case "&":
+			return left & right, true
+		case "|":
+			return left | right, true
+		case "^":
+			return left ^ right, true
+		case "==":
+			return boolValue(left == right), true
+		case "!=":
+			return boolValue(left != right), true
+		case "<":
+			return boolValue(left < right), true
+		case ">":
+			return boolValue(left > right), true
+		case "<=":
+			return boolValue(left <= right), true
+		case ">=":
+			return boolValue(left >= right), true
+		case "&&":
+			return boolValue(left != 0 && right != 0), true
+		case "||":
+			return boolValue(left != 0 || right != 0), true
+		}
+	case *CallExpression:
+		if ident, ok := e.Function.(*Identifier); ok {
+			analyzer := &SemanticAnalyzer{context: as.context}
+			if value := analyzer.evaluateBuiltinFunction(ident.Value, e.Arguments); value != -1 {
+				return value, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// assembleDirective handles the directives that set the PC, define symbols or emit data
+func (as *assembler) assembleDirective(file *assemblerFile, node *DirectiveStatement) {
+	directive := strings.ToLower(node.Token.Literal)
+	switch directive {
+	case "*=", "*", ".pc":
+		if value, ok := as.evaluate(node.Value); ok && value >= 0 && value <= 0xFFFF {
+			as.pc = value
+		} else {
+			as.errorAt(file, node.Token, "Invalid program counter")
+		}
+
+	case ".const", "const", ".var", "var", ".label":
+		if node.Name == nil || node.Value == nil {
+			return
+		}
+		kind := Constant
+		if strings.HasSuffix(directive, "var") {
+			kind = Variable
+		}
+		if value, ok := as.evaluate(node.Value); ok {
+			as.defineSymbol(node.Name.Value, kind, value)
+		} else {
+			as.errorAt(file, node.Token, "Cannot evaluate value of '%s'", node.Name.Value)
+		}
+
+	case ".byte", ".by", ".byt", ".word", ".wo", ".dword", ".dw":
+		size := 1
+		if strings.HasPrefix(directive, ".w") {
+			size = 2
+		} else if strings.HasPrefix(directive, ".d") {
+			size = 4
+		}
+		for _, element := range directiveElements(node.Value) {
+			value, ok := as.evaluate(element)
+			if !ok {
+				as.errorAt(file, node.Token, "Cannot evaluate %s value", directive)
+			}
+			limit := int64(1) << (8 * uint(size))
+			if ok && (value < -limit/2 || value >= limit) {
+				as.errorAt(file, node.Token, "Value %d doesn't fit in %s", value, directive)
+			}
+			bytes := make([]byte, size)
+			for i := range bytes {
+				bytes[i] = byte(value >> (8 * uint(i)))
+			}
+			as.emit(file, node.Token, bytes...)
+		}
+
+	case ".text", ".tx":
+		for _, element := range directiveElements(node.Value) {
+			if bytes, ok := as.textBytes(file, node.Token, element); ok {
+				as.emit(file, node.Token, bytes...)
+			} else {
+				as.errorAt(file, node.Token, "Cannot evaluate %s value", directive)
+			}
+		}
+
+	case ".encoding":
+		if str, ok := node.Value.(*StringLiteral); ok {
+			if textEncodings[strings.ToLower(str.Value)] == nil {
+				as.errorAt(file, node.Token, "Unknown encoding '%s'", str.Value)
+				return
+			}
+			as.encoding = strings.ToLower(str.Value)
+		}
+
+	case ".fill", ".fi":
+		elements := directiveElements(node.Value)
+		if len(elements) != 2 {
+			as.errorAt(file, node.Token, ".fill expects a count and a value")
+			return
+		}
+		count, ok := as.evaluate(elements[0])
+		if !ok || count < 0 {
+			as.errorAt(file, node.Token, "Cannot evaluate .fill count")
+			return
+		}
+		if as.pc+count > 0x10000 {
+			as.errorAt(file, node.Token, ".fill of %d bytes runs past $FFFF", count)
+			return
+		}
+		// The value may use the index i
+		saved, hadI := as.context.DefinedLabels["i"]
+		for i := int64(0); i < count; i++ {
+			as.context.DefinedLabels["i"] = &Symbol{Name: "i", Kind: Variable, Address: i}
+			value, ok := as.evaluate(elements[1])
+			if !ok {
+				as.errorAt(file, node.Token, "Cannot evaluate .fill value")
+				break
+			}
+			as.emit(file, node.Token, byte(value))
+		}
+		if hadI {
+			as.context.DefinedLabels["i"] = saved
+		} else {
+			delete(as.context.DefinedLabels, "i")
+		}
+
+	case ".align":
+		elements := directiveElements(node.Value)
+		alignment, ok := int64(0), false
+		if len(elements) > 0 {
+			alignment, ok = as.evaluate(elements[0])
+		}
+		if !ok || alignment <= 0 {
+			as.errorAt(file, node.Token, "Invalid .align value")
+			return
+		}
+		for as.pc%alignment != 0 {
+			as.emit(file, node.Token, 0)
+		}
+
+	case ".namespace":
+		if node.Name == nil || node.Block == nil {
+			return
+		}
+		as.context.NamespaceStack = append(as.context.NamespaceStack, as.context.CurrentNamespace)
+		as.context.CurrentNamespace = as.context.getQualifiedLabelName(node.Name.Value)
+		as.assembleStatements(file, node.Block.Statements)
+		as.context.CurrentNamespace = as.context.NamespaceStack[len(as.context.NamespaceStack)-1]
+		as.context.NamespaceStack = as.context.NamespaceStack[:len(as.context.NamespaceStack)-1]
+
+	case "#import":
+		as.assembleImport(file, node)
+
+	case "#if":
+		// The parser kept the branch whose condition holds
+		if node.Block != nil {
+			as.assembleStatements(file, node.Block.Statements)
+		}
+
+	case ".if":
+		as.assembleIf(file, node)
+
+	case "#importonce":
+		file.importOnce = true
+
+	case ".macro", ".function", ".pseudocommand", ".print", ".printnow", ".assert",
+		".break", ".watch", "#define", "#undef":
+		// Templates and directives without output
+
+	default:
+		as.errorAt(file, node.Token, "'%s' is not supported by the assembler yet", node.Token.Literal)
+	}
+}
+
+// assembleIf assembles the branch of an .if/else chain whose condition holds
+func (as *assembler) assembleIf(file *assemblerFile, node *DirectiveStatement) {
+	for node != nil {
+		condition, ok := as.evaluate(node.Value)
+		if !ok {
+			as.errorAt(file, node.Token, "Cannot evaluate .if condition")
+			return
+		}
+		if condition != 0 {
+			if node.Block != nil {
+				as.assembleStatements(file, node.Block.Statements)
+			}
+			return
+		}
+		switch alternative := node.Alternative.(type) {
+		case *DirectiveStatement:
+			node = alternative
+		case *BlockStatement:
+			as.assembleStatements(file, alternative.Statements)
+			return
+		default:
+			return
+		}
+	}
+}
+
+// directiveElements returns the comma separated values of a directive
+func directiveElements(value Expression) []Expression {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case *ArrayExpression:
+		return v.Elements
+	}
+	return []Expression{value}
+}
+
+// textBytes evaluates a .text value to encoded bytes: string literals (@"..." with escape
+// sequences) joined with +, numbers as decimal digits
+func (as *assembler) textBytes(file *assemblerFile, token Token, expr Expression) ([]byte, bool) {
+	switch e := expr.(type) {
+	case *StringLiteral:
+		return as.encodeText(file, token, e.Value, false), true
+	case *PrefixExpression:
+		if str, ok := e.Right.(*StringLiteral); ok && e.Operator == "@" {
+			return as.encodeText(file, token, str.Value, true), true
+		}
+	case *GroupedExpression:
+		return as.textBytes(file, token, e.Expression)
+	case *InfixExpression:
+		if e.Operator == "+" && hasStringLiteral(e) {
+			left, okLeft := as.textBytes(file, token, e.Left)
+			right, okRight := as.textBytes(file, token, e.Right)
+			return append(left, right...), okLeft && okRight
+		}
+	}
+	if value, ok := as.evaluate(expr); ok {
+		return as.encodeText(file, token, strconv.FormatInt(value, 10), false), true
+	}
+	return nil, false
+}
+
+// encodeText encodes a string in the current encoding and reports characters it can't encode
+func (as *assembler) encodeText(file *assemblerFile, token Token, text string, escaped bool) []byte {
+	bytes, errors := encodeText(text, escaped, as.encoding)
+	for _, err := range errors {
+		as.errorAt(file, token, "%s", err.message)
+	}
+	return bytes
+}
+
+// assembleCall handles call statements: KickAssembler's BasicUpstart macros are built in,
+// other macro calls aren't expanded yet
+func (as *assembler) assembleCall(file *assemblerFile, node *ExpressionStatement) {
+	call, ok := node.Expression.(*CallExpression)
+	if !ok {
+		return
+	}
+	ident, ok := call.Function.(*Identifier)
+	if !ok {
+		return
+	}
+
+	switch ident.Value {
+	case "BasicUpstart", "BasicUpstart2":
+		if len(call.Arguments) != 1 {
+			as.errorAt(file, node.Token, "%s expects one argument", ident.Value)
+			return
+		}
+		address, ok := as.evaluate(call.Arguments[0])
+		if !ok {
+			as.errorAt(file, node.Token, "Cannot evaluate %s address", ident.Value)
+		}
+		if ident.Value == "BasicUpstart2" {
+			// * = $0801 "Basic", BasicUpstart(address), * = $080e "Basic End"
+			as.pc = 0x0801
+			as.basicUpstart(file, node.Token, address)
+			as.pc = 0x080e
+			return
+		}
+		as.basicUpstart(file, node.Token, address)
+	default:
+		as.errorAt(file, node.Token, "Macro call '%s' is not supported by the assembler yet", ident.Value)
+	}
+}
+
+// basicUpstart emits KickAssembler's BasicUpstart macro at the PC
+func (as *assembler) basicUpstart(file *assemblerFile, token Token, address int64) {
+	digits := as.encodeText(file, token, strconv.FormatInt(address, 10), false)
+	as.emit(file, token, basicUpstartBytes(as.pc, digits)...)
+}
+
+// basicUpstartBytes is the BASIC line "10 SYS <address>" generated at pc by KickAssembler's
+// BasicUpstart macro, from the address as encoded text:
+//
+//	.word upstartEnd
+//	.word 10
+//	.byte $9e
+//	.text toIntString(address)
+//	.byte 0
+//	upstartEnd: .word 0
+func basicUpstartBytes(pc int64, digits []byte) []byte {
+	upstartEnd := pc + 2 + 2 + 1 + int64(len(digits)) + 1
+	bytes := []byte{byte(upstartEnd), byte(upstartEnd >> 8), 10, 0, 0x9e}
+	bytes = append(bytes, digits...)
+	return append(bytes, 0, 0, 0)
+}
+
+// assembleImport assembles an #import'ed file in place. A file with #importonce is only
+// assembled the first time it is imported.
+func (as *assembler) assembleImport(file *assemblerFile, node *DirectiveStatement) {
+	str, ok := node.Value.(*StringLiteral)
+	if !ok {
+		return
+	}
+	path, found := resolveImportPath(pathToURI(file.path), str.Value)
+	if !found {
+		as.errorAt(file, node.Token, "Cannot find imported file '%s'", str.Value)
+		return
+	}
+	for _, chained := range as.chain {
+		if sameFile(chained, path) {
+			as.errorAt(file, node.Token, "Circular #import of '%s'", str.Value)
+			return
+		}
+	}
+
+	imported, loaded := as.files[path]
+	if loaded && imported.importOnce && as.included[path] {
+		return
+	}
+	if !loaded {
+		text, fromEditor := openDocumentText(path)
+		if !fromEditor {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				as.errorAt(file, node.Token, "Cannot read imported file '%s': %v", str.Value, err)
+				return
+			}
+			text = string(content)
+		}
+		var errors []AssemblyError
+		imported, errors = as.loadFile(path, text)
+		if len(errors) > 0 {
+			as.errors = append(as.errors, errors...)
+			return
+		}
+	}
+
+	as.included[path] = true
+	as.chain = append(as.chain, path)
+	as.assembleStatements(imported, imported.program.Statements)
+	as.chain = as.chain[:len(as.chain)-1]
+}
@@ -0,0 +1,378 @@
+package lsp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "c64.nvim/internal/log"
+)
+
+// AssemblerSymbols holds the label addresses written by a real Kick Assembler build
+// (-symbolfile, -vicesymbols or -debugdump)
+type AssemblerSymbols struct {
+	Path    string
+	ModTime time.Time
+	Labels  map[string]int64 // label name as written by the assembler -> address
+
+	// Label scopes ({ ... }) are not tracked by the analyzer, so labels are also
+	// indexed by their last name component. Ambiguous short names are left out.
+	shortNames map[string]int64
+	ambiguous  map[string]bool
+}
+
+// assemblerSymbolExtensions are the symbol file types, in order of preference
+var assemblerSymbolExtensions = []string{".sym", ".dbg", ".vs"}
+
+// assemblerOutputDirs are searched for symbol files, relative to the source file
+var assemblerOutputDirs = []string{".", "bin", "build", "out"}
+
+// assemblerSymbolCache holds parsed symbol files, keyed by path
+var assemblerSymbolCache = struct {
+	sync.RWMutex
+	files map[string]*AssemblerSymbols
+}{
+	files: make(map[string]*AssemblerSymbols),
+}
+
+// findAssemblerSymbolFile returns the newest symbol file next to the source file (or in one
+// of the usual output directories) that was written after the source was last saved
+func findAssemblerSymbolFile(uri string) (string, time.Time, bool) {
+	sourcePath := uriToPath(uri)
+	source, err := os.Stat(sourcePath)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	base := strings.TrimSuffix(filepath.Base(sourcePath), filepath.Ext(sourcePath))
+
+	var bestPath string
+	var bestTime time.Time
+	for _, dir := range assemblerOutputDirs {
+		for _, ext := range assemblerSymbolExtensions {
+			candidate := filepath.Join(filepath.Dir(sourcePath), dir, base+ext)
+			info, err := os.Stat(candidate)
+			if err != nil || info.IsDir() || !info.ModTime().After(bestTime) {
+				continue
+			}
+			bestPath, bestTime = candidate, info.ModTime()
+		}
+	}
+	if bestPath == "" {
+		return "", time.Time{}, false
+	}
+
+	// A build older than the source doesn't describe it anymore
+	if bestTime.Before(source.ModTime()) {
+		log.Debug("findAssemblerSymbolFile: ignoring %s, it is older than %s", bestPath, sourcePath)
+		return "", time.Time{}, false
+	}
+	return bestPath, bestTime, true
+}
+
+// assemblerSymbolStamp identifies the symbol file currently used for a document, so cached
+// analysis results can be dropped after a new build
+func assemblerSymbolStamp(uri string) string {
+	if !GetDocumentConfig(uri).AssemblerSymbols.Enabled {
+		return ""
+	}
+	path, modTime, found := findAssemblerSymbolFile(uri)
+	if !found {
+		return ""
+	}
+	return fmt.Sprintf("%s@%d", path, modTime.UnixNano())
+}
+
+// loadAssemblerSymbols returns the label addresses from the last build of a document,
+// or nil if there is no up-to-date symbol file
+func loadAssemblerSymbols(uri string) *AssemblerSymbols {
+	if !GetDocumentConfig(uri).AssemblerSymbols.Enabled {
+		return nil
+	}
+	path, modTime, found := findAssemblerSymbolFile(uri)
+	if !found {
+		return nil
+	}
+
+	assemblerSymbolCache.RLock()
+	cached, exists := assemblerSymbolCache.files[path]
+	assemblerSymbolCache.RUnlock()
+	if exists && cached.ModTime.Equal(modTime) {
+		return cached
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Warn("loadAssemblerSymbols: cannot read %s: %v", path, err)
+		return nil
+	}
+
+	symbols := &AssemblerSymbols{
+		Path:       path,
+		ModTime:    modTime,
+		Labels:     make(map[string]int64),
+		shortNames: make(map[string]int64),
+		ambiguous:  make(map[string]bool),
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".sym":
+		symbols.parseSymbolFile(string(data))
+	case ".vs":
+		symbols.parseViceSymbols(string(data))
+	case ".dbg":
+		if err := symbols.parseDebugDump(data); err != nil {
+			log.Warn("loadAssemblerSymbols: cannot parse %s: %v", path, err)
+			return nil
+		}
+	}
+	log.Debug("loadAssemblerSymbols: %d labels from %s", len(symbols.Labels), path)
+
+	assemblerSymbolCache.Lock()
+	assemblerSymbolCache.files[path] = symbols
+	assemblerSymbolCache.Unlock()
+	return symbols
+}
+
+// Name returns the file name of the symbol file for messages
+func (s *AssemblerSymbols) Name() string {
+	return filepath.Base(s.Path)
+}
+
+// lookup returns the address of a namespace-qualified label ("ns.label")
+func (s *AssemblerSymbols) lookup(name string) (int64, bool) {
+	if address, found := s.Labels[name]; found {
+		return address, true
+	}
+	address, found := s.shortNames[name[strings.LastIndex(name, ".")+1:]]
+	return address, found
+}
+
+// addLabel records a label. name is namespace-qualified, fullName also contains label scopes.
+func (s *AssemblerSymbols) addLabel(name, fullName string, address int64) {
+	s.Labels[name] = address
+	if fullName != name {
+		s.Labels[fullName] = address
+	}
+
+	short := name[strings.LastIndex(name, ".")+1:]
+	if s.ambiguous[short] {
+		return
+	}
+	if existing, found := s.shortNames[short]; found && existing != address {
+		delete(s.shortNames, short)
+		s.ambiguous[short] = true
+		return
+	}
+	s.shortNames[short] = address
+}
+
+// symbolFileLinePattern matches a definition in a Kick Assembler -symbolfile, e.g.
+// ".label start=$801 {" or ".namespace music {"
+var symbolFileLinePattern = regexp.MustCompile(`^\.(label|namespace|const|var)\s+([A-Za-z_@][\w@]*)\s*(?:=\s*([^\s{]+))?\s*(\{)?$`)
+
+// parseSymbolFile reads a Kick Assembler -symbolfile (.sym). Labels open a scope for the
+// labels defined inside their { } block, namespaces qualify the names like in the analyzer.
+func (s *AssemblerSymbols) parseSymbolFile(text string) {
+	type symbolScope struct {
+		name        string
+		isNamespace bool
+	}
+	var scopes []symbolScope
+
+	qualify := func(name string, namespacesOnly bool) string {
+		var parts []string
+		for _, scope := range scopes {
+			if scope.name != "" && (scope.isNamespace || !namespacesOnly) {
+				parts = append(parts, scope.name)
+			}
+		}
+		return strings.Join(append(parts, name), ".")
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line == "}" {
+			if len(scopes) > 0 {
+				scopes = scopes[:len(scopes)-1]
+			}
+			continue
+		}
+
+		match := symbolFileLinePattern.FindStringSubmatch(line)
+		if match == nil {
+			if strings.HasSuffix(line, "{") {
+				scopes = append(scopes, symbolScope{})
+			}
+			continue
+		}
+		kind, name, value, opensScope := match[1], match[2], match[3], match[4] != ""
+
+		if kind == "label" {
+			if address, ok := parseStateValue(value); ok {
+				s.addLabel(qualify(name, true), qualify(name, false), address)
+			}
+		}
+		if opensScope {
+			scopes = append(scopes, symbolScope{name: name, isNamespace: kind == "namespace"})
+		}
+	}
+}
+
+// parseViceSymbols reads a VICE label file (-vicesymbols), e.g. "al C:0801 .start"
+func (s *AssemblerSymbols) parseViceSymbols(text string) {
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "al" {
+			continue
+		}
+		address, ok := parseStateValue("$" + strings.TrimPrefix(fields[1], "C:"))
+		if !ok {
+			continue
+		}
+		name := strings.TrimPrefix(fields[2], ".")
+		s.addLabel(name, name, address)
+	}
+}
+
+// debugDump is the part of a Kick Assembler -debugdump file (C64 Debugger format) we use
+type debugDump struct {
+	Labels []struct {
+		Values string `xml:"values,attr"`
+		Data   string `xml:",chardata"`
+	} `xml:"Labels"`
+}
+
+// parseDebugDump reads the <Labels> table of a -debugdump file. The column order is taken
+// from its "values" attribute (e.g. "SEGMENT,ADDRESS,NAME,START,END,FILE_IDX").
+func (s *AssemblerSymbols) parseDebugDump(data []byte) error {
+	var dump debugDump
+	if err := xml.Unmarshal(data, &dump); err != nil {
+		return err
+	}
+
+	for _, labels := range dump.Labels {
+		addressColumn, nameColumn := -1, -1
+		for i, column := range strings.Split(labels.Values, ",") {
+			switch strings.ToUpper(strings.TrimSpace(column)) {
+			case "ADDRESS":
+				addressColumn = i
+			case "NAME":
+				nameColumn = i
+			}
+		}
+		if addressColumn < 0 || nameColumn < 0 {
+			continue
+		}
+
+		for _, line := range strings.Split(labels.Data, "\n") {
+			fields := strings.Split(strings.TrimSpace(line), ",")
+			if len(fields) <= addressColumn || len(fields) <= nameColumn {
+				continue
+			}
+			address, ok := parseStateValue(fields[addressColumn])
+			if !ok {
+				continue
+			}
+			name := strings.TrimSpace(fields[nameColumn])
+			s.addLabel(name, name, address)
+		}
+	}
+	return nil
+}
+
+// checkAssemblerSymbols compares the label addresses computed in Pass 1 with the addresses
+// from the last real build and reports every label the analyzer got wrong
+func (a *SemanticAnalyzer) checkAssemblerSymbols() {
+	config := a.config
+	if !config.AssemblerSymbols.ShowMismatches || a.scope == nil {
+		return
+	}
+	symbols := loadAssemblerSymbols(a.scope.Uri)
+	if symbols == nil {
+		return
+	}
+
+	names := make([]string, 0, len(a.context.DefinedLabels))
+	for name, symbol := range a.context.DefinedLabels {
+		if symbol.Kind == Label {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		symbol := a.context.DefinedLabels[name]
+		built, found := symbols.lookup(name)
+		if !found || built == symbol.Address {
+			continue
+		}
+		label := normalizeLabel(symbol.Name)
+		a.diagnostics = append(a.diagnostics, Diagnostic{
+			Severity: SeverityInfo,
+			Range: Range{
+				Start: symbol.Position,
+				End:   Position{Line: symbol.Position.Line, Character: symbol.Position.Character + len(label)},
+			},
+			Message: fmt.Sprintf("Label '%s' is at $%04X in the last build (%s), the language server computed $%04X",
+				label, built, symbols.Name(), symbol.Address),
+			Source: "enhanced-analyzer",
+		})
+	}
+}
+
+// labelAddress returns the address of a label for hover and inlay hints, preferring the last
+// build over the analyzer. source names the symbol file, or is empty for computed addresses.
+func labelAddress(uri string, symbol *Symbol) (address int64, source string, found bool) {
+	symbolStore.RLock()
+	context := symbolStore.contexts[uri]
+	symbolStore.RUnlock()
+	if context == nil || symbol == nil {
+		return 0, "", false
+	}
+
+	labels := context.DefinedLabels
+	if symbol.Scope != nil && symbol.Scope.Uri != "" && symbol.Scope.Uri != uri {
+		labels = context.ImportedLabels
+	}
+	var name string
+	var computed *Symbol
+	for qualifiedName, candidate := range labels {
+		if isLaterIteration(qualifiedName) || context.inMacroExpansion(qualifiedName) {
+			continue
+		}
+		if candidate.Kind == Label && candidate.Position == symbol.Position && normalizeLabel(candidate.Name) == normalizeLabel(symbol.Name) {
+			name, computed = qualifiedName, candidate
+			break
+		}
+	}
+	if computed == nil {
+		return 0, "", false
+	}
+
+	if symbols := loadAssemblerSymbols(uri); symbols != nil {
+		if built, ok := symbols.lookup(name); ok {
+			return built, symbols.Name(), true
+		}
+	}
+	return computed.Address, "", true
+}
+
+// labelAddressMarkdown formats the address of a label for hover
+func labelAddressMarkdown(uri string, symbol *Symbol) string {
+	address, source, found := labelAddress(uri, symbol)
+	if !found {
+		return ""
+	}
+	if source != "" {
+		return fmt.Sprintf("\n\n**Address:** `$%04X` (from `%s`)", address, source)
+	}
+	return fmt.Sprintf("\n\n**Address:** `$%04X`", address)
+}
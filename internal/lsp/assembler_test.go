@@ -0,0 +1,149 @@
+package lsp
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// The expected bytes are Kick Assembler's .prg output for the same source
+func TestAssemblePRG(t *testing.T) {
+	loadTestData(t)
+	tests := []struct {
+		name   string
+		source string
+		prg    []byte
+	}{
+		{
+			name:   "BasicUpstart2",
+			source: "BasicUpstart2(start)\nstart: inc $d020\n    jmp start\n",
+			prg: []byte{
+				0x01, 0x08, // load address
+				0x0b, 0x08, 0x0a, 0x00, 0x9e, '2', '0', '6', '2', 0x00, 0x00, 0x00, // 10 SYS 2062
+				0x00,             // gap up to $080e
+				0xee, 0x20, 0xd0, // inc $d020
+				0x4c, 0x0e, 0x08, // jmp start
+			},
+		},
+		{
+			name:   "BasicUpstart with a five digit address",
+			source: "*=$0801\nBasicUpstart($c000)\n",
+			prg:    []byte{0x01, 0x08, 0x0c, 0x08, 0x0a, 0x00, 0x9e, '4', '9', '1', '5', '2', 0x00, 0x00, 0x00},
+		},
+		{
+			name:   "addressing modes",
+			source: "*=$c000\n    lda #$01\n    sta $d020\n    lda $fb\n    ldx $1000,y\n    sta ($fb),y\n    jmp ($fffc)\n    rts\n",
+			prg: []byte{0x00, 0xc0,
+				0xa9, 0x01,
+				0x8d, 0x20, 0xd0,
+				0xa5, 0xfb,
+				0xbe, 0x00, 0x10,
+				0x91, 0xfb,
+				0x6c, 0xfc, 0xff,
+				0x60,
+			},
+		},
+		{
+			name:   "branches and multi-labels",
+			source: "*=$1000\nloop: dex\n    bne loop\n!next: dey\n    bpl !next-\n    beq !next+\n    nop\n!next: rts\n",
+			prg:    []byte{0x00, 0x10, 0xca, 0xd0, 0xfd, 0x88, 0x10, 0xfd, 0xf0, 0x01, 0xea, 0x60},
+		},
+		{
+			name:   "forward references are absolute",
+			source: "*=$1000\n    lda data\n    lda zp\n    rts\ndata: .byte 1\n.label zp = $fb\n",
+			prg:    []byte{0x00, 0x10, 0xad, 0x07, 0x10, 0xad, 0xfb, 0x00, 0x60, 0x01},
+		},
+		{
+			name:   "data directives",
+			source: "*=$2000\n.byte 1, $ff, <$1234, >$1234\n.word $1234, 2\n.text \"ab\"\n",
+			prg:    []byte{0x00, 0x20, 0x01, 0xff, 0x34, 0x12, 0x34, 0x12, 0x02, 0x00, 0x01, 0x02},
+		},
+		{
+			name:   "illegal opcode",
+			source: "*=$1000\n    lax #$05\n    lax $fb\n",
+			prg:    []byte{0x00, 0x10, 0xab, 0x05, 0xa7, 0xfb},
+		},
+		{
+			name:   "gaps between blocks are zeros",
+			source: "*=$1000\n    nop\n*=$1003\n    rts\n",
+			prg:    []byte{0x00, 0x10, 0xea, 0x00, 0x00, 0x60},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			program, errors := Assemble("test.asm", test.source)
+			if len(errors) > 0 {
+				t.Fatalf("assembly failed: %v", errors)
+			}
+			prg, err := program.PRG()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(prg, test.prg) {
+				t.Errorf("got  % x\nwant % x", prg, test.prg)
+			}
+		})
+	}
+}
+
+func TestAssembleImportOnce(t *testing.T) {
+	loadTestData(t)
+	main := "*=$1000\n#import \"a.asm\"\n#import \"b.asm\"\nafter: rts\n"
+	tests := []struct {
+		name   string
+		common string
+		b      string
+		prg    []byte
+	}{
+		{
+			name:   "with #importonce",
+			common: "#importonce\ncommon: rts\n",
+			b:      "#import \"common.asm\"\njsr common\n",
+			prg:    []byte{0x00, 0x10, 0x60, 0xea, 0x20, 0x00, 0x10, 0x60},
+		},
+		{
+			name:   "without #importonce",
+			common: "    rts\n",
+			b:      "#import \"common.asm\"\nnop\n",
+			prg:    []byte{0x00, 0x10, 0x60, 0xea, 0x60, 0xea, 0x60},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeTestFiles(t, map[string]string{
+				"main.asm":   main,
+				"a.asm":      "#import \"common.asm\"\nnop\n",
+				"b.asm":      test.b,
+				"common.asm": test.common,
+			})
+			program, errors := Assemble(filepath.Join(dir, "main.asm"), main)
+			if len(errors) > 0 {
+				t.Fatalf("assembly failed: %v", errors)
+			}
+			prg, err := program.PRG()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(prg, test.prg) {
+				t.Errorf("got  % x\nwant % x", prg, test.prg)
+			}
+		})
+	}
+}
+
+func TestBasicUpstartBytes(t *testing.T) {
+	tests := []struct {
+		pc     int64
+		digits string
+		want   []byte
+	}{
+		{0x0801, "2064", []byte{0x0b, 0x08, 0x0a, 0x00, 0x9e, '2', '0', '6', '4', 0x00, 0x00, 0x00}},
+		{0x0801, "49152", []byte{0x0c, 0x08, 0x0a, 0x00, 0x9e, '4', '9', '1', '5', '2', 0x00, 0x00, 0x00}},
+		{0x1ffe, "8", []byte{0x05, 0x20, 0x0a, 0x00, 0x9e, '8', 0x00, 0x00, 0x00}},
+	}
+	for _, test := range tests {
+		if got := basicUpstartBytes(test.pc, []byte(test.digits)); !bytes.Equal(got, test.want) {
+			t.Errorf("basicUpstartBytes($%04X, %s) = % x, want % x", test.pc, test.digits, got, test.want)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package lsp
 
+import "strings"
+
 // --- Abstract Syntax Tree (AST) --- //
 
 type Node interface {
@@ -18,6 +20,7 @@ type Expression interface {
 
 type Program struct {
 	Statements []Statement
+	Inactive   []InactiveRange // #if branches the preprocessor discarded
 }
 
 func (p *Program) TokenLiteral() string {
@@ -38,6 +41,7 @@ func (bs *BlockStatement) TokenLiteral() string { return bs.Token.Literal }
 
 type InstructionStatement struct {
 	Token   Token
+	Suffix  string // mnemonic extension forcing the addressing mode, e.g. "abs" in lda.abs
 	Operand Expression
 }
 
@@ -58,6 +62,12 @@ type DirectiveStatement struct {
 	Parameters []*Identifier
 	Value      Expression
 	Block      *BlockStatement
+	// Else branch of an .if: a *BlockStatement, or the *DirectiveStatement of an else .if
+	Alternative Statement
+	// [name=value, ...] of .segmentdef, .segment, .file and .segmentout
+	Options *ParameterList
+	// Memory block name: *=$1000 "Main", .segment Code "Main" or .memblock "Main"
+	Description *StringLiteral
 }
 
 func (ds *DirectiveStatement) statementNode()       {}
@@ -71,6 +81,23 @@ type LabelStatement struct {
 func (ls *LabelStatement) statementNode()       {}
 func (ls *LabelStatement) TokenLiteral() string { return ls.Token.Literal }
 
+// statementToken returns the first token of a statement
+func statementToken(stmt Statement) Token {
+	switch node := stmt.(type) {
+	case *BlockStatement:
+		return node.Token
+	case *InstructionStatement:
+		return node.Token
+	case *ExpressionStatement:
+		return node.Token
+	case *DirectiveStatement:
+		return node.Token
+	case *LabelStatement:
+		return node.Token
+	}
+	return Token{}
+}
+
 type Identifier struct {
 	Token Token
 	Value string
@@ -131,6 +158,27 @@ type CallExpression struct {
 func (ce *CallExpression) expressionNode()      {}
 func (ce *CallExpression) TokenLiteral() string { return ce.Token.Literal }
 
+// IndexExpression selects an iteration of a labeled .for or .while loop: loop[2]
+type IndexExpression struct {
+	Token Token // The '[' token
+	Left  Expression
+	Index Expression
+}
+
+func (ie *IndexExpression) expressionNode()      {}
+func (ie *IndexExpression) TokenLiteral() string { return ie.Token.Literal }
+
+// ForExpression is the header of a .for loop: (var i = 0, j = 0; i < 10; i++, j += 2)
+type ForExpression struct {
+	Token     Token // The '(' token
+	Init      []Expression
+	Condition Expression
+	Step      []Expression
+}
+
+func (fe *ForExpression) expressionNode()      {}
+func (fe *ForExpression) TokenLiteral() string { return fe.Token.Literal }
+
 // ArrayExpression represents an array of expressions (for comma-separated values)
 type ArrayExpression struct {
 	Token    Token // The first token
@@ -140,6 +188,32 @@ type ArrayExpression struct {
 func (ae *ArrayExpression) expressionNode()      {}
 func (ae *ArrayExpression) TokenLiteral() string { return ae.Token.Literal }
 
+// ParameterList is the [name=value, ...] list of the segment directives. A parameter
+// without a value, like fill, is a flag that is set.
+type ParameterList struct {
+	Token      Token // The '[' token
+	Parameters []*Parameter
+}
+
+// Parameter is an entry of a ParameterList
+type Parameter struct {
+	Name  *Identifier
+	Value Expression // nil for a flag
+}
+
+// Lookup returns the parameter with a name, nil if there is none
+func (pl *ParameterList) Lookup(name string) *Parameter {
+	if pl == nil {
+		return nil
+	}
+	for _, parameter := range pl.Parameters {
+		if parameter.Name.Value == name {
+			return parameter
+		}
+	}
+	return nil
+}
+
 // ProgramCounterExpression represents the program counter (*) in addressing modes
 type ProgramCounterExpression struct {
 	Token Token // The '*' token
@@ -147,3 +221,50 @@ type ProgramCounterExpression struct {
 
 func (pc *ProgramCounterExpression) expressionNode()      {}
 func (pc *ProgramCounterExpression) TokenLiteral() string { return pc.Token.Literal }
+
+// expressionSource writes an expression back as source, with single spaces around binary
+// operators
+func expressionSource(expr Expression) string {
+	switch e := expr.(type) {
+	case *Identifier:
+		if e.Token.Literal != "" {
+			return e.Token.Literal
+		}
+		return e.Value
+	case *IntegerLiteral:
+		return e.Token.Literal
+	case *StringLiteral:
+		return e.Token.Literal
+	case *ProgramCounterExpression:
+		return e.Token.Literal
+	case *PrefixExpression:
+		return e.Operator + expressionSource(e.Right)
+	case *InfixExpression:
+		switch {
+		case e.Right == nil: // i++
+			return expressionSource(e.Left) + e.Operator
+		case e.Operator == ".":
+			return expressionSource(e.Left) + "." + expressionSource(e.Right)
+		case e.Operator == ",":
+			return expressionSource(e.Left) + ", " + expressionSource(e.Right)
+		}
+		return expressionSource(e.Left) + " " + e.Operator + " " + expressionSource(e.Right)
+	case *GroupedExpression:
+		return "(" + expressionSource(e.Expression) + ")"
+	case *CallExpression:
+		arguments := make([]string, len(e.Arguments))
+		for i, argument := range e.Arguments {
+			arguments[i] = expressionSource(argument)
+		}
+		return expressionSource(e.Function) + "(" + strings.Join(arguments, ", ") + ")"
+	case *IndexExpression:
+		return expressionSource(e.Left) + "[" + expressionSource(e.Index) + "]"
+	case *ArrayExpression:
+		elements := make([]string, len(e.Elements))
+		for i, element := range e.Elements {
+			elements[i] = expressionSource(element)
+		}
+		return strings.Join(elements, ", ")
+	}
+	return ""
+}
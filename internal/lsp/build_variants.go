@@ -0,0 +1,113 @@
+package lsp
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "c64.nvim/internal/log"
+)
+
+// selectedBuildVariant is the variant picked with kickass.selectBuildVariant, it wins over
+// the "buildVariant" setting. Empty means the configured variant. Guarded by configMutex.
+var selectedBuildVariant string
+
+// activeDefines returns the preprocessor symbols the build defines, like the -define options
+// of Kick Assembler: the common defines and those of the active build variant
+func (config *LSPConfiguration) activeDefines() []string {
+	defines := []string{}
+	seen := make(map[string]bool)
+	for _, name := range append(append([]string{}, config.Defines...), config.BuildVariants[config.BuildVariant]...) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			defines = append(defines, name)
+		}
+	}
+	return defines
+}
+
+// knownBuildVariants returns the build variants configured for a document, or for the editor
+// settings and every open document if uri is empty
+func knownBuildVariants(uri string) map[string][]string {
+	variants := make(map[string][]string)
+	if uri != "" {
+		for name, defines := range GetDocumentConfig(uri).BuildVariants {
+			variants[name] = defines
+		}
+		return variants
+	}
+
+	for name, defines := range GetLSPConfig().BuildVariants {
+		variants[name] = defines
+	}
+	documentStore.RLock()
+	uris := make([]string, 0, len(documentStore.documents))
+	for uri := range documentStore.documents {
+		uris = append(uris, uri)
+	}
+	documentStore.RUnlock()
+	for _, uri := range uris {
+		for name, defines := range GetDocumentConfig(uri).BuildVariants {
+			if _, ok := variants[name]; !ok {
+				variants[name] = defines
+			}
+		}
+	}
+	return variants
+}
+
+// selectBuildVariant switches the build variant and analyzes all open documents again.
+//
+// Arguments: the variant name, or {"variant", "uri"}. An empty name goes back to the
+// "buildVariant" setting. Without a name the variants are only listed, those of the document
+// at uri if given.
+func selectBuildVariant(writer *bufio.Writer, arguments []interface{}) (interface{}, error) {
+	var name, uri string
+	selecting := false
+	if len(arguments) > 0 {
+		switch arg := arguments[0].(type) {
+		case string:
+			name, selecting = arg, true
+		case map[string]interface{}:
+			name, selecting = arg["variant"].(string)
+			uri, _ = arg["uri"].(string)
+		}
+	}
+
+	variants := knownBuildVariants(uri)
+	if selecting {
+		if _, ok := variants[name]; name != "" && !ok {
+			if len(variants) == 0 {
+				return nil, fmt.Errorf("unknown build variant %q, no variants are configured in \"buildVariants\"", name)
+			}
+			return nil, fmt.Errorf("unknown build variant %q, known variants are %s", name, strings.Join(buildVariantNames(variants), ", "))
+		}
+
+		configMutex.Lock()
+		changed := selectedBuildVariant != name
+		selectedBuildVariant = name
+		configMutex.Unlock()
+		if changed {
+			log.Info("Build variant %q selected, re-analyzing open documents", name)
+			reanalyzeOpenDocuments(writer)
+		}
+	}
+
+	config := GetDocumentConfig(uri)
+	return map[string]interface{}{
+		"active":   config.BuildVariant,
+		"defines":  config.activeDefines(),
+		"variants": variants,
+	}, nil
+}
+
+// buildVariantNames returns the names of variants, sorted
+func buildVariantNames(variants map[string][]string) []string {
+	names := make([]string, 0, len(variants))
+	for name := range variants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,116 @@
+package lsp
+
+import (
+	"bufio"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const buildVariantsSource = `*=$1000
+#if DEBUG
+debug: nop
+#endif
+#if PAL
+pal: nop
+#elif NTSC
+ntsc: nop
+#endif
+after: rts
+`
+
+func TestBuildVariantDefines(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		defines []string
+		labels  map[string]int64
+	}{
+		{
+			name:    "defines",
+			config:  `{"kickass_ls": {"defines": ["DEBUG"]}}`,
+			defines: []string{"DEBUG"},
+			labels:  map[string]int64{"debug": 0x1000, "after": 0x1001},
+		},
+		{
+			name: "build variant",
+			config: `{"kickass_ls": {"defines": ["DEBUG"], "buildVariant": "ntsc",
+				"buildVariants": {"pal": ["PAL"], "ntsc": ["NTSC", "DEBUG"]}}}`,
+			defines: []string{"DEBUG", "NTSC"},
+			labels:  map[string]int64{"debug": 0x1000, "ntsc": 0x1001, "after": 0x1002},
+		},
+		{
+			name:    "build variants without one selected",
+			config:  `{"kickass_ls": {"buildVariants": {"pal": ["PAL"]}}}`,
+			defines: []string{},
+			labels:  map[string]int64{"after": 0x1000},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			loadTestData(t)
+			dir := writeTestFiles(t, map[string]string{ProjectConfigFile: test.config, "main.asm": buildVariantsSource})
+			config := GetDocumentConfig(pathToURI(filepath.Join(dir, "main.asm")))
+			if defines := config.activeDefines(); !reflect.DeepEqual(defines, test.defines) {
+				t.Errorf("defines = %v, want %v", defines, test.defines)
+			}
+			context, _ := analyzeTestFile(t, dir, "main.asm")
+			for label, want := range test.labels {
+				if got := lookupTestLabel(t, context, label); got != want {
+					t.Errorf("%s = $%04X, want $%04X", label, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectBuildVariant(t *testing.T) {
+	loadTestData(t)
+	dir := writeTestFiles(t, map[string]string{
+		ProjectConfigFile: `{"kickass_ls": {"buildVariant": "ntsc", "buildVariants": {"pal": ["PAL"], "ntsc": ["NTSC"]}}}`,
+		"main.asm":        buildVariantsSource,
+	})
+	uri := pathToURI(filepath.Join(dir, "main.asm"))
+	writer := bufio.NewWriter(io.Discard)
+	t.Cleanup(func() {
+		configMutex.Lock()
+		selectedBuildVariant = ""
+		configMutex.Unlock()
+	})
+
+	choose := func(name string) (map[string]interface{}, error) {
+		t.Helper()
+		result, err := selectBuildVariant(writer, []interface{}{map[string]interface{}{"variant": name, "uri": uri}})
+		if err != nil {
+			return nil, err
+		}
+		return result.(map[string]interface{}), nil
+	}
+
+	if _, err := choose("c128"); err == nil || !strings.Contains(err.Error(), `unknown build variant "c128", known variants are ntsc, pal`) {
+		t.Errorf("selecting an unknown variant: error %v", err)
+	}
+
+	result, err := choose("pal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["active"] != "pal" || !reflect.DeepEqual(result["defines"], []string{"PAL"}) {
+		t.Errorf("after selecting pal: active %v, defines %v", result["active"], result["defines"])
+	}
+	context, _ := analyzeTestFile(t, dir, "main.asm")
+	if got := lookupTestLabel(t, context, "pal"); got != 0x1000 {
+		t.Errorf("pal = $%04X, want $1000", got)
+	}
+
+	// The empty name goes back to the configured variant
+	result, err = choose("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["active"] != "ntsc" || !reflect.DeepEqual(result["defines"], []string{"NTSC"}) {
+		t.Errorf("after the reset: active %v, defines %v", result["active"], result["defines"])
+	}
+}
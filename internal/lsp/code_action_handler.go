@@ -0,0 +1,472 @@
+package lsp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	log "c64.nvim/internal/log"
+)
+
+// numberLiteralPattern matches hex and decimal number literals in an operand
+var numberLiteralPattern = regexp.MustCompile(`\$[0-9A-Fa-f]+|\b[0-9]+\b`)
+
+// nearestOperandForms lists, per unsupported operand form, the forms a quick fix tries instead
+var nearestOperandForms = map[string][]string{
+	"Immediate":        {"Address"},
+	"Address":          {"Immediate", "Implied"},
+	"Address,X":        {"Address,Y", "Address"},
+	"Address,Y":        {"Address,X", "Address"},
+	"Indirect":         {"Indirect-indexed", "Indexed-indirect"},
+	"Indexed-indirect": {"Indirect-indexed"},
+	"Indirect-indexed": {"Indexed-indirect"},
+	"Accumulator":      {"Implied"},
+}
+
+// invertedBranches maps each conditional branch to the branch with the opposite condition
+var invertedBranches = map[string]string{
+	"BCC": "BCS", "BCS": "BCC",
+	"BEQ": "BNE", "BNE": "BEQ",
+	"BMI": "BPL", "BPL": "BMI",
+	"BVC": "BVS", "BVS": "BVC",
+}
+
+// handleCodeAction handles the textDocument/codeAction LSP request
+func handleCodeAction(params map[string]interface{}) []interface{} {
+	textDocument, ok := params["textDocument"].(map[string]interface{})
+	if !ok {
+		log.Error("Invalid textDocument in codeAction request")
+		return nil
+	}
+	uri, ok := textDocument["uri"].(string)
+	if !ok {
+		log.Error("Invalid URI in codeAction request")
+		return nil
+	}
+
+	documentStore.RLock()
+	text, exists := documentStore.documents[uri]
+	documentStore.RUnlock()
+	if !exists {
+		log.Warn("Document not found for codeAction: %s", uri)
+		return []interface{}{}
+	}
+	lines := strings.Split(text, "\n")
+
+	context, _ := params["context"].(map[string]interface{})
+	diagnostics, _ := context["diagnostics"].([]interface{})
+
+	actions := []interface{}{}
+	for _, rawDiagnostic := range diagnostics {
+		diagnostic, ok := rawDiagnostic.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		code, _ := diagnostic["code"].(string)
+		data, _ := diagnostic["data"].(map[string]interface{})
+		line, ok := diagnosticLine(diagnostic)
+		if !ok || line < 0 || line >= len(lines) {
+			continue
+		}
+
+		var action map[string]interface{}
+		switch code {
+		case codeBranchOutOfRange:
+			action = longBranchAction(uri, lines, line)
+		case codeZeroPageAddress:
+			if address, ok := dataNumber(data, "address"); ok {
+				action = zeroPageAction(uri, lines, line, address)
+			}
+		case codeMagicNumber:
+			if address, ok := dataNumber(data, "address"); ok {
+				description, _ := data["description"].(string)
+				action = namedConstantAction(uri, lines, line, address, description)
+			}
+		case codeUndefinedSymbol:
+			if name, ok := data["name"].(string); ok {
+				action = defineConstantAction(uri, lines, name)
+			}
+		case codeUnsupportedOperand:
+			mnemonic, _ := data["mnemonic"].(string)
+			form, _ := data["form"].(string)
+			action = addressingModeAction(uri, lines, line, mnemonic, form)
+		}
+
+		if action != nil {
+			action["diagnostics"] = []interface{}{diagnostic}
+			actions = append(actions, action)
+		}
+	}
+
+	log.Debug("codeAction: %d quick fixes for %s", len(actions), uri)
+	return actions
+}
+
+// diagnosticLine returns the start line of an LSP diagnostic
+func diagnosticLine(diagnostic map[string]interface{}) (int, bool) {
+	diagRange, ok := diagnostic["range"].(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	start, ok := diagRange["start"].(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	line, ok := start["line"].(float64)
+	if !ok {
+		return 0, false
+	}
+	return int(line), true
+}
+
+// dataNumber reads a number from the data of a diagnostic, which went through JSON
+func dataNumber(data map[string]interface{}, key string) (int64, bool) {
+	switch value := data[key].(type) {
+	case float64:
+		return int64(value), true
+	case int64:
+		return value, true
+	}
+	return 0, false
+}
+
+// quickFix builds a CodeAction of kind quickfix that applies edits to a single document
+func quickFix(title, uri string, edits []interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"title": title,
+		"kind":  "quickfix",
+		"edit": map[string]interface{}{
+			"changes": map[string]interface{}{
+				uri: edits,
+			},
+		},
+	}
+}
+
+// instructionLine is the instruction on a source line. Offsets are bytes into the line.
+type instructionLine struct {
+	mnemonic      string // Without an extension like .abs
+	mnemonicStart int
+	mnemonicEnd   int    // After the extension
+	operand       string // Empty without operand
+	operandStart  int    // -1 without operand
+}
+
+// lexInstructionLine splits a source line into mnemonic and operand with the lexer the
+// analyzer uses
+func lexInstructionLine(line string) (instructionLine, bool) {
+	instruction := instructionLine{operandStart: -1}
+	lexer := NewContextAwareLexer(line, GetProcessorContext())
+	found := false
+	for {
+		token := lexer.NextToken()
+		if token.Type == TOKEN_COMMENT_BLOCK && !found {
+			continue
+		}
+		if token.Type == TOKEN_EOF || token.Type == TOKEN_COMMENT || token.Type == TOKEN_COMMENT_BLOCK {
+			if instruction.operandStart >= 0 {
+				end := min(token.Column-1, len(line))
+				instruction.operand = strings.TrimRight(line[instruction.operandStart:end], " \t")
+			}
+			return instruction, found
+		}
+		switch {
+		case !found && isMnemonicToken(token.Type):
+			found = true
+			instruction.mnemonic, _, _ = strings.Cut(token.Literal, ".")
+			instruction.mnemonicStart = token.Column - 1
+			instruction.mnemonicEnd = token.Column - 1 + len(token.Literal)
+		case !found && (token.Type == TOKEN_LABEL || token.Type == TOKEN_MULTILABEL):
+			// A label in front of the instruction
+		case !found:
+			return instruction, false
+		case instruction.operandStart < 0:
+			instruction.operandStart = token.Column - 1
+		}
+	}
+}
+
+// isMnemonicToken reports whether a token type is one of the mnemonic types
+func isMnemonicToken(tokenType TokenType) bool {
+	switch tokenType {
+	case TOKEN_MNEMONIC_STD, TOKEN_MNEMONIC_CTRL, TOKEN_MNEMONIC_ILL, TOKEN_MNEMONIC_65C02:
+		return true
+	}
+	return false
+}
+
+// longBranchAction rewrites an out-of-range "bne far" into "beq *+5" followed by "jmp far"
+func longBranchAction(uri string, lines []string, lineNum int) map[string]interface{} {
+	line := lines[lineNum]
+	instruction, ok := lexInstructionLine(line)
+	if !ok || instruction.operand == "" {
+		return nil
+	}
+	mnemonic, operand := instruction.mnemonic, instruction.operand
+	inverted, isBranch := invertedBranches[strings.ToUpper(mnemonic)]
+	if !isBranch {
+		return nil
+	}
+
+	// Align the JMP with the branch, keeping tabs and blanking out a label in front of it
+	alignment := []rune{}
+	for _, r := range line[:instruction.mnemonicStart] {
+		if r == '\t' {
+			alignment = append(alignment, '\t')
+		} else {
+			alignment = append(alignment, ' ')
+		}
+	}
+
+	newText := fmt.Sprintf("%s *+5\n%s%s %s",
+		applyCase(mnemonic, inverted), string(alignment), applyCase(mnemonic, "jmp"), operand)
+	edit := renameTextEdit(line, lineNum, instruction.mnemonicStart,
+		instruction.operandStart+len(operand)-instruction.mnemonicStart, newText)
+
+	title := fmt.Sprintf("Replace with %s *+5 / %s %s",
+		strings.ToLower(inverted), "jmp", operand)
+	return quickFix(title, uri, []interface{}{edit})
+}
+
+// zeroPageAction shortens an absolute operand like $0080 to its zero-page form $80
+func zeroPageAction(uri string, lines []string, lineNum int, value int64) map[string]interface{} {
+	line := lines[lineNum]
+	instruction, ok := lexInstructionLine(line)
+	if !ok || instruction.operandStart < 0 {
+		return nil
+	}
+	operand, operandStart := instruction.operand, instruction.operandStart
+
+	start, length, found := findNumberLiteral(operand, value)
+	if !found || !strings.HasPrefix(operand[start:], "$") {
+		return nil
+	}
+
+	literal := operand[start : start+length]
+	digits := fmt.Sprintf("%02x", value)
+	if strings.ToUpper(literal) == literal {
+		digits = strings.ToUpper(digits)
+	}
+	newText := "$" + digits
+
+	edit := renameTextEdit(line, lineNum, operandStart+start, length, newText)
+	title := fmt.Sprintf("Use zero-page addressing (%s)", newText)
+	return quickFix(title, uri, []interface{}{edit})
+}
+
+// namedConstantAction replaces a magic address with a named constant, defining the
+// constant at the top of the file if the document does not have one for that address yet
+func namedConstantAction(uri string, lines []string, lineNum int, value int64, description string) map[string]interface{} {
+	line := lines[lineNum]
+	instruction, ok := lexInstructionLine(line)
+	if !ok || instruction.operandStart < 0 {
+		return nil
+	}
+	operand, operandStart := instruction.operand, instruction.operandStart
+	start, length, found := findNumberLiteral(operand, value)
+	if !found {
+		return nil
+	}
+
+	name, exists := findConstantForValue(uri, value)
+	if !exists {
+		if region, inMap := currentData().c64MemoryMap.MemoryMap.Regions[fmt.Sprintf("0x%04X", value)]; inMap {
+			name = constantNameFor(region.Name)
+		} else if description != "" {
+			name = constantNameFor(description)
+		}
+		if name == "" {
+			return nil
+		}
+	}
+
+	edits := []interface{}{renameTextEdit(line, lineNum, operandStart+start, length, name)}
+	title := fmt.Sprintf("Replace $%04X with constant %s", value, name)
+	if !exists {
+		insertLine := constInsertionLine(lines)
+		edits = append([]interface{}{
+			renameTextEdit("", insertLine, 0, 0, fmt.Sprintf(".const %s = $%04X\n", name, value)),
+		}, edits...)
+		title = fmt.Sprintf("Define constant %s = $%04X and use it", name, value)
+	}
+	return quickFix(title, uri, edits)
+}
+
+// defineConstantAction inserts a placeholder .const for an undefined symbol
+func defineConstantAction(uri string, lines []string, name string) map[string]interface{} {
+	insertLine := constInsertionLine(lines)
+	edit := renameTextEdit("", insertLine, 0, 0, fmt.Sprintf(".const %s = 0\n", name))
+	return quickFix(fmt.Sprintf("Define constant '%s'", name), uri, []interface{}{edit})
+}
+
+// addressingModeAction rewrites an operand into the nearest operand form the mnemonic
+// supports, e.g. "stx $10,x" into "stx $10,y" or "jmp #$1000" into "jmp $1000"
+func addressingModeAction(uri string, lines []string, lineNum int, mnemonic, form string) map[string]interface{} {
+	ctx := GetProcessorContext()
+	if ctx == nil {
+		return nil
+	}
+	info := ctx.GetMnemonicInfo(mnemonic)
+	if info == nil {
+		return nil
+	}
+	line := lines[lineNum]
+	instruction, ok := lexInstructionLine(line)
+	if !ok || instruction.operandStart < 0 {
+		return nil
+	}
+	written, operand, operandStart := instruction.mnemonic, instruction.operand, instruction.operandStart
+	base := operandBase(operand, form)
+
+	for _, target := range nearestOperandForms[form] {
+		if !supportsOperandForm(info, target) {
+			continue
+		}
+		// Skip indexed forms that only exist in zero page if the operand doesn't fit
+		if value, isNumber := parseStateValue(base); isNumber && value > 0xFF &&
+			(target == "Address,X" || target == "Address,Y") &&
+			!hasAddressingMode(info, "Absolute"+strings.TrimPrefix(target, "Address")) {
+			continue
+		}
+		if target == "Implied" {
+			// Remove the operand together with the blanks in front of it
+			start := operandStart
+			for start > instruction.mnemonicEnd && (line[start-1] == ' ' || line[start-1] == '\t') {
+				start--
+			}
+			edit := renameTextEdit(line, lineNum, start, operandStart+len(operand)-start, "")
+			return quickFix(fmt.Sprintf("Remove the operand of %s", written), uri, []interface{}{edit})
+		}
+
+		newOperand := formatOperand(base, target, written)
+		edit := renameTextEdit(line, lineNum, operandStart, len(operand), newOperand)
+		return quickFix(fmt.Sprintf("Change to %s %s", written, newOperand), uri, []interface{}{edit})
+	}
+	return nil
+}
+
+// operandBase strips the addressing mode syntax from an operand: "#$10", "$10,x", "($10),y"
+// all yield "$10"
+func operandBase(operand, form string) string {
+	switch form {
+	case "Immediate":
+		return strings.TrimSpace(strings.TrimPrefix(operand, "#"))
+	case "Address,X", "Address,Y":
+		if comma := strings.LastIndex(operand, ","); comma >= 0 {
+			return strings.TrimSpace(operand[:comma])
+		}
+	case "Indirect", "Indexed-indirect", "Indirect-indexed":
+		inner := operand
+		if closing := strings.LastIndex(inner, ")"); strings.HasPrefix(inner, "(") && closing > 0 {
+			inner = inner[1:closing]
+		}
+		if comma := strings.LastIndex(inner, ","); form == "Indexed-indirect" && comma >= 0 {
+			inner = inner[:comma]
+		}
+		return strings.TrimSpace(inner)
+	case "Accumulator":
+		return ""
+	}
+	return operand
+}
+
+// formatOperand writes an operand in the given form, with index registers in the case of
+// the mnemonic
+func formatOperand(base, form, mnemonic string) string {
+	x, y := applyCase(mnemonic, "x"), applyCase(mnemonic, "y")
+	switch form {
+	case "Immediate":
+		return "#" + base
+	case "Address,X":
+		return base + "," + x
+	case "Address,Y":
+		return base + "," + y
+	case "Indirect":
+		return "(" + base + ")"
+	case "Indexed-indirect":
+		return "(" + base + "," + x + ")"
+	case "Indirect-indexed":
+		return "(" + base + ")," + y
+	}
+	return base
+}
+
+// findNumberLiteral returns the offset and length of the first number literal in an
+// operand that evaluates to value
+func findNumberLiteral(operand string, value int64) (int, int, bool) {
+	for _, match := range numberLiteralPattern.FindAllStringIndex(operand, -1) {
+		literal := operand[match[0]:match[1]]
+		var parsed int64
+		var err error
+		if strings.HasPrefix(literal, "$") {
+			parsed, err = parseInt(literal[1:], 16)
+		} else {
+			parsed, err = parseInt(literal, 10)
+		}
+		if err == nil && parsed == value {
+			return match[0], match[1] - match[0], true
+		}
+	}
+	return 0, 0, false
+}
+
+// findConstantForValue returns the name of a constant visible in the document whose value
+// is the given address
+func findConstantForValue(uri string, value int64) (string, bool) {
+	symbolStore.RLock()
+	context := symbolStore.contexts[uri]
+	symbolStore.RUnlock()
+	if context == nil {
+		return "", false
+	}
+
+	for _, labels := range []map[string]*Symbol{context.DefinedLabels, context.ImportedLabels} {
+		for _, symbol := range labels {
+			if symbol.Kind == Constant && symbol.Address == value {
+				return symbol.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// constantNameFor derives an UPPER_CASE constant name from a register description,
+// e.g. "Border Color Register" -> BORDER_COLOR
+func constantNameFor(description string) string {
+	words := strings.FieldsFunc(description, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) > 1 && strings.EqualFold(words[len(words)-1], "register") {
+		words = words[:len(words)-1]
+	}
+	if len(words) == 0 {
+		return ""
+	}
+
+	name := strings.ToUpper(strings.Join(words, "_"))
+	if unicode.IsDigit(rune(name[0])) {
+		name = "_" + name
+	}
+	return name
+}
+
+// constInsertionLine returns the line where new constants are inserted: after the leading
+// block of comments, preprocessor directives and existing .const/.var definitions
+func constInsertionLine(lines []string) int {
+	insertLine := 0
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			continue
+		case strings.HasPrefix(trimmed, "//"), strings.HasPrefix(trimmed, ";"),
+			strings.HasPrefix(trimmed, "#"),
+			strings.HasPrefix(trimmed, ".const "), strings.HasPrefix(trimmed, ".var "):
+			insertLine = i + 1
+		default:
+			return insertLine
+		}
+	}
+	return insertLine
+}
@@ -0,0 +1,132 @@
+package lsp
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// codeActionTestParams builds a codeAction request for diagnostics as the client got them
+func codeActionTestParams(t *testing.T, uri string, diagnostics []Diagnostic) map[string]interface{} {
+	t.Helper()
+	lspDiagnostics := make([]map[string]interface{}, len(diagnostics))
+	for i, diagnostic := range diagnostics {
+		lspDiagnostics[i] = lspDiagnostic(diagnostic)
+	}
+	request, err := json.Marshal(map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri},
+		"context":      map[string]interface{}{"diagnostics": lspDiagnostics},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var params map[string]interface{}
+	if err := json.Unmarshal(request, &params); err != nil {
+		t.Fatal(err)
+	}
+	return params
+}
+
+func TestCodeActions(t *testing.T) {
+	loadTestData(t)
+	tests := []struct {
+		name   string
+		source string
+		code   string
+		title  string
+		edits  []string // "line:start-end newText" per edit, in UTF-16 code units
+	}{
+		{
+			name:   "long branch",
+			source: "*=$1000\nloop: nop\n.fill 200, 0\n    bne loop\n",
+			code:   codeBranchOutOfRange,
+			title:  "Replace with beq *+5 / jmp loop",
+			edits:  []string{"3:4-12 beq *+5\n    jmp loop"},
+		},
+		{
+			name:   "long branch after a label",
+			source: "*=$1000\n    beq far\n.fill 200, 0\nfar: rts\n",
+			code:   codeBranchOutOfRange,
+			title:  "Replace with bne *+5 / jmp far",
+			edits:  []string{"1:4-11 bne *+5\n    jmp far"},
+		},
+		{
+			name:   "zero page",
+			source: "*=$1000\n    lda $0080\n",
+			code:   codeZeroPageAddress,
+			title:  "Use zero-page addressing ($80)",
+			edits:  []string{"1:8-13 $80"},
+		},
+		{
+			name:   "magic number",
+			source: "*=$1000\n    sta $d020\n",
+			code:   codeMagicNumber,
+			title:  "Define constant BORDER_COLOR = $D020 and use it",
+			edits:  []string{"0:0-0 .const BORDER_COLOR = $D020\n", "1:8-13 BORDER_COLOR"},
+		},
+		{
+			name:   "undefined symbol",
+			source: "*=$1000\n    bne missing\n",
+			code:   codeUndefinedSymbol,
+			title:  "Define constant 'missing'",
+			edits:  []string{"0:0-0 .const missing = 0\n"},
+		},
+		{
+			name:   "unsupported operand",
+			source: "*=$1000\n    stx $10,x\n",
+			code:   codeUnsupportedOperand,
+			title:  "Change to stx $10,y",
+			edits:  []string{"1:8-13 $10,y"},
+		},
+		{
+			name:   "columns after non-ASCII text",
+			source: "*=$1000\n/* Zähler */ stx $10,x\n",
+			code:   codeUnsupportedOperand,
+			title:  "Change to stx $10,y",
+			edits:  []string{"1:17-22 $10,y"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			uri := "file:///codeaction/" + test.code + ".asm"
+			var coded []Diagnostic
+			for _, diagnostic := range openTestDocument(t, uri, test.source) {
+				if diagnostic.Code == test.code {
+					coded = append(coded, diagnostic)
+				}
+			}
+			if len(coded) != 1 {
+				t.Fatalf("got %d diagnostics with code %s, want 1", len(coded), test.code)
+			}
+
+			actions := handleCodeAction(codeActionTestParams(t, uri, coded))
+			if len(actions) != 1 {
+				t.Fatalf("got %d code actions, want 1", len(actions))
+			}
+			action := actions[0].(map[string]interface{})
+			if action["title"] != test.title {
+				t.Errorf("title %q, want %q", action["title"], test.title)
+			}
+			edits := action["edit"].(map[string]interface{})["changes"].(map[string]interface{})[uri].([]interface{})
+			var got []string
+			for _, rawEdit := range edits {
+				edit := rawEdit.(map[string]interface{})
+				editRange := edit["range"].(Range)
+				got = append(got, formatTestEdit(editRange, edit["newText"].(string)))
+			}
+			if len(got) != len(test.edits) {
+				t.Fatalf("edits %q, want %q", got, test.edits)
+			}
+			for i := range got {
+				if got[i] != test.edits[i] {
+					t.Errorf("edit %q, want %q", got[i], test.edits[i])
+				}
+			}
+		})
+	}
+}
+
+// formatTestEdit writes a single line edit as "line:start-end newText"
+func formatTestEdit(editRange Range, newText string) string {
+	return fmt.Sprintf("%d:%d-%d %s", editRange.Start.Line, editRange.Start.Character, editRange.End.Character, newText)
+}
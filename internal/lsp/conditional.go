@@ -0,0 +1,184 @@
+package lsp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// InactiveRange is source that isn't assembled: an #if branch the preprocessor left out, or
+// an .if branch whose condition never selects it
+type InactiveRange struct {
+	Range   Range
+	Message string // Why the code is inactive, shown as a diagnostic
+}
+
+// isIfDirective reports whether a directive is an .if, which may have else branches
+func isIfDirective(node *DirectiveStatement) bool {
+	return node != nil && strings.ToLower(node.Token.Literal) == ".if"
+}
+
+// conditionalBlocks returns the blocks of an .if/else chain in source order: the block of
+// each .if and a final else block
+func conditionalBlocks(node *DirectiveStatement) []*BlockStatement {
+	var blocks []*BlockStatement
+	for current := node; current != nil; {
+		if current.Block != nil {
+			blocks = append(blocks, current.Block)
+		}
+		switch alternative := current.Alternative.(type) {
+		case *DirectiveStatement:
+			current = alternative
+		case *BlockStatement:
+			blocks = append(blocks, alternative)
+			current = nil
+		default:
+			current = nil
+		}
+	}
+	return blocks
+}
+
+// ifCondition evaluates the condition of an .if. known is false when the condition depends on
+// something unknown, like a macro parameter in the template of the macro.
+func (a *SemanticAnalyzer) ifCondition(node *DirectiveStatement) (holds bool, known bool) {
+	if node.Value == nil {
+		return false, false
+	}
+	condition := a.evaluateValue(node.Value)
+	a.reportValueError(condition)
+	switch condition.Kind {
+	case ValueBoolean:
+		return condition.Boolean, true
+	case ValueNumber:
+		return condition.Number != 0, true
+	case ValueUnknown, ValueInvalid:
+		return false, false
+	}
+	if !a.inMacroOrFunction {
+		a.addError(node.Token, ".if condition must be a Boolean, got %s", condition.TypeName())
+	}
+	return false, true
+}
+
+// assembleConditional returns the blocks of an .if/else chain Pass 1 assembles: the block
+// whose condition holds, or all of them in a template. Outside of templates it records the
+// blocks it chose, a block that is never chosen is inactive.
+func (a *SemanticAnalyzer) assembleConditional(node *DirectiveStatement) []*BlockStatement {
+	blocks := conditionalBlocks(node)
+	if a.inMacroOrFunction {
+		for current := node; current != nil; {
+			a.ifCondition(current)
+			current, _ = current.Alternative.(*DirectiveStatement)
+		}
+		return blocks
+	}
+
+	if !a.evaluatedConditionals[node] {
+		a.evaluatedConditionals[node] = true
+		a.conditionals = append(a.conditionals, node)
+	}
+	for current := node; current != nil; {
+		holds, known := a.ifCondition(current)
+		if !known {
+			// Any branch may be assembled, addresses follow this one
+			for _, block := range blocks {
+				a.assembledBlocks[block] = true
+			}
+			if current.Block == nil {
+				return nil
+			}
+			return []*BlockStatement{current.Block}
+		}
+		if holds {
+			if current.Block == nil {
+				return nil
+			}
+			a.assembledBlocks[current.Block] = true
+			return []*BlockStatement{current.Block}
+		}
+		switch alternative := current.Alternative.(type) {
+		case *DirectiveStatement:
+			current = alternative
+		case *BlockStatement:
+			a.assembledBlocks[alternative] = true
+			return []*BlockStatement{alternative}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// activeConditionalBlocks returns the blocks of an .if/else chain Pass 1 assembled at least
+// once, all of them if Pass 1 never got to the chain
+func (a *SemanticAnalyzer) activeConditionalBlocks(node *DirectiveStatement) []*BlockStatement {
+	blocks := conditionalBlocks(node)
+	if !a.evaluatedConditionals[node] {
+		return blocks
+	}
+	active := blocks[:0:0]
+	for _, block := range blocks {
+		if a.assembledBlocks[block] {
+			active = append(active, block)
+		}
+	}
+	return active
+}
+
+// collectInactiveRanges records the #if branches the parser left out and the .if branches
+// Pass 1 never assembled, and reports them as unnecessary code so editors dim them
+func (a *SemanticAnalyzer) collectInactiveRanges(program *Program) {
+	inactive := append([]InactiveRange{}, program.Inactive...)
+	for _, node := range a.conditionals {
+		for i, block := range conditionalBlocks(node) {
+			if a.assembledBlocks[block] {
+				continue
+			}
+			message := "Inactive code: the .if condition is always false"
+			if i > 0 {
+				message = fmt.Sprintf("Inactive code: an earlier branch of the .if in line %d is always assembled", node.Token.Line)
+			}
+			end := Position{Line: block.EndToken.Line - 1, Character: block.EndToken.Column}
+			if block.EndToken.Type == TOKEN_EOF || block.EndToken.Line == 0 {
+				end = Position{Line: len(a.documentLines), Character: 0}
+			}
+			inactive = append(inactive, InactiveRange{
+				Range:   Range{Start: Position{Line: block.Token.Line - 1, Character: block.Token.Column - 1}, End: end},
+				Message: message,
+			})
+		}
+	}
+	sort.SliceStable(inactive, func(i, j int) bool {
+		return positionBefore(inactive[i].Range.Start, inactive[j].Range.Start)
+	})
+	a.context.InactiveRanges = inactive
+
+	for _, r := range inactive {
+		a.diagnostics = append(a.diagnostics, Diagnostic{
+			Range:    r.Range,
+			Severity: SeverityHint,
+			Source:   "analyzer",
+			Message:  r.Message,
+			Tags:     []DiagnosticTag{DiagnosticTagUnnecessary},
+		})
+	}
+}
+
+// isInactive reports whether a position is in code that isn't assembled
+func (ctx *AnalysisContext) isInactive(pos Position) bool {
+	if ctx == nil {
+		return false
+	}
+	for _, r := range ctx.InactiveRanges {
+		if !positionBefore(pos, r.Range.Start) && positionBefore(pos, r.Range.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// positionBefore reports whether a comes before b
+func positionBefore(a, b Position) bool {
+	return a.Line < b.Line || (a.Line == b.Line && a.Character < b.Character)
+}
@@ -0,0 +1,107 @@
+package lsp
+
+import "testing"
+
+func TestConditionals(t *testing.T) {
+	runSegmentTests(t, []segmentTest{
+		{
+			name: "#if keeps the first branch whose condition holds",
+			source: `#define PAL
+*=$1000
+#if NTSC
+ntsc: nop
+#elif PAL
+pal: nop
+    nop
+#else
+other: brk
+#endif
+after: rts
+`,
+			labels: map[string]int64{"pal": 0x1000, "after": 0x1002},
+			errors: []string{
+				"Inactive code: the #if condition is false",
+				"Inactive code: an earlier branch of the #if in line 3 is assembled",
+			},
+		},
+		{
+			name:   "#else",
+			source: "*=$1000\n#if PAL\n    nop\n#else\nother: brk\n#endif\nafter: rts\n",
+			labels: map[string]int64{"other": 0x1000, "after": 0x1001},
+			errors: []string{"Inactive code: the #if condition is false"},
+		},
+		{
+			name: ".if/else chain",
+			source: `*=$1000
+.const X = 2
+.if (X == 1) {
+    nop
+} else .if (X == 2) {
+    nop
+    nop
+} else {
+    brk
+}
+after: rts
+`,
+			labels: map[string]int64{"after": 0x1002},
+			errors: []string{
+				"Inactive code: the .if condition is always false",
+				"Inactive code: an earlier branch of the .if in line 3 is always assembled",
+			},
+		},
+		{
+			name:   ".if without braces",
+			source: "*=$1000\n.const X = 2\n.if (X == 2) nop\n.if (X == 3) nop\nafter: rts\n",
+			labels: map[string]int64{"after": 0x1001},
+			errors: []string{"Inactive code: the .if condition is always false"},
+		},
+		{
+			name:   ".if that depends on a later label",
+			source: "*=$1000\n.if (end > $1000) {\n    nop\n}\nend: rts\n",
+			labels: map[string]int64{"end": 0x1001},
+		},
+	}, nil)
+}
+
+func TestInactiveRanges(t *testing.T) {
+	loadTestData(t)
+	source := `*=$1000
+#if NTSC
+    nop
+#endif
+.if (false) {
+    nop
+} else {
+    nop
+}
+.if (true) nop
+.if (false) nop
+`
+	dir := writeTestFiles(t, map[string]string{"main.asm": source})
+	context, diagnostics := analyzeTestFile(t, dir, "main.asm")
+	want := []Range{
+		{Start: Position{Line: 2, Character: 0}, End: Position{Line: 3, Character: 0}},
+		{Start: Position{Line: 4, Character: 12}, End: Position{Line: 6, Character: 1}},
+		{Start: Position{Line: 10, Character: 12}, End: Position{Line: 10, Character: 15}},
+	}
+	if len(context.InactiveRanges) != len(want) {
+		t.Fatalf("inactive ranges %v, want %v", context.InactiveRanges, want)
+	}
+	for i, r := range context.InactiveRanges {
+		if r.Range != want[i] {
+			t.Errorf("inactive range %d = %v, want %v", i, r.Range, want[i])
+		}
+	}
+
+	// Editors dim inactive code through hints tagged as unnecessary
+	hints := 0
+	for _, diagnostic := range diagnostics {
+		if len(diagnostic.Tags) == 1 && diagnostic.Tags[0] == DiagnosticTagUnnecessary && diagnostic.Severity == SeverityHint {
+			hints++
+		}
+	}
+	if hints != len(want) {
+		t.Errorf("%d unnecessary code hints, want %d", hints, len(want))
+	}
+}
@@ -0,0 +1,149 @@
+package lsp
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DefaultProfile holds the built-in default settings
+const DefaultProfile = "default"
+
+// profileExcludedSettings can't be set by a profile: profiles describe which checks run,
+// not where sources are, what is built or how the server works
+var profileExcludedSettings = map[string]bool{
+	"profile":            true,
+	"profiles":           true,
+	"libraryDirs":        true,
+	"defines":            true,
+	"buildVariants":      true,
+	"buildVariant":       true,
+	"parserFeatureFlags": true,
+}
+
+// builtinProfiles are the named profiles selectable with the "profile" setting. Every profile
+// extends "default", a snapshot of the built-in defaults, so selecting one always gives the
+// same result no matter what was configured before.
+var builtinProfiles = map[string]map[string]interface{}{
+	DefaultProfile: profileSettings(*lspConfig),
+
+	// Every check with all of its warnings and hints
+	"strict": {
+		"extends":                  DefaultProfile,
+		"warnUnusedLabels":         true,
+		"zeroPageOptimization":     map[string]interface{}{"enabled": true, "showHints": true},
+		"branchDistanceValidation": map[string]interface{}{"enabled": true, "showWarnings": true},
+		"illegalOpcodeDetection":   map[string]interface{}{"enabled": true, "showWarnings": true},
+		"hardwareBugDetection":     map[string]interface{}{"enabled": true, "showWarnings": true, "jmpIndirectBug": true},
+		"memoryLayoutAnalysis":     map[string]interface{}{"enabled": true, "showIOAccess": true, "showStackWarnings": true, "showROMWriteWarnings": true},
+		"magicNumberDetection":     map[string]interface{}{"enabled": true, "showHints": true, "c64Addresses": true},
+		"deadCodeDetection":        map[string]interface{}{"enabled": true, "showWarnings": true},
+		"styleGuideEnforcement":    map[string]interface{}{"enabled": true, "showHints": true, "upperCaseConstants": true, "descriptiveLabels": true},
+		"cycleBudgetValidation":    map[string]interface{}{"enabled": true, "showWarnings": true},
+		"assemblerSymbols":         map[string]interface{}{"enabled": true, "showMismatches": true, "addressHints": true},
+	},
+
+	// Only problems that break the program
+	"minimal": {
+		"extends":                  DefaultProfile,
+		"warnUnusedLabels":         false,
+		"zeroPageOptimization":     map[string]interface{}{"enabled": false},
+		"branchDistanceValidation": map[string]interface{}{"enabled": true, "showWarnings": true},
+		"illegalOpcodeDetection":   map[string]interface{}{"enabled": false},
+		"hardwareBugDetection":     map[string]interface{}{"enabled": true, "showWarnings": true},
+		"memoryLayoutAnalysis":     map[string]interface{}{"enabled": false},
+		"magicNumberDetection":     map[string]interface{}{"enabled": false},
+		"deadCodeDetection":        map[string]interface{}{"enabled": false},
+		"styleGuideEnforcement":    map[string]interface{}{"enabled": false},
+	},
+
+	// Existing code that isn't going to be restyled
+	"legacy": {
+		"extends":                  DefaultProfile,
+		"warnUnusedLabels":         false,
+		"zeroPageOptimization":     map[string]interface{}{"enabled": true, "showHints": false},
+		"branchDistanceValidation": map[string]interface{}{"enabled": true, "showWarnings": true},
+		"illegalOpcodeDetection":   map[string]interface{}{"enabled": false},
+		"hardwareBugDetection":     map[string]interface{}{"enabled": true, "showWarnings": true},
+		"memoryLayoutAnalysis":     map[string]interface{}{"enabled": false},
+		"magicNumberDetection":     map[string]interface{}{"enabled": false},
+		"deadCodeDetection":        map[string]interface{}{"enabled": false},
+		"styleGuideEnforcement":    map[string]interface{}{"enabled": false},
+	},
+
+	// Illegal opcodes, raw hardware addresses and I/O writes are intended; timing matters
+	"demo-scene": {
+		"extends":                DefaultProfile,
+		"warnUnusedLabels":       false,
+		"illegalOpcodeDetection": map[string]interface{}{"enabled": true, "showWarnings": false},
+		"memoryLayoutAnalysis":   map[string]interface{}{"enabled": true, "showIOAccess": false, "showStackWarnings": true, "showROMWriteWarnings": true},
+		"magicNumberDetection":   map[string]interface{}{"enabled": false},
+		"styleGuideEnforcement":  map[string]interface{}{"enabled": false},
+		"cycleHints":             map[string]interface{}{"enabled": true, "showRunningTotal": true},
+		"cycleBudgetValidation":  map[string]interface{}{"enabled": true, "showWarnings": true},
+	},
+}
+
+// profileSettings turns a configuration into a settings map a profile can apply
+func profileSettings(config LSPConfiguration) map[string]interface{} {
+	data, _ := json.Marshal(config)
+	var settings map[string]interface{}
+	json.Unmarshal(data, &settings)
+	for key := range settings {
+		if profileExcludedSettings[key] || lspSettingSchema.fields[key] == nil {
+			delete(settings, key)
+		}
+	}
+	return settings
+}
+
+// builtinProfileNames returns the names of the built-in profiles, sorted
+func builtinProfileNames() []string {
+	names := make([]string, 0, len(builtinProfiles))
+	for name := range builtinProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// profileLayers returns the settings to apply for a profile, the profiles it extends first.
+// User-defined profiles extend "default" unless they name another one.
+func profileLayers(name string, userProfiles map[string]map[string]interface{}, seen []string) ([]map[string]interface{}, error) {
+	for _, previous := range seen {
+		if previous == name {
+			return nil, fmt.Errorf("profiles extend each other: %s", strings.Join(append(seen, name), " -> "))
+		}
+	}
+	seen = append(seen, name)
+
+	profile, builtin := builtinProfiles[name]
+	if !builtin {
+		profile = userProfiles[name]
+	}
+	if profile == nil {
+		return nil, fmt.Errorf("unknown profile %q (built-in profiles: %s)", name, strings.Join(builtinProfileNames(), ", "))
+	}
+
+	var layers []map[string]interface{}
+	parent, _ := profile["extends"].(string)
+	if parent == "" && !builtin {
+		parent = DefaultProfile
+	}
+	if parent != "" {
+		parentLayers, err := profileLayers(parent, userProfiles, seen)
+		if err != nil {
+			return nil, err
+		}
+		layers = parentLayers
+	}
+
+	layer := make(map[string]interface{}, len(profile))
+	for key, value := range profile {
+		if key != "extends" && !profileExcludedSettings[key] {
+			layer[key] = value
+		}
+	}
+	return append(layers, layer), nil
+}
@@ -0,0 +1,127 @@
+package lsp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProfileLayers(t *testing.T) {
+	userProfiles := map[string]map[string]interface{}{
+		"team":    {"extends": "strict", "warnUnusedLabels": false, "libraryDirs": []interface{}{"lib"}},
+		"project": {"extends": "team", "cycleHints": map[string]interface{}{"enabled": true}},
+		"plain":   {"deadCodeDetection": map[string]interface{}{"enabled": false}},
+		"loop-a":  {"extends": "loop-b"},
+		"loop-b":  {"extends": "loop-a"},
+		"broken":  {"extends": "missing"},
+	}
+
+	tests := []struct {
+		name   string
+		layers int
+		error  string
+	}{
+		{name: "project", layers: 4}, // default, strict, team, project
+		{name: "plain", layers: 2},   // extends default
+		{name: "strict", layers: 2},
+		{name: DefaultProfile, layers: 1},
+		{name: "loop-a", error: "profiles extend each other: loop-a -> loop-b -> loop-a"},
+		{name: "unknown", error: `unknown profile "unknown" (built-in profiles: default, demo-scene, legacy, minimal, strict)`},
+		{name: "broken", error: `unknown profile "missing"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layers, err := profileLayers(test.name, userProfiles, nil)
+			if test.error != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.error) {
+					t.Fatalf("error = %v, want %q", err, test.error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(layers) != test.layers {
+				t.Fatalf("%d layers, want %d", len(layers), test.layers)
+			}
+			for _, layer := range layers {
+				if _, ok := layer["extends"]; ok {
+					t.Error("a layer sets extends")
+				}
+				if _, ok := layer["libraryDirs"]; ok {
+					t.Error("a layer sets libraryDirs, which profiles can't")
+				}
+			}
+		})
+	}
+}
+
+func TestProfileSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		check    func(t *testing.T, config LSPConfiguration)
+	}{
+		{
+			name:     "settings next to the profile override it",
+			settings: map[string]interface{}{"profile": "strict", "warnUnusedLabels": false},
+			check: func(t *testing.T, config LSPConfiguration) {
+				if config.Profile != "strict" || config.WarnUnusedLabels || !config.ZeroPageOptimization.ShowHints {
+					t.Errorf("profile %q, warnUnusedLabels %v, zero page hints %v", config.Profile,
+						config.WarnUnusedLabels, config.ZeroPageOptimization.ShowHints)
+				}
+			},
+		},
+		{
+			name: "user profile extending a built-in one",
+			settings: map[string]interface{}{
+				"profile":  "quiet-strict",
+				"profiles": map[string]interface{}{"quiet-strict": map[string]interface{}{"extends": "strict", "deadCodeDetection": map[string]interface{}{"enabled": false}}},
+			},
+			check: func(t *testing.T, config LSPConfiguration) {
+				if config.DeadCodeDetection.Enabled || !config.StyleGuideEnforcement.Enabled {
+					t.Errorf("dead code detection %v, style guide %v", config.DeadCodeDetection.Enabled, config.StyleGuideEnforcement.Enabled)
+				}
+			},
+		},
+		{
+			name: "built-in profiles can't be redefined",
+			settings: map[string]interface{}{
+				"profile":  "strict",
+				"profiles": map[string]interface{}{"strict": map[string]interface{}{"warnUnusedLabels": false}},
+			},
+			check: func(t *testing.T, config LSPConfiguration) {
+				if !config.WarnUnusedLabels {
+					t.Error("the redefinition of strict was applied")
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := GetLSPConfig()
+			applyLSPSettings(&config, test.settings)
+			test.check(t, config)
+		})
+	}
+}
+
+func TestProfileDiagnostics(t *testing.T) {
+	text := `{"kickass_ls": {"profiles": {
+  "strict": {"warnUnusedLabels": false},
+  "mine": {"extends": "nope", "defines": ["X"]}
+}}}`
+	want := []string{
+		"'strict' is a built-in profile and can't be redefined",
+		"'defines' can't be set in a profile",
+		"Unknown profile 'nope'",
+	}
+	diagnostics := validateProjectConfig(text)
+	for _, message := range want {
+		if !hasDiagnostic(diagnostics, message) {
+			t.Errorf("no diagnostic %q in %v", message, diagnostics)
+		}
+	}
+	if len(diagnostics) != len(want) {
+		t.Errorf("got %d diagnostics, want %d: %v", len(diagnostics), len(want), diagnostics)
+	}
+}
@@ -549,12 +549,14 @@ func (l *ContextAwareLexer) createToken(tokenType TokenType, literal string, sta
 func (l *ContextAwareLexer) tokenizeNormal() *ContextToken {
 	remaining := l.input[l.position:]
 
-	// Check for preprocessor directives (#define, #undef, #import, #importif)
+	// Check for preprocessor directives (#define, #undef, #import, #importif, #if)
 	if strings.HasPrefix(remaining, "#") {
-		// Check if it matches any preprocessor statement from kickass.json
+		// Check if it matches any preprocessor statement from kickass.json, but not the
+		// immediate value of a symbol like #iflag
 		if l.processorCtx != nil && l.processorCtx.PreprocessorStatements != nil {
 			for directiveName := range l.processorCtx.PreprocessorStatements {
-				if strings.HasPrefix(remaining, directiveName) {
+				if strings.HasPrefix(remaining, directiveName) &&
+					(len(remaining) == len(directiveName) || !isAlphaNumeric(remaining[len(directiveName)]) && remaining[len(directiveName)] != '_') {
 					return l.tokenizePreprocessorDirective()
 				}
 			}
@@ -566,9 +568,12 @@ func (l *ContextAwareLexer) tokenizeNormal() *ContextToken {
 		return l.tokenizeDirective()
 	}
 
-	// Check for program counter directive (*=)
-	if strings.HasPrefix(remaining, "*=") {
-		return l.tokenizeProgramCounter()
+	// Check for program counter directive (*= or * =)
+	if strings.HasPrefix(remaining, "*") {
+		trimmed := strings.TrimLeft(remaining[1:], " \t")
+		if strings.HasPrefix(trimmed, "=") && !strings.HasPrefix(trimmed, "==") {
+			return l.tokenizeProgramCounter()
+		}
 	}
 
 	// Check for multi-labels first (!label:, !label+, !label-)
@@ -715,6 +720,14 @@ func (l *ContextAwareLexer) tokenizeDirectiveContent() *ContextToken {
 		return l.NextToken()
 	}
 
+	// .if (condition) statement: the statement is lexed as if it started the line
+	if ch := l.peek(); l.CurrentContext().Directive == ".if" && l.parenDepth == 0 &&
+		(ch == '.' || ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')) &&
+		strings.HasSuffix(strings.TrimRight(l.input[:l.position], " \t"), ")") {
+		l.PopContext()
+		return l.tokenizeNormal()
+	}
+
 	// Check for block start (for .for, .if, etc.)
 	if l.peek() == '{' {
 		l.PopContext() // Exit directive context
@@ -739,6 +752,14 @@ func (l *ContextAwareLexer) tokenizeDirectiveContent() *ContextToken {
 		return l.tokenizeString()
 	}
 
+	// Multi-label references (!loop+), otherwise '!' is the not operator
+	if l.peek() == '!' {
+		if token := l.tryTokenizeMultiLabel(); token != nil {
+			return token
+		}
+		return l.tokenizeOperatorOrPunctuation()
+	}
+
 	// Check for identifiers
 	if token := l.tryTokenizeIdentifier(); token != nil {
 		return token
@@ -773,6 +794,14 @@ func (l *ContextAwareLexer) tokenizeExpression() *ContextToken {
 		return l.tokenizeString()
 	}
 
+	// Multi-label references (!loop+), otherwise '!' is the not operator
+	if l.peek() == '!' {
+		if token := l.tryTokenizeMultiLabel(); token != nil {
+			return token
+		}
+		return l.tokenizeOperatorOrPunctuation()
+	}
+
 	// Check for identifiers/functions/constants
 	if token := l.tryTokenizeIdentifier(); token != nil {
 		return token
@@ -956,10 +985,13 @@ func (l *ContextAwareLexer) tokenizeString() *ContextToken {
 	}
 }
 
-// tokenizeProgramCounter handles *= directive
+// tokenizeProgramCounter handles the *= directive, also written as * =
 func (l *ContextAwareLexer) tokenizeProgramCounter() *ContextToken {
 	startCol := l.column
 	l.advance() // *
+	for l.peek() == ' ' || l.peek() == '\t' {
+		l.advance()
+	}
 	l.advance() // =
 
 	return &ContextToken{
@@ -1158,6 +1190,20 @@ func (l *ContextAwareLexer) tryTokenizeMnemonic() *ContextToken {
 				tokenType = TOKEN_MNEMONIC_CTRL
 			}
 
+			// A mnemonic extension forcing the addressing mode (lda.abs, ldx.zpy) is part of the token
+			if l.peek() == '.' {
+				end := l.position + 1
+				for end < len(l.input) && isAlpha(l.input[end]) {
+					end++
+				}
+				_, known := mnemonicSuffixModes[strings.ToLower(l.input[l.position+1:end])]
+				if known && (end >= len(l.input) || !(isAlphaNumeric(l.input[end]) || l.input[end] == '_')) {
+					for l.position < end {
+						l.advance()
+					}
+				}
+			}
+
 			metadata := &TokenMetadata{
 				IsInstruction: true,
 				MnemonicInfo:  mnemonicInfo,
@@ -1387,6 +1433,22 @@ func (l *ContextAwareLexer) tryTokenizeIdentifier() *ContextToken {
 	}
 }
 
+// twoCharOperators are the comparison, logical and assignment operators of expressions
+var twoCharOperators = map[string]TokenType{
+	"==": TOKEN_EQUAL_EQUAL,
+	"!=": TOKEN_NOT_EQUAL,
+	"<=": TOKEN_LESS_EQUAL,
+	">=": TOKEN_GREATER_EQUAL,
+	"&&": TOKEN_LOGICAL_AND,
+	"||": TOKEN_LOGICAL_OR,
+	"++": TOKEN_INCREMENT,
+	"--": TOKEN_DECREMENT,
+	"+=": TOKEN_PLUS_EQUAL,
+	"-=": TOKEN_MINUS_EQUAL,
+	"*=": TOKEN_TIMES_EQUAL,
+	"/=": TOKEN_DIVIDE_EQUAL,
+}
+
 // tokenizeOperatorOrPunctuation handles operators and punctuation
 func (l *ContextAwareLexer) tokenizeOperatorOrPunctuation() *ContextToken {
 	startCol := l.column
@@ -1405,6 +1467,12 @@ func (l *ContextAwareLexer) tokenizeOperatorOrPunctuation() *ContextToken {
 		l.advance()
 		return l.createToken(TOKEN_RIGHT_SHIFT, ">>", startCol, nil)
 	}
+	if tokenType, found := twoCharOperators[l.input[l.position:min(l.position+2, len(l.input))]]; found {
+		literal := l.input[l.position : l.position+2]
+		l.advance()
+		l.advance()
+		return l.createToken(tokenType, literal, startCol, nil)
+	}
 
 	// Single character operators/punctuation
 	var tokenType TokenType
@@ -1473,6 +1541,10 @@ func (l *ContextAwareLexer) tokenizeOperatorOrPunctuation() *ContextToken {
 		tokenType = TOKEN_BITWISE_XOR
 	case '%':
 		tokenType = TOKEN_MODULO
+	case '~':
+		tokenType = TOKEN_BITWISE_NOT
+	case '!':
+		tokenType = TOKEN_BANG
 	default:
 		// Unknown character
 		startCol := l.column
@@ -3,7 +3,6 @@ package lsp
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 	"strconv"
 	"strings"
 	"unicode"
@@ -17,7 +16,7 @@ import (
 func (ctx *ProcessorContext) loadMnemonics(path string) error {
 	log.Debug("Loading mnemonics from %s", path)
 
-	data, err := os.ReadFile(path)
+	data, err := readDataFile(path)
 	if err != nil {
 		return fmt.Errorf("failed to read mnemonic file %s: %v", path, err)
 	}
@@ -61,7 +60,7 @@ func (ctx *ProcessorContext) loadMnemonics(path string) error {
 func (ctx *ProcessorContext) loadKickAssemblerData(path string) error {
 	log.Debug("Loading Kick Assembler data from %s", path)
 
-	data, err := os.ReadFile(path)
+	data, err := readDataFile(path)
 	if err != nil {
 		return fmt.Errorf("failed to read kickass file %s: %v", path, err)
 	}
@@ -120,7 +119,7 @@ func (ctx *ProcessorContext) loadKickAssemblerData(path string) error {
 func (ctx *ProcessorContext) loadC64Memory(path string) error {
 	log.Debug("Loading C64 memory map from %s", path)
 
-	data, err := os.ReadFile(path)
+	data, err := readDataFile(path)
 	if err != nil {
 		return fmt.Errorf("failed to read c64memory file %s: %v", path, err)
 	}
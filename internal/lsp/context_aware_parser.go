@@ -1,6 +1,7 @@
 package lsp
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
@@ -12,8 +13,15 @@ import (
 const (
 	_ int = iota
 	LOWEST
-	EQUALS      // ==
+	EQUALS      // = (assignment in .eval)
+	LOGICALOR   // ||
+	LOGICALAND  // &&
+	BITWISEOR   // |
+	BITWISEXOR  // ^
+	BITWISEAND  // &
+	EQUALITY    // == or !=
 	LESSGREATER // > or <
+	SHIFT       // << or >>
 	SUM         // +
 	PRODUCT     // *
 	PREFIX      // -X or <X
@@ -23,15 +31,34 @@ const (
 
 // precedences maps token types to their precedence levels
 var precedences = map[TokenType]int{
-	TOKEN_EQUAL:    EQUALS,
-	TOKEN_PLUS:     SUM,
-	TOKEN_MINUS:    SUM,
-	TOKEN_SLASH:    PRODUCT,
-	TOKEN_ASTERISK: PRODUCT,
-	TOKEN_LESS:     PREFIX,
-	TOKEN_GREATER:  PREFIX,
-	TOKEN_LPAREN:   CALL,
-	TOKEN_DOT:      MEMBER,
+	TOKEN_EQUAL:         EQUALS,
+	TOKEN_PLUS_EQUAL:    EQUALS,
+	TOKEN_MINUS_EQUAL:   EQUALS,
+	TOKEN_TIMES_EQUAL:   EQUALS,
+	TOKEN_DIVIDE_EQUAL:  EQUALS,
+	TOKEN_LOGICAL_OR:    LOGICALOR,
+	TOKEN_LOGICAL_AND:   LOGICALAND,
+	TOKEN_BITWISE_OR:    BITWISEOR,
+	TOKEN_BITWISE_XOR:   BITWISEXOR,
+	TOKEN_BITWISE_AND:   BITWISEAND,
+	TOKEN_EQUAL_EQUAL:   EQUALITY,
+	TOKEN_NOT_EQUAL:     EQUALITY,
+	TOKEN_LESS:          LESSGREATER,
+	TOKEN_GREATER:       LESSGREATER,
+	TOKEN_LESS_EQUAL:    LESSGREATER,
+	TOKEN_GREATER_EQUAL: LESSGREATER,
+	TOKEN_LEFT_SHIFT:    SHIFT,
+	TOKEN_RIGHT_SHIFT:   SHIFT,
+	TOKEN_PLUS:          SUM,
+	TOKEN_MINUS:         SUM,
+	TOKEN_SLASH:         PRODUCT,
+	TOKEN_ASTERISK:      PRODUCT,
+	TOKEN_MODULO:        PRODUCT,
+	TOKEN_INCREMENT:     CALL,
+	TOKEN_DECREMENT:     CALL,
+	TOKEN_LPAREN:        CALL,
+	TOKEN_LBRACKET:      CALL,
+	TOKEN_DOT:           MEMBER,
 }
 
 // Context-Aware Parser for 6510/C64/Kick Assembler
@@ -45,6 +72,18 @@ type ContextAwareParser struct {
 	diagnostics  []Diagnostic
 	processorCtx *ProcessorContext
 	debugMode    bool
+
+	// Budget for pathological input: parsing stops when ctx is done or blocks and
+	// parentheses nest deeper than maxDepth (0 = unlimited)
+	ctx      context.Context
+	depth    int
+	maxDepth int
+	stopped  bool
+
+	// Preprocessor symbols defined at the current line, and the #if branches left out
+	// because of them
+	defines  map[string]bool
+	inactive []InactiveRange
 }
 
 // NewContextAwareParser creates a new context-aware parser instance
@@ -54,6 +93,9 @@ func NewContextAwareParser(lexer *ContextAwareLexer, processorCtx *ProcessorCont
 		diagnostics:  []Diagnostic{},
 		processorCtx: processorCtx,
 		debugMode:    IsParserDebugModeEnabled(),
+		ctx:          context.Background(),
+		maxDepth:     GetLSPConfig().AnalysisLimits.MaxNestingDepth,
+		defines:      make(map[string]bool),
 	}
 
 	// Read first two tokens
@@ -89,7 +131,7 @@ func (p *ContextAwareParser) ParseProgram() *Program {
 	}
 
 	for p.currentToken.Type != TOKEN_EOF {
-		if p.currentToken == nil {
+		if p.currentToken == nil || p.shouldStop() {
 			break
 		}
 
@@ -101,6 +143,8 @@ func (p *ContextAwareParser) ParseProgram() *Program {
 		p.nextToken()
 	}
 
+	program.Inactive = p.inactive
+
 	if p.debugMode {
 		log.Debug("ContextAwareParser: Parsed %d statements", len(program.Statements))
 	}
@@ -108,6 +152,51 @@ func (p *ContextAwareParser) ParseProgram() *Program {
 	return program
 }
 
+// shouldStop reports whether parsing was aborted, recording why on the first call after
+// the analysis budget ran out
+func (p *ContextAwareParser) shouldStop() bool {
+	if p.stopped {
+		return true
+	}
+	if p.ctx.Err() != nil {
+		p.stop("Parsing stopped here, the analysis time budget ran out - results below are incomplete")
+	}
+	return p.stopped
+}
+
+// stop aborts parsing at the current token, keeping the statements parsed so far
+func (p *ContextAwareParser) stop(message string) {
+	if p.stopped {
+		return
+	}
+	line, column := 1, 1
+	if p.currentToken != nil {
+		line, column = p.currentToken.Line, p.currentToken.Column
+	}
+	p.addError(message, line, column)
+	p.stopped = true
+	log.Warn("ContextAwareParser: %s (line %d)", message, line)
+}
+
+// enterNesting counts a nested block or parenthesis and stops parsing when it is too deep.
+// Callers must call leaveNesting when it returns true.
+func (p *ContextAwareParser) enterNesting() bool {
+	if p.stopped {
+		return false
+	}
+	if p.maxDepth > 0 && p.depth >= p.maxDepth {
+		p.stop(fmt.Sprintf("Nesting deeper than %d levels, parsing stopped here - results below are incomplete", p.maxDepth))
+		return false
+	}
+	p.depth++
+	return true
+}
+
+// leaveNesting ends a nesting level started with enterNesting
+func (p *ContextAwareParser) leaveNesting() {
+	p.depth--
+}
+
 // parseStatement parses a single statement based on current token type and context
 func (p *ContextAwareParser) parseStatement() Statement {
 	if p.currentToken == nil {
@@ -233,7 +322,11 @@ func (p *ContextAwareParser) parseInstructionStatement() *InstructionStatement {
 	}
 
 	// Store mnemonic info in token literal (for now, until we have enhanced AST)
-	// The mnemonic is already in Token.Literal
+	// The mnemonic is already in Token.Literal, a mnemonic extension goes to Suffix
+	if dot := strings.Index(stmt.Token.Literal, "."); dot >= 0 {
+		stmt.Suffix = stmt.Token.Literal[dot+1:]
+		stmt.Token.Literal = stmt.Token.Literal[:dot]
+	}
 
 	// Check if there's an operand by peeking at next token
 	// Don't advance if next token is EOF or statement terminator
@@ -281,8 +374,8 @@ func (p *ContextAwareParser) parseInstructionStatement() *InstructionStatement {
 		}
 	}
 
-	// TODO: Validate addressing mode using metadata from ContextToken
-	// For now, we use the existing InstructionStatement structure
+	// Addressing modes are validated by the SemanticAnalyzer (checkAddressingMode),
+	// which knows the symbol values that decide between zero page and absolute
 
 	if p.debugMode {
 		log.Debug("ContextAwareParser: Parsed instruction '%s' at Line %d", stmt.Token.Literal, stmt.Token.Line)
@@ -330,6 +423,12 @@ func (p *ContextAwareParser) parseProgramCounterDirective() *DirectiveStatement
 		stmt.Value = p.parseExpression(LOWEST)
 	}
 
+	// A string after the address names the memory block: *=$1000 "Main"
+	if stmt.Value != nil && p.peekToken.Type == TOKEN_STRING && p.peekToken.Line == p.currentToken.Line {
+		p.nextToken()
+		stmt.Description = p.parseStringLiteral().(*StringLiteral)
+	}
+
 	if p.debugMode {
 		log.Debug("ContextAwareParser: Parsed program counter directive '%s' at Line %d", directiveLiteral, stmt.Token.Line)
 	}
@@ -352,6 +451,14 @@ func (p *ContextAwareParser) parseDirectiveStatement() *DirectiveStatement {
 		}
 	}
 
+	// The preprocessor picks the branch of #if/#elif/#else while parsing
+	switch directiveName {
+	case "#if":
+		return p.parsePreprocessorConditional()
+	case "#elif", "#else", "#endif":
+		return p.parseStrayPreprocessorBranch()
+	}
+
 	// Route to appropriate parser based on SourceType
 	if sourceType == SourcePreprocessor {
 		return p.parseDefineDirective()
@@ -375,6 +482,8 @@ func (p *ContextAwareParser) parseDirectiveStatement() *DirectiveStatement {
 		return p.parseNamespaceDirective()
 	case ".enum":
 		return p.parseEnumDirective()
+	case ".segmentdef", ".segment", ".memblock", ".file", ".segmentout":
+		return p.parseSegmentDirective()
 	}
 
 	// Special handling for data directives with comma-separated values
@@ -382,10 +491,13 @@ func (p *ContextAwareParser) parseDirectiveStatement() *DirectiveStatement {
 		return p.parseDataDirective()
 	}
 
-	// Special handling for .for loops
+	// Special handling for .for and .while loops
 	if directiveName == ".for" {
 		return p.parseForDirective()
 	}
+	if directiveName == ".while" {
+		return p.parseWhileDirective()
+	}
 
 	// Special handling for .if/.else
 	if directiveName == ".if" {
@@ -590,24 +702,9 @@ func (p *ContextAwareParser) parseForDirective() *DirectiveStatement {
 	}
 
 	// Parse (var i = 0; i < 3; i++)
-	// For now, skip the entire parameter list until we find the closing )
 	p.nextToken()
 	if p.currentToken.Type == TOKEN_LPAREN {
-		parenDepth := 1
-		p.nextToken() // skip (
-
-		// Skip all tokens until we find the matching )
-		for parenDepth > 0 && p.currentToken.Type != TOKEN_EOF {
-			if p.currentToken.Type == TOKEN_LPAREN {
-				parenDepth++
-			} else if p.currentToken.Type == TOKEN_RPAREN {
-				parenDepth--
-			}
-			if parenDepth > 0 {
-				p.nextToken()
-			}
-		}
-		// Now currentToken should be the closing )
+		stmt.Value = p.parseForHeader()
 	}
 
 	// Parse block { }
@@ -623,6 +720,122 @@ func (p *ContextAwareParser) parseForDirective() *DirectiveStatement {
 	return stmt
 }
 
+// parseForHeader parses the (init; condition; step) part of a .for loop. Init and step are
+// comma-separated, the loop variables in init are declared with var.
+func (p *ContextAwareParser) parseForHeader() Expression {
+	header := &ForExpression{
+		Token: Token{
+			Type:    p.currentToken.Type,
+			Literal: p.currentToken.Literal,
+			Line:    p.currentToken.Line,
+			Column:  p.currentToken.Column,
+		},
+	}
+
+	p.nextToken() // skip (
+	header.Init = p.parseForClause(TOKEN_SEMICOLON)
+	if p.currentToken.Type != TOKEN_SEMICOLON {
+		p.addError("Expected ';' after .for initialization", p.currentToken.Line, p.currentToken.Column)
+		p.skipToClosingParen()
+		return header
+	}
+
+	p.nextToken() // skip ;
+	if p.currentToken.Type != TOKEN_SEMICOLON {
+		header.Condition = p.parseExpression(LOWEST)
+		p.nextToken()
+	}
+	if p.currentToken.Type != TOKEN_SEMICOLON {
+		p.addError("Expected ';' after .for condition", p.currentToken.Line, p.currentToken.Column)
+		p.skipToClosingParen()
+		return header
+	}
+
+	p.nextToken() // skip ;
+	header.Step = p.parseForClause(TOKEN_RPAREN)
+	if p.currentToken.Type != TOKEN_RPAREN {
+		p.addError("Expected ')' after .for step", p.currentToken.Line, p.currentToken.Column)
+		p.skipToClosingParen()
+	}
+
+	return header
+}
+
+// parseForClause parses comma-separated expressions up to end and stops on it
+func (p *ContextAwareParser) parseForClause(end TokenType) []Expression {
+	var expressions []Expression
+	for p.currentToken.Type != end && p.currentToken.Type != TOKEN_EOF && !p.isStatementTerminator() {
+		// var only declares the loop variable
+		if p.currentToken.Type == TOKEN_IDENTIFIER && p.currentToken.Literal == "var" {
+			p.nextToken()
+		}
+		if expression := p.parseExpression(LOWEST); expression != nil {
+			expressions = append(expressions, expression)
+		}
+		p.nextToken()
+		if p.currentToken.Type != TOKEN_COMMA {
+			break
+		}
+		p.nextToken() // skip ,
+	}
+	return expressions
+}
+
+// skipToClosingParen skips the rest of a parenthesized list after an error
+func (p *ContextAwareParser) skipToClosingParen() {
+	parenDepth := 1
+	for p.currentToken.Type != TOKEN_EOF {
+		if p.currentToken.Type == TOKEN_LPAREN {
+			parenDepth++
+		} else if p.currentToken.Type == TOKEN_RPAREN {
+			parenDepth--
+			if parenDepth == 0 {
+				return
+			}
+		}
+		p.nextToken()
+	}
+}
+
+// parseWhileDirective parses .while (condition) { ... }
+func (p *ContextAwareParser) parseWhileDirective() *DirectiveStatement {
+	stmt := &DirectiveStatement{
+		Token: Token{
+			Type:    p.currentToken.Type,
+			Literal: p.currentToken.Literal,
+			Line:    p.currentToken.Line,
+			Column:  p.currentToken.Column,
+		},
+		Name: &Identifier{
+			Token: Token{
+				Type:    TOKEN_DIRECTIVE_KICK_FLOW,
+				Literal: ".while",
+				Line:    p.currentToken.Line,
+				Column:  p.currentToken.Column,
+			},
+			Value: ".while",
+		},
+	}
+
+	// Parse condition
+	p.nextToken()
+	if p.currentToken.Type == TOKEN_LPAREN {
+		stmt.Value = p.parseExpression(LOWEST)
+	}
+
+	// Parse block { }
+	if p.peekToken.Type == TOKEN_LBRACE {
+		p.nextToken()
+		stmt.Block = p.parseBlockStatement()
+	}
+
+	if p.debugMode {
+		log.Debug("ContextAwareParser: Parsed .while directive at Line %d", stmt.Token.Line)
+	}
+
+	return stmt
+}
+
 // parseConditionalDirective parses .if/.else directive
 func (p *ContextAwareParser) parseConditionalDirective() *DirectiveStatement {
 	stmt := &DirectiveStatement{
@@ -649,13 +862,31 @@ func (p *ContextAwareParser) parseConditionalDirective() *DirectiveStatement {
 		stmt.Value = p.parseExpression(LOWEST)
 	}
 
-	// Parse then block
-	if p.peekToken.Type == TOKEN_LBRACE {
+	// Parse then block, or the one statement of .if (cond) statement
+	switch {
+	case p.peekToken.Type == TOKEN_LBRACE:
 		p.nextToken()
 		stmt.Block = p.parseBlockStatement()
+	case stmt.Value != nil && p.peekToken.Type != TOKEN_EOF && p.peekToken.Type != TOKEN_ELSE &&
+		p.peekToken.Line == p.currentToken.Line:
+		p.nextToken()
+		stmt.Block = p.parseSingleStatementBlock()
 	}
 
-	// TODO: Parse else block if present
+	// else { ... } or else .if (...) { ... }
+	if stmt.Block != nil && p.peekToken.Type == TOKEN_ELSE {
+		p.nextToken()
+		switch {
+		case p.peekToken.Type == TOKEN_LBRACE:
+			p.nextToken()
+			stmt.Alternative = p.parseBlockStatement()
+		case strings.ToLower(p.peekToken.Literal) == ".if":
+			p.nextToken()
+			stmt.Alternative = p.parseConditionalDirective()
+		default:
+			p.addError("Expected '{' or .if after else", p.currentToken.Line, p.currentToken.Column)
+		}
+	}
 
 	if p.debugMode {
 		log.Debug("ContextAwareParser: Parsed .if directive at Line %d", stmt.Token.Line)
@@ -664,6 +895,252 @@ func (p *ContextAwareParser) parseConditionalDirective() *DirectiveStatement {
 	return stmt
 }
 
+// parseSingleStatementBlock parses the statement of a branch without braces into a block
+// that ends with the statement
+func (p *ContextAwareParser) parseSingleStatementBlock() *BlockStatement {
+	block := &BlockStatement{
+		Token: Token{
+			Type:    p.currentToken.Type,
+			Literal: p.currentToken.Literal,
+			Line:    p.currentToken.Line,
+			Column:  p.currentToken.Column,
+		},
+		Statements: []Statement{},
+	}
+	if stmt := p.parseStatement(); stmt != nil {
+		block.Statements = append(block.Statements, stmt)
+	}
+	// The end is the last character of the statement, like the closing brace of a block
+	block.EndToken = Token{
+		Type:    p.currentToken.Type,
+		Literal: p.currentToken.Literal,
+		Line:    p.currentToken.Line,
+		Column:  p.currentToken.Column + len(p.currentToken.Literal) - 1,
+	}
+	return block
+}
+
+// parsePreprocessorConditional parses #if/#elif/#else/#endif. Like Kick Assembler's
+// preprocessor it keeps only the branch whose condition holds, in the Block of the #if.
+// The lines of the other branches are skipped without parsing and recorded as inactive.
+func (p *ContextAwareParser) parsePreprocessorConditional() *DirectiveStatement {
+	stmt := &DirectiveStatement{
+		Token: Token{
+			Type:    p.currentToken.Type,
+			Literal: p.currentToken.Literal,
+			Line:    p.currentToken.Line,
+			Column:  p.currentToken.Column,
+		},
+	}
+	stmt.Block = &BlockStatement{Token: stmt.Token, Statements: []Statement{}}
+
+	if !p.enterNesting() {
+		return stmt
+	}
+	defer p.leaveNesting()
+
+	taken, afterElse := false, false
+	for {
+		directive := p.currentToken
+		name := strings.ToLower(directive.Literal)
+		if afterElse {
+			p.addError(fmt.Sprintf("%s after #else", name), directive.Line, directive.Column)
+		}
+
+		reason := fmt.Sprintf("Inactive code: an earlier branch of the #if in line %d is assembled", stmt.Token.Line)
+		active := !taken
+		if name == "#else" {
+			afterElse = true
+			p.expectPreprocessorLineEnd(directive)
+		} else {
+			condition := p.parsePreprocessorCondition(directive)
+			if name == "#if" {
+				stmt.Value = condition
+			}
+			holds := p.preprocessorCondition(condition, directive)
+			if !taken && !holds {
+				reason = fmt.Sprintf("Inactive code: the %s condition is false", name)
+			}
+			active = active && holds
+		}
+
+		var found bool
+		if active {
+			taken = true
+			found = p.parsePreprocessorBranch(stmt.Block)
+		} else {
+			found = p.skipPreprocessorBranch(directive, reason)
+		}
+		if !found {
+			p.addError(fmt.Sprintf("Missing #endif for the #if in line %d", stmt.Token.Line), stmt.Token.Line, stmt.Token.Column)
+			return stmt
+		}
+
+		if strings.ToLower(p.currentToken.Literal) == "#endif" {
+			stmt.Block.EndToken = Token{
+				Type:    p.currentToken.Type,
+				Literal: p.currentToken.Literal,
+				Line:    p.currentToken.Line,
+				Column:  p.currentToken.Column,
+			}
+			p.expectPreprocessorLineEnd(p.currentToken)
+			return stmt
+		}
+	}
+}
+
+// parseStrayPreprocessorBranch reports an #elif, #else or #endif that doesn't belong to an #if
+func (p *ContextAwareParser) parseStrayPreprocessorBranch() *DirectiveStatement {
+	stmt := &DirectiveStatement{
+		Token: Token{
+			Type:    p.currentToken.Type,
+			Literal: p.currentToken.Literal,
+			Line:    p.currentToken.Line,
+			Column:  p.currentToken.Column,
+		},
+	}
+	p.addError(fmt.Sprintf("%s without #if", strings.ToLower(p.currentToken.Literal)), p.currentToken.Line, p.currentToken.Column)
+	for p.peekToken.Type != TOKEN_EOF && p.peekToken.Line == stmt.Token.Line {
+		p.nextToken()
+	}
+	return stmt
+}
+
+// parsePreprocessorCondition parses the condition of an #if or #elif, which ends with the line
+func (p *ContextAwareParser) parsePreprocessorCondition(directive *ContextToken) Expression {
+	name := strings.ToLower(directive.Literal)
+	if p.peekToken.Type == TOKEN_EOF || p.peekToken.Type == TOKEN_COMMENT || p.peekToken.Line != directive.Line {
+		p.addError(fmt.Sprintf("Expected condition after %s", name), directive.Line, directive.Column)
+		return nil
+	}
+	p.nextToken()
+	condition := p.parseExpression(LOWEST)
+	p.expectPreprocessorLineEnd(directive)
+	return condition
+}
+
+// expectPreprocessorLineEnd reports and skips anything but a comment after a preprocessor
+// directive in its line
+func (p *ContextAwareParser) expectPreprocessorLineEnd(directive *ContextToken) {
+	if p.peekToken.Type == TOKEN_EOF || p.peekToken.Type == TOKEN_COMMENT || p.peekToken.Line != directive.Line {
+		return
+	}
+	p.addError(fmt.Sprintf("Unexpected '%s' after %s", p.peekToken.Literal, strings.ToLower(directive.Literal)), p.peekToken.Line, p.peekToken.Column)
+	for p.peekToken.Type != TOKEN_EOF && p.peekToken.Line == directive.Line {
+		p.nextToken()
+	}
+}
+
+// preprocessorCondition evaluates an #if condition. A symbol is true when it is defined.
+func (p *ContextAwareParser) preprocessorCondition(expr Expression, directive *ContextToken) bool {
+	switch e := expr.(type) {
+	case nil:
+		return false
+	case *Identifier:
+		switch e.Value {
+		case "true":
+			return true
+		case "false":
+			return false
+		}
+		return p.defines[e.Value]
+	case *GroupedExpression:
+		return p.preprocessorCondition(e.Expression, directive)
+	case *PrefixExpression:
+		if e.Operator == "!" {
+			return !p.preprocessorCondition(e.Right, directive)
+		}
+	case *InfixExpression:
+		left := p.preprocessorCondition(e.Left, directive)
+		right := p.preprocessorCondition(e.Right, directive)
+		switch e.Operator {
+		case "&&":
+			return left && right
+		case "||":
+			return left || right
+		case "==":
+			return left == right
+		case "!=":
+			return left != right
+		}
+	}
+	p.addError(fmt.Sprintf("'%s' can't be used in a preprocessor condition, only symbols, !, &&, ||, == and !=", expr.TokenLiteral()),
+		directive.Line, directive.Column)
+	return false
+}
+
+// parsePreprocessorBranch parses the statements of the active #if branch into block. It stops
+// on the #elif, #else or #endif ending the branch and reports whether there was one.
+func (p *ContextAwareParser) parsePreprocessorBranch(block *BlockStatement) bool {
+	for !p.shouldStop() {
+		switch {
+		case p.peekToken.Type == TOKEN_EOF || p.peekToken.Type == TOKEN_RBRACE:
+			return false
+		case isPreprocessorBranchEnd(p.peekToken):
+			p.nextToken()
+			return true
+		}
+		p.nextToken()
+		if stmt := p.parseStatement(); stmt != nil {
+			block.Statements = append(block.Statements, stmt)
+		}
+	}
+	return false
+}
+
+// skipPreprocessorBranch skips the lines of an inactive #if branch, nested #if blocks
+// included, and records them as inactive. It stops on the #elif, #else or #endif ending the
+// branch and reports whether there was one.
+func (p *ContextAwareParser) skipPreprocessorBranch(directive *ContextToken, reason string) bool {
+	depth := 0
+	found := false
+	for p.peekToken.Type != TOKEN_EOF && !found && !p.shouldStop() {
+		if p.peekToken.Type == TOKEN_DIRECTIVE_KICK_PRE {
+			switch strings.ToLower(p.peekToken.Literal) {
+			case "#if":
+				depth++
+			case "#endif":
+				found = depth == 0
+				depth--
+			case "#elif", "#else":
+				found = depth == 0
+			}
+		}
+		if !found {
+			p.nextToken()
+		}
+	}
+
+	// Whole lines from the one after the directive up to the end of the branch
+	inactive := Range{
+		Start: Position{Line: directive.Line, Character: 0},
+		End:   Position{Line: p.peekToken.Line - 1, Character: 0},
+	}
+	if !found {
+		inactive.End.Character = p.peekToken.Column - 1
+	}
+	if inactive.End.Line > inactive.Start.Line || inactive.End.Character > 0 {
+		p.inactive = append(p.inactive, InactiveRange{Range: inactive, Message: reason})
+	}
+
+	if found {
+		p.nextToken()
+	}
+	return found
+}
+
+// isPreprocessorBranchEnd reports whether a token ends the branch of an #if
+func isPreprocessorBranchEnd(token *ContextToken) bool {
+	if token.Type != TOKEN_DIRECTIVE_KICK_PRE {
+		return false
+	}
+	switch strings.ToLower(token.Literal) {
+	case "#elif", "#else", "#endif":
+		return true
+	}
+	return false
+}
+
 // parseBlockStatement parses a block { ... }
 func (p *ContextAwareParser) parseBlockStatement() *BlockStatement {
 	block := &BlockStatement{
@@ -676,9 +1153,14 @@ func (p *ContextAwareParser) parseBlockStatement() *BlockStatement {
 		Statements: []Statement{},
 	}
 
+	if !p.enterNesting() {
+		return block
+	}
+	defer p.leaveNesting()
+
 	p.nextToken() // skip {
 
-	for p.currentToken.Type != TOKEN_RBRACE && p.currentToken.Type != TOKEN_EOF {
+	for p.currentToken.Type != TOKEN_RBRACE && p.currentToken.Type != TOKEN_EOF && !p.shouldStop() {
 		if p.debugMode {
 			log.Debug("parseBlockStatement: currentToken=%s (%s) at line %d",
 				p.currentToken.Literal, p.currentToken.Type.String(), p.currentToken.Line)
@@ -703,6 +1185,14 @@ func (p *ContextAwareParser) parseBlockStatement() *BlockStatement {
 		log.Debug("parseBlockStatement: Exited loop, currentToken=%s", p.currentToken.Literal)
 	}
 
+	// Remember the closing brace (or EOF for unterminated blocks) so scopes get a real range
+	block.EndToken = Token{
+		Type:    p.currentToken.Type,
+		Literal: p.currentToken.Literal,
+		Line:    p.currentToken.Line,
+		Column:  p.currentToken.Column,
+	}
+
 	return block
 }
 
@@ -819,6 +1309,10 @@ func (p *ContextAwareParser) isStatementTerminator() bool {
 }
 
 func (p *ContextAwareParser) isNextTokenStatementTerminator() bool {
+	// An operand doesn't continue in the next line, which may start with a macro call
+	if p.currentToken != nil && p.peekToken.Line > p.currentToken.Line {
+		return true
+	}
 	return p.peekToken.Type == TOKEN_EOF ||
 		p.peekToken.Type == TOKEN_LABEL ||
 		p.peekToken.Type == TOKEN_MULTILABEL ||
@@ -852,12 +1346,6 @@ func isNamedDirective(directive string) bool {
 	return false
 }
 
-// validateAddressingMode validates if the addressing mode is valid for the mnemonic
-func (p *ContextAwareParser) validateAddressingMode(stmt *InstructionStatement) {
-	// TODO: Implement addressing mode validation using MnemonicInfo.AddressingModes
-	// This will check if the parsed operand matches one of the valid addressing modes
-}
-
 // Errors returns all diagnostics collected during parsing
 func (p *ContextAwareParser) Errors() []Diagnostic {
 	return p.diagnostics
@@ -865,6 +1353,10 @@ func (p *ContextAwareParser) Errors() []Diagnostic {
 
 // addError adds a diagnostic error
 func (p *ContextAwareParser) addError(message string, line, column int) {
+	// Errors after an aborted parse are follow-ups of the abort
+	if p.stopped {
+		return
+	}
 	diagnostic := Diagnostic{
 		Severity: SeverityError,
 		Range: Range{
@@ -884,6 +1376,10 @@ func (p *ContextAwareParser) parseExpression(precedence int) Expression {
 	if p.currentToken == nil || p.currentToken.Type == TOKEN_COMMENT {
 		return nil
 	}
+	if !p.enterNesting() {
+		return nil
+	}
+	defer p.leaveNesting()
 
 	if p.debugMode && p.currentToken.Type == TOKEN_RBRACE {
 		log.Debug("parseExpression: Called with RBRACE token at Line %d", p.currentToken.Line)
@@ -904,7 +1400,7 @@ func (p *ContextAwareParser) parseExpression(precedence int) Expression {
 	case TOKEN_ASTERISK:
 		// Program Counter expression
 		leftExp = p.parseProgramCounter()
-	case TOKEN_HASH, TOKEN_MINUS, TOKEN_PLUS, TOKEN_LESS, TOKEN_GREATER, TOKEN_DOT, TOKEN_AT:
+	case TOKEN_HASH, TOKEN_MINUS, TOKEN_PLUS, TOKEN_LESS, TOKEN_GREATER, TOKEN_DOT, TOKEN_AT, TOKEN_BANG, TOKEN_BITWISE_NOT:
 		leftExp = p.parsePrefixExpression()
 	case TOKEN_LPAREN:
 		leftExp = p.parseGroupedExpression()
@@ -936,14 +1432,21 @@ func (p *ContextAwareParser) parseExpression(precedence int) Expression {
 	// Parse infix expressions
 	for p.peekToken != nil && p.peekToken.Type != TOKEN_EOF && precedence < p.peekPrecedence() {
 		switch p.peekToken.Type {
-		case TOKEN_PLUS, TOKEN_MINUS, TOKEN_SLASH, TOKEN_ASTERISK, TOKEN_EQUAL, TOKEN_DOT:
+		case TOKEN_INCREMENT, TOKEN_DECREMENT:
 			p.nextToken()
-			leftExp = p.parseInfixExpression(leftExp)
+			leftExp = p.parsePostfixExpression(leftExp)
 		case TOKEN_LPAREN:
 			p.nextToken()
 			leftExp = p.parseCallExpression(leftExp)
+		case TOKEN_LBRACKET:
+			p.nextToken()
+			leftExp = p.parseIndexExpression(leftExp)
+		case TOKEN_EQUAL, TOKEN_PLUS_EQUAL, TOKEN_MINUS_EQUAL, TOKEN_TIMES_EQUAL, TOKEN_DIVIDE_EQUAL:
+			p.nextToken()
+			leftExp = p.parseAssignmentExpression(leftExp)
 		default:
-			return leftExp
+			p.nextToken()
+			leftExp = p.parseInfixExpression(leftExp)
 		}
 	}
 
@@ -1179,6 +1682,64 @@ func (p *ContextAwareParser) parseInfixExpression(left Expression) Expression {
 	return expression
 }
 
+// parseAssignmentExpression parses the assignments of .eval (x = 1, x += 2). They are right
+// associative, so x = y = 0 assigns both.
+func (p *ContextAwareParser) parseAssignmentExpression(left Expression) Expression {
+	expression := &InfixExpression{
+		Token: Token{
+			Type:    p.currentToken.Type,
+			Literal: p.currentToken.Literal,
+			Line:    p.currentToken.Line,
+			Column:  p.currentToken.Column,
+		},
+		Operator: p.currentToken.Literal,
+		Left:     left,
+	}
+
+	p.nextToken()
+	expression.Right = p.parseExpression(LOWEST)
+
+	return expression
+}
+
+// parsePostfixExpression parses x++ and x--. The result is an InfixExpression without a
+// right operand.
+func (p *ContextAwareParser) parsePostfixExpression(left Expression) Expression {
+	return &InfixExpression{
+		Token: Token{
+			Type:    p.currentToken.Type,
+			Literal: p.currentToken.Literal,
+			Line:    p.currentToken.Line,
+			Column:  p.currentToken.Column,
+		},
+		Operator: p.currentToken.Literal,
+		Left:     left,
+	}
+}
+
+// parseIndexExpression parses loop[2], the iteration of a labeled loop
+func (p *ContextAwareParser) parseIndexExpression(left Expression) Expression {
+	expression := &IndexExpression{
+		Token: Token{
+			Type:    p.currentToken.Type,
+			Literal: p.currentToken.Literal,
+			Line:    p.currentToken.Line,
+			Column:  p.currentToken.Column,
+		},
+		Left: left,
+	}
+
+	p.nextToken()
+	expression.Index = p.parseExpression(LOWEST)
+	if p.peekToken == nil || p.peekToken.Type != TOKEN_RBRACKET {
+		p.addError("Expected ']'", p.currentToken.Line, p.currentToken.Column)
+		return expression
+	}
+	p.nextToken()
+
+	return expression
+}
+
 // parseCallExpression parses function calls
 func (p *ContextAwareParser) parseCallExpression(function Expression) Expression {
 	exp := &CallExpression{
@@ -1282,6 +1843,144 @@ func (p *ContextAwareParser) curPrecedence() int {
 	return precedences[p.currentToken.Type]
 }
 
+// parseSegmentDirective parses the segment directives:
+//
+//	.segmentdef Name [parameters]
+//	.segment Name [parameters] "block name"
+//	.memblock "block name"
+//	.file [parameters]
+//	.segmentout [parameters]
+func (p *ContextAwareParser) parseSegmentDirective() *DirectiveStatement {
+	directiveName := strings.ToLower(p.currentToken.Literal)
+	directiveToken := p.currentToken
+
+	stmt := &DirectiveStatement{
+		Token: Token{
+			Type:    directiveToken.Type,
+			Literal: directiveToken.Literal,
+			Line:    directiveToken.Line,
+			Column:  directiveToken.Column,
+		},
+	}
+
+	// .segmentdef and .segment name a segment, the others are named after the directive
+	if directiveName == ".segmentdef" || directiveName == ".segment" {
+		if p.peekToken.Type != TOKEN_IDENTIFIER || p.peekToken.Line != directiveToken.Line {
+			p.addError(fmt.Sprintf("Expected segment name after %s", directiveName), directiveToken.Line, directiveToken.Column)
+			return stmt
+		}
+		p.nextToken()
+		stmt.Name = &Identifier{
+			Token: Token{
+				Type:    p.currentToken.Type,
+				Literal: p.currentToken.Literal,
+				Line:    p.currentToken.Line,
+				Column:  p.currentToken.Column,
+			},
+			Value: p.currentToken.Literal,
+		}
+	} else {
+		stmt.Name = &Identifier{
+			Token: Token{
+				Type:    directiveToken.Type,
+				Literal: directiveName,
+				Line:    directiveToken.Line,
+				Column:  directiveToken.Column,
+			},
+			Value: directiveName,
+		}
+	}
+
+	if directiveName != ".memblock" && p.peekToken.Type == TOKEN_LBRACKET && p.peekToken.Line == directiveToken.Line {
+		p.nextToken()
+		stmt.Options = p.parseSegmentParameters()
+	} else if directiveName == ".file" || directiveName == ".segmentout" {
+		p.addError(fmt.Sprintf("Expected '[' with parameters after %s", directiveName), directiveToken.Line, directiveToken.Column)
+		return stmt
+	}
+
+	if directiveName == ".segment" || directiveName == ".memblock" {
+		if p.peekToken.Type == TOKEN_STRING && p.peekToken.Line == directiveToken.Line {
+			p.nextToken()
+			stmt.Description = p.parseStringLiteral().(*StringLiteral)
+		} else if directiveName == ".memblock" {
+			p.addError("Expected memory block name after .memblock", directiveToken.Line, directiveToken.Column)
+		}
+	}
+
+	if p.debugMode {
+		log.Debug("ContextAwareParser: Parsed segment directive '%s' at Line %d", directiveName, stmt.Token.Line)
+	}
+
+	return stmt
+}
+
+// parseSegmentParameters parses [name=value, flag, ...], the current token is '['. It stops
+// on the ']', or on the last token of the line if the list isn't closed.
+func (p *ContextAwareParser) parseSegmentParameters() *ParameterList {
+	list := &ParameterList{
+		Token: Token{
+			Type:    p.currentToken.Type,
+			Literal: p.currentToken.Literal,
+			Line:    p.currentToken.Line,
+			Column:  p.currentToken.Column,
+		},
+	}
+	line := p.currentToken.Line
+
+	for p.peekToken.Type != TOKEN_RBRACKET {
+		if p.peekToken.Type == TOKEN_EOF || p.peekToken.Line != line {
+			p.addError("Expected ']' to close the parameter list", p.currentToken.Line, p.currentToken.Column)
+			return list
+		}
+		p.nextToken()
+		if p.currentToken.Type != TOKEN_IDENTIFIER {
+			p.addError(fmt.Sprintf("Expected parameter name, got '%s'", p.currentToken.Literal), p.currentToken.Line, p.currentToken.Column)
+			p.skipToParameterListEnd(line)
+			return list
+		}
+
+		parameter := &Parameter{
+			Name: &Identifier{
+				Token: Token{
+					Type:    p.currentToken.Type,
+					Literal: p.currentToken.Literal,
+					Line:    p.currentToken.Line,
+					Column:  p.currentToken.Column,
+				},
+				Value: p.currentToken.Literal,
+			},
+		}
+		if p.peekToken.Type == TOKEN_EQUAL {
+			p.nextToken() // skip name
+			p.nextToken() // skip '='
+			parameter.Value = p.parseExpression(LOWEST)
+		}
+		list.Parameters = append(list.Parameters, parameter)
+
+		switch p.peekToken.Type {
+		case TOKEN_COMMA:
+			p.nextToken()
+		case TOKEN_RBRACKET:
+		default:
+			if p.peekToken.Line == line && p.peekToken.Type != TOKEN_EOF {
+				p.addError(fmt.Sprintf("Expected ',' or ']' in parameter list, got '%s'", p.peekToken.Literal), p.peekToken.Line, p.peekToken.Column)
+				p.skipToParameterListEnd(line)
+				return list
+			}
+		}
+	}
+	p.nextToken() // move to ']'
+	return list
+}
+
+// skipToParameterListEnd skips to the ']' of a parameter list, or to the end of its line
+func (p *ContextAwareParser) skipToParameterListEnd(line int) {
+	for p.currentToken.Type != TOKEN_RBRACKET && p.peekToken.Type != TOKEN_EOF && p.peekToken.Line == line {
+		p.nextToken()
+	}
+}
+
 // parseEncodingDirective handles .encoding "string"
 // Format: .encoding "petscii_upper"
 func (p *ContextAwareParser) parseEncodingDirective() *DirectiveStatement {
@@ -1354,6 +2053,11 @@ func (p *ContextAwareParser) parseDefineDirective() *DirectiveStatement {
 		},
 	}
 
+	// #importonce takes no argument - it only marks the file as include-once
+	if directiveName == "#importonce" {
+		return stmt
+	}
+
 	// Check if next token is on the same line using peekToken (don't consume it yet)
 	if p.peekToken == nil || p.peekToken.Line != directiveToken.Line {
 		// No argument on same line - this is an error
@@ -1368,11 +2072,36 @@ func (p *ContextAwareParser) parseDefineDirective() *DirectiveStatement {
 	p.nextToken()
 
 	// Different preprocessor directives have different requirements:
-	// #import, #importif: expect string (filename)
+	// #import: expect string (filename)
+	// #importif: expect identifier (condition symbol) followed by string (filename)
 	// #define, #undef: expect identifier (symbol name)
 	if directiveName == "#import" || directiveName == "#importif" {
+		stmt.Name = nil // No symbol name for import
+
+		// #importif carries the condition symbol in Name
+		if directiveName == "#importif" && p.currentToken.Type == TOKEN_IDENTIFIER {
+			stmt.Name = &Identifier{
+				Token: Token{
+					Type:    p.currentToken.Type,
+					Literal: p.currentToken.Literal,
+					Line:    p.currentToken.Line,
+					Column:  p.currentToken.Column,
+				},
+				Value: p.currentToken.Literal,
+			}
+			if p.peekToken != nil && p.peekToken.Line == directiveToken.Line {
+				p.nextToken()
+			}
+		}
+
 		// Expect string literal (filename)
 		if p.currentToken.Type == TOKEN_STRING {
+			// Remove quotes from string value
+			value := p.currentToken.Literal
+			if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+				value = value[1 : len(value)-1]
+			}
+
 			stmt.Value = &StringLiteral{
 				Token: Token{
 					Type:    p.currentToken.Type,
@@ -1380,9 +2109,8 @@ func (p *ContextAwareParser) parseDefineDirective() *DirectiveStatement {
 					Line:    p.currentToken.Line,
 					Column:  p.currentToken.Column,
 				},
-				Value: p.currentToken.Literal,
+				Value: value,
 			}
-			stmt.Name = nil // No symbol name for import
 		} else {
 			// Error: expected filename string
 			p.addError(fmt.Sprintf("Expected filename string after %s directive", directiveName), directiveToken.Line, directiveToken.Column)
@@ -1396,7 +2124,6 @@ func (p *ContextAwareParser) parseDefineDirective() *DirectiveStatement {
 				},
 				Value: "",
 			}
-			stmt.Name = nil
 		}
 	} else {
 		// #define, #undef: expect identifier (symbol name)
@@ -1431,6 +2158,16 @@ func (p *ContextAwareParser) parseDefineDirective() *DirectiveStatement {
 		}
 	}
 
+	// Later #if lines see the symbol
+	if stmt.Name != nil {
+		switch directiveName {
+		case "#define":
+			p.defines[stmt.Name.Value] = true
+		case "#undef":
+			delete(p.defines, stmt.Name.Value)
+		}
+	}
+
 	return stmt
 }
 
@@ -1513,6 +2250,15 @@ func (p *ContextAwareParser) parseImportDirective() *DirectiveStatement {
 			Value: value,
 		})
 
+		// Optional offset and length: .import binary "file", offset, length
+		for p.peekToken.Type == TOKEN_COMMA && p.peekToken.Line == directiveToken.Line {
+			p.nextToken() // skip filename or previous argument
+			p.nextToken() // skip ','
+			if argument := p.parseExpression(LOWEST); argument != nil {
+				elements = append(elements, argument)
+			}
+		}
+
 		stmt.Value = &ArrayExpression{
 			Token: Token{
 				Type:    directiveToken.Type,
@@ -2037,11 +2783,14 @@ func (sb *scopeBuilder) buildScope(statements []Statement, currentScope *Scope)
 		return
 	}
 
+	loopLabel := ""
 	for _, statement := range statements {
 		if statement == nil {
 			log.Debug("buildScope: Encountered a nil statement, skipping.")
 			continue
 		}
+		label := loopLabel
+		loopLabel = ""
 
 		switch stmt := statement.(type) {
 		case *InstructionStatement:
@@ -2063,6 +2812,8 @@ func (sb *scopeBuilder) buildScope(statements []Statement, currentScope *Scope)
 			symbolKind := Label
 			if stmt.Token.Type == TOKEN_MULTILABEL {
 				symbolKind = MultiLabel
+			} else {
+				loopLabel = stmt.Name.Value // names the iterations of a loop right after it
 			}
 
 			symbol := &Symbol{
@@ -2104,6 +2855,9 @@ func (sb *scopeBuilder) buildScope(statements []Statement, currentScope *Scope)
 				if directiveName == ".enum" && stmt.Block != nil && stmt.Block.Statements != nil {
 					log.Debug("buildScope: Processing .enum block")
 					sb.buildScope(stmt.Block.Statements, currentScope)
+				} else if directiveName == "#if" && stmt.Block != nil {
+					// The branch the preprocessor kept belongs to the surrounding scope
+					sb.buildScope(stmt.Block.Statements, currentScope)
 				} else {
 					log.Debug("buildScope: DirectiveStatement '%s' has no name, skipping", stmt.Token.Literal)
 				}
@@ -2189,8 +2943,9 @@ func (sb *scopeBuilder) buildScope(statements []Statement, currentScope *Scope)
 
 			// Process blocks for directives that create scopes or contain statements
 			if stmt.Block != nil && stmt.Block.Statements != nil {
-				if directiveName == ".namespace" && stmt.Name != nil {
-					// Create new scope for namespace
+				if (directiveName == ".namespace" || directiveName == ".macro") && stmt.Name != nil {
+					// Create new scope for namespace. A macro body is a scope of its own too, its
+					// labels are local to each expansion.
 					endLine := stmt.Name.Token.Line - 1
 					endChar := stmt.Name.Token.Column - 1
 					if stmt.Block.EndToken.Type != TOKEN_EOF {
@@ -2215,7 +2970,29 @@ func (sb *scopeBuilder) buildScope(statements []Statement, currentScope *Scope)
 					}
 					currentScope.AddChildScope(newScope)
 					sb.buildScope(stmt.Block.Statements, newScope)
-				} else if directiveName == ".function" || directiveName == ".macro" || directiveName == ".pseudocommand" {
+				} else if directiveName == ".for" || directiveName == ".while" {
+					// Labels in a loop body are local to each iteration, loop[2].label
+					scopeName := directiveName
+					if label != "" {
+						scopeName = normalizeLabel(label)
+					}
+					newScope := &Scope{
+						Name:     scopeName,
+						Parent:   currentScope,
+						Children: make([]*Scope, 0),
+						Symbols:  make(map[string]*Symbol),
+						Uri:      currentScope.Uri,
+						Range: Range{
+							Start: Position{Line: stmt.Token.Line - 1, Character: stmt.Token.Column - 1},
+							End:   Position{Line: stmt.Block.EndToken.Line - 1, Character: stmt.Block.EndToken.Column},
+						},
+					}
+					if stmt.Block.EndToken.Type == TOKEN_EOF {
+						newScope.Range.End = Position{Line: 999999, Character: 0}
+					}
+					currentScope.AddChildScope(newScope)
+					sb.buildScope(stmt.Block.Statements, newScope)
+				} else if directiveName == ".function" || directiveName == ".pseudocommand" {
 					// Process blocks without creating new scope
 					log.Debug("buildScope: Processing block for directive '%s'", stmt.Token.Literal)
 					sb.buildScope(stmt.Block.Statements, currentScope)
@@ -0,0 +1,351 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	log "c64.nvim/internal/log"
+)
+
+// JSON Source of Truth files
+const (
+	MnemonicDataFile  = "mnemonic.json"
+	KickassDataFile   = "kickass.json"
+	C64MemoryDataFile = "c64memory.json"
+)
+
+// workspaceDataDir is the directory in a workspace whose data files override the user's
+const workspaceDataDir = ".kickass_ls"
+
+// dataFileNames are the files that are layered: built-in defaults, then the user config
+// directory, then the workspace .kickass_ls/ directory
+var dataFileNames = map[string]bool{
+	MnemonicDataFile:  true,
+	KickassDataFile:   true,
+	C64MemoryDataFile: true,
+}
+
+// dataEntryKeys identify entries of JSON arrays, so an override can replace or add single
+// mnemonics, directives, functions or constants instead of the whole list
+var dataEntryKeys = []string{"mnemonic", "directive", "name"}
+
+// dataLayers holds the sources of the data files
+var dataLayers = struct {
+	sync.RWMutex
+	embedded     fs.FS  // defaults built into the binary
+	userDir      string // ~/.config/kickass_ls
+	workspaceDir string // <workspace>/.kickass_ls
+}{}
+
+// SetEmbeddedData sets the default data files built into the binary
+func SetEmbeddedData(files fs.FS) {
+	dataLayers.Lock()
+	dataLayers.embedded = files
+	dataLayers.Unlock()
+}
+
+// setUserDataDir sets the user config directory the data files are loaded from
+func setUserDataDir(dir string) {
+	dataLayers.Lock()
+	dataLayers.userDir = dir
+	dataLayers.Unlock()
+}
+
+// setWorkspaceDataDir points the workspace layer at <root>/.kickass_ls. It reports whether
+// that directory exists.
+func setWorkspaceDataDir(root string) bool {
+	dir := filepath.Join(uriToPath(root), workspaceDataDir)
+	info, err := os.Stat(dir)
+	exists := err == nil && info.IsDir()
+
+	dataLayers.Lock()
+	dataLayers.workspaceDir = dir
+	dataLayers.Unlock()
+	return exists
+}
+
+// readDataFile reads a data file. For the JSON Source of Truth files the built-in defaults,
+// the file at path and the workspace override are merged, later layers winning; any of
+// them may be missing. Other files are read as they are.
+func readDataFile(path string) ([]byte, error) {
+	name := filepath.Base(path)
+	if !dataFileNames[name] {
+		return os.ReadFile(path)
+	}
+
+	data, sources, err := loadLayeredDataFile(name, path)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("readDataFile: %s from %v", name, sources)
+	return data, nil
+}
+
+// loadLayeredDataFile merges the layers of a data file. userPath replaces the user config
+// directory as the middle layer when it is set. It returns the merged JSON and the layers used.
+func loadLayeredDataFile(name, userPath string) ([]byte, []string, error) {
+	dataLayers.RLock()
+	embedded, userDir, workspaceDir := dataLayers.embedded, dataLayers.userDir, dataLayers.workspaceDir
+	dataLayers.RUnlock()
+
+	if userPath == "" && userDir != "" {
+		userPath = filepath.Join(userDir, name)
+	}
+
+	var merged interface{}
+	var sources []string
+	addLayer := func(source string, data []byte) error {
+		var layer interface{}
+		if err := json.Unmarshal(data, &layer); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", source, err)
+		}
+		merged = mergeDataJSON(merged, layer)
+		sources = append(sources, source)
+		return nil
+	}
+
+	if embedded != nil {
+		if data, err := fs.ReadFile(embedded, name); err == nil {
+			if err := addLayer("built-in "+name, data); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	overrides := []string{userPath}
+	if workspaceDir != "" {
+		workspacePath := filepath.Join(workspaceDir, name)
+		if userPath == "" || !sameFile(workspacePath, userPath) {
+			overrides = append(overrides, workspacePath)
+		}
+	}
+	for _, path := range overrides {
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Warn("loadLayeredDataFile: cannot read %s: %v", path, err)
+			}
+			continue
+		}
+		if err := addLayer(path, data); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(sources) == 0 {
+		return nil, nil, fmt.Errorf("%s not found (no built-in copy and none at %s)", name, userPath)
+	}
+	data, err := json.Marshal(merged)
+	return data, sources, err
+}
+
+// mergeDataJSON merges an override layer into base. Objects are merged key by key, arrays of
+// named entries (see dataEntryKeys) entry by entry; anything else is replaced.
+func mergeDataJSON(base, override interface{}) interface{} {
+	switch overrideValue := override.(type) {
+	case map[string]interface{}:
+		baseMap, ok := base.(map[string]interface{})
+		if !ok {
+			return overrideValue
+		}
+		for key, value := range overrideValue {
+			baseMap[key] = mergeDataJSON(baseMap[key], value)
+		}
+		return baseMap
+
+	case []interface{}:
+		baseList, ok := base.([]interface{})
+		if !ok {
+			return overrideValue
+		}
+		key := dataEntryKey(overrideValue)
+		if key == "" || dataEntryKey(baseList) != key {
+			return overrideValue
+		}
+		index := make(map[interface{}]int, len(baseList))
+		for i, entry := range baseList {
+			index[entry.(map[string]interface{})[key]] = i
+		}
+		for _, entry := range overrideValue {
+			id := entry.(map[string]interface{})[key]
+			if i, exists := index[id]; exists {
+				baseList[i] = mergeDataJSON(baseList[i], entry)
+			} else {
+				index[id] = len(baseList)
+				baseList = append(baseList, entry)
+			}
+		}
+		return baseList
+	}
+	return override
+}
+
+// dataEntryKey returns the key that names every entry of a list, or "" if there is none
+func dataEntryKey(list []interface{}) string {
+	if len(list) == 0 {
+		return ""
+	}
+	for _, key := range dataEntryKeys {
+		named := true
+		for _, entry := range list {
+			object, ok := entry.(map[string]interface{})
+			if !ok {
+				named = false
+				break
+			}
+			if _, ok := object[key].(string); !ok {
+				named = false
+				break
+			}
+		}
+		if named {
+			return key
+		}
+	}
+	return ""
+}
+
+// dataSnapshot holds what is loaded from the data files. A load builds a new snapshot and
+// publishes it at once, so analysis and requests running meanwhile keep a consistent one.
+type dataSnapshot struct {
+	mnemonics        []Mnemonic
+	c64MemoryMap     C64MemoryMap
+	builtinFunctions []BuiltinFunction
+	builtinConstants []BuiltinConstant
+	tokenDefs        []tokenDefinition
+}
+
+// loadedData is the published snapshot; dataUpdate serializes the loads publishing a new one
+var loadedData atomic.Pointer[dataSnapshot]
+var dataUpdate sync.Mutex
+
+// noData is returned before the first load
+var noData dataSnapshot
+
+// currentData returns the published data. Callers that read several fields keep the result,
+// so they don't mix two loads.
+func currentData() *dataSnapshot {
+	if data := loadedData.Load(); data != nil {
+		return data
+	}
+	return &noData
+}
+
+// updateData publishes a copy of the current data, changed by update
+func updateData(update func(data *dataSnapshot)) {
+	dataUpdate.Lock()
+	defer dataUpdate.Unlock()
+
+	data := *currentData()
+	update(&data)
+	loadedData.Store(&data)
+}
+
+// loadDataFiles loads all JSON Source of Truth files from their layers and rebuilds
+// everything derived from them (lexer tokens, ProcessorContext). Data that fails to load
+// keeps its previous value.
+func loadDataFiles(configDir string) {
+	dataUpdate.Lock()
+	defer dataUpdate.Unlock()
+
+	setUserDataDir(configDir)
+	mnemonicPath := filepath.Join(configDir, MnemonicDataFile)
+	c64MemoryPath := filepath.Join(configDir, C64MemoryDataFile)
+	kickassPath := filepath.Join(configDir, KickassDataFile)
+
+	// Set mnemonic.json and kickass.json paths for lexer
+	SetMnemonicJSONPath(mnemonicPath)
+	SetKickassJSONPath(kickassPath)
+
+	// Load JSON Source of Truth files in parallel, each into its own field
+	data := *currentData()
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	// Load mnemonic data
+	go func() {
+		defer wg.Done()
+		loaded, err := loadMnemonics(mnemonicPath)
+		if err != nil {
+			log.Error("Error loading mnemonics from %s: %v", mnemonicPath, err)
+			return
+		}
+		data.mnemonics = loaded
+		log.Info("Successfully loaded mnemonics from %s", mnemonicPath)
+	}()
+
+	// Load C64 memory map data
+	go func() {
+		defer wg.Done()
+		loaded, err := loadC64MemoryMap(c64MemoryPath)
+		if err != nil {
+			log.Error("Could not load C64 memory map from %s: %v", c64MemoryPath, err)
+			log.Error("Memory address hover information will be limited.")
+			return
+		}
+		data.c64MemoryMap = loaded
+		log.Info("Successfully loaded C64 memory map with %d regions from %s", len(loaded.MemoryMap.Regions), c64MemoryPath)
+	}()
+
+	// Load kickass data
+	go func() {
+		defer wg.Done()
+
+		// Load kickass directives from single file
+		functions, constants, err := LoadBuiltins(kickassPath)
+		if err != nil {
+			log.Error("Failed to load kickass builtins from %s: %v", kickassPath, err)
+			return
+		}
+		data.builtinFunctions = functions
+		data.builtinConstants = constants
+		log.Info("Successfully loaded %d built-in functions and %d built-in constants from %s", len(functions), len(constants), kickassPath)
+	}()
+
+	// Wait for all JSON files to load
+	wg.Wait()
+	log.Info("All JSON Source of Truth files loaded (user overrides from %s)", configDir)
+
+	// Initialize lexer token definitions AFTER all JSON files are loaded
+	data.tokenDefs = buildTokenDefs()
+	loadedData.Store(&data)
+
+	// Initialize ProcessorContext (used by completion and context-aware parser)
+	if err := InitializeProcessorContext(configDir); err != nil {
+		log.Error("Failed to initialize ProcessorContext: %v", err)
+		log.Error("Context-aware features (completion, parsing) will fall back to legacy mode")
+	} else {
+		log.Info("Successfully initialized ProcessorContext")
+	}
+}
+
+// reloadData handles kickass_ls/reloadData: the data files are read again from all layers
+// and every open document is re-analyzed. The result lists the layers used per file.
+func reloadData(writer *bufio.Writer) map[string]interface{} {
+	dataLayers.RLock()
+	configDir := dataLayers.userDir
+	dataLayers.RUnlock()
+
+	loadDataFiles(configDir)
+	reanalyzeOpenDocuments(writer)
+
+	files := make(map[string]interface{}, len(dataFileNames))
+	for name := range dataFileNames {
+		_, sources, err := loadLayeredDataFile(name, "")
+		if err != nil {
+			files[name] = map[string]interface{}{"error": err.Error()}
+			continue
+		}
+		files[name] = map[string]interface{}{"sources": sources}
+	}
+	log.Info("Reloaded data files")
+	return map[string]interface{}{"files": files}
+}
@@ -0,0 +1,43 @@
+package lsp
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+// loadTestData loads the data files of the repository the way the binary embeds them,
+// without user or workspace overrides
+func loadTestData(t *testing.T) {
+	t.Helper()
+	SetEmbeddedData(os.DirFS("../.."))
+	loadDataFiles(t.TempDir())
+}
+
+func TestReloadDataWhileAnalysing(t *testing.T) {
+	loadTestData(t)
+	configDir := t.TempDir()
+	source := "*=$1000\nstart:\n    lda #$00\n    sta $d020\n    jmp start\n"
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			loadDataFiles(configDir)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			if i%100 == 0 {
+				ParseDocument("file:///reload.asm", source)
+			}
+			if getOpcodeDescription("LDA") == "" || !isBuiltinName("sin") {
+				t.Error("LDA has no description while the data is reloaded")
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
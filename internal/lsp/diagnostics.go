@@ -10,10 +10,39 @@ const (
 	SeverityHint    DiagnosticSeverity = 4
 )
 
+// DiagnosticTag gives clients extra information about a diagnostic.
+type DiagnosticTag int
+
+const (
+	DiagnosticTagUnnecessary DiagnosticTag = 1 // Unused or inactive code, usually shown faded
+	DiagnosticTagDeprecated  DiagnosticTag = 2
+)
+
+// Codes of the diagnostics that have a quick fix, see handleCodeAction
+const (
+	codeBranchOutOfRange   = "branch-out-of-range"
+	codeZeroPageAddress    = "zero-page-address"   // Data: address
+	codeMagicNumber        = "magic-number"        // Data: address, description
+	codeUndefinedSymbol    = "undefined-symbol"    // Data: name
+	codeUnsupportedOperand = "unsupported-operand" // Data: mnemonic, form
+)
+
 // Diagnostic represents a diagnostic message, such as a compiler error or warning.
 type Diagnostic struct {
-	Range    Range
-	Severity DiagnosticSeverity
-	Source   string
-	Message  string
+	Range              Range
+	Severity           DiagnosticSeverity
+	Source             string
+	Message            string
+	Code               string                 // Identifies the problem independent of the message
+	Data               map[string]interface{} // Facts the quick fix for Code needs
+	Tags               []DiagnosticTag
+	RelatedInformation []DiagnosticRelatedInformation
+}
+
+// DiagnosticRelatedInformation points to another place that belongs to a diagnostic, like
+// the other side of a memory overlap.
+type DiagnosticRelatedInformation struct {
+	URI     string
+	Range   Range
+	Message string
 }
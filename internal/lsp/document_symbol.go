@@ -40,7 +40,8 @@ func generateDocumentSymbols(uri string) []DocumentSymbol {
 		return []DocumentSymbol{}
 	}
 
-	return convertScopeToDocumentSymbols(tree)
+	// Named memory blocks follow the symbols
+	return append(convertScopeToDocumentSymbols(tree), memoryBlockSymbols(uri)...)
 }
 
 // convertScopeToDocumentSymbols recursively converts a scope to document symbols
@@ -0,0 +1,578 @@
+package lsp
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 6502 status register flags
+const (
+	flagC byte = 1 << iota
+	flagZ
+	flagI
+	flagD
+	flagB
+	flagU
+	flagV
+	flagN
+)
+
+// opcodeEntry describes one opcode of the decode table
+type opcodeEntry struct {
+	Mnemonic  string // canonical name (aliases of illegal opcodes resolved)
+	Mode      string // addressing mode as named in mnemonic.json
+	Length    int
+	Cycles    int  // base cycles
+	PageCross bool // +1 cycle if the indexed access crosses a page
+}
+
+// illegalOpcodeAliases maps alternative names of undocumented opcodes to the name the
+// emulator implements
+var illegalOpcodeAliases = map[string]string{
+	"ASO": "SLO", "LSE": "SRE", "DCM": "DCP", "INS": "ISC", "ISB": "ISC",
+	"AAX": "SAX", "AXS": "SBX", "ASR": "ALR", "AAC": "ANC", "HLT": "JAM",
+	"KIL": "JAM", "DOP": "NOP", "TOP": "NOP", "SKB": "NOP", "SKW": "NOP",
+}
+
+// buildOpcodeTable builds the decode table from the opcode metadata of the processor context.
+// Documented mnemonics win over illegal aliases sharing an opcode.
+func buildOpcodeTable(ctx *ProcessorContext) *[256]*opcodeEntry {
+	table := &[256]*opcodeEntry{}
+	if ctx == nil {
+		return table
+	}
+
+	ctx.mutex.RLock()
+	defer ctx.mutex.RUnlock()
+	for _, group := range []map[string]*EnhancedMnemonicInfo{ctx.StandardMnemonics, ctx.ControlMnemonics, ctx.IllegalMnemonics} {
+		names := make([]string, 0, len(group))
+		for name := range group {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			info := group[name]
+			mnemonic := strings.ToUpper(info.Name)
+			if alias, ok := illegalOpcodeAliases[mnemonic]; ok {
+				mnemonic = alias
+			}
+			for _, mode := range info.AddressingModes {
+				opcode, err := parseInt(mode.Opcode, 16)
+				if err != nil || opcode < 0 || opcode > 0xFF || table[opcode] != nil {
+					continue
+				}
+				base := strings.TrimSuffix(strings.SplitN(mode.Cycles, "/", 2)[0], "*")
+				cycles, err := strconv.Atoi(base)
+				if err != nil {
+					continue
+				}
+				entry := &opcodeEntry{Mnemonic: mnemonic, Mode: mode.Mode, Length: mode.Length, Cycles: cycles}
+				switch mode.Mode {
+				case "Absolute,X", "Absolute,Y", "Indirect-indexed":
+					entry.PageCross = strings.HasSuffix(mode.Cycles, "*") || pageCrossingMnemonics[mnemonic]
+				}
+				table[opcode] = entry
+			}
+		}
+	}
+	return table
+}
+
+// cpu6502 is a minimal NMOS 6502 core without I/O: memory is plain RAM
+type cpu6502 struct {
+	A, X, Y, SP, P byte
+	PC             uint16
+	Cycles         int
+
+	memory [0x10000]byte
+	table  *[256]*opcodeEntry
+	reads  map[uint16]bool
+	writes map[uint16]byte // address -> value before the first write
+}
+
+// newCPU6502 creates a CPU in the usual post-reset state
+func newCPU6502(table *[256]*opcodeEntry) *cpu6502 {
+	return &cpu6502{
+		SP:     0xFF,
+		P:      flagU | flagI,
+		table:  table,
+		reads:  make(map[uint16]bool),
+		writes: make(map[uint16]byte),
+	}
+}
+
+// errCPUHalted stops execution at BRK or JAM
+type errCPUHalted struct {
+	Mnemonic string
+	PC       uint16
+}
+
+func (e *errCPUHalted) Error() string {
+	return fmt.Sprintf("%s at $%04X", e.Mnemonic, e.PC)
+}
+
+func (c *cpu6502) read(addr uint16) byte {
+	c.reads[addr] = true
+	return c.memory[addr]
+}
+
+func (c *cpu6502) write(addr uint16, value byte) {
+	if _, seen := c.writes[addr]; !seen {
+		c.writes[addr] = c.memory[addr]
+	}
+	c.memory[addr] = value
+}
+
+func (c *cpu6502) push(value byte) {
+	c.write(0x0100|uint16(c.SP), value)
+	c.SP--
+}
+
+func (c *cpu6502) pull() byte {
+	c.SP++
+	return c.read(0x0100 | uint16(c.SP))
+}
+
+func (c *cpu6502) setFlag(flag byte, on bool) {
+	if on {
+		c.P |= flag
+	} else {
+		c.P &^= flag
+	}
+}
+
+func (c *cpu6502) setNZ(value byte) {
+	c.setFlag(flagZ, value == 0)
+	c.setFlag(flagN, value&0x80 != 0)
+}
+
+// pointer reads a 16-bit pointer from the zero page, wrapping within it
+func (c *cpu6502) pointer(zp byte) uint16 {
+	return uint16(c.read(uint16(zp))) | uint16(c.read(uint16(zp+1)))<<8
+}
+
+// effectiveAddress resolves the operand address of an instruction at pc. The second result
+// reports whether an indexed access crossed a page.
+func (c *cpu6502) effectiveAddress(mode string, pc uint16) (uint16, bool) {
+	lo := c.memory[pc+1]
+	hi := c.memory[pc+2]
+	absolute := uint16(lo) | uint16(hi)<<8
+	indexed := func(base uint16, index byte) (uint16, bool) {
+		addr := base + uint16(index)
+		return addr, addr&0xFF00 != base&0xFF00
+	}
+
+	switch mode {
+	case "Immediate":
+		return pc + 1, false
+	case "Zeropage":
+		return uint16(lo), false
+	case "Zeropage,X":
+		return uint16(lo + c.X), false
+	case "Zeropage,Y":
+		return uint16(lo + c.Y), false
+	case "Absolute":
+		return absolute, false
+	case "Absolute,X":
+		return indexed(absolute, c.X)
+	case "Absolute,Y":
+		return indexed(absolute, c.Y)
+	case "Indirect":
+		// JMP ($xxFF) fetches the high byte from $xx00
+		return uint16(c.read(absolute)) | uint16(c.read(absolute&0xFF00|uint16(byte(absolute)+1)))<<8, false
+	case "Indexed-indirect":
+		return c.pointer(lo + c.X), false
+	case "Indirect-indexed":
+		return indexed(c.pointer(lo), c.Y)
+	case "Relative":
+		return pc + 2 + uint16(int8(lo)), false
+	}
+	return 0, false
+}
+
+// load reads the operand value; immediates are read without counting as a memory access
+func (c *cpu6502) load(op *opcodeEntry, addr uint16) byte {
+	switch op.Mode {
+	case "Accumulator":
+		return c.A
+	case "Immediate":
+		return c.memory[addr]
+	}
+	return c.read(addr)
+}
+
+// store writes the result of a read-modify-write instruction back to A or memory
+func (c *cpu6502) store(op *opcodeEntry, addr uint16, value byte) {
+	if op.Mode == "Accumulator" {
+		c.A = value
+		return
+	}
+	c.write(addr, value)
+}
+
+func (c *cpu6502) compare(register, value byte) {
+	c.setFlag(flagC, register >= value)
+	c.setNZ(register - value)
+}
+
+func (c *cpu6502) adc(value byte) {
+	carry := int(c.P & flagC)
+	binary := int(c.A) + int(value) + carry
+	if c.P&flagD == 0 {
+		c.setFlag(flagC, binary > 0xFF)
+		c.setFlag(flagV, (^(c.A^value))&(c.A^byte(binary))&0x80 != 0)
+		c.A = byte(binary)
+		c.setNZ(c.A)
+		return
+	}
+
+	// NMOS decimal mode: Z comes from the binary sum, N and V from the intermediate result
+	lo := int(c.A&0x0F) + int(value&0x0F) + carry
+	hi := int(c.A>>4) + int(value>>4)
+	if lo > 9 {
+		lo += 6
+	}
+	if lo > 0x0F {
+		hi++
+	}
+	c.setFlag(flagZ, byte(binary) == 0)
+	c.setFlag(flagN, hi&0x08 != 0)
+	c.setFlag(flagV, (^(c.A^value))&(c.A^byte(hi<<4))&0x80 != 0)
+	if hi > 9 {
+		hi += 6
+	}
+	c.setFlag(flagC, hi > 0x0F)
+	c.A = byte(hi<<4) | byte(lo&0x0F)
+}
+
+func (c *cpu6502) sbc(value byte) {
+	borrow := 1 - int(c.P&flagC)
+	binary := int(c.A) - int(value) - borrow
+	c.setFlag(flagC, binary >= 0)
+	c.setFlag(flagV, (c.A^value)&(c.A^byte(binary))&0x80 != 0)
+	c.setNZ(byte(binary))
+	if c.P&flagD == 0 {
+		c.A = byte(binary)
+		return
+	}
+
+	lo := int(c.A&0x0F) - int(value&0x0F) - borrow
+	hi := int(c.A>>4) - int(value>>4)
+	if lo < 0 {
+		lo -= 6
+		hi--
+	}
+	if hi < 0 {
+		hi -= 6
+	}
+	c.A = byte(hi<<4) | byte(lo&0x0F)
+}
+
+func (c *cpu6502) asl(value byte) byte {
+	c.setFlag(flagC, value&0x80 != 0)
+	value <<= 1
+	c.setNZ(value)
+	return value
+}
+
+func (c *cpu6502) lsr(value byte) byte {
+	c.setFlag(flagC, value&0x01 != 0)
+	value >>= 1
+	c.setNZ(value)
+	return value
+}
+
+func (c *cpu6502) rol(value byte) byte {
+	carry := c.P & flagC
+	c.setFlag(flagC, value&0x80 != 0)
+	value = value<<1 | carry
+	c.setNZ(value)
+	return value
+}
+
+func (c *cpu6502) ror(value byte) byte {
+	carry := (c.P & flagC) << 7
+	c.setFlag(flagC, value&0x01 != 0)
+	value = value>>1 | carry
+	c.setNZ(value)
+	return value
+}
+
+// branch takes a conditional branch: +1 cycle, +1 more if the target is on another page
+func (c *cpu6502) branch(condition bool, target uint16) {
+	if !condition {
+		return
+	}
+	c.Cycles++
+	if target&0xFF00 != c.PC&0xFF00 {
+		c.Cycles++
+	}
+	c.PC = target
+}
+
+// step executes one instruction
+func (c *cpu6502) step() error {
+	pc := c.PC
+	opcode := c.memory[pc]
+	op := c.table[opcode]
+	if op == nil {
+		return fmt.Errorf("unknown opcode $%02X at $%04X", opcode, pc)
+	}
+
+	addr, crossed := c.effectiveAddress(op.Mode, pc)
+	c.PC = pc + uint16(op.Length)
+	c.Cycles += op.Cycles
+	if crossed && op.PageCross {
+		c.Cycles++
+	}
+
+	switch op.Mnemonic {
+	// Loads and stores
+	case "LDA":
+		c.A = c.load(op, addr)
+		c.setNZ(c.A)
+	case "LDX":
+		c.X = c.load(op, addr)
+		c.setNZ(c.X)
+	case "LDY":
+		c.Y = c.load(op, addr)
+		c.setNZ(c.Y)
+	case "LAX":
+		c.A = c.load(op, addr)
+		c.X = c.A
+		c.setNZ(c.A)
+	case "STA":
+		c.write(addr, c.A)
+	case "STX":
+		c.write(addr, c.X)
+	case "STY":
+		c.write(addr, c.Y)
+	case "SAX":
+		c.write(addr, c.A&c.X)
+
+	// Transfers and stack
+	case "TAX":
+		c.X = c.A
+		c.setNZ(c.X)
+	case "TAY":
+		c.Y = c.A
+		c.setNZ(c.Y)
+	case "TXA":
+		c.A = c.X
+		c.setNZ(c.A)
+	case "TYA":
+		c.A = c.Y
+		c.setNZ(c.A)
+	case "TSX":
+		c.X = c.SP
+		c.setNZ(c.X)
+	case "TXS":
+		c.SP = c.X
+	case "PHA":
+		c.push(c.A)
+	case "PHP":
+		c.push(c.P | flagB | flagU)
+	case "PLA":
+		c.A = c.pull()
+		c.setNZ(c.A)
+	case "PLP":
+		c.P = c.pull()&^flagB | flagU
+
+	// Arithmetic and logic
+	case "ADC":
+		c.adc(c.load(op, addr))
+	case "SBC":
+		c.sbc(c.load(op, addr))
+	case "AND":
+		c.A &= c.load(op, addr)
+		c.setNZ(c.A)
+	case "ORA":
+		c.A |= c.load(op, addr)
+		c.setNZ(c.A)
+	case "EOR":
+		c.A ^= c.load(op, addr)
+		c.setNZ(c.A)
+	case "CMP":
+		c.compare(c.A, c.load(op, addr))
+	case "CPX":
+		c.compare(c.X, c.load(op, addr))
+	case "CPY":
+		c.compare(c.Y, c.load(op, addr))
+	case "BIT":
+		value := c.load(op, addr)
+		c.setFlag(flagZ, c.A&value == 0)
+		c.setFlag(flagN, value&0x80 != 0)
+		c.setFlag(flagV, value&0x40 != 0)
+	case "ANC":
+		c.A &= c.load(op, addr)
+		c.setNZ(c.A)
+		c.setFlag(flagC, c.A&0x80 != 0)
+	case "ALR":
+		c.A = c.lsr(c.A & c.load(op, addr))
+	case "SBX":
+		value := c.load(op, addr)
+		c.setFlag(flagC, c.A&c.X >= value)
+		c.X = c.A&c.X - value
+		c.setNZ(c.X)
+
+	// Increments, decrements and shifts
+	case "INC":
+		value := c.load(op, addr) + 1
+		c.store(op, addr, value)
+		c.setNZ(value)
+	case "DEC":
+		value := c.load(op, addr) - 1
+		c.store(op, addr, value)
+		c.setNZ(value)
+	case "INX":
+		c.X++
+		c.setNZ(c.X)
+	case "INY":
+		c.Y++
+		c.setNZ(c.Y)
+	case "DEX":
+		c.X--
+		c.setNZ(c.X)
+	case "DEY":
+		c.Y--
+		c.setNZ(c.Y)
+	case "ASL":
+		c.store(op, addr, c.asl(c.load(op, addr)))
+	case "LSR":
+		c.store(op, addr, c.lsr(c.load(op, addr)))
+	case "ROL":
+		c.store(op, addr, c.rol(c.load(op, addr)))
+	case "ROR":
+		c.store(op, addr, c.ror(c.load(op, addr)))
+
+	// Undocumented read-modify-write combinations
+	case "SLO":
+		value := c.asl(c.load(op, addr))
+		c.store(op, addr, value)
+		c.A |= value
+		c.setNZ(c.A)
+	case "RLA":
+		value := c.rol(c.load(op, addr))
+		c.store(op, addr, value)
+		c.A &= value
+		c.setNZ(c.A)
+	case "SRE":
+		value := c.lsr(c.load(op, addr))
+		c.store(op, addr, value)
+		c.A ^= value
+		c.setNZ(c.A)
+	case "RRA":
+		value := c.ror(c.load(op, addr))
+		c.store(op, addr, value)
+		c.adc(value)
+	case "DCP":
+		value := c.load(op, addr) - 1
+		c.store(op, addr, value)
+		c.compare(c.A, value)
+	case "ISC":
+		value := c.load(op, addr) + 1
+		c.store(op, addr, value)
+		c.sbc(value)
+
+	// Flags
+	case "CLC":
+		c.setFlag(flagC, false)
+	case "SEC":
+		c.setFlag(flagC, true)
+	case "CLI":
+		c.setFlag(flagI, false)
+	case "SEI":
+		c.setFlag(flagI, true)
+	case "CLD":
+		c.setFlag(flagD, false)
+	case "SED":
+		c.setFlag(flagD, true)
+	case "CLV":
+		c.setFlag(flagV, false)
+
+	// Branches and jumps
+	case "BCC":
+		c.branch(c.P&flagC == 0, addr)
+	case "BCS":
+		c.branch(c.P&flagC != 0, addr)
+	case "BNE":
+		c.branch(c.P&flagZ == 0, addr)
+	case "BEQ":
+		c.branch(c.P&flagZ != 0, addr)
+	case "BPL":
+		c.branch(c.P&flagN == 0, addr)
+	case "BMI":
+		c.branch(c.P&flagN != 0, addr)
+	case "BVC":
+		c.branch(c.P&flagV == 0, addr)
+	case "BVS":
+		c.branch(c.P&flagV != 0, addr)
+	case "JMP":
+		c.PC = addr
+	case "JSR":
+		returnAddr := c.PC - 1
+		c.push(byte(returnAddr >> 8))
+		c.push(byte(returnAddr))
+		c.PC = addr
+	case "RTS":
+		lo := c.pull()
+		hi := c.pull()
+		c.PC = (uint16(lo) | uint16(hi)<<8) + 1
+	case "RTI":
+		c.P = c.pull()&^flagB | flagU
+		lo := c.pull()
+		hi := c.pull()
+		c.PC = uint16(lo) | uint16(hi)<<8
+
+	case "NOP":
+		if op.Mode != "Implied" && op.Mode != "Immediate" {
+			c.read(addr)
+		}
+	case "BRK", "JAM":
+		c.PC = pc
+		return &errCPUHalted{Mnemonic: op.Mnemonic, PC: pc}
+	default:
+		c.PC = pc
+		return fmt.Errorf("%s ($%02X) at $%04X is not supported by the emulator", op.Mnemonic, opcode, pc)
+	}
+	return nil
+}
+
+// run executes from the current PC until it reaches end, leaves [start, end], halts or
+// exceeds maxCycles. Code outside the range only runs inside subroutines called from it.
+// It returns the number of executed instructions and the stop reason.
+func (c *cpu6502) run(start, end uint16, maxCycles int) (int, string) {
+	instructions := 0
+	entrySP := c.SP
+	for {
+		switch {
+		case c.PC == end:
+			return instructions, "end of selection"
+		case (c.PC < start || c.PC > end) && c.SP >= entrySP:
+			return instructions, fmt.Sprintf("PC left the selection at $%04X", c.PC)
+		case c.Cycles >= maxCycles:
+			return instructions, fmt.Sprintf("cycle limit of %d reached", maxCycles)
+		}
+		if err := c.step(); err != nil {
+			return instructions, err.Error()
+		}
+		instructions++
+	}
+}
+
+// flagString renders the status register as "NV-BDIZC", upper case for set flags
+func flagString(p byte) string {
+	const names = "NV-BDIZC"
+	var sb strings.Builder
+	for i := 0; i < 8; i++ {
+		if p&(0x80>>i) != 0 {
+			sb.WriteByte(names[i])
+		} else {
+			sb.WriteString(strings.ToLower(names[i : i+1]))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,193 @@
+package lsp
+
+import (
+	"strings"
+	"testing"
+)
+
+// newTestCPU returns a CPU with code at $1000, the PC pointing to it
+func newTestCPU(t *testing.T, code ...byte) *cpu6502 {
+	t.Helper()
+	loadTestData(t)
+	c := newCPU6502(buildOpcodeTable(GetProcessorContext()))
+	copy(c.memory[0x1000:], code)
+	c.PC = 0x1000
+	return c
+}
+
+// The expected results are those of an NMOS 6510, decimal mode included
+func TestADC(t *testing.T) {
+	tests := []struct {
+		name           string
+		a, value, p    byte
+		wantA, wantSet byte // flags among N, V, Z and C that are set afterwards
+	}{
+		{"binary", 0x50, 0x10, 0, 0x60, 0},
+		{"binary with carry", 0x01, 0x01, flagC, 0x03, 0},
+		{"binary signed overflow", 0x50, 0x50, 0, 0xa0, flagN | flagV},
+		{"binary carry and zero", 0xff, 0x01, 0, 0x00, flagZ | flagC},
+		{"binary negative overflow", 0x80, 0xff, 0, 0x7f, flagV | flagC},
+		{"decimal", 0x09, 0x01, flagD, 0x10, 0},
+		{"decimal carry, N and V from the intermediate $A5", 0x58, 0x46, flagD | flagC, 0x05, flagN | flagV | flagC},
+		{"decimal wrap keeps binary Z", 0x99, 0x01, flagD, 0x00, flagN | flagC},
+		{"decimal overflow", 0x79, 0x00, flagD | flagC, 0x80, flagN | flagV},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestCPU(t, 0x69, test.value) // adc #value
+			c.A, c.P = test.a, flagU|test.p
+			if err := c.step(); err != nil {
+				t.Fatal(err)
+			}
+			checkArithmetic(t, c, test.wantA, test.wantSet)
+		})
+	}
+}
+
+func TestSBC(t *testing.T) {
+	tests := []struct {
+		name           string
+		a, value, p    byte
+		wantA, wantSet byte
+	}{
+		{"binary", 0x05, 0x03, 0, 0x01, flagC},
+		{"binary zero", 0x05, 0x05, flagC, 0x00, flagZ | flagC},
+		{"binary borrow", 0x00, 0x01, flagC, 0xff, flagN},
+		{"binary no overflow", 0x50, 0xf0, flagC, 0x60, 0},
+		{"binary signed overflow", 0x50, 0xb0, flagC, 0xa0, flagN | flagV},
+		{"decimal", 0x46, 0x12, flagD | flagC, 0x34, flagC},
+		{"decimal half borrow", 0x40, 0x13, flagD | flagC, 0x27, flagC},
+		{"decimal with borrow in", 0x32, 0x02, flagD, 0x29, flagC},
+		{"decimal borrow", 0x12, 0x21, flagD | flagC, 0x91, flagN},
+		{"decimal double borrow", 0x21, 0x34, flagD | flagC, 0x87, flagN},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestCPU(t, 0xe9, test.value) // sbc #value
+			c.A, c.P = test.a, flagU|test.p
+			if err := c.step(); err != nil {
+				t.Fatal(err)
+			}
+			checkArithmetic(t, c, test.wantA, test.wantSet)
+		})
+	}
+}
+
+// checkArithmetic compares A and the N, V, Z and C flags
+func checkArithmetic(t *testing.T, c *cpu6502, wantA, wantSet byte) {
+	t.Helper()
+	const checked = flagN | flagV | flagZ | flagC
+	if c.A != wantA {
+		t.Errorf("A = $%02X, want $%02X", c.A, wantA)
+	}
+	if c.P&checked != wantSet {
+		t.Errorf("flags %s, want N, V, Z and C as in %s", flagString(c.P), flagString(wantSet))
+	}
+}
+
+func TestCycles(t *testing.T) {
+	tests := []struct {
+		name       string
+		at         uint16
+		code       []byte
+		setup      func(c *cpu6502)
+		wantCycles int
+		wantPC     uint16
+	}{
+		{"branch not taken", 0x1000, []byte{0xd0, 0x02}, func(c *cpu6502) { c.P |= flagZ }, 2, 0x1002},
+		{"branch taken", 0x1000, []byte{0xd0, 0x02}, nil, 3, 0x1004},
+		{"branch taken to the next page", 0x10f0, []byte{0xd0, 0x20}, nil, 4, 0x1112},
+		{"branch taken to the previous page", 0x1000, []byte{0xd0, 0xfc}, nil, 4, 0x0ffe},
+		{"absolute,X", 0x1000, []byte{0xbd, 0xfe, 0x10}, func(c *cpu6502) { c.X = 1 }, 4, 0x1003},
+		{"absolute,X crossing a page", 0x1000, []byte{0xbd, 0xff, 0x10}, func(c *cpu6502) { c.X = 1 }, 5, 0x1003},
+		{"store absolute,X crossing a page", 0x1000, []byte{0x9d, 0xff, 0x10}, func(c *cpu6502) { c.X = 1 }, 5, 0x1003},
+		{"indirect-indexed", 0x1000, []byte{0xb1, 0xfb}, func(c *cpu6502) { c.memory[0xfb], c.memory[0xfc] = 0xfe, 0x20; c.Y = 1 }, 5, 0x1002},
+		{"indirect-indexed crossing a page", 0x1000, []byte{0xb1, 0xfb}, func(c *cpu6502) { c.memory[0xfb], c.memory[0xfc] = 0xff, 0x20; c.Y = 1 }, 6, 0x1002},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestCPU(t)
+			copy(c.memory[test.at:], test.code)
+			c.PC = test.at
+			if test.setup != nil {
+				test.setup(c)
+			}
+			if err := c.step(); err != nil {
+				t.Fatal(err)
+			}
+			if c.Cycles != test.wantCycles {
+				t.Errorf("%d cycles, want %d", c.Cycles, test.wantCycles)
+			}
+			if c.PC != test.wantPC {
+				t.Errorf("PC = $%04X, want $%04X", c.PC, test.wantPC)
+			}
+		})
+	}
+}
+
+// JMP ($xxFF) takes the high byte of the target from $xx00, not from the next page
+func TestIndirectJumpPageWrap(t *testing.T) {
+	c := newTestCPU(t, 0x6c, 0xff, 0x10) // jmp ($10ff)
+	c.memory[0x10ff] = 0x34
+	c.memory[0x1000] = 0x6c // the opcode doubles as the high byte read from $1000
+	c.memory[0x1100] = 0x56
+	if err := c.step(); err != nil {
+		t.Fatal(err)
+	}
+	if c.PC != 0x6c34 {
+		t.Errorf("PC = $%04X, want $6C34", c.PC)
+	}
+	if c.Cycles != 5 {
+		t.Errorf("%d cycles, want 5", c.Cycles)
+	}
+}
+
+func TestEvaluateSelectionData(t *testing.T) {
+	loadTestData(t)
+	selection := map[string]interface{}{
+		"start": map[string]interface{}{"line": float64(1), "character": float64(0)},
+		"end":   map[string]interface{}{"line": float64(3), "character": float64(0)},
+	}
+	tests := []struct {
+		name   string
+		source string
+		a      int
+		error  string
+	}{
+		{
+			name:   "table after the selection",
+			source: "*=$1000\n    ldx #2\n    lda table,x\n    rts\ntable: .byte 5, 6, 7\n",
+			a:      7,
+		},
+		{
+			name:   "subroutine after the selection",
+			source: "*=$1000\n    jsr load\n    adc #1\n    rts\nload: lda #$41\n    rts\n",
+			a:      0x42,
+		},
+		{
+			name:   "document the assembler can't assemble",
+			source: ".macro Load() { lda table }\n    ldx #2\n    lda table,x\n    rts\nLoad()\ntable: .byte 5, 6, 7\n",
+			error:  "the data in line 6 can't be loaded",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			uri := "file:///evaluate.asm"
+			openTestDocument(t, uri, test.source)
+			result, err := evaluateSelection(map[string]interface{}{"uri": uri, "range": selection})
+			if test.error != "" {
+				if err == nil || !strings.Contains(err.Error(), test.error) {
+					t.Fatalf("error = %v, want %q", err, test.error)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			registers := result.(map[string]interface{})["registers"].(map[string]interface{})
+			if registers["a"] != test.a {
+				t.Errorf("A = %v, want $%02X", registers["a"], test.a)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package lsp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// defaultTextEncoding is the encoding .text uses until an .encoding directive
+const defaultTextEncoding = "screencode_mixed"
+
+// textEncoding maps the characters an encoding can represent to their bytes
+type textEncoding map[rune]byte
+
+// charRange maps the characters first..last to consecutive bytes starting at code
+type charRange struct {
+	first, last rune
+	code        byte
+}
+
+func newTextEncoding(ranges ...charRange) textEncoding {
+	encoding := make(textEncoding)
+	for _, r := range ranges {
+		for char := r.first; char <= r.last; char++ {
+			encoding[char] = r.code + byte(char-r.first)
+		}
+	}
+	return encoding
+}
+
+// textEncodings are Kick Assembler's text encodings. Besides ASCII, the C64 character sets
+// have the pound sign, the arrows and pi, which are written with their Unicode characters.
+var textEncodings = map[string]textEncoding{
+	"ascii": newTextEncoding(
+		charRange{' ', '~', 0x20},
+	),
+	"petscii_upper": newTextEncoding(
+		charRange{' ', ']', 0x20},
+		charRange{'a', 'z', 0x41},
+		charRange{'£', '£', 0x5C},
+		charRange{'↑', '↑', 0x5E},
+		charRange{'←', '←', 0x5F},
+		charRange{'π', 'π', 0xFF},
+	),
+	"petscii_mixed": newTextEncoding(
+		charRange{' ', ']', 0x20},
+		charRange{'a', 'z', 0x41},
+		charRange{'A', 'Z', 0xC1},
+		charRange{'£', '£', 0x5C},
+		charRange{'↑', '↑', 0x5E},
+		charRange{'←', '←', 0x5F},
+	),
+	"screencode_upper": newTextEncoding(
+		charRange{'@', ']', 0x00},
+		charRange{' ', '?', 0x20},
+		charRange{'a', 'z', 0x01},
+		charRange{'£', '£', 0x1C},
+		charRange{'↑', '↑', 0x1E},
+		charRange{'←', '←', 0x1F},
+		charRange{'π', 'π', 0x5E},
+	),
+	"screencode_mixed": newTextEncoding(
+		charRange{'@', '@', 0x00},
+		charRange{'a', 'z', 0x01},
+		charRange{'[', '[', 0x1B},
+		charRange{']', ']', 0x1D},
+		charRange{' ', '?', 0x20},
+		charRange{'A', 'Z', 0x41},
+		charRange{'£', '£', 0x1C},
+		charRange{'↑', '↑', 0x1E},
+		charRange{'←', '←', 0x1F},
+	),
+}
+
+// textEncodingNames returns the names of the encodings, sorted
+func textEncodingNames() []string {
+	names := make([]string, 0, len(textEncodings))
+	for name := range textEncodings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// encodeTextByte converts a character to its byte in a KickAssembler text encoding
+func encodeTextByte(r rune, encoding string) (byte, bool) {
+	if r < 0x20 {
+		return byte(r), true // control characters are passed through
+	}
+	table, ok := textEncodings[encoding]
+	if !ok {
+		table = textEncodings[defaultTextEncoding]
+	}
+	b, ok := table[r]
+	return b, ok
+}
+
+// textError is a problem with a string, at the index of the character in the string
+type textError struct {
+	index   int
+	message string
+}
+
+// encodeText encodes a string. In escaped strings (@"...") \$xx is a raw byte and \n, \r, \t,
+// \b, \f, \" and \\ stand for the usual characters.
+func encodeText(text string, escaped bool, encoding string) ([]byte, []textError) {
+	var bytes []byte
+	var errors []textError
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		start := i
+		r := runes[i]
+		if escaped && r == '\\' && i+1 < len(runes) {
+			i++
+			switch runes[i] {
+			case '$':
+				if i+2 < len(runes) {
+					if value, err := parseInt(string(runes[i+1:i+3]), 16); err == nil {
+						bytes = append(bytes, byte(value))
+						i += 2
+						continue
+					}
+				}
+				errors = append(errors, textError{start, "Invalid escape sequence in string"})
+				continue
+			case 'n':
+				r = '\n'
+			case 'r':
+				r = '\r'
+			case 't':
+				r = '\t'
+			case 'b':
+				r = '\b'
+			case 'f':
+				r = '\f'
+			default:
+				r = runes[i]
+			}
+		}
+		b, ok := encodeTextByte(r, encoding)
+		if !ok {
+			errors = append(errors, textError{start, fmt.Sprintf("Character '%c' can't be encoded in %s", r, encoding)})
+		}
+		bytes = append(bytes, b)
+	}
+	return bytes, errors
+}
+
+// EncodedText is a string of a .text directive with the bytes it assembles to
+type EncodedText struct {
+	Range    Range
+	Encoding string
+	Bytes    []byte
+}
+
+// encodedTextMarkdown describes the bytes of a string for hover
+func encodedTextMarkdown(text EncodedText) string {
+	var markdown strings.Builder
+	fmt.Fprintf(&markdown, "**%d bytes** in `%s`", len(text.Bytes), text.Encoding)
+	if len(text.Bytes) == 0 {
+		return markdown.String()
+	}
+	markdown.WriteString("\n\n```\n")
+	for start := 0; start < len(text.Bytes); start += 16 {
+		values := make([]string, 0, 16)
+		for _, b := range text.Bytes[start:min(start+16, len(text.Bytes))] {
+			values = append(values, fmt.Sprintf("$%02X", b))
+		}
+		markdown.WriteString(".byte " + strings.Join(values, ", ") + "\n")
+	}
+	markdown.WriteString("```")
+	return markdown.String()
+}
+
+// encodedTextHover returns the hover for a .text string at a position, empty if there is none
+func encodedTextHover(uri string, line, character int) string {
+	symbolStore.RLock()
+	context := symbolStore.contexts[uri]
+	symbolStore.RUnlock()
+	if context == nil {
+		return ""
+	}
+	position := Position{Line: line, Character: character}
+	for _, text := range context.EncodedTexts {
+		if !positionBefore(position, text.Range.Start) && positionBefore(position, text.Range.End) {
+			return encodedTextMarkdown(text)
+		}
+	}
+	return ""
+}
+
+// textBytes encodes a .text value like the assembler does: string literals, @"..." with
+// escape sequences and other values as they are written, joined with +. Unknown values have
+// no bytes.
+func (a *SemanticAnalyzer) textBytes(token Token, expr Expression) []byte {
+	switch e := expr.(type) {
+	case *StringLiteral:
+		return a.encodeLiteral(e, false)
+	case *PrefixExpression:
+		if str, ok := e.Right.(*StringLiteral); ok && e.Operator == "@" {
+			return a.encodeLiteral(str, true)
+		}
+	case *GroupedExpression:
+		return a.textBytes(token, e.Expression)
+	case *InfixExpression:
+		// Strings written in the source are encoded one by one, so hover shows each
+		if e.Operator == "+" && hasStringLiteral(e) {
+			return append(a.textBytes(token, e.Left), a.textBytes(token, e.Right)...)
+		}
+	}
+
+	value := a.evaluateValue(expr)
+	if !value.Known() {
+		return nil
+	}
+	bytes, errors := encodeText(value.text(), false, a.encoding)
+	if len(errors) > 0 {
+		a.reportTextError(token, errors[0].message)
+	}
+	return bytes
+}
+
+// encodeLiteral encodes a string literal and records its bytes for hover. Characters that
+// can't be encoded are reported where they are.
+func (a *SemanticAnalyzer) encodeLiteral(str *StringLiteral, escaped bool) []byte {
+	bytes, errors := encodeText(str.Value, escaped, a.encoding)
+
+	start := Position{Line: str.Token.Line - 1, Character: str.Token.Column - 1}
+	text := EncodedText{
+		Range:    Range{Start: start, End: Position{Line: start.Line, Character: start.Character + len(str.Token.Literal)}},
+		Encoding: a.encoding,
+		Bytes:    bytes,
+	}
+	if index, recorded := a.context.encodedTexts[start]; recorded {
+		// Repeated by a loop or macro, the last time counts
+		a.context.EncodedTexts[index] = text
+	} else {
+		a.context.encodedTexts[start] = len(a.context.EncodedTexts)
+		a.context.EncodedTexts = append(a.context.EncodedTexts, text)
+	}
+
+	runes := []rune(str.Value)
+	for _, err := range errors {
+		// Columns count bytes, the string starts after the quote
+		column := str.Token.Column + 1 + len(string(runes[:err.index]))
+		a.reportTextError(Token{Type: str.Token.Type, Line: str.Token.Line, Column: column}, err.message)
+	}
+	return bytes
+}
+
+// reportTextError reports a problem with a string once, even if a loop or macro encodes it
+// again
+func (a *SemanticAnalyzer) reportTextError(token Token, message string) {
+	position := Position{Line: token.Line, Character: token.Column}
+	if a.checkedTexts[position] {
+		return
+	}
+	a.checkedTexts[position] = true
+	a.addError(token, "%s", message)
+}
+
+// hasStringLiteral reports whether a concatenation contains a string written in the source
+func hasStringLiteral(expr Expression) bool {
+	switch e := expr.(type) {
+	case *StringLiteral:
+		return true
+	case *PrefixExpression:
+		_, ok := e.Right.(*StringLiteral)
+		return ok && e.Operator == "@"
+	case *GroupedExpression:
+		return hasStringLiteral(e.Expression)
+	case *InfixExpression:
+		return e.Operator == "+" && (hasStringLiteral(e.Left) || hasStringLiteral(e.Right))
+	}
+	return false
+}
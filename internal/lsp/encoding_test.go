@@ -0,0 +1,92 @@
+package lsp
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The expected bytes are those Kick Assembler assembles for .text in each encoding
+func TestEncodeText(t *testing.T) {
+	tests := []struct {
+		encoding string
+		text     string
+		escaped  bool
+		want     []byte
+	}{
+		{"screencode_mixed", "Hello @[]!", false, []byte{0x48, 0x05, 0x0c, 0x0c, 0x0f, 0x20, 0x00, 0x1b, 0x1d, 0x21}},
+		{"screencode_mixed", "az AZ 09?", false, []byte{0x01, 0x1a, 0x20, 0x41, 0x5a, 0x20, 0x30, 0x39, 0x3f}},
+		{"screencode_upper", "Hello @[]!", false, []byte{0x08, 0x05, 0x0c, 0x0c, 0x0f, 0x20, 0x00, 0x1b, 0x1d, 0x21}},
+		{"screencode_upper", "£↑←π", false, []byte{0x1c, 0x1e, 0x1f, 0x5e}},
+		{"petscii_upper", "Hello @[]!", false, []byte{0x48, 0x45, 0x4c, 0x4c, 0x4f, 0x20, 0x40, 0x5b, 0x5d, 0x21}},
+		{"petscii_upper", "£↑←π", false, []byte{0x5c, 0x5e, 0x5f, 0xff}},
+		{"petscii_mixed", "Hello @[]!", false, []byte{0xc8, 0x45, 0x4c, 0x4c, 0x4f, 0x20, 0x40, 0x5b, 0x5d, 0x21}},
+		{"petscii_mixed", "AZaz", false, []byte{0xc1, 0xda, 0x41, 0x5a}},
+		{"ascii", "Hello @[]!~", false, []byte{0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x20, 0x40, 0x5b, 0x5d, 0x21, 0x7e}},
+
+		// @"..." strings: \$xx is a raw byte in any encoding, the other escapes are characters
+		{"screencode_mixed", `\$ff\$00a`, true, []byte{0xff, 0x00, 0x01}},
+		{"petscii_mixed", `\$41A`, true, []byte{0x41, 0xc1}},
+		{"screencode_mixed", `a\nb\rc`, true, []byte{0x01, 0x0a, 0x02, 0x0d, 0x03}},
+		{"screencode_mixed", `\"x\"`, true, []byte{0x22, 0x18, 0x22}},
+		{"petscii_upper", `\\`, true, []byte{0x5c}},
+
+		// Without @ a backslash is just a character
+		{"petscii_upper", `\$41`, false, []byte{0x5c, 0x24, 0x34, 0x31}},
+	}
+	for _, test := range tests {
+		t.Run(test.encoding+" "+test.text, func(t *testing.T) {
+			got, errors := encodeText(test.text, test.escaped, test.encoding)
+			if len(errors) > 0 {
+				t.Fatalf("unexpected errors: %v", errors)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("got  % x\nwant % x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEncodeTextErrors(t *testing.T) {
+	tests := []struct {
+		encoding string
+		text     string
+		escaped  bool
+		index    int
+		message  string
+	}{
+		{"ascii", "café", false, 3, "Character 'é' can't be encoded in ascii"},
+		{"screencode_mixed", "a\\b", false, 1, "Character '\\' can't be encoded in screencode_mixed"},
+		{"petscii_mixed", "π", false, 0, "Character 'π' can't be encoded in petscii_mixed"},
+		{"screencode_mixed", `ab\$g0`, true, 2, "Invalid escape sequence in string"},
+		{"screencode_mixed", `\$4`, true, 0, "Invalid escape sequence in string"},
+	}
+	for _, test := range tests {
+		t.Run(test.encoding+" "+test.text, func(t *testing.T) {
+			_, errors := encodeText(test.text, test.escaped, test.encoding)
+			if len(errors) != 1 {
+				t.Fatalf("got %d errors, want 1: %v", len(errors), errors)
+			}
+			if errors[0].index != test.index || errors[0].message != test.message {
+				t.Errorf("got %q at %d, want %q at %d", errors[0].message, errors[0].index, test.message, test.index)
+			}
+		})
+	}
+}
+
+func TestAssembleTextEncodings(t *testing.T) {
+	loadTestData(t)
+	source := "*=$1000\n.text \"Ab\"\n.encoding \"petscii_mixed\"\n.text \"Ab\"\n.encoding \"ascii\"\n.text @\"Ab\\$00\"\n"
+	want := []byte{0x00, 0x10, 0x41, 0x02, 0xc1, 0x42, 0x41, 0x62, 0x00}
+
+	program, errors := Assemble("test.asm", source)
+	if len(errors) > 0 {
+		t.Fatalf("assembly failed: %v", errors)
+	}
+	prg, err := program.PRG()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(prg, want) {
+		t.Errorf("got  % x\nwant % x", prg, want)
+	}
+}
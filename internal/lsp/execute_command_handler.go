@@ -0,0 +1,382 @@
+package lsp
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "c64.nvim/internal/log"
+)
+
+// Commands served by workspace/executeCommand
+const (
+	CommandEvaluateSelection  = "kickass.evaluateSelection"
+	CommandShowConfiguration  = "kickass.showConfiguration"
+	CommandShowMacroExpansion = "kickass.showMacroExpansion"
+	CommandSelectBuildVariant = "kickass.selectBuildVariant"
+)
+
+// executeCommands lists the commands advertised in the executeCommandProvider capability
+var executeCommands = []string{CommandEvaluateSelection, CommandShowConfiguration, CommandShowMacroExpansion, CommandSelectBuildVariant}
+
+// defaultEvaluationCycleLimit stops runaway loops in an evaluated selection
+const defaultEvaluationCycleLimit = 1000000
+
+// handleExecuteCommand handles the workspace/executeCommand LSP request. Commands that change
+// how documents are analyzed publish the new diagnostics through writer.
+func handleExecuteCommand(writer *bufio.Writer, params map[string]interface{}) (interface{}, error) {
+	command, _ := params["command"].(string)
+	arguments, _ := params["arguments"].([]interface{})
+
+	switch command {
+	case CommandEvaluateSelection:
+		if len(arguments) == 0 {
+			return nil, fmt.Errorf("%s expects an argument object", command)
+		}
+		args, ok := arguments[0].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s expects an argument object", command)
+		}
+		return evaluateSelection(args)
+	case CommandShowConfiguration:
+		// The file may be given as a URI string or as {"uri": ...}
+		var uri string
+		if len(arguments) > 0 {
+			switch arg := arguments[0].(type) {
+			case string:
+				uri = arg
+			case map[string]interface{}:
+				uri, _ = arg["uri"].(string)
+			}
+		}
+		if uri == "" {
+			return nil, fmt.Errorf("%s expects the URI of a file", command)
+		}
+		return showConfiguration(uri), nil
+	case CommandShowMacroExpansion:
+		if len(arguments) == 0 {
+			return nil, fmt.Errorf("%s expects an argument object", command)
+		}
+		args, ok := arguments[0].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s expects an argument object", command)
+		}
+		return showMacroExpansion(args)
+	case CommandSelectBuildVariant:
+		return selectBuildVariant(writer, arguments)
+	}
+	return nil, fmt.Errorf("unknown command %q", command)
+}
+
+// evaluateSelection loads the document into the emulator, assembles the instructions in the
+// selected lines with the addresses from the analysis, runs them and reports the final CPU
+// state.
+//
+// Arguments: {"uri", "range", "registers": {"a","x","y","sp","p"}, "memory": {"$d020": 0,
+// "$1000": [1, 2, 3]}, "maxCycles"}. Values may be numbers or "$hex", "%bin", decimal strings.
+func evaluateSelection(args map[string]interface{}) (interface{}, error) {
+	uri, _ := args["uri"].(string)
+	selection, ok := args["range"].(map[string]interface{})
+	if uri == "" || !ok {
+		return nil, fmt.Errorf("uri and range are required")
+	}
+	start, okStart := changePosition(selection, "start")
+	end, okEnd := changePosition(selection, "end")
+	if !okStart || !okEnd {
+		return nil, fmt.Errorf("invalid range")
+	}
+	// A selection ending at the start of a line doesn't include that line
+	lastLine := end.Line
+	if end.Character == 0 && end.Line > start.Line {
+		lastLine--
+	}
+
+	context, err := analyzedContext(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	table := buildOpcodeTable(GetProcessorContext())
+	cpu := newCPU6502(table)
+
+	// Assemble the rest of the document first so subroutines and tables the selection uses
+	// are in memory
+	if err := loadDocumentMemory(cpu, uri, context); err != nil {
+		return nil, err
+	}
+	if err := applyEvaluationState(cpu, args); err != nil {
+		return nil, err
+	}
+
+	// Lay the selection out from the address of its first instruction. Targets inside the
+	// selection are relocated in case the analyzer's addresses have gaps.
+	var selected []InstructionTiming
+	relocated := make(map[int64]int64)
+	first, next := int64(-1), int64(-1)
+	for _, timing := range context.Timings {
+		if timing.Line < start.Line || timing.Line > lastLine {
+			continue
+		}
+		if timing.PC < 0 {
+			return nil, fmt.Errorf("line %d: %s is inside a macro or function template and has no address", timing.Line+1, timing.Mnemonic)
+		}
+		if first < 0 {
+			first, next = timing.PC, timing.PC
+		}
+		relocated[timing.PC] = next
+		selected = append(selected, timing)
+		next += int64(timing.Length)
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no instructions in the selection")
+	}
+	if next >= 0x10000 {
+		return nil, fmt.Errorf("selection runs up to $FFFF")
+	}
+
+	// The selection itself overrides user-supplied memory
+	for _, timing := range selected {
+		timing.PC = relocated[timing.PC]
+		if target, ok := relocated[timing.Operand]; ok && (timing.Mode == "Relative" || timing.Mnemonic == "JMP" || timing.Mnemonic == "JSR") {
+			timing.Operand = target
+		}
+		bytes, err := assembleInstruction(&timing)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", timing.Line+1, err)
+		}
+		for i, b := range bytes {
+			cpu.memory[uint16(timing.PC)+uint16(i)] = b
+		}
+	}
+
+	maxCycles := defaultEvaluationCycleLimit
+	if value, ok := parseStateValue(args["maxCycles"]); ok && value > 0 {
+		maxCycles = int(value)
+	}
+
+	cpu.PC = uint16(first)
+	instructions, reason := cpu.run(uint16(first), uint16(next), maxCycles)
+	log.Debug("evaluateSelection: %s lines %d-%d: %d instructions, %d cycles (%s)",
+		uri, start.Line+1, lastLine+1, instructions, cpu.Cycles, reason)
+
+	return evaluationResult(cpu, instructions, reason), nil
+}
+
+// loadDocumentMemory puts the code and data of a document into the emulator's memory. If the
+// assembler can't assemble the document, only its instructions are loaded from the analysis,
+// which is an error for a document with data directives.
+func loadDocumentMemory(cpu *cpu6502, uri string, context *AnalysisContext) error {
+	documentStore.RLock()
+	text := documentStore.documents[uri]
+	documentStore.RUnlock()
+
+	program, errors := Assemble(uriToPath(uri), text)
+	if len(errors) == 0 {
+		for _, block := range program.Blocks {
+			for i, b := range block.Bytes {
+				cpu.memory[uint16(block.Start+int64(i))] = b
+			}
+		}
+		return nil
+	}
+	log.Debug("loadDocumentMemory: %s doesn't assemble, loading its instructions: %v", uri, errors[0])
+
+	for _, segment := range context.Segments {
+		for _, block := range segment.Blocks {
+			for _, e := range block.emitted {
+				if emittingDirectives[strings.ToLower(e.token.Literal)] {
+					return fmt.Errorf("the data in line %d can't be loaded, the document doesn't assemble: %s",
+						e.token.Line, errors[0].Message)
+				}
+			}
+		}
+	}
+	for _, timing := range context.Timings {
+		if timing.PC < 0 {
+			continue
+		}
+		if bytes, err := assembleInstruction(&timing); err == nil {
+			for i, b := range bytes {
+				cpu.memory[uint16(timing.PC)+uint16(i)] = b
+			}
+		}
+	}
+	return nil
+}
+
+// analyzedContext returns the analysis of an open document, analyzing it if that hasn't
+// happened yet
+func analyzedContext(uri string) (*AnalysisContext, error) {
+	symbolStore.RLock()
+	context := symbolStore.contexts[uri]
+	symbolStore.RUnlock()
+	if context != nil {
+		return context, nil
+	}
+
+	documentStore.RLock()
+	text, exists := documentStore.documents[uri]
+	documentStore.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("document %s is not open", uri)
+	}
+	_, context, _ = ParseDocument(uri, text)
+	if context == nil {
+		return nil, fmt.Errorf("document %s could not be analyzed", uri)
+	}
+	return context, nil
+}
+
+// assembleInstruction encodes a recorded instruction from its opcode and resolved operand
+func assembleInstruction(timing *InstructionTiming) ([]byte, error) {
+	if timing.Opcode < 0 || timing.Length == 0 {
+		return nil, fmt.Errorf("%s has no opcode for %s addressing", timing.Mnemonic, timing.Mode)
+	}
+
+	bytes := []byte{byte(timing.Opcode)}
+	if timing.Length == 1 {
+		return bytes, nil
+	}
+	if timing.Operand < 0 {
+		return nil, fmt.Errorf("operand of %s could not be resolved", timing.Mnemonic)
+	}
+
+	operand := timing.Operand
+	if timing.Mode == "Relative" {
+		operand = timing.Operand - (timing.PC + 2)
+		if operand < -128 || operand > 127 {
+			return nil, fmt.Errorf("branch target $%04X is out of range", timing.Operand)
+		}
+	}
+	bytes = append(bytes, byte(operand))
+	if timing.Length == 3 {
+		bytes = append(bytes, byte(operand>>8))
+	}
+	return bytes, nil
+}
+
+// applyEvaluationState loads the "registers" and "memory" arguments into the CPU
+func applyEvaluationState(cpu *cpu6502, args map[string]interface{}) error {
+	if registers, ok := args["registers"].(map[string]interface{}); ok {
+		targets := map[string]*byte{"a": &cpu.A, "x": &cpu.X, "y": &cpu.Y, "sp": &cpu.SP, "p": &cpu.P}
+		for name, raw := range registers {
+			target, known := targets[strings.ToLower(name)]
+			if !known {
+				return fmt.Errorf("unknown register %q", name)
+			}
+			value, ok := parseStateValue(raw)
+			if !ok || value < 0 || value > 0xFF {
+				return fmt.Errorf("invalid value for register %s", name)
+			}
+			*target = byte(value)
+		}
+		cpu.P |= flagU
+	}
+
+	if memory, ok := args["memory"].(map[string]interface{}); ok {
+		for key, raw := range memory {
+			addr, ok := parseStateValue(key)
+			if !ok || addr < 0 || addr > 0xFFFF {
+				return fmt.Errorf("invalid memory address %q", key)
+			}
+			values, isList := raw.([]interface{})
+			if !isList {
+				values = []interface{}{raw}
+			}
+			for i, rawValue := range values {
+				value, ok := parseStateValue(rawValue)
+				if !ok || value < 0 || value > 0xFF {
+					return fmt.Errorf("invalid byte at %s+%d", key, i)
+				}
+				cpu.memory[uint16(addr)+uint16(i)] = byte(value)
+			}
+		}
+	}
+	return nil
+}
+
+// parseStateValue reads a number given as JSON number or as "$ff", "%1010", "0xff" or "255"
+func parseStateValue(raw interface{}) (int64, bool) {
+	switch value := raw.(type) {
+	case float64:
+		return int64(value), true
+	case string:
+		value = strings.TrimSpace(value)
+		var parsed int64
+		var err error
+		switch {
+		case strings.HasPrefix(value, "$"):
+			parsed, err = parseInt(value[1:], 16)
+		case strings.HasPrefix(value, "%"):
+			parsed, err = parseInt(value[1:], 2)
+		case strings.HasPrefix(strings.ToLower(value), "0x"):
+			parsed, err = parseInt(value[2:], 16)
+		default:
+			parsed, err = parseInt(value, 10)
+		}
+		return parsed, err == nil
+	}
+	return 0, false
+}
+
+// evaluationResult reports the final CPU state, the memory it wrote and read, and a summary
+func evaluationResult(cpu *cpu6502, instructions int, reason string) map[string]interface{} {
+	written := make([]int, 0, len(cpu.writes))
+	for addr := range cpu.writes {
+		written = append(written, int(addr))
+	}
+	sort.Ints(written)
+	read := make([]int, 0, len(cpu.reads))
+	for addr := range cpu.reads {
+		read = append(read, int(addr))
+	}
+	sort.Ints(read)
+
+	var summary strings.Builder
+	fmt.Fprintf(&summary, "A=$%02X X=$%02X Y=$%02X SP=$%02X P=$%02X [%s]\n",
+		cpu.A, cpu.X, cpu.Y, cpu.SP, cpu.P, flagString(cpu.P))
+	fmt.Fprintf(&summary, "%d cycles, %d instructions (%s)", cpu.Cycles, instructions, reason)
+
+	memory := make([]interface{}, 0, len(written))
+	for _, addr := range written {
+		before, after := cpu.writes[uint16(addr)], cpu.memory[addr]
+		memory = append(memory, map[string]interface{}{
+			"address": addr,
+			"before":  int(before),
+			"after":   int(after),
+		})
+		fmt.Fprintf(&summary, "\n$%04X: $%02X -> $%02X", addr, before, after)
+	}
+
+	return map[string]interface{}{
+		"registers": map[string]interface{}{
+			"a":  int(cpu.A),
+			"x":  int(cpu.X),
+			"y":  int(cpu.Y),
+			"sp": int(cpu.SP),
+			"p":  int(cpu.P),
+			"pc": int(cpu.PC),
+		},
+		"flags":        flagString(cpu.P),
+		"cycles":       cpu.Cycles,
+		"instructions": instructions,
+		"stopReason":   reason,
+		"memory":       memory,
+		"reads":        read,
+		"summary":      summary.String(),
+	}
+}
+
+// showConfiguration returns the effective configuration for a file together with the
+// settings layers it was built from, lowest first
+func showConfiguration(uri string) interface{} {
+	config, sources := resolveDocumentConfig(uri)
+	log.Debug("showConfiguration: %s from %v", uri, sources)
+	return map[string]interface{}{
+		"uri":           uri,
+		"profile":       config.Profile,
+		"sources":       sources,
+		"configuration": config,
+	}
+}
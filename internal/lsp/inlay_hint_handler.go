@@ -0,0 +1,153 @@
+package lsp
+
+import (
+	"fmt"
+	"strings"
+
+	log "c64.nvim/internal/log"
+)
+
+// handleInlayHint handles the textDocument/inlayHint LSP request. Every instruction gets
+// its cycle count and the running total since the last label, every label its address.
+func handleInlayHint(params map[string]interface{}) []interface{} {
+	textDocument, ok := params["textDocument"].(map[string]interface{})
+	if !ok {
+		log.Error("Invalid textDocument in inlayHint request")
+		return nil
+	}
+	uri, ok := textDocument["uri"].(string)
+	if !ok {
+		log.Error("Invalid URI in inlayHint request")
+		return nil
+	}
+
+	config := GetDocumentConfig(uri)
+	if !config.CycleHints.Enabled && !(config.AssemblerSymbols.Enabled && config.AssemblerSymbols.AddressHints) {
+		return []interface{}{}
+	}
+
+	startLine, endLine := 0, -1
+	if hintRange, ok := params["range"].(map[string]interface{}); ok {
+		if start, ok := changePosition(hintRange, "start"); ok {
+			startLine = start.Line
+		}
+		if end, ok := changePosition(hintRange, "end"); ok {
+			endLine = end.Line
+		}
+	}
+
+	documentStore.RLock()
+	text, exists := documentStore.documents[uri]
+	documentStore.RUnlock()
+	symbolStore.RLock()
+	context := symbolStore.contexts[uri]
+	symbolStore.RUnlock()
+	if !exists || context == nil {
+		return []interface{}{}
+	}
+	lines := strings.Split(text, "\n")
+
+	hints := []interface{}{}
+	if config.AssemblerSymbols.Enabled && config.AssemblerSymbols.AddressHints {
+		hints = append(hints, labelAddressHints(uri, text, lines, context, startLine, endLine)...)
+	}
+	if !config.CycleHints.Enabled {
+		return hints
+	}
+
+	totalMin, totalMax := 0, 0
+	for i := range context.Timings {
+		timing := &context.Timings[i]
+		if timing.StartsBlock {
+			totalMin, totalMax = 0, 0
+		}
+		totalMin += timing.MinCycles
+		totalMax += timing.MaxCycles
+
+		if timing.Line < startLine || (endLine >= 0 && timing.Line > endLine) || timing.Line >= len(lines) {
+			continue
+		}
+
+		label := timing.cycleLabel() + "c"
+		if config.CycleHints.ShowRunningTotal {
+			label += fmt.Sprintf("  Σ%s", formatCycles(totalMin, totalMax))
+		}
+
+		// Place the hint after the operand, in front of a trailing comment
+		line := lines[timing.Line]
+		codeEnd := len(line)
+		if commentStart := findCommentStart(line); commentStart >= 0 {
+			codeEnd = commentStart
+		}
+		codeEnd = len(strings.TrimRight(line[:codeEnd], " \t\r"))
+
+		hints = append(hints, map[string]interface{}{
+			"position": Position{
+				Line:      timing.Line,
+				Character: utf8ToUTF16Offset(text, timing.Line, codeEnd),
+			},
+			"label":       label,
+			"paddingLeft": true,
+			"tooltip": map[string]interface{}{
+				"kind":  "markdown",
+				"value": timing.timingDescription(),
+			},
+		})
+	}
+
+	log.Debug("inlayHint: %d hints for %s", len(hints), uri)
+	return hints
+}
+
+// labelAddressHints shows the address of every label behind its definition. Addresses from
+// the last build are preferred over the ones computed by the analyzer.
+func labelAddressHints(uri, text string, lines []string, context *AnalysisContext, startLine, endLine int) []interface{} {
+	symbols := loadAssemblerSymbols(uri)
+
+	hints := []interface{}{}
+	for name, symbol := range context.DefinedLabels {
+		line := symbol.Position.Line
+		if symbol.Kind != Label || isLaterIteration(name) || context.inMacroExpansion(name) || line < startLine || (endLine >= 0 && line > endLine) || line >= len(lines) {
+			continue
+		}
+
+		address := symbol.Address
+		tooltip := "Address computed by the language server"
+		if symbols != nil {
+			if built, found := symbols.lookup(name); found {
+				address = built
+				tooltip = fmt.Sprintf("Address from `%s` (last build)", symbols.Name())
+				if built != symbol.Address {
+					tooltip += fmt.Sprintf(", the language server computed $%04X", symbol.Address)
+				}
+			}
+		}
+
+		// Place the hint right after the label and its colon
+		content := lines[line]
+		labelEnd := symbol.Position.Character
+		if labelEnd > len(content) {
+			continue
+		}
+		if offset := strings.Index(content[labelEnd:], normalizeLabel(symbol.Name)); offset >= 0 {
+			labelEnd += offset + len(normalizeLabel(symbol.Name))
+		}
+		if labelEnd < len(content) && content[labelEnd] == ':' {
+			labelEnd++
+		}
+
+		hints = append(hints, map[string]interface{}{
+			"position": Position{
+				Line:      line,
+				Character: utf8ToUTF16Offset(text, line, labelEnd),
+			},
+			"label":       fmt.Sprintf("$%04X", address),
+			"paddingLeft": true,
+			"tooltip": map[string]interface{}{
+				"kind":  "markdown",
+				"value": tooltip,
+			},
+		})
+	}
+	return hints
+}
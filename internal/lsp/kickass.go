@@ -2,7 +2,6 @@ package lsp
 
 import (
 	"encoding/json"
-	"os"
 	"path/filepath"
 
 	"c64.nvim/internal/log"
@@ -19,7 +18,7 @@ func LoadKickassDirectives(workspaceRoot string) ([]KickassDirective, error) {
 	jsonPath := filepath.Join(workspaceRoot, "kickass.json")
 	log.Debug("Loading kickass directives from %s", jsonPath)
 
-	file, err := os.ReadFile(jsonPath)
+	file, err := readDataFile(jsonPath)
 	if err != nil {
 		return nil, err
 	}
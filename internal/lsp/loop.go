@@ -0,0 +1,333 @@
+package lsp
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// maxListedIterations limits the addresses listed when hovering a label inside a loop or macro
+const maxListedIterations = 8
+
+// laterIterationPattern matches the label namespace of a loop iteration after the first, loop[3]
+var laterIterationPattern = regexp.MustCompile(`\[[1-9][0-9]*\]`)
+
+// loopLabelReferencePattern matches a label of a loop iteration in the source: loop[2].label
+var loopLabelReferencePattern = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*(\[[0-9]+\])+(\.[A-Za-z_][A-Za-z0-9_]*(\[[0-9]+\])*)+`)
+
+// isLoopDirective reports whether a directive is a .for or .while loop
+func isLoopDirective(node *DirectiveStatement) bool {
+	directive := strings.ToLower(node.Token.Literal)
+	return directive == ".for" || directive == ".while"
+}
+
+// isLaterIteration reports whether a qualified label name belongs to a loop iteration after
+// the first. Features showing one address per definition use the first iteration.
+func isLaterIteration(qualifiedName string) bool {
+	return laterIterationPattern.MatchString(qualifiedName)
+}
+
+// loopNamespace is the label namespace of one iteration of a loop: loop[2] for a loop labeled
+// loop, @12[2] for an unlabeled loop in line 12 (its labels can't be referenced from outside)
+func (a *SemanticAnalyzer) loopNamespace(node *DirectiveStatement, iteration int) string {
+	name := a.loopLabels[node]
+	if name == "" {
+		name = fmt.Sprintf("@%d", node.Token.Line)
+	}
+	return a.context.getQualifiedLabelName(fmt.Sprintf("%s[%d]", normalizeLabel(name), iteration))
+}
+
+// runLoop runs the body of a .for or .while loop once per iteration, in Pass 1 to place its
+// code and labels and in Pass 3 to check it. Every iteration has its own label namespace so
+// references in the body see the labels of their own iteration, and the loop[2].label of a
+// labeled loop can be used after it. A loop whose condition isn't known runs once.
+func (a *SemanticAnalyzer) runLoop(node *DirectiveStatement, isPass1 bool, runBody func()) {
+	var condition Expression
+	var steps []Expression
+	savedVariables := make(map[string]*Symbol)
+
+	if header, ok := node.Value.(*ForExpression); ok {
+		condition, steps = header.Condition, header.Step
+		for _, init := range header.Init {
+			assignment, isAssignment := init.(*InfixExpression)
+			if !isAssignment || assignment.Operator != "=" {
+				a.evaluateEffect(init, isPass1)
+				continue
+			}
+			variable, ok := assignment.Left.(*Identifier)
+			if !ok {
+				continue
+			}
+
+			// The loop variable only exists inside the loop
+			symbol := &Symbol{
+				Name:     variable.Value,
+				Kind:     Variable,
+				Position: Position{Line: variable.Token.Line - 1, Character: variable.Token.Column - 1},
+			}
+			value := a.evaluateValue(assignment.Right)
+			if isPass1 {
+				a.reportValueError(value)
+			}
+			a.setSymbolValue(symbol, value)
+
+			qualifiedName := a.context.getQualifiedLabelName(normalizeLabel(variable.Value))
+			if _, saved := savedVariables[qualifiedName]; !saved {
+				savedVariables[qualifiedName] = a.context.DefinedLabels[qualifiedName]
+			}
+			a.context.DefinedLabels[qualifiedName] = symbol
+		}
+	} else {
+		condition = node.Value
+	}
+
+	diagnosticsStart := len(a.diagnostics)
+	timingsEnd := -1
+	limit := a.config.AnalysisLimits.MaxLoopIterations
+
+	for iteration := 0; ; iteration++ {
+		if a.shouldStop(node) {
+			break
+		}
+
+		running, known := true, true
+		if condition != nil {
+			value := a.evaluateValue(condition)
+			if isPass1 {
+				a.reportValueError(value)
+			}
+			switch value.Kind {
+			case ValueBoolean:
+				running = value.Boolean
+			case ValueNumber:
+				running = value.Number != 0
+			case ValueUnknown, ValueInvalid:
+				known = false
+			default:
+				if isPass1 {
+					a.addError(node.Token, "%s condition must be a Boolean, got %s", strings.ToLower(node.Token.Literal), value.TypeName())
+				}
+				running = false
+			}
+		}
+		if !running || (!known && iteration > 0) {
+			break
+		}
+		if limit > 0 && iteration >= limit {
+			if isPass1 {
+				a.addWarning(node.Token, "Loop stopped after %d iterations (analysisLimits.maxLoopIterations), addresses after it may be wrong", limit)
+			}
+			break
+		}
+
+		a.context.NamespaceStack = append(a.context.NamespaceStack, a.context.CurrentNamespace)
+		a.context.CurrentNamespace = a.loopNamespace(node, iteration)
+		runBody()
+		a.context.CurrentNamespace = a.context.NamespaceStack[len(a.context.NamespaceStack)-1]
+		a.context.NamespaceStack = a.context.NamespaceStack[:len(a.context.NamespaceStack)-1]
+
+		// Cycle timings are per source line, the first iteration stands for all of them
+		if timingsEnd < 0 {
+			timingsEnd = len(a.context.Timings)
+		}
+		a.context.Timings = a.context.Timings[:timingsEnd]
+
+		if !known {
+			break
+		}
+		for _, step := range steps {
+			a.evaluateEffect(step, isPass1)
+		}
+	}
+
+	for qualifiedName, saved := range savedVariables {
+		if saved != nil {
+			a.context.DefinedLabels[qualifiedName] = saved
+		} else {
+			delete(a.context.DefinedLabels, qualifiedName)
+		}
+	}
+
+	// A problem in the body is reported once, not once per iteration
+	a.diagnostics = append(a.diagnostics[:diagnosticsStart], uniqueDiagnostics(a.diagnostics[diagnosticsStart:])...)
+}
+
+// uniqueDiagnostics drops repeated diagnostics, keeping the first of each
+func uniqueDiagnostics(diagnostics []Diagnostic) []Diagnostic {
+	type diagnosticKey struct {
+		Range    Range
+		Severity DiagnosticSeverity
+		Message  string
+	}
+	seen := make(map[diagnosticKey]bool, len(diagnostics))
+	unique := make([]Diagnostic, 0, len(diagnostics))
+	for _, diagnostic := range diagnostics {
+		key := diagnosticKey{diagnostic.Range, diagnostic.Severity, diagnostic.Message}
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, diagnostic)
+		}
+	}
+	return unique
+}
+
+// loopLabelName returns the qualified name of a label of a loop iteration, loop[2].label. The
+// index may be any expression with a known value.
+func (a *SemanticAnalyzer) loopLabelName(expr Expression) (string, bool) {
+	switch e := expr.(type) {
+	case *Identifier:
+		return normalizeLabel(e.Value), true
+	case *IndexExpression:
+		name, ok := a.loopLabelName(e.Left)
+		if !ok {
+			return "", false
+		}
+		index, ok := a.evaluateValue(e.Index).Int()
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf("%s[%d]", name, index), true
+	case *InfixExpression:
+		if e.Operator != "." {
+			return "", false
+		}
+		left, ok := a.loopLabelName(e.Left)
+		if !ok || !strings.Contains(left, "[") {
+			return "", false
+		}
+		right, ok := a.loopLabelName(e.Right)
+		if !ok {
+			return "", false
+		}
+		return left + "." + right, true
+	}
+	return "", false
+}
+
+// loopLabelAt resolves the loop[2].label reference at an LSP position (UTF-16 character), nil
+// if there is none
+func loopLabelAt(uri, line string, char int) (string, *Symbol) {
+	char = utf16ToUTF8Offset(line, char)
+	var reference string
+	for _, match := range loopLabelReferencePattern.FindAllStringIndex(line, -1) {
+		if char >= match[0] && char < match[1] {
+			reference = line[match[0]:match[1]]
+			break
+		}
+	}
+	if reference == "" {
+		return "", nil
+	}
+
+	symbolStore.RLock()
+	context := symbolStore.contexts[uri]
+	symbolStore.RUnlock()
+	if context == nil {
+		return "", nil
+	}
+	if symbol, found := context.lookupLabel(normalizeLabel(reference)); found {
+		return reference, symbol
+	}
+	return "", nil
+}
+
+// loopLabelHover describes the loop[2].label reference at a position for hover
+func loopLabelHover(uri, line string, char int) string {
+	reference, symbol := loopLabelAt(uri, line, char)
+	if symbol == nil {
+		return ""
+	}
+	return fmt.Sprintf("(%s) **%s**\n\n**Address:** `$%04X`", symbol.Kind.String(), reference, symbol.Address)
+}
+
+// repeatedLabelMarkdown lists the addresses a label inside a loop gets in each iteration, or
+// a label inside a macro in each expansion
+func repeatedLabelMarkdown(uri string, symbol *Symbol) string {
+	symbolStore.RLock()
+	context := symbolStore.contexts[uri]
+	symbolStore.RUnlock()
+	if context == nil || symbol == nil || (symbol.Scope != nil && symbol.Scope.Uri != "" && symbol.Scope.Uri != uri) {
+		return ""
+	}
+
+	var addresses []int64
+	expanded := false
+	for qualifiedName, candidate := range context.DefinedLabels {
+		inMacro := context.inMacroExpansion(qualifiedName)
+		if (strings.Contains(qualifiedName, "[") || inMacro) && candidate.Kind == symbol.Kind && candidate.Position == symbol.Position &&
+			normalizeLabel(candidate.Name) == normalizeLabel(symbol.Name) {
+			addresses = append(addresses, candidate.Address)
+			expanded = expanded || inMacro
+		}
+	}
+	// A label of a macro has no address of its own, one expansion is worth listing
+	if len(addresses) == 0 || (len(addresses) == 1 && !expanded) {
+		return ""
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i] < addresses[j] })
+
+	listed := make([]string, 0, maxListedIterations+1)
+	for i, address := range addresses {
+		if i == maxListedIterations {
+			listed = append(listed, "...")
+			break
+		}
+		listed = append(listed, fmt.Sprintf("`$%04X`", address))
+	}
+	heading := "Iterations"
+	if expanded {
+		heading = "Expansions"
+	}
+	return fmt.Sprintf("\n\n**%s:** %d (%s)", heading, len(addresses), strings.Join(listed, ", "))
+}
+
+// loopLabelPath splits a loop[2].inner[1].label reference into the names of its loops and
+// label, and the index expressions in it
+func loopLabelPath(expr Expression) ([]string, []Expression, bool) {
+	switch e := expr.(type) {
+	case *Identifier:
+		return []string{normalizeLabel(e.Value)}, nil, true
+	case *IndexExpression:
+		path, indexes, ok := loopLabelPath(e.Left)
+		return path, append(indexes, e.Index), ok
+	case *InfixExpression:
+		if e.Operator != "." {
+			return nil, nil, false
+		}
+		left, leftIndexes, ok := loopLabelPath(e.Left)
+		if !ok || len(leftIndexes) == 0 {
+			return nil, nil, false
+		}
+		right, rightIndexes, ok := loopLabelPath(e.Right)
+		if !ok {
+			return nil, nil, false
+		}
+		return append(left, right...), append(leftIndexes, rightIndexes...), true
+	}
+	return nil, nil, false
+}
+
+// findLoopLabels finds the labels a loop[2].inner[1].label reference uses: the labels of
+// its loops and the label in the body of the innermost one, searching the loops visible from
+// this scope. It returns nil if the reference doesn't resolve.
+func (s *Scope) findLoopLabels(path []string) []*Symbol {
+	for scope := s; scope != nil; scope = scope.Parent {
+		var symbols []*Symbol
+		loop := scope
+		for _, name := range path[:len(path)-1] {
+			if symbol, ok := loop.Symbols[name]; ok {
+				symbols = append(symbols, symbol)
+			}
+			if loop = loop.FindNamespace(name); loop == nil {
+				break
+			}
+		}
+		if loop != nil {
+			if symbol, ok := loop.Symbols[path[len(path)-1]]; ok {
+				return append(symbols, symbol)
+			}
+		}
+	}
+	return nil
+}
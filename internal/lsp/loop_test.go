@@ -0,0 +1,65 @@
+package lsp
+
+import "testing"
+
+func TestLoops(t *testing.T) {
+	runSegmentTests(t, []segmentTest{
+		{
+			name: ".for with its own variable and a multi-byte body",
+			source: `*=$1000
+loop: .for (var x = 0; x < 3; x++) {
+entry: lda #x
+    .word entry
+}
+after: jmp loop[1].entry
+`,
+			labels: map[string]int64{"loop[0].entry": 0x1000, "loop[1].entry": 0x1004, "loop[2].entry": 0x1008, "after": 0x100C},
+		},
+		{
+			name: ".while",
+			source: `*=$1000
+.var n = 0
+.while (n < 4) {
+    nop
+    .eval n++
+}
+after: rts
+`,
+			labels: map[string]int64{"after": 0x1004},
+		},
+		{
+			name:   "iteration limit",
+			source: "*=$1000\n.while (true) {\n    nop\n}\nafter: rts\n",
+			labels: map[string]int64{"after": 0x1000 + 10000},
+			errors: []string{"Loop stopped after 10000 iterations"},
+		},
+	}, nil)
+}
+
+func TestLoopLabelAt(t *testing.T) {
+	loadTestData(t)
+	uri := "file:///loop.asm"
+	source := "*=$1000\nloop: .for (var x = 0; x < 3; x++) {\nentry: nop\n}\n/* Zähler */ jmp loop[2].entry\n"
+	openTestDocument(t, uri, source)
+	line := "/* Zähler */ jmp loop[2].entry"
+
+	// Characters are UTF-16 code units, the ä is one of them and two bytes
+	tests := []struct {
+		char      int
+		reference string
+	}{
+		{16, ""},
+		{17, "loop[2].entry"},
+		{29, "loop[2].entry"},
+		{30, ""},
+	}
+	for _, test := range tests {
+		reference, symbol := loopLabelAt(uri, line, test.char)
+		if reference != test.reference {
+			t.Errorf("character %d: reference %q, want %q", test.char, reference, test.reference)
+		}
+		if reference != "" && symbol.Address != 0x1002 {
+			t.Errorf("character %d: address $%04X, want $1002", test.char, symbol.Address)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package lsp
+
+import (
+	"fmt"
+	"strings"
+
+	log "c64.nvim/internal/log"
+)
+
+// MacroExpansion is one expansion of a macro call, made in Pass 1
+type MacroExpansion struct {
+	Macro      *MacroDefinition
+	Call       Position        // Macro name of the call, in the document or the body of Parent's macro
+	Namespace  string          // Label namespace of the expansion
+	Parameters []*Symbol       // Parameters bound to the arguments of the call
+	Arguments  []Expression    // Arguments of the call
+	Start      int64           // Address of the first byte
+	End        int64           // Address after the last byte
+	Parent     *MacroExpansion // Expansion the call was made in, nil for calls in the document
+	Addresses  map[int]int64   // Address of the first statement in each line of the macro body
+}
+
+// recordAddress remembers the address a line of the macro body starts at in this expansion
+func (e *MacroExpansion) recordAddress(line int, pc int64) {
+	if _, recorded := e.Addresses[line]; !recorded {
+		e.Addresses[line] = pc
+	}
+}
+
+// macroArgument is a macro argument that couldn't be evaluated in Pass 1, usually a label
+// further down
+type macroArgument struct {
+	parameter *Symbol
+	value     Expression
+	namespace string // Namespace of the call
+}
+
+// lookupMacro finds a macro by name, in the current namespace and the ones around it first
+func (ctx *AnalysisContext) lookupMacro(name string) *MacroDefinition {
+	for namespace := ctx.CurrentNamespace; namespace != ""; namespace = parentNamespace(namespace) {
+		if macro, found := ctx.MacroDefinitions[namespace+"."+name]; found {
+			return macro
+		}
+	}
+	return ctx.MacroDefinitions[name]
+}
+
+// inMacroExpansion reports whether a qualified name was defined in a macro expansion. Labels
+// of a macro body have one address per expansion, so features showing one address skip them.
+func (ctx *AnalysisContext) inMacroExpansion(qualifiedName string) bool {
+	for dot := strings.LastIndex(qualifiedName, "."); dot > 0; dot = strings.LastIndex(qualifiedName[:dot], ".") {
+		if _, found := ctx.expansions[qualifiedName[:dot]]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// collectMacroDefinitions registers the macros of the document before Pass 1, since a macro
+// can be called above its definition
+func (a *SemanticAnalyzer) collectMacroDefinitions(statements []Statement, namespace string) {
+	for _, statement := range statements {
+		node, ok := statement.(*DirectiveStatement)
+		if !ok || node == nil || node.Block == nil {
+			continue
+		}
+		switch strings.ToLower(node.Token.Literal) {
+		case ".macro":
+			if node.Name == nil {
+				continue
+			}
+			name := node.Name.Value
+			if namespace != "" {
+				name = namespace + "." + name
+			}
+			a.context.MacroDefinitions[name] = a.newMacroDefinition(node)
+		case ".function", ".pseudocommand":
+			// Templates of their own, macros can't be defined in them
+		case ".namespace":
+			nested := namespace
+			if node.Name != nil {
+				nested = node.Name.Value
+				if namespace != "" {
+					nested = namespace + "." + node.Name.Value
+				}
+			}
+			a.collectMacroDefinitions(node.Block.Statements, nested)
+		default:
+			a.collectMacroDefinitions(node.Block.Statements, namespace)
+		}
+	}
+}
+
+// newMacroDefinition describes a .macro directive for expansion
+func (a *SemanticAnalyzer) newMacroDefinition(node *DirectiveStatement) *MacroDefinition {
+	macro := &MacroDefinition{
+		Name:       node.Name.Value,
+		Body:       node.Block.Statements,
+		Definition: node,
+		SourceLine: node.Block.Token.Line - 1,
+	}
+	if a.scope != nil {
+		macro.URI = a.scope.Uri
+	}
+	for _, parameter := range node.Parameters {
+		if parameter != nil {
+			macro.Parameters = append(macro.Parameters, parameter.Value)
+		}
+	}
+	for _, statement := range node.Block.Statements {
+		if label, ok := statement.(*LabelStatement); ok && label.Name != nil {
+			macro.LocalLabels = append(macro.LocalLabels, label.Name.Value)
+		}
+	}
+
+	// The body runs from behind the opening brace up to the closing one
+	endLine, endColumn := len(a.documentLines)-1, -1
+	if node.Block.EndToken.Type != TOKEN_EOF && node.Block.EndToken.Line > 0 {
+		endLine, endColumn = node.Block.EndToken.Line-1, node.Block.EndToken.Column-1
+	}
+	var body []string
+	for line := macro.SourceLine; line >= 0 && line <= endLine && line < len(a.documentLines); line++ {
+		text := a.documentLines[line]
+		if line == endLine && endColumn >= 0 && endColumn <= len(text) {
+			text = text[:endColumn]
+		}
+		if line == macro.SourceLine {
+			if start := node.Block.Token.Column; start <= len(text) {
+				text = text[start:]
+			} else {
+				text = ""
+			}
+		}
+		body = append(body, strings.TrimRight(text, "\r"))
+	}
+	macro.Source = strings.Join(body, "\n")
+	return macro
+}
+
+// expandMacroCall runs the body of a called macro in Pass 1, so the code it emits moves the
+// program counter. The parameters are bound to the arguments, and every expansion has its
+// own label namespace: the label in front of the call, or @line for an unlabeled call.
+func (a *SemanticAnalyzer) expandMacroCall(node *ExpressionStatement, label string) {
+	call, ok := node.Expression.(*CallExpression)
+	if !ok {
+		return
+	}
+	ident, ok := call.Function.(*Identifier)
+	if !ok {
+		return
+	}
+	macro := a.context.lookupMacro(ident.Value)
+	if macro == nil {
+		return
+	}
+
+	depth := 0
+	for outer := a.expansion; outer != nil; outer = outer.Parent {
+		depth++
+	}
+	if limit := a.config.AnalysisLimits.MaxNestingDepth; limit > 0 && depth >= limit {
+		a.addWarning(node.Token, "Macro '%s' is nested deeper than %d levels and not expanded (analysisLimits.maxNestingDepth), addresses after it may be wrong", macro.Name, limit)
+		return
+	}
+
+	name := normalizeLabel(label)
+	if name == "" {
+		name = fmt.Sprintf("@%d", node.Token.Line)
+	}
+	expansion := &MacroExpansion{
+		Macro:     macro,
+		Call:      Position{Line: node.Token.Line - 1, Character: node.Token.Column - 1},
+		Namespace: a.context.getQualifiedLabelName(name),
+		Arguments: call.Arguments,
+		Start:     a.context.CurrentPC,
+		Parent:    a.expansion,
+		Addresses: make(map[int]int64),
+	}
+
+	// Arguments are evaluated where the macro is called
+	for i, parameter := range macro.Definition.Parameters {
+		if parameter == nil {
+			continue
+		}
+		symbol := &Symbol{
+			Name:     parameter.Value,
+			Kind:     Constant,
+			Position: Position{Line: parameter.Token.Line - 1, Character: parameter.Token.Column - 1},
+		}
+		value := unknownValue()
+		if i < len(call.Arguments) {
+			value = a.evaluateValue(call.Arguments[i])
+			a.reportValueError(value)
+			if !value.Known() {
+				a.pendingArguments = append(a.pendingArguments, macroArgument{
+					parameter: symbol,
+					value:     call.Arguments[i],
+					namespace: a.context.CurrentNamespace,
+				})
+			}
+		}
+		a.setSymbolValue(symbol, value)
+		expansion.Parameters = append(expansion.Parameters, symbol)
+	}
+
+	a.context.MacroExpansions = append(a.context.MacroExpansions, expansion)
+	a.context.expansions[expansion.Namespace] = expansion
+	macro.UsageCount++
+
+	diagnosticsStart := len(a.diagnostics)
+	referencesStart := len(a.context.ForwardRefs)
+	timingsEnd := len(a.context.Timings)
+
+	a.context.NamespaceStack = append(a.context.NamespaceStack, a.context.CurrentNamespace)
+	a.context.CurrentNamespace = expansion.Namespace
+	for _, parameter := range expansion.Parameters {
+		a.context.DefinedLabels[a.context.getQualifiedLabelName(normalizeLabel(parameter.Name))] = parameter
+	}
+	a.expansion = expansion
+	a.pass1AddressCalculation(macro.Body)
+	a.expansion = expansion.Parent
+	a.context.CurrentNamespace = a.context.NamespaceStack[len(a.context.NamespaceStack)-1]
+	a.context.NamespaceStack = a.context.NamespaceStack[:len(a.context.NamespaceStack)-1]
+
+	expansion.End = a.context.CurrentPC
+	a.pendingTimingBlock = true
+	log.Debug("expandMacroCall: %s at line %d expands to $%04X-$%04X", macro.Name, node.Token.Line, expansion.Start, expansion.End)
+
+	// Cycle timings are shown on the macro body itself, not once per expansion
+	a.context.Timings = a.context.Timings[:timingsEnd]
+
+	if a.scope != nil && macro.URI != a.scope.Uri {
+		// Problems in an imported macro are reported in its own file
+		a.diagnostics = a.diagnostics[:diagnosticsStart]
+		a.context.ForwardRefs = a.context.ForwardRefs[:referencesStart]
+		return
+	}
+	// A problem in the body is reported once, not once per expansion
+	a.diagnostics = append(a.diagnostics[:diagnosticsStart], uniqueDiagnostics(a.diagnostics[diagnosticsStart:])...)
+}
+
+// resolveMacroArguments evaluates the macro arguments that referred to labels further down,
+// now that Pass 1 has placed every label
+func (a *SemanticAnalyzer) resolveMacroArguments() {
+	savedNamespace := a.context.CurrentNamespace
+	for _, argument := range a.pendingArguments {
+		a.context.CurrentNamespace = argument.namespace
+		if value := a.evaluateValue(argument.value); value.Known() {
+			a.setSymbolValue(argument.parameter, value)
+		}
+	}
+	a.context.CurrentNamespace = savedNamespace
+}
+
+// showMacroExpansion returns the source the macro call in a line expands to, with the
+// parameters replaced by the arguments, nested macro calls expanded and the address of
+// every line. The first expansion is shown for a call that is expanded several times.
+//
+// Arguments: {"uri", "position"}.
+func showMacroExpansion(args map[string]interface{}) (interface{}, error) {
+	uri, _ := args["uri"].(string)
+	position, ok := changePosition(args, "position")
+	if uri == "" || !ok {
+		return nil, fmt.Errorf("uri and position are required")
+	}
+	context, err := analyzedContext(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	var expansion *MacroExpansion
+	for _, candidate := range context.MacroExpansions {
+		inDocument := candidate.Parent == nil || candidate.Parent.Macro.URI == uri
+		if inDocument && candidate.Call.Line == position.Line {
+			expansion = candidate
+			break
+		}
+	}
+	if expansion == nil {
+		return nil, fmt.Errorf("no macro call in line %d", position.Line+1)
+	}
+
+	var lines []string
+	renderMacroExpansion(context, expansion, nil, "", &lines)
+	log.Debug("showMacroExpansion: %s at line %d, %d lines", expansion.Macro.Name, position.Line+1, len(lines))
+
+	// The call is in a line of the document, its position is in bytes
+	documentStore.RLock()
+	text := documentStore.documents[uri]
+	documentStore.RUnlock()
+	call := expansion.Call
+
+	return map[string]interface{}{
+		"macro": expansion.Macro.Name,
+		"range": Range{
+			Start: Position{Line: call.Line, Character: utf8ToUTF16Offset(text, call.Line, call.Character)},
+			End:   Position{Line: call.Line, Character: utf8ToUTF16Offset(text, call.Line, call.Character+len(expansion.Macro.Name))},
+		},
+		"start": expansion.Start,
+		"end":   expansion.End,
+		"text":  strings.Join(lines, "\n") + "\n",
+	}, nil
+}
+
+// renderMacroExpansion appends the lines of an expansion: a comment naming the call and the
+// addresses it covers, then the macro body with the arguments in place. The arguments of a
+// call in another macro's body use that expansion's substitutions.
+func renderMacroExpansion(context *AnalysisContext, expansion *MacroExpansion, outer map[string]string, indent string, lines *[]string) {
+	macro := expansion.Macro
+	arguments := make([]string, len(expansion.Arguments))
+	for i, argument := range expansion.Arguments {
+		arguments[i] = substituteMacroParameters(expressionSource(argument), outer)
+	}
+	if expansion.End > expansion.Start {
+		*lines = append(*lines, fmt.Sprintf("%s// %s(%s) at $%04X-$%04X, %d bytes", indent, macro.Name,
+			strings.Join(arguments, ", "), expansion.Start, expansion.End-1, expansion.End-expansion.Start))
+	} else {
+		*lines = append(*lines, fmt.Sprintf("%s// %s(%s) at $%04X, no bytes", indent, macro.Name,
+			strings.Join(arguments, ", "), expansion.Start))
+	}
+
+	substitutions := make(map[string]string)
+	for i, parameter := range macro.Parameters {
+		if i >= len(arguments) {
+			continue
+		}
+		// An argument keeps its meaning next to the operators of the body
+		substitutions[parameter] = arguments[i]
+		if infix, ok := expansion.Arguments[i].(*InfixExpression); ok && infix.Operator != "." && infix.Right != nil {
+			substitutions[parameter] = "(" + arguments[i] + ")"
+		}
+	}
+
+	body := strings.Split(macro.Source, "\n")
+	first, last := 0, len(body)-1
+	for first <= last && strings.TrimSpace(body[first]) == "" {
+		first++
+	}
+	for last >= first && strings.TrimSpace(body[last]) == "" {
+		last--
+	}
+	margin := -1
+	for _, line := range body[first : last+1] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if width := len(line) - len(strings.TrimLeft(line, " \t")); margin < 0 || width < margin {
+			margin = width
+		}
+	}
+
+	for i := first; i <= last; i++ {
+		line := body[i]
+		if margin > 0 && len(line) >= margin {
+			line = line[margin:]
+		}
+		line = substituteMacroParameters(line, substitutions)
+		sourceLine := macro.SourceLine + i
+
+		if nested := nestedMacroExpansion(context, expansion, sourceLine); nested != nil {
+			renderMacroExpansion(context, nested, substitutions, indent+line[:len(line)-len(strings.TrimLeft(line, " \t"))], lines)
+			continue
+		}
+		address, known := expansion.Addresses[sourceLine]
+		if !known || strings.TrimSpace(line) == "" {
+			*lines = append(*lines, strings.TrimRight(indent+line, " \t"))
+			continue
+		}
+		*lines = append(*lines, fmt.Sprintf("%-39s // $%04X", indent+line, address))
+	}
+}
+
+// nestedMacroExpansion finds the expansion of a macro called in a line of another expansion
+func nestedMacroExpansion(context *AnalysisContext, parent *MacroExpansion, line int) *MacroExpansion {
+	for _, expansion := range context.MacroExpansions {
+		if expansion.Parent == parent && expansion.Call.Line == line {
+			return expansion
+		}
+	}
+	return nil
+}
+
+// substituteMacroParameters replaces the macro parameters in a line of a macro body by the
+// arguments of the call. Only names are replaced, not the words in numbers, strings,
+// comments and qualified names.
+func substituteMacroParameters(line string, substitutions map[string]string) string {
+	if len(substitutions) == 0 {
+		return line
+	}
+	var result strings.Builder
+	copied := 0
+	lexer := NewContextAwareLexer(line, GetProcessorContext())
+	for token := lexer.NextToken(); token.Type != TOKEN_EOF; token = lexer.NextToken() {
+		argument, isParameter := substitutions[token.Literal]
+		start := token.Column - 1
+		if token.Type != TOKEN_IDENTIFIER || !isParameter || start < copied || (start > 0 && line[start-1] == '.') {
+			continue
+		}
+		result.WriteString(line[copied:start])
+		result.WriteString(argument)
+		copied = start + len(token.Literal)
+	}
+	result.WriteString(line[copied:])
+	return result.String()
+}
@@ -0,0 +1,80 @@
+package lsp
+
+import "testing"
+
+func TestMacroExpansion(t *testing.T) {
+	wait := `.macro Wait(n) {
+    ldx #n
+l:  dex
+    bne l
+}
+`
+	runSegmentTests(t, []segmentTest{
+		{
+			name:   "calls move the program counter",
+			source: "*=$1000\n" + wait + "first: Wait(5)\nsecond: Wait(10)\nafter: rts\n",
+			labels: map[string]int64{"first": 0x1000, "second": 0x1005, "after": 0x100A},
+		},
+		{
+			name:   "every expansion has its own labels",
+			source: "*=$1000\n" + wait + "first: Wait(5)\nsecond: Wait(10)\n",
+			labels: map[string]int64{"first.l": 0x1002, "second.l": 0x1007},
+		},
+		{
+			name:   "unlabeled calls",
+			source: "*=$1000\n" + wait + "    Wait(5)\n    Wait(10)\nafter: rts\n",
+			labels: map[string]int64{"after": 0x100A},
+		},
+		{
+			name:   "nesting limit",
+			source: "*=$1000\n.macro Again() {\n    nop\n    Again()\n}\n    Again()\n",
+			errors: []string{"Macro 'Again' is nested deeper than"},
+		},
+	}, nil)
+}
+
+func TestShowMacroExpansion(t *testing.T) {
+	loadTestData(t)
+	uri := "file:///macro.asm"
+	source := `*=$1000
+.const size = 4
+.macro Fill(value, count) {
+    lda #value      // value
+    ldx #count
+l:  sta $0400,x
+    Inner(count)
+}
+.macro Inner(n) {
+    ldy #n
+    dex
+    bne l
+}
+/* Zähler */ Fill(<table, size+1)
+table: .byte 0
+`
+	openTestDocument(t, uri, source)
+	result, err := showMacroExpansion(map[string]interface{}{
+		"uri":      uri,
+		"position": map[string]interface{}{"line": float64(13), "character": float64(0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expansion := result.(map[string]interface{})
+	text := `// Fill(<table, size + 1) at $1000-$100B, 12 bytes
+    lda #<table      // value           // $1000
+    ldx #(size + 1)                     // $1002
+l:  sta $0400,x                         // $1004
+    // Inner((size + 1)) at $1007-$100B, 5 bytes
+    ldy #(size + 1)                     // $1007
+    dex                                 // $1009
+    bne l                               // $100A
+`
+	if expansion["text"] != text {
+		t.Errorf("text =\n%s\nwant\n%s", expansion["text"], text)
+	}
+	want := Range{Start: Position{Line: 13, Character: 13}, End: Position{Line: 13, Character: 17}}
+	if expansion["range"] != want {
+		t.Errorf("range = %v, want %v", expansion["range"], want)
+	}
+}
@@ -0,0 +1,181 @@
+package lsp
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// emission is a range of bytes a statement assembles to
+type emission struct {
+	start int64
+	end   int64 // First address after the bytes
+	token Token // The statement, or the call in the document of the macro it was expanded from
+}
+
+// emittingDirectives are the directives that assemble to bytes
+var emittingDirectives = map[string]bool{
+	".byte":   true,
+	".byt":    true,
+	".word":   true,
+	".wo":     true,
+	".dword":  true,
+	".text":   true,
+	".tx":     true,
+	".fill":   true,
+	".import": true,
+}
+
+// recordEmission records the bytes from start to the program counter as assembled by a
+// statement
+func (a *SemanticAnalyzer) recordEmission(token Token, start int64) {
+	// Code of a macro belongs to the call in the document
+	for expansion := a.expansion; expansion != nil; expansion = expansion.Parent {
+		if expansion.Parent == nil {
+			token = Token{Literal: expansion.Macro.Name, Line: expansion.Call.Line + 1, Column: expansion.Call.Character + 1}
+		}
+	}
+	a.addEmission(emission{start: start, end: a.context.CurrentPC, token: token})
+}
+
+// addEmission adds bytes to the current memory block. Templates and virtual segments don't
+// assemble bytes.
+func (a *SemanticAnalyzer) addEmission(e emission) {
+	block := a.context.currentBlock
+	if a.inMacroOrFunction || block == nil || e.end <= e.start || a.context.currentSegment.Virtual {
+		return
+	}
+
+	// Loops and macros repeat statements, consecutive bytes of one statement are one range
+	if n := len(block.emitted); n > 0 && block.emitted[n-1].end == e.start && block.emitted[n-1].token == e.token {
+		block.emitted[n-1].end = e.end
+		return
+	}
+	block.emitted = append(block.emitted, e)
+}
+
+// importData runs .import binary, c64 and text: the file's bytes take space, without the load
+// address for c64 and limited by the optional offset and length
+func (a *SemanticAnalyzer) importData(importType string, filename *StringLiteral, arguments []Expression) {
+	path, found := resolveImportPath(a.documentURI(), filename.Value)
+	if !found {
+		a.addError(filename.Token, "Cannot find imported file '%s'", filename.Value)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		a.addError(filename.Token, "Cannot read imported file '%s': %v", filename.Value, err)
+		return
+	}
+
+	size := info.Size()
+	if importType == "c64" {
+		size = max(size-2, 0)
+	}
+	if len(arguments) > 0 {
+		offset, ok := a.evaluateValue(arguments[0]).Int()
+		if !ok {
+			return
+		}
+		if offset < 0 || offset > size {
+			a.addError(filename.Token, "Offset %d is outside of '%s', which has %d bytes", offset, filename.Value, size)
+			return
+		}
+		size -= offset
+	}
+	if len(arguments) > 1 {
+		length, ok := a.evaluateValue(arguments[1]).Int()
+		if !ok {
+			return
+		}
+		if length < 0 || length > size {
+			a.addError(filename.Token, "Length %d is more than the %d bytes of '%s' after the offset", length, size, filename.Value)
+			return
+		}
+		size = length
+	}
+	a.context.CurrentPC += size
+}
+
+// placedEmission is an emission with the block and segment it was assembled in
+type placedEmission struct {
+	emission
+	block   *SegmentBlock
+	segment *Segment
+}
+
+// checkMemoryOverlaps reports bytes that two memory blocks both assemble to. Each side gets
+// an error that points to the other one. Blocks of a segment with allowOverlap may overlap
+// each other.
+func (a *SemanticAnalyzer) checkMemoryOverlaps() {
+	var emissions []placedEmission
+	for _, segment := range a.context.Segments {
+		for _, block := range segment.Blocks {
+			for _, e := range block.emitted {
+				emissions = append(emissions, placedEmission{emission: e, block: block, segment: segment})
+			}
+		}
+	}
+	sort.SliceStable(emissions, func(i, j int) bool {
+		return emissions[i].start < emissions[j].start
+	})
+
+	// Each pair of blocks is reported once, at the first bytes they overlap at
+	reported := make(map[[2]*SegmentBlock]bool)
+	var active []placedEmission
+	for _, current := range emissions {
+		kept := active[:0]
+		for _, other := range active {
+			if other.end > current.start {
+				kept = append(kept, other)
+			}
+		}
+		active = kept
+
+		for _, other := range active {
+			if other.block == current.block || (other.segment == current.segment && current.segment.AllowOverlap) {
+				continue
+			}
+			if reported[[2]*SegmentBlock{other.block, current.block}] || reported[[2]*SegmentBlock{current.block, other.block}] {
+				continue
+			}
+			reported[[2]*SegmentBlock{other.block, current.block}] = true
+			a.reportOverlap(other, current)
+		}
+		active = append(active, current)
+	}
+}
+
+// reportOverlap adds an error on both sides of an overlap
+func (a *SemanticAnalyzer) reportOverlap(first, second placedEmission) {
+	start, end := max(first.start, second.start), min(first.end, second.end)
+	addresses := fmt.Sprintf("$%04X", start)
+	if end-start > 1 {
+		addresses = fmt.Sprintf("$%04X-$%04X", start, end-1)
+	}
+
+	for _, side := range [][2]placedEmission{{first, second}, {second, first}} {
+		here, other := side[0], side[1]
+		message := fmt.Sprintf("Memory overlap: %s is also assembled in line %d", addresses, other.token.Line)
+		if here.segment != other.segment {
+			message = fmt.Sprintf("Memory overlap: %s is also assembled in line %d, in segment '%s'", addresses, other.token.Line, other.segment.Name)
+		}
+		a.diagnostics = append(a.diagnostics, Diagnostic{
+			Range:    tokenRange(here.token),
+			Severity: SeverityError,
+			Source:   "enhanced-analyzer",
+			Message:  message,
+			RelatedInformation: []DiagnosticRelatedInformation{{
+				URI:     a.documentURI(),
+				Range:   tokenRange(other.token),
+				Message: fmt.Sprintf("%s is also assembled here", addresses),
+			}},
+		})
+	}
+}
+
+// tokenRange returns the range of a token in the document
+func tokenRange(token Token) Range {
+	start := Position{Line: token.Line - 1, Character: token.Column - 1}
+	return Range{Start: start, End: Position{Line: start.Line, Character: start.Character + max(len(token.Literal), 1)}}
+}
@@ -0,0 +1,171 @@
+package lsp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemoryOverlaps(t *testing.T) {
+	loadTestData(t)
+	tests := []struct {
+		name   string
+		source string
+		want   []string // Messages of the overlap errors, in the order of their lines
+	}{
+		{
+			name:   "blocks without overlap",
+			source: "*=$1000\n    nop\n*=$1001\n    rts\n",
+		},
+		{
+			name:   "two blocks",
+			source: "*=$1000\n    jmp $1000\n*=$1001\n    rts\n",
+			want: []string{
+				"Memory overlap: $1001 is also assembled in line 4",
+				"Memory overlap: $1001 is also assembled in line 2",
+			},
+		},
+		{
+			name:   "a range of bytes",
+			source: "*=$1000\n.fill 8, 0\n*=$1004\n.word 1, 2, 3\n",
+			want: []string{
+				"Memory overlap: $1004-$1007 is also assembled in line 4",
+				"Memory overlap: $1004-$1007 is also assembled in line 2",
+			},
+		},
+		{
+			name:   "segments",
+			source: ".segmentdef Code [start=$1000]\n.segment Code\n    nop\n.segment Default\n*=$1000\n    rts\n",
+			want: []string{
+				"Memory overlap: $1000 is also assembled in line 6, in segment 'Default'",
+				"Memory overlap: $1000 is also assembled in line 3, in segment 'Code'",
+			},
+		},
+		{
+			name:   "macro code is reported at the call",
+			source: ".macro Clear() {\n    lda #0\n}\n*=$1000\n    Clear()\n*=$1000\n    nop\n",
+			want: []string{
+				"Memory overlap: $1000 is also assembled in line 7",
+				"Memory overlap: $1000 is also assembled in line 5",
+			},
+		},
+		{
+			name:   "a pair of blocks is reported once",
+			source: "*=$1000\n    nop\n    nop\n*=$1000\n    nop\n    nop\n",
+			want: []string{
+				"Memory overlap: $1000 is also assembled in line 5",
+				"Memory overlap: $1000 is also assembled in line 2",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeTestFiles(t, map[string]string{"main.asm": test.source})
+			_, diagnostics := analyzeTestFile(t, dir, "main.asm")
+
+			var got []Diagnostic
+			for _, diagnostic := range diagnostics {
+				if strings.HasPrefix(diagnostic.Message, "Memory overlap") {
+					got = append(got, diagnostic)
+				}
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("got %d overlap errors, want %d: %v", len(got), len(test.want), got)
+			}
+			sortDiagnosticsByLine(got)
+			for i, diagnostic := range got {
+				if diagnostic.Message != test.want[i] {
+					t.Errorf("got %q, want %q", diagnostic.Message, test.want[i])
+				}
+				if len(diagnostic.RelatedInformation) != 1 {
+					t.Errorf("%q has %d related locations, want 1", diagnostic.Message, len(diagnostic.RelatedInformation))
+				}
+			}
+			// Each side points to the other one
+			if len(got) == 2 {
+				if got[0].RelatedInformation[0].Range != got[1].Range || got[1].RelatedInformation[0].Range != got[0].Range {
+					t.Errorf("related information doesn't point to the other side: %v", got)
+				}
+			}
+		})
+	}
+}
+
+// sortDiagnosticsByLine orders diagnostics by their start line
+func sortDiagnosticsByLine(diagnostics []Diagnostic) {
+	for i := 1; i < len(diagnostics); i++ {
+		for j := i; j > 0 && diagnostics[j].Range.Start.Line < diagnostics[j-1].Range.Start.Line; j-- {
+			diagnostics[j], diagnostics[j-1] = diagnostics[j-1], diagnostics[j]
+		}
+	}
+}
+
+func TestImportDataSize(t *testing.T) {
+	files := map[string]string{
+		"data.bin": "0123456789",
+		"tune.prg": "\x00\x10abcdef",
+	}
+	runSegmentTests(t, []segmentTest{
+		{
+			name:   "whole file",
+			source: "*=$2000\n.import binary \"data.bin\"\nafter: rts\n",
+			labels: map[string]int64{"after": 0x200a},
+		},
+		{
+			name:   "offset",
+			source: "*=$2000\n.import binary \"data.bin\", 4\nafter: rts\n",
+			labels: map[string]int64{"after": 0x2006},
+		},
+		{
+			name:   "offset and length",
+			source: "*=$2000\n.import binary \"data.bin\", 2, 5\nafter: rts\n",
+			labels: map[string]int64{"after": 0x2005},
+		},
+		{
+			name:   "c64 without the load address",
+			source: "*=$2000\n.import c64 \"tune.prg\"\nafter: rts\n",
+			labels: map[string]int64{"after": 0x2006},
+		},
+		{
+			name:   "text",
+			source: "*=$2000\n.import text \"data.bin\", 8\nafter: rts\n",
+			labels: map[string]int64{"after": 0x2002},
+		},
+		{
+			name:   "offset outside of the file",
+			source: "*=$2000\n.import binary \"data.bin\", 11\n",
+			errors: []string{"Offset 11 is outside of 'data.bin', which has 10 bytes"},
+		},
+		{
+			name:   "length beyond the file",
+			source: "*=$2000\n.import binary \"data.bin\", 4, 7\n",
+			errors: []string{"Length 7 is more than the 6 bytes of 'data.bin' after the offset"},
+		},
+		{
+			name:   "missing file",
+			source: "*=$2000\n.import binary \"missing.bin\"\n",
+			errors: []string{"Cannot find imported file 'missing.bin'"},
+		},
+		{
+			name:   "imported data overlaps code",
+			source: "*=$2000\n.import binary \"data.bin\"\n*=$2009\n    nop\n",
+			errors: []string{"Memory overlap: $2009 is also assembled in line 4"},
+		},
+	}, files)
+}
+
+func TestImportedCodeOverlaps(t *testing.T) {
+	runSegmentTests(t, []segmentTest{
+		{
+			name:   "import between the importing code",
+			source: "*=$1000\n    nop\n#import \"lib.asm\"\n    nop\n",
+		},
+		{
+			name:   "import that sets its own program counter",
+			source: "*=$1000\n    nop\n    nop\n    nop\n    nop\n*=$2000\n#import \"lib.asm\"\n",
+			errors: []string{
+				"Memory overlap: $1002 is also assembled in line 7",
+				"Memory overlap: $1002 is also assembled in line 4",
+			},
+		},
+	}, map[string]string{"lib.asm": "*=$1002\n    rts\n"})
+}
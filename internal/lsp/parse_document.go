@@ -1,11 +1,41 @@
 package lsp
 
 import (
+	"context"
+	"time"
+
 	log "c64.nvim/internal/log"
 )
 
 // ParseDocument parses an assembly document and returns the symbol scope, analysis context, and diagnostics
 func ParseDocument(uri string, text string) (*Scope, *AnalysisContext, []Diagnostic) {
+	return ParseDocumentContext(context.Background(), uri, text)
+}
+
+// ParseDocumentContext is ParseDocument with cancellation. Parsing and analysis stop when ctx
+// is done or the configured time budget runs out, returning what was analysed so far.
+func ParseDocumentContext(ctx context.Context, uri string, text string) (*Scope, *AnalysisContext, []Diagnostic) {
+	return parseDocumentWithImports(ctx, uri, text, nil, defaultStartAddress, newIncludedFiles())
+}
+
+// withAnalysisTimeout limits ctx to the analysis time budget configured for a document
+func withAnalysisTimeout(ctx context.Context, config LSPConfiguration) (context.Context, context.CancelFunc) {
+	timeout := config.AnalysisLimits.TimeoutMs
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+}
+
+// parseDocumentWithImports parses a document that may itself be the target of an #import.
+// importChain holds the URIs of the importing files to break #import cycles, startPC is the
+// program counter the document's code is assembled at, and included holds the files the root
+// document has included so far.
+func parseDocumentWithImports(ctx context.Context, uri string, text string, importChain []string, startPC int64, included *includedFiles) (*Scope, *AnalysisContext, []Diagnostic) {
+	config := GetDocumentConfig(uri)
+	ctx, cancel := withAnalysisTimeout(ctx, config)
+	defer cancel()
+
 	var program *Program
 	var parserDiagnostics []Diagnostic
 
@@ -29,6 +59,11 @@ func ParseDocument(uri string, text string) (*Scope, *AnalysisContext, []Diagnos
 	// Create context-aware lexer and parser
 	lexer := NewContextAwareLexer(text, processorCtx)
 	parser := NewContextAwareParser(lexer, processorCtx)
+	parser.ctx = ctx
+	parser.maxDepth = config.AnalysisLimits.MaxNestingDepth
+	for _, name := range config.activeDefines() {
+		parser.defines[name] = true
+	}
 	program = parser.ParseProgram()
 	parserDiagnostics = parser.Errors()
 
@@ -37,7 +72,16 @@ func ParseDocument(uri string, text string) (*Scope, *AnalysisContext, []Diagnos
 
 	// Pass 2: Perform semantic analysis (e.g., find symbol usages)
 	analyzer := NewSemanticAnalyzer(scope, text)
+	analyzer.ctx = ctx
+	// Out of time while parsing - the parser already reported where it stopped
+	analyzer.stopped = parser.stopped && ctx.Err() != nil
+	analyzer.importChain = append(append([]string{}, importChain...), uri)
+	analyzer.startAddress = startPC
+	analyzer.included = included
 	semanticDiagnostics := analyzer.Analyze(program)
+	if parser.stopped {
+		analyzer.GetContext().Incomplete = true
+	}
 
 	// Combine all diagnostics
 	allDiagnostics := append(parserDiagnostics, definitionDiagnostics...)
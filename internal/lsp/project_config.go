@@ -0,0 +1,721 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	log "c64.nvim/internal/log"
+)
+
+// ProjectConfigFile holds project settings, checked into the repository next to the sources
+const ProjectConfigFile = ".kickass_ls.json"
+
+// projectConfigKey is the object holding the settings, the same key the client uses in
+// workspace/didChangeConfiguration
+const projectConfigKey = "kickass_ls"
+
+// serverWideSettings can't differ between documents, they are ignored in project files
+var serverWideSettings = map[string]bool{
+	"parserFeatureFlags": true,
+}
+
+// ProjectConfig is a parsed .kickass_ls.json
+type ProjectConfig struct {
+	Path        string
+	Settings    map[string]interface{} // nil if the file can't be used
+	Diagnostics []Diagnostic
+}
+
+// projectConfigs caches the config file of every directory looked at. A nil entry means the
+// directory has none.
+var projectConfigs = struct {
+	sync.RWMutex
+	dirs map[string]*ProjectConfig
+}{
+	dirs: make(map[string]*ProjectConfig),
+}
+
+// projectConfigIn returns the config file in dir, loading it on first use
+func projectConfigIn(dir string) *ProjectConfig {
+	projectConfigs.RLock()
+	config, cached := projectConfigs.dirs[dir]
+	projectConfigs.RUnlock()
+	if cached {
+		return config
+	}
+
+	config = loadProjectConfig(filepath.Join(dir, ProjectConfigFile))
+	projectConfigs.Lock()
+	projectConfigs.dirs[dir] = config
+	projectConfigs.Unlock()
+	return config
+}
+
+// forgetProjectConfigs drops the cached config files, so they are read again on next use
+func forgetProjectConfigs() {
+	projectConfigs.Lock()
+	projectConfigs.dirs = make(map[string]*ProjectConfig)
+	projectConfigs.Unlock()
+}
+
+// projectConfigChain returns the config files that apply to a document, outermost first.
+// The search goes up from the document's directory to the workspace root, or to the
+// filesystem root for documents outside the workspace.
+func projectConfigChain(uri string) []*ProjectConfig {
+	workspaceIndex.RLock()
+	root := workspaceIndex.root
+	workspaceIndex.RUnlock()
+
+	dir, err := filepath.Abs(filepath.Dir(uriToPath(uri)))
+	if err != nil {
+		return nil
+	}
+	var chain []*ProjectConfig
+	for {
+		if config := projectConfigIn(dir); config != nil {
+			chain = append([]*ProjectConfig{config}, chain...)
+		}
+		parent := filepath.Dir(dir)
+		if (root != "" && sameFile(dir, root)) || parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return chain
+}
+
+// GetDocumentConfig returns the configuration for a document: the user settings with every
+// .kickass_ls.json between the workspace root and the document merged over them, so the
+// closest file wins
+func GetDocumentConfig(uri string) LSPConfiguration {
+	config, _ := resolveDocumentConfig(uri)
+	return config
+}
+
+// resolveDocumentConfig is GetDocumentConfig, also returning the settings layers used
+func resolveDocumentConfig(uri string) (LSPConfiguration, []string) {
+	configMutex.RLock()
+	config := *lspConfig
+	sources := []string{"built-in defaults"}
+	if editorSettingsReceived {
+		sources = append(sources, "editor settings")
+	}
+	selected := selectedBuildVariant
+	configMutex.RUnlock()
+
+	if uri != "" {
+		for _, project := range projectConfigChain(uri) {
+			if project.Settings != nil {
+				applyLSPSettings(&config, project.Settings)
+				sources = append(sources, project.Path)
+			}
+		}
+	}
+	// The variant picked with the command wins over the configured one
+	if selected != "" {
+		config.BuildVariant = selected
+		sources = append(sources, CommandSelectBuildVariant)
+	}
+	return config, sources
+}
+
+// loadProjectConfig reads and validates a config file. It returns nil if there is none.
+func loadProjectConfig(path string) *ProjectConfig {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn("loadProjectConfig: cannot read %s: %v", path, err)
+		}
+		return nil
+	}
+
+	config := &ProjectConfig{Path: path}
+	config.Diagnostics = validateProjectConfig(string(data))
+	for _, diagnostic := range config.Diagnostics {
+		if diagnostic.Source == "json" {
+			log.Warn("loadProjectConfig: ignoring %s, it is not valid JSON", path)
+			return config
+		}
+	}
+
+	var file map[string]interface{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return config
+	}
+	settings, _ := file[projectConfigKey].(map[string]interface{})
+	if settings == nil {
+		settings = make(map[string]interface{})
+	}
+	for key := range serverWideSettings {
+		delete(settings, key)
+	}
+
+	// Relative library dirs belong to the directory of the config file
+	if dirs, ok := settings["libraryDirs"].([]interface{}); ok {
+		for i, dir := range dirs {
+			if name, ok := dir.(string); ok && name != "" && !filepath.IsAbs(name) && !strings.HasPrefix(name, "~") {
+				dirs[i] = filepath.Join(filepath.Dir(path), name)
+			}
+		}
+	}
+	config.Settings = settings
+	log.Info("Loaded project configuration %s", path)
+	return config
+}
+
+// settingSchema describes a setting, derived from the json tags of LSPConfiguration
+type settingSchema struct {
+	kind       reflect.Kind
+	fields     map[string]*settingSchema // for objects
+	elem       *settingSchema            // for maps, the schema of the values
+	profileRef bool                      // a string naming a profile
+	variantRef bool                      // a string naming a build variant
+}
+
+var lspSettingSchema = buildSettingSchema(reflect.TypeOf(LSPConfiguration{}))
+
+// profileSettingSchema describes an entry of "profiles": the settings a profile may set and
+// the profile it extends
+var profileSettingSchema = buildProfileSchema()
+
+func buildProfileSchema() *settingSchema {
+	schema := &settingSchema{kind: reflect.Struct, fields: make(map[string]*settingSchema)}
+	for name, field := range lspSettingSchema.fields {
+		if !profileExcludedSettings[name] {
+			schema.fields[name] = field
+		}
+	}
+	schema.fields["extends"] = &settingSchema{kind: reflect.String, profileRef: true}
+	return schema
+}
+
+// buildSettingSchema collects the fields with a json tag. Structs without any (formatting)
+// are not read from settings and left out.
+func buildSettingSchema(t reflect.Type) *settingSchema {
+	schema := &settingSchema{kind: t.Kind()}
+	if t.Kind() == reflect.Map {
+		schema.elem = buildSettingSchema(t.Elem())
+	}
+	if t.Kind() != reflect.Struct {
+		return schema
+	}
+	schema.fields = make(map[string]*settingSchema)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		child := buildSettingSchema(field.Type)
+		if child.kind == reflect.Struct && len(child.fields) == 0 {
+			continue
+		}
+		schema.fields[name] = child
+	}
+	if profile := schema.fields["profile"]; profile != nil {
+		profile.profileRef = true
+	}
+	if variant := schema.fields["buildVariant"]; variant != nil {
+		variant.variantRef = true
+	}
+	return schema
+}
+
+// describe names the expected value for messages
+func (s *settingSchema) describe() string {
+	switch s.kind {
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int:
+		return "a non-negative whole number"
+	case reflect.Slice:
+		return "a list of strings"
+	case reflect.String:
+		return "a string"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	}
+	return s.kind.String()
+}
+
+// closestSetting suggests a known name for a mistyped key
+func (s *settingSchema) closestSetting(key string) string {
+	best, bestDistance := "", 3
+	names := make([]string, 0, len(s.fields))
+	for name := range s.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.EqualFold(name, key) {
+			return name
+		}
+		if distance := editDistance(strings.ToLower(name), strings.ToLower(key)); distance < bestDistance {
+			best, bestDistance = name, distance
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+// configValidator walks a config file token by token, so problems can be reported at the key
+type configValidator struct {
+	text        string
+	decoder     *json.Decoder
+	diagnostics []Diagnostic
+
+	// Profiles and build variants defined in the file and references to them, checked at
+	// the end
+	definedProfiles map[string]bool
+	profileRefs     []settingRef
+	definedVariants map[string]bool
+	variantRefs     []settingRef
+}
+
+// settingRef is a "profile", "extends" or "buildVariant" value
+type settingRef struct {
+	name       string
+	start, end int
+}
+
+// validateProjectConfig reports syntax errors, unknown keys and values of the wrong type
+func validateProjectConfig(text string) []Diagnostic {
+	v := &configValidator{
+		text:            text,
+		decoder:         json.NewDecoder(strings.NewReader(text)),
+		definedProfiles: make(map[string]bool),
+		definedVariants: make(map[string]bool),
+	}
+	v.decoder.UseNumber()
+	err := v.validateFile()
+	if err == nil {
+		v.checkProfileRefs()
+		v.checkVariantRefs()
+	} else {
+		offset := int(v.decoder.InputOffset())
+		var syntaxError *json.SyntaxError
+		if errors.As(err, &syntaxError) {
+			offset = int(syntaxError.Offset)
+		}
+		message := err.Error()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			message = "unexpected end of file"
+		}
+		position := v.position(offset)
+		v.diagnostics = append(v.diagnostics, Diagnostic{
+			Severity: SeverityError,
+			Range:    Range{Start: position, End: position},
+			Message:  fmt.Sprintf("Invalid JSON, the file is ignored: %s", message),
+			Source:   "json",
+		})
+	}
+	return v.diagnostics
+}
+
+// checkProfileRefs reports references to profiles that are neither built in nor defined in
+// the file or the editor settings
+func (v *configValidator) checkProfileRefs() {
+	editorProfiles := GetLSPConfig().Profiles
+	for _, ref := range v.profileRefs {
+		if builtinProfiles[ref.name] != nil || v.definedProfiles[ref.name] || editorProfiles[ref.name] != nil {
+			continue
+		}
+		v.report(SeverityWarning, ref.start, ref.end, fmt.Sprintf("Unknown profile '%s', built-in profiles are %s",
+			ref.name, strings.Join(builtinProfileNames(), ", ")))
+	}
+}
+
+// checkVariantRefs reports a selected build variant that is neither defined in the file nor
+// in the editor settings
+func (v *configValidator) checkVariantRefs() {
+	editorVariants := GetLSPConfig().BuildVariants
+	for _, ref := range v.variantRefs {
+		if ref.name == "" || v.definedVariants[ref.name] {
+			continue
+		}
+		if _, ok := editorVariants[ref.name]; ok {
+			continue
+		}
+		v.report(SeverityWarning, ref.start, ref.end, fmt.Sprintf("Unknown build variant '%s', only the common defines apply", ref.name))
+	}
+}
+
+func (v *configValidator) validateFile() error {
+	token, err := v.decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != json.Delim('{') {
+		v.report(SeverityError, 0, 0, fmt.Sprintf("Expected an object with a %q key", projectConfigKey))
+		return nil
+	}
+	for v.decoder.More() {
+		key, start, end, err := v.readKey()
+		if err != nil {
+			return err
+		}
+		switch {
+		case key == projectConfigKey:
+			if err := v.validateValue(lspSettingSchema, key, start, end); err != nil {
+				return err
+			}
+			continue
+		case lspSettingSchema.fields[key] != nil:
+			v.report(SeverityWarning, start, end, fmt.Sprintf("'%s' is ignored here, settings belong in the %q object", key, projectConfigKey))
+		default:
+			v.report(SeverityWarning, start, end, fmt.Sprintf("Unknown key '%s', settings belong in the %q object", key, projectConfigKey))
+		}
+		if err := v.skipValue(); err != nil {
+			return err
+		}
+	}
+	_, err = v.decoder.Token()
+	return err
+}
+
+// validateValue checks the next value against schema. The key spans start..end, problems
+// with the value are reported there.
+func (v *configValidator) validateValue(schema *settingSchema, path string, start, end int) error {
+	token, err := v.decoder.Token()
+	if err != nil {
+		return err
+	}
+	mismatch := func() error {
+		v.report(SeverityError, start, end, fmt.Sprintf("'%s' must be %s, the value is ignored", path, schema.describe()))
+		if delim, ok := token.(json.Delim); ok && (delim == '{' || delim == '[') {
+			return v.skipRest()
+		}
+		return nil
+	}
+
+	switch schema.kind {
+	case reflect.Bool:
+		if _, ok := token.(bool); !ok {
+			return mismatch()
+		}
+	case reflect.Int:
+		number, ok := token.(json.Number)
+		if !ok {
+			return mismatch()
+		}
+		if n, err := number.Int64(); err != nil || n < 0 {
+			return mismatch()
+		}
+	case reflect.String:
+		name, ok := token.(string)
+		if !ok {
+			return mismatch()
+		}
+		if schema.profileRef {
+			v.profileRefs = append(v.profileRefs, settingRef{name: name, start: start, end: end})
+		}
+		if schema.variantRef {
+			v.variantRefs = append(v.variantRefs, settingRef{name: name, start: start, end: end})
+		}
+	case reflect.Map:
+		// "profiles": name -> profile settings, "buildVariants": name -> defines
+		if token != json.Delim('{') {
+			return mismatch()
+		}
+		for v.decoder.More() {
+			name, nameStart, nameEnd, err := v.readKey()
+			if err != nil {
+				return err
+			}
+			if path == "buildVariants" {
+				v.definedVariants[name] = true
+				if err := v.validateValue(schema.elem, path+"."+name, nameStart, nameEnd); err != nil {
+					return err
+				}
+				continue
+			}
+			if builtinProfiles[name] != nil {
+				v.report(SeverityWarning, nameStart, nameEnd, fmt.Sprintf("'%s' is a built-in profile and can't be redefined", name))
+				if err := v.skipValue(); err != nil {
+					return err
+				}
+				continue
+			}
+			v.definedProfiles[name] = true
+			if err := v.validateValue(profileSettingSchema, path+"."+name, nameStart, nameEnd); err != nil {
+				return err
+			}
+		}
+		_, err = v.decoder.Token()
+		return err
+	case reflect.Slice:
+		if token != json.Delim('[') {
+			return mismatch()
+		}
+		reported := false
+		for v.decoder.More() {
+			item, err := v.decoder.Token()
+			if err != nil {
+				return err
+			}
+			if _, ok := item.(string); ok {
+				continue
+			}
+			if !reported {
+				v.report(SeverityError, start, end, fmt.Sprintf("'%s' must only contain strings, other entries are ignored", path))
+				reported = true
+			}
+			if delim, ok := item.(json.Delim); ok && (delim == '{' || delim == '[') {
+				if err := v.skipRest(); err != nil {
+					return err
+				}
+			}
+		}
+		_, err = v.decoder.Token()
+		return err
+	case reflect.Struct:
+		if token != json.Delim('{') {
+			return mismatch()
+		}
+		for v.decoder.More() {
+			key, keyStart, keyEnd, err := v.readKey()
+			if err != nil {
+				return err
+			}
+			keyPath := key
+			if path != projectConfigKey {
+				keyPath = path + "." + key
+			}
+			field := schema.fields[key]
+			switch {
+			case schema == profileSettingSchema && profileExcludedSettings[key]:
+				v.report(SeverityWarning, keyStart, keyEnd, fmt.Sprintf("'%s' can't be set in a profile", key))
+			case field == nil:
+				message := fmt.Sprintf("Unknown setting '%s'", keyPath)
+				if suggestion := schema.closestSetting(key); suggestion != "" {
+					message += fmt.Sprintf(", did you mean '%s'?", suggestion)
+				}
+				v.report(SeverityWarning, keyStart, keyEnd, message)
+			case path == projectConfigKey && serverWideSettings[key]:
+				v.report(SeverityWarning, keyStart, keyEnd, fmt.Sprintf("'%s' applies to the whole server and is ignored in %s, set it in the editor configuration", key, ProjectConfigFile))
+			default:
+				if err := v.validateValue(field, keyPath, keyStart, keyEnd); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := v.skipValue(); err != nil {
+				return err
+			}
+		}
+		_, err = v.decoder.Token()
+		return err
+	}
+	return nil
+}
+
+// readKey reads an object key and returns its byte range including the quotes
+func (v *configValidator) readKey() (string, int, int, error) {
+	token, err := v.decoder.Token()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	key, _ := token.(string)
+	end := int(v.decoder.InputOffset())
+	start := strings.LastIndex(v.text[:end-1], `"`)
+	if start < 0 {
+		start = end
+	}
+	return key, start, end, nil
+}
+
+// skipValue skips the next value
+func (v *configValidator) skipValue() error {
+	token, err := v.decoder.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); ok && (delim == '{' || delim == '[') {
+		return v.skipRest()
+	}
+	return nil
+}
+
+// skipRest skips to the end of the object or array just opened
+func (v *configValidator) skipRest() error {
+	for depth := 1; depth > 0; {
+		token, err := v.decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+	return nil
+}
+
+func (v *configValidator) report(severity DiagnosticSeverity, start, end int, message string) {
+	v.diagnostics = append(v.diagnostics, Diagnostic{
+		Severity: severity,
+		Range:    Range{Start: v.position(start), End: v.position(end)},
+		Message:  message,
+		Source:   "kickass_ls",
+	})
+}
+
+// position converts a byte offset into a line and a character in UTF-16 code units
+func (v *configValidator) position(offset int) Position {
+	if offset > len(v.text) {
+		offset = len(v.text)
+	}
+	before := v.text[:offset]
+	line := strings.Count(before, "\n")
+	lineStart := strings.LastIndex(before, "\n") + 1
+	return Position{Line: line, Character: utf8ToUTF16Offset(v.text, line, offset-lineStart)}
+}
+
+// publishProjectConfigDiagnostics shows the problems of a config file in the file itself
+func publishProjectConfigDiagnostics(writer *bufio.Writer, config *ProjectConfig) {
+	diagnostics := config.Diagnostics
+	if diagnostics == nil {
+		diagnostics = []Diagnostic{}
+	}
+	publishDiagnostics(writer, pathToURI(config.Path), diagnostics)
+}
+
+// scanProjectConfigs loads the config files in the workspace and publishes their diagnostics.
+// Hidden directories other than the root are skipped.
+func scanProjectConfigs(writer *bufio.Writer) {
+	workspaceIndex.RLock()
+	root := workspaceIndex.root
+	workspaceIndex.RUnlock()
+	if root == "" {
+		return
+	}
+
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() {
+			if path != root && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.Name() == ProjectConfigFile {
+			if config := projectConfigIn(filepath.Dir(path)); config != nil {
+				publishProjectConfigDiagnostics(writer, config)
+			}
+		}
+		return nil
+	})
+}
+
+// handleWatchedFilesChange handles workspace/didChangeWatchedFiles. A changed config file is
+// read again and the documents below it are re-analyzed; changed data files in the workspace
+// .kickass_ls/ directory are reloaded like kickass_ls/reloadData does.
+func handleWatchedFilesChange(writer *bufio.Writer, changes []interface{}) {
+	var configDirs []string
+	reload := false
+	for _, change := range changes {
+		event, ok := change.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		uri, _ := event["uri"].(string)
+		path := uriToPath(uri)
+
+		switch filepath.Base(path) {
+		case ProjectConfigFile:
+			dir := filepath.Dir(path)
+			projectConfigs.Lock()
+			delete(projectConfigs.dirs, dir)
+			projectConfigs.Unlock()
+
+			if config := projectConfigIn(dir); config != nil {
+				publishProjectConfigDiagnostics(writer, config)
+			} else {
+				// Deleted
+				publishDiagnostics(writer, uri, []Diagnostic{})
+			}
+			configDirs = append(configDirs, dir)
+			log.Info("Project configuration %s changed", path)
+		default:
+			dataLayers.RLock()
+			workspaceDir := dataLayers.workspaceDir
+			dataLayers.RUnlock()
+			if dataFileNames[filepath.Base(path)] && workspaceDir != "" && sameFile(filepath.Dir(path), workspaceDir) {
+				reload = true
+			}
+		}
+	}
+
+	if reload {
+		reloadData(writer)
+		return
+	}
+	for _, dir := range configDirs {
+		reanalyzeOpenDocumentsUnder(writer, dir)
+	}
+}
+
+// clientWatchesFiles is set when the client can register file watchers for the server
+var clientWatchesFiles = false
+
+// registerFileWatchers asks the client to report changes to config and data files
+func registerFileWatchers(writer *bufio.Writer) {
+	if !clientWatchesFiles {
+		log.Info("Client can't watch files, changes to %s need a restart or kickass_ls/reloadData", ProjectConfigFile)
+		return
+	}
+	request, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      "kickass_ls/registerFileWatchers",
+		"method":  "client/registerCapability",
+		"params": map[string]interface{}{
+			"registrations": []interface{}{
+				map[string]interface{}{
+					"id":     "kickass_ls/watchedFiles",
+					"method": "workspace/didChangeWatchedFiles",
+					"registerOptions": map[string]interface{}{
+						"watchers": []interface{}{
+							map[string]interface{}{"globPattern": "**/" + ProjectConfigFile},
+							map[string]interface{}{"globPattern": "**/" + workspaceDataDir + "/*.json"},
+						},
+					},
+				},
+			},
+		},
+	})
+	writeResponse(writer, request)
+}
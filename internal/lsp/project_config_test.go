@@ -0,0 +1,148 @@
+package lsp
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProjectConfigPositionInUTF16(t *testing.T) {
+	tests := []struct {
+		text      string
+		character int
+	}{
+		{"{\n  \"name\": \"demo\" x}", 18},
+		{"{\n  \"name\": \"démo\" x}", 18},
+		{"{\n  \"name\": \"😀\" x}", 16},
+	}
+	for _, test := range tests {
+		var syntaxErrors []Diagnostic
+		for _, diagnostic := range validateProjectConfig(test.text) {
+			if diagnostic.Source == "json" {
+				syntaxErrors = append(syntaxErrors, diagnostic)
+			}
+		}
+		if len(syntaxErrors) != 1 {
+			t.Fatalf("%q: got %d syntax errors, want 1", test.text, len(syntaxErrors))
+		}
+		start := syntaxErrors[0].Range.Start
+		if start.Line != 1 || start.Character != test.character {
+			t.Errorf("%q: error at %d:%d, want 1:%d", test.text, start.Line, start.Character, test.character)
+		}
+	}
+}
+
+func TestProjectConfigMerging(t *testing.T) {
+	dir := writeTestFiles(t, map[string]string{
+		ProjectConfigFile: `{"kickass_ls": {
+			"warnUnusedLabels": false,
+			"defines": ["OUTER"],
+			"cycleHints": {"enabled": true, "showRunningTotal": true}
+		}}`,
+		"game/" + ProjectConfigFile: `{"kickass_ls": {
+			"defines": ["INNER"],
+			"cycleHints": {"showRunningTotal": false}
+		}}`,
+	})
+	forgetProjectConfigs()
+
+	inner := GetDocumentConfig(pathToURI(filepath.Join(dir, "game", "level", "main.asm")))
+	if inner.WarnUnusedLabels {
+		t.Error("warnUnusedLabels of the outer file is not applied")
+	}
+	if !reflect.DeepEqual(inner.Defines, []string{"INNER"}) {
+		t.Errorf("defines = %v, want the closest file's [INNER]", inner.Defines)
+	}
+	if !inner.CycleHints.Enabled || inner.CycleHints.ShowRunningTotal {
+		t.Errorf("cycleHints = %+v, want enabled by the outer file and no running total from the inner one", inner.CycleHints)
+	}
+
+	outer := GetDocumentConfig(pathToURI(filepath.Join(dir, "main.asm")))
+	if !reflect.DeepEqual(outer.Defines, []string{"OUTER"}) || !outer.CycleHints.ShowRunningTotal {
+		t.Errorf("outer document: defines %v, cycleHints %+v", outer.Defines, outer.CycleHints)
+	}
+}
+
+func TestProjectConfigDiagnostics(t *testing.T) {
+	text := `{"kickass_ls": {
+  "warnUnusedLabel": true,
+  "libraryDirs": "lib",
+  "cycleHints": {"enabled": "yes"}
+}}`
+	want := []struct {
+		severity DiagnosticSeverity
+		start    Position
+		end      Position
+		message  string
+	}{
+		{SeverityWarning, Position{Line: 1, Character: 2}, Position{Line: 1, Character: 19}, "Unknown setting 'warnUnusedLabel', did you mean 'warnUnusedLabels'?"},
+		{SeverityError, Position{Line: 2, Character: 2}, Position{Line: 2, Character: 15}, "'libraryDirs' must be"},
+		{SeverityError, Position{Line: 3, Character: 17}, Position{Line: 3, Character: 26}, "'cycleHints.enabled' must be"},
+	}
+	diagnostics := validateProjectConfig(text)
+	if len(diagnostics) != len(want) {
+		t.Fatalf("got %d diagnostics, want %d: %v", len(diagnostics), len(want), diagnostics)
+	}
+	for i, diagnostic := range diagnostics {
+		if diagnostic.Severity != want[i].severity || diagnostic.Range.Start != want[i].start ||
+			diagnostic.Range.End != want[i].end || !strings.HasPrefix(diagnostic.Message, want[i].message) {
+			t.Errorf("diagnostic %d = %d %v %q, want %d %v-%v %q", i, diagnostic.Severity, diagnostic.Range,
+				diagnostic.Message, want[i].severity, want[i].start, want[i].end, want[i].message)
+		}
+	}
+
+	// Values of the wrong type are ignored
+	dir := writeTestFiles(t, map[string]string{ProjectConfigFile: text})
+	forgetProjectConfigs()
+	config := GetDocumentConfig(pathToURI(filepath.Join(dir, "main.asm")))
+	defaults := GetLSPConfig()
+	if !reflect.DeepEqual(config.LibraryDirs, defaults.LibraryDirs) || config.CycleHints.Enabled != defaults.CycleHints.Enabled {
+		t.Errorf("libraryDirs %v, cycleHints %+v, want the defaults", config.LibraryDirs, config.CycleHints)
+	}
+}
+
+func TestProjectConfigLibraryDirs(t *testing.T) {
+	loadTestData(t)
+	dir := writeTestFiles(t, map[string]string{
+		"game/" + ProjectConfigFile: `{"kickass_ls": {"libraryDirs": ["lib", "/opt/kick", "~/kick"]}}`,
+		"game/lib/util.asm":         "util: rts\n",
+		"game/src/main.asm":         "*=$1000\n    jsr util\n#import \"util.asm\"\n",
+	})
+	forgetProjectConfigs()
+
+	config := GetDocumentConfig(pathToURI(filepath.Join(dir, "game", "src", "main.asm")))
+	want := []string{filepath.Join(dir, "game", "lib"), "/opt/kick", "~/kick"}
+	if !reflect.DeepEqual(config.LibraryDirs, want) {
+		t.Errorf("libraryDirs = %v, want %v", config.LibraryDirs, want)
+	}
+
+	context, diagnostics := analyzeTestFile(t, filepath.Join(dir, "game", "src"), "main.asm")
+	if got := lookupTestLabel(t, context, "util"); got != 0x1003 {
+		t.Errorf("util = $%04X, want $1003", got)
+	}
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Severity == SeverityError {
+			t.Errorf("unexpected error: %s", diagnostic.Message)
+		}
+	}
+}
+
+func TestProjectConfigServerWideSettings(t *testing.T) {
+	text := `{"kickass_ls": {"parserFeatureFlags": {"debugMode": true}, "warnUnusedLabels": false}}`
+	diagnostics := validateProjectConfig(text)
+	if len(diagnostics) != 1 || diagnostics[0].Severity != SeverityWarning ||
+		!strings.HasPrefix(diagnostics[0].Message, "'parserFeatureFlags' applies to the whole server and is ignored") {
+		t.Errorf("diagnostics = %v", diagnostics)
+	}
+
+	dir := writeTestFiles(t, map[string]string{ProjectConfigFile: text})
+	forgetProjectConfigs()
+	config := GetDocumentConfig(pathToURI(filepath.Join(dir, "main.asm")))
+	if config.ParserFeatureFlags != GetLSPConfig().ParserFeatureFlags {
+		t.Errorf("parserFeatureFlags = %+v, want the editor's", config.ParserFeatureFlags)
+	}
+	if config.WarnUnusedLabels {
+		t.Error("the other settings of the file are not applied")
+	}
+}
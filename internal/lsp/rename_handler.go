@@ -0,0 +1,506 @@
+package lsp
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	log "c64.nvim/internal/log"
+)
+
+// renameIdentifierPattern matches a valid Kick Assembler symbol name
+var renameIdentifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// renameTarget describes the symbol selected for a rename
+type renameTarget struct {
+	Name       string
+	Symbol     *Symbol // Resolved symbol (nil for multi-labels)
+	MultiLabel bool
+	DefLine    int   // Line of the bound multi-label definition
+	Range      Range // Range of the name under the cursor
+}
+
+// renameDocument is a document taking part in a rename
+type renameDocument struct {
+	URI  string
+	Text string
+	Tree *Scope
+}
+
+// handlePrepareRename handles the textDocument/prepareRename LSP request
+func handlePrepareRename(params map[string]interface{}) (interface{}, error) {
+	uri, line, char, ok := renamePosition(params)
+	if !ok {
+		return nil, fmt.Errorf("invalid prepareRename request")
+	}
+
+	target, err := resolveRenameTarget(uri, line, char)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"range":       target.Range,
+		"placeholder": target.Name,
+	}, nil
+}
+
+// handleRename handles the textDocument/rename LSP request and returns a WorkspaceEdit
+func handleRename(params map[string]interface{}) (interface{}, error) {
+	uri, line, char, ok := renamePosition(params)
+	if !ok {
+		return nil, fmt.Errorf("invalid rename request")
+	}
+	newName, ok := params["newName"].(string)
+	if !ok {
+		return nil, fmt.Errorf("missing newName in rename request")
+	}
+
+	target, err := resolveRenameTarget(uri, line, char)
+	if err != nil {
+		return nil, err
+	}
+
+	newName = strings.TrimSpace(newName)
+	if target.MultiLabel {
+		newName = strings.TrimPrefix(newName, "!")
+	}
+	if newName == target.Name {
+		return map[string]interface{}{"changes": map[string]interface{}{}}, nil
+	}
+	if err := validateRenameName(target, newName, uri); err != nil {
+		return nil, err
+	}
+
+	changes := map[string]interface{}{}
+	if target.MultiLabel {
+		documentStore.RLock()
+		text := documentStore.documents[uri]
+		documentStore.RUnlock()
+		edits := multiLabelRenameEdits(strings.Split(text, "\n"), target, newName)
+		if len(edits) > 0 {
+			changes[uri] = edits
+		}
+	} else {
+		for _, doc := range renameDocuments(uri, target.Symbol) {
+			edits := symbolRenameEdits(doc, target.Symbol, newName)
+			if len(edits) > 0 {
+				changes[doc.URI] = edits
+			}
+		}
+	}
+
+	log.Debug("handleRename: renaming '%s' to '%s' touches %d documents", target.Name, newName, len(changes))
+	return map[string]interface{}{"changes": changes}, nil
+}
+
+// renamePosition extracts the document URI and cursor position from rename params
+func renamePosition(params map[string]interface{}) (string, int, int, bool) {
+	textDocument, ok := params["textDocument"].(map[string]interface{})
+	if !ok {
+		return "", 0, 0, false
+	}
+	uri, ok := textDocument["uri"].(string)
+	if !ok {
+		return "", 0, 0, false
+	}
+	position, ok := params["position"].(map[string]interface{})
+	if !ok {
+		return "", 0, 0, false
+	}
+	line, ok := position["line"].(float64)
+	if !ok {
+		return "", 0, 0, false
+	}
+	char, ok := position["character"].(float64)
+	if !ok {
+		return "", 0, 0, false
+	}
+	return uri, int(line), int(char), true
+}
+
+// resolveRenameTarget finds the symbol under the cursor and checks that it can be renamed
+func resolveRenameTarget(uri string, lineNum, char int) (*renameTarget, error) {
+	documentStore.RLock()
+	text, docFound := documentStore.documents[uri]
+	documentStore.RUnlock()
+
+	symbolStore.RLock()
+	tree, treeFound := symbolStore.trees[uri]
+	symbolStore.RUnlock()
+
+	if !docFound || !treeFound {
+		return nil, fmt.Errorf("document is not analyzed yet")
+	}
+
+	lines := strings.Split(text, "\n")
+	if lineNum < 0 || lineNum >= len(lines) {
+		return nil, fmt.Errorf("position is outside the document")
+	}
+	line := lines[lineNum]
+	// The position counts UTF-16 code units, the line is searched in bytes
+	char = utf16ToUTF8Offset(line, char)
+
+	// Cursor on the '!' of a multi-label: move onto the name
+	if char < len(line) && line[char] == '!' {
+		char++
+	}
+
+	start, end := identifierBoundsAt(line, char)
+	if start == end {
+		return nil, fmt.Errorf("no symbol at cursor position")
+	}
+	if commentStart := findCommentStart(line); commentStart != -1 && start >= commentStart {
+		return nil, fmt.Errorf("cannot rename inside a comment")
+	}
+
+	name := line[start:end]
+	nameRange := Range{
+		Start: Position{Line: lineNum, Character: utf8ToUTF16Offset(line, 0, start)},
+		End:   Position{Line: lineNum, Character: utf8ToUTF16Offset(line, 0, end)},
+	}
+
+	// Multi-label (!name:, !name+, !name-)
+	if start > 0 && line[start-1] == '!' {
+		defLines := findMultiLabelDefinitions(lines, name)
+		defLine := -1
+		suffix := byte(0)
+		if end < len(line) {
+			suffix = line[end]
+		}
+		switch suffix {
+		case ':':
+			defLine = lineNum
+		case '+':
+			for _, l := range defLines {
+				if l > lineNum {
+					defLine = l
+					break
+				}
+			}
+		case '-':
+			for _, l := range defLines {
+				if l < lineNum {
+					defLine = l
+				}
+			}
+		}
+		if defLine == -1 {
+			return nil, fmt.Errorf("multi-label '!%s' has no matching definition", name)
+		}
+		return &renameTarget{Name: name, MultiLabel: true, DefLine: defLine, Range: nameRange}, nil
+	}
+
+	qualifier, isDirective := qualifierBefore(line, start)
+	if isDirective || (start > 0 && line[start-1] == '#') {
+		return nil, fmt.Errorf("cannot rename directive '%s'", name)
+	}
+
+	if symbol, found := resolveSymbolAt(tree, lineNum, qualifier, name); found {
+		return &renameTarget{Name: name, Symbol: symbol, Range: nameRange}, nil
+	}
+
+	if isMnemonic(name) {
+		return nil, fmt.Errorf("cannot rename instruction '%s'", name)
+	}
+	if isBuiltinName(name) {
+		return nil, fmt.Errorf("cannot rename built-in '%s'", name)
+	}
+	return nil, fmt.Errorf("no symbol named '%s' found", name)
+}
+
+// validateRenameName rejects new names that are invalid or collide with
+// mnemonics, directives, built-ins or existing symbols
+func validateRenameName(target *renameTarget, newName, uri string) error {
+	if !renameIdentifierPattern.MatchString(newName) {
+		return fmt.Errorf("'%s' is not a valid symbol name", newName)
+	}
+	lower := strings.ToLower(newName)
+	if lower == "a" || lower == "x" || lower == "y" {
+		return fmt.Errorf("'%s' is a register name", newName)
+	}
+	if isMnemonic(newName) {
+		return fmt.Errorf("'%s' collides with the mnemonic %s", newName, strings.ToUpper(newName))
+	}
+	if isDirective(lower) {
+		return fmt.Errorf("'%s' collides with the directive .%s", newName, lower)
+	}
+	if isBuiltinName(newName) {
+		return fmt.Errorf("'%s' collides with a built-in function or constant", newName)
+	}
+
+	if target.MultiLabel {
+		documentStore.RLock()
+		text := documentStore.documents[uri]
+		documentStore.RUnlock()
+		if len(findMultiLabelDefinitions(strings.Split(text, "\n"), newName)) > 0 {
+			return fmt.Errorf("multi-label '!%s' already exists", newName)
+		}
+		return nil
+	}
+
+	if target.Symbol.Scope != nil {
+		if existing, found := target.Symbol.Scope.FindSymbol(newName); found {
+			return fmt.Errorf("symbol '%s' already exists (%s at line %d)", newName, existing.Kind.String(), existing.Position.Line+1)
+		}
+	}
+	return nil
+}
+
+// isBuiltinName reports whether a name is a Kick Assembler built-in function or constant
+func isBuiltinName(name string) bool {
+	data := currentData()
+	for _, fn := range data.builtinFunctions {
+		if fn.Name == name {
+			return true
+		}
+	}
+	for _, c := range data.builtinConstants {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// identifierBoundsAt returns the byte range of the identifier touching char
+func identifierBoundsAt(line string, char int) (int, int) {
+	isIdentChar := func(c byte) bool {
+		return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_'
+	}
+	if char > len(line) {
+		char = len(line)
+	}
+	start := char
+	for start > 0 && isIdentChar(line[start-1]) {
+		start--
+	}
+	end := char
+	for end < len(line) && isIdentChar(line[end]) {
+		end++
+	}
+	return start, end
+}
+
+// qualifierBefore returns the namespace qualifier in front of an identifier ("ns" in "ns.label").
+// isDirective is true when the identifier is preceded by a bare '.', i.e. it is a directive name.
+func qualifierBefore(line string, start int) (qualifier string, isDirective bool) {
+	if start == 0 || line[start-1] != '.' {
+		return "", false
+	}
+	qualStart, qualEnd := identifierBoundsAt(line, start-1)
+	if qualStart == qualEnd {
+		return "", true
+	}
+	return line[qualStart:qualEnd], false
+}
+
+// resolveSymbolAt resolves a (possibly namespace-qualified) name as seen from the given line
+func resolveSymbolAt(tree *Scope, lineNum int, qualifier, name string) (*Symbol, bool) {
+	if tree == nil {
+		return nil, false
+	}
+	if qualifier != "" {
+		return tree.FindSymbol(qualifier + "." + name)
+	}
+	return tree.findInnermostScope(lineNum).FindSymbol(name)
+}
+
+// sameSymbol reports whether two symbols are the same definition, possibly from different parses
+func sameSymbol(a, b *Symbol) bool {
+	if a == b {
+		return true
+	}
+	if a == nil || b == nil || a.Name != b.Name || a.Position != b.Position {
+		return false
+	}
+	if a.Scope == nil || b.Scope == nil {
+		return a.Scope == b.Scope
+	}
+	return sameFile(a.Scope.Uri, b.Scope.Uri)
+}
+
+// renameDocuments collects the documents that may reference the symbol: the current document,
+// the file defining the symbol and all open documents importing that file
+func renameDocuments(uri string, symbol *Symbol) []renameDocument {
+	uris := []string{uri}
+	if symbol.Scope != nil && symbol.Scope.Uri != "" && !sameFile(symbol.Scope.Uri, uri) {
+		definingURI := symbol.Scope.Uri
+		uris = append(uris, definingURI)
+		for _, dependent := range findImportingDocuments(definingURI) {
+			if !containsFile(uris, dependent) {
+				uris = append(uris, dependent)
+			}
+		}
+	} else {
+		for _, dependent := range findImportingDocuments(uri) {
+			if !containsFile(uris, dependent) {
+				uris = append(uris, dependent)
+			}
+		}
+	}
+
+	docs := []renameDocument{}
+	for _, docURI := range uris {
+		if doc, ok := loadRenameDocument(docURI); ok {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
+
+// loadRenameDocument returns the text and symbol tree of an open document or an indexed import
+func loadRenameDocument(uri string) (renameDocument, bool) {
+	documentStore.RLock()
+	text, isOpen := documentStore.documents[uri]
+	documentStore.RUnlock()
+	if isOpen {
+		symbolStore.RLock()
+		tree, treeFound := symbolStore.trees[uri]
+		symbolStore.RUnlock()
+		if treeFound {
+			return renameDocument{URI: uri, Text: text, Tree: tree}, true
+		}
+	}
+
+	// Not open in the editor - look it up in the workspace index
+	workspaceIndex.RLock()
+	var file *IndexedFile
+	for indexedURI, indexed := range workspaceIndex.files {
+		if sameFile(indexedURI, uri) {
+			file = indexed
+			break
+		}
+	}
+	workspaceIndex.RUnlock()
+	if file == nil {
+		return renameDocument{}, false
+	}
+
+	data, err := os.ReadFile(file.Path)
+	if err != nil {
+		log.Warn("loadRenameDocument: cannot read %s: %v", file.Path, err)
+		return renameDocument{}, false
+	}
+	return renameDocument{URI: file.URI, Text: string(data), Tree: file.Scope}, true
+}
+
+// symbolRenameEdits returns the TextEdits renaming every occurrence in doc that resolves to symbol
+func symbolRenameEdits(doc renameDocument, symbol *Symbol, newName string) []interface{} {
+	edits := []interface{}{}
+	for lineNum, line := range strings.Split(doc.Text, "\n") {
+		for _, start := range findIdentifierOccurrences(line, symbol.Name) {
+			// Multi-labels and preprocessor symbols live in their own namespaces
+			if start > 0 && (line[start-1] == '!' || line[start-1] == '#') {
+				continue
+			}
+			qualifier, isDirective := qualifierBefore(line, start)
+			if isDirective {
+				continue
+			}
+			resolved, found := resolveSymbolAt(doc.Tree, lineNum, qualifier, symbol.Name)
+			if !found || !sameSymbol(resolved, symbol) {
+				continue
+			}
+			edits = append(edits, renameTextEdit(line, lineNum, start, len(symbol.Name), newName))
+		}
+	}
+	return edits
+}
+
+// multiLabelRenameEdits renames the bound multi-label definition and the references resolving to it
+func multiLabelRenameEdits(lines []string, target *renameTarget, newName string) []interface{} {
+	defLines := findMultiLabelDefinitions(lines, target.Name)
+	edits := []interface{}{}
+
+	for lineNum, line := range lines {
+		for _, start := range findIdentifierOccurrences(line, target.Name) {
+			end := start + len(target.Name)
+			if start == 0 || line[start-1] != '!' || end >= len(line) {
+				continue
+			}
+
+			bound := -1
+			switch line[end] {
+			case ':':
+				bound = lineNum
+			case '+':
+				for _, l := range defLines {
+					if l > lineNum {
+						bound = l
+						break
+					}
+				}
+			case '-':
+				for _, l := range defLines {
+					if l < lineNum {
+						bound = l
+					}
+				}
+			}
+
+			if bound == target.DefLine {
+				edits = append(edits, renameTextEdit(line, lineNum, start, len(target.Name), newName))
+			}
+		}
+	}
+	return edits
+}
+
+// findMultiLabelDefinitions returns the lines defining !name: in ascending order
+func findMultiLabelDefinitions(lines []string, name string) []int {
+	defLines := []int{}
+	for lineNum, line := range lines {
+		for _, start := range findIdentifierOccurrences(line, name) {
+			end := start + len(name)
+			if start > 0 && line[start-1] == '!' && end < len(line) && line[end] == ':' {
+				defLines = append(defLines, lineNum)
+				break
+			}
+		}
+	}
+	return defLines
+}
+
+// findIdentifierOccurrences returns the start offsets of name as a whole identifier,
+// skipping comments and string literals
+func findIdentifierOccurrences(line, name string) []int {
+	occurrences := []int{}
+	if name == "" {
+		return occurrences
+	}
+
+	limit := len(line)
+	if commentStart := findCommentStart(line); commentStart != -1 {
+		limit = commentStart
+	}
+
+	inString := false
+	for i := 0; i < limit; i++ {
+		if line[i] == '"' {
+			inString = !inString
+			continue
+		}
+		if inString || i+len(name) > limit || line[i:i+len(name)] != name {
+			continue
+		}
+		start, end := identifierBoundsAt(line, i)
+		if start == i && end == i+len(name) {
+			occurrences = append(occurrences, i)
+		}
+	}
+	return occurrences
+}
+
+// renameTextEdit builds a TextEdit replacing length bytes at start of a line with newText.
+// The range is converted to the UTF-16 code units LSP positions count.
+func renameTextEdit(text string, line, start, length int, newText string) map[string]interface{} {
+	return map[string]interface{}{
+		"range": Range{
+			Start: Position{Line: line, Character: utf8ToUTF16Offset(text, 0, start)},
+			End:   Position{Line: line, Character: utf8ToUTF16Offset(text, 0, start+length)},
+		},
+		"newText": newText,
+	}
+}
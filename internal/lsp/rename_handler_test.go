@@ -0,0 +1,49 @@
+package lsp
+
+import (
+	"reflect"
+	"testing"
+)
+
+// renameTestParams builds the params of a rename request at a UTF-16 position
+func renameTestParams(uri string, line, character int, newName string) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri},
+		"position":     map[string]interface{}{"line": float64(line), "character": float64(character)},
+		"newName":      newName,
+	}
+}
+
+func TestRenameUsesUTF16Columns(t *testing.T) {
+	loadTestData(t)
+	uri := "file:///rename/utf16.asm"
+	openTestDocument(t, uri, ".const size = 2\n.print \"Größe \" + size\n.print \"😀\" + size\n")
+
+	// The cursor on the last line, after the emoji that takes two UTF-16 code units
+	prepared, err := handlePrepareRename(renameTestParams(uri, 2, 15, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRange := Range{Start: Position{Line: 2, Character: 14}, End: Position{Line: 2, Character: 18}}
+	if got := prepared.(map[string]interface{})["range"]; got != wantRange {
+		t.Errorf("prepareRename range = %v, want %v", got, wantRange)
+	}
+
+	result, err := handleRename(renameTestParams(uri, 1, 18, "length"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edits := result.(map[string]interface{})["changes"].(map[string]interface{})[uri].([]interface{})
+	var got []Range
+	for _, edit := range edits {
+		got = append(got, edit.(map[string]interface{})["range"].(Range))
+	}
+	want := []Range{
+		{Start: Position{Line: 0, Character: 7}, End: Position{Line: 0, Character: 11}},
+		{Start: Position{Line: 1, Character: 18}, End: Position{Line: 1, Character: 22}},
+		{Start: Position{Line: 2, Character: 14}, End: Position{Line: 2, Character: 18}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rename edits at %v, want %v", got, want)
+	}
+}
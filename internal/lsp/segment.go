@@ -0,0 +1,627 @@
+package lsp
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// defaultStartAddress is the program counter before the first *= or segment of a document
+// that isn't #import'ed
+const defaultStartAddress = 0x1000
+
+// defaultSegment is the segment code goes to outside of a .segment
+const defaultSegment = "Default"
+
+// Segment is a Kick Assembler segment: memory blocks with a program counter of their own.
+// Addresses that aren't set are -1.
+type Segment struct {
+	Name         string
+	URI          string   // Document of the definition, empty for Default
+	Position     Position // Of the name in the definition
+	Start        int64
+	StartAfter   string
+	Align        int64 // 0 if not set
+	Min          int64
+	Max          int64
+	Fill         bool
+	FillByte     int64
+	Virtual      bool
+	AllowOverlap bool
+	Blocks       []*SegmentBlock // Blocks with code and named blocks, in the order they were started
+
+	token   Token     // Name in the definition
+	defined bool      // by a .segmentdef or by the parameters of a .segment
+	entered bool      // Pass 1 put code in the segment
+	pc      int64     // Program counter when Pass 1 left the segment
+	assumed int64     // Start of a startAfter segment when Pass 1 entered it
+	labels  []*Symbol // Labels in the segment, moved along with a startAfter segment
+}
+
+// SegmentBlock is a continuous range of memory in a segment. A block starts where a segment is
+// entered, at *= and at .memblock.
+type SegmentBlock struct {
+	Name     string // Empty if the block has no name
+	Segment  string
+	Start    int64
+	End      int64    // First address after the block
+	Position Position // Of the name, or of the directive that started the block
+
+	token   Token
+	emitted []emission // Bytes the statements in the block assemble to, in order
+}
+
+func newSegment(name string) *Segment {
+	return &Segment{Name: name, Start: -1, Min: -1, Max: -1}
+}
+
+// parameterType is the type of value a parameter of a segment directive takes
+type parameterType int
+
+const (
+	numberParameter parameterType = iota
+	stringParameter
+	flagParameter // Boolean, true if only the name is given
+	anyParameter
+)
+
+// segmentParameters are the parameters of .segmentdef and .segment [...]
+var segmentParameters = map[string]parameterType{
+	"start":        numberParameter,
+	"min":          numberParameter,
+	"max":          numberParameter,
+	"align":        numberParameter,
+	"fillByte":     numberParameter,
+	"startAfter":   stringParameter,
+	"segments":     stringParameter,
+	"dest":         stringParameter,
+	"outBin":       stringParameter,
+	"outPrg":       stringParameter,
+	"prgFiles":     stringParameter,
+	"sidFiles":     stringParameter,
+	"modify":       stringParameter,
+	"fill":         flagParameter,
+	"allowOverlap": flagParameter,
+	"virtual":      flagParameter,
+	"hide":         flagParameter,
+	"marg1":        anyParameter,
+	"marg2":        anyParameter,
+	"marg3":        anyParameter,
+	"marg4":        anyParameter,
+	"marg5":        anyParameter,
+}
+
+// fileParameters are the parameters of .file
+var fileParameters = map[string]parameterType{
+	"name":     stringParameter,
+	"type":     stringParameter,
+	"segments": stringParameter,
+	"prgFiles": stringParameter,
+	"sidFiles": stringParameter,
+	"modify":   stringParameter,
+	"mbfiles":  flagParameter,
+	"marg1":    anyParameter,
+	"marg2":    anyParameter,
+	"marg3":    anyParameter,
+	"marg4":    anyParameter,
+	"marg5":    anyParameter,
+}
+
+// segmentOutParameters are the parameters of .segmentout
+var segmentOutParameters = map[string]parameterType{
+	"segments": stringParameter,
+	"prgFiles": stringParameter,
+	"sidFiles": stringParameter,
+	"modify":   stringParameter,
+	"marg1":    anyParameter,
+	"marg2":    anyParameter,
+	"marg3":    anyParameter,
+	"marg4":    anyParameter,
+	"marg5":    anyParameter,
+}
+
+// segmentRef is a segment named in a parameter, checked once all segments are defined
+type segmentRef struct {
+	name  string
+	token Token
+}
+
+// lookupSegment returns a segment by name
+func (ctx *AnalysisContext) lookupSegment(name string) *Segment {
+	for _, segment := range ctx.Segments {
+		if segment.Name == name {
+			return segment
+		}
+	}
+	return nil
+}
+
+// beginSegments starts Pass 1 in the first block of the Default segment
+func (a *SemanticAnalyzer) beginSegments() {
+	segment := a.context.lookupSegment(defaultSegment)
+	if segment == nil {
+		segment = newSegment(defaultSegment)
+		a.context.Segments = append([]*Segment{segment}, a.context.Segments...)
+	}
+	segment.entered = true
+	a.context.currentSegment = segment
+	a.context.CurrentPC = a.startAddress
+	a.openMemoryBlock("", Token{Line: 1, Column: 1}, nil)
+}
+
+// openMemoryBlock starts a block of the current segment at the program counter
+func (a *SemanticAnalyzer) openMemoryBlock(name string, token Token, nameLiteral *StringLiteral) {
+	block := &SegmentBlock{
+		Name:     name,
+		Segment:  a.context.currentSegment.Name,
+		Start:    a.context.CurrentPC,
+		End:      a.context.CurrentPC,
+		Position: Position{Line: token.Line - 1, Character: token.Column - 1},
+		token:    token,
+	}
+	if nameLiteral != nil {
+		block.Position = Position{Line: nameLiteral.Token.Line - 1, Character: nameLiteral.Token.Column - 1}
+	}
+	a.context.currentBlock = block
+}
+
+// closeMemoryBlock ends the current block at the program counter. Blocks without code are
+// only kept if they have a name.
+func (a *SemanticAnalyzer) closeMemoryBlock() {
+	block := a.context.currentBlock
+	if block == nil {
+		return
+	}
+	a.context.currentBlock = nil
+	block.End = a.context.CurrentPC
+	if block.End > block.Start || block.Name != "" {
+		segment := a.context.currentSegment
+		segment.Blocks = append(segment.Blocks, block)
+	}
+}
+
+// setProgramCounter runs *=, which starts a new block of the current segment
+func (a *SemanticAnalyzer) setProgramCounter(node *DirectiveStatement, address int64) {
+	a.closeMemoryBlock()
+	a.context.CurrentPC = address
+	a.openMemoryBlock(descriptionText(node), node.Token, node.Description)
+}
+
+// startMemoryBlock runs .memblock, which names the code that follows
+func (a *SemanticAnalyzer) startMemoryBlock(node *DirectiveStatement) {
+	if node.Description == nil {
+		return
+	}
+	a.closeMemoryBlock()
+	a.openMemoryBlock(node.Description.Value, node.Token, node.Description)
+}
+
+// descriptionText returns the memory block name of a directive, empty if it has none
+func descriptionText(node *DirectiveStatement) string {
+	if node.Description == nil {
+		return ""
+	}
+	return node.Description.Value
+}
+
+// defineSegment runs .segmentdef, and the parameters of a .segment that defines its segment
+func (a *SemanticAnalyzer) defineSegment(node *DirectiveStatement, directive string) *Segment {
+	name := node.Name.Value
+	segment := a.context.lookupSegment(name)
+	if segment != nil && segment.defined {
+		// A loop or macro runs the same definition again
+		if segment.URI == a.documentURI() && segment.token == node.Name.Token {
+			return segment
+		}
+		if segment.URI == a.documentURI() {
+			a.addError(node.Name.Token, "Segment '%s' is already defined in line %d", name, segment.token.Line)
+		} else {
+			a.addError(node.Name.Token, "Segment '%s' is already defined in %s", name, filepath.Base(uriToPath(segment.URI)))
+		}
+		return segment
+	}
+	if segment == nil {
+		segment = newSegment(name)
+		a.context.Segments = append(a.context.Segments, segment)
+	}
+	segment.defined = true
+	segment.URI = a.documentURI()
+	segment.Position = Position{Line: node.Name.Token.Line - 1, Character: node.Name.Token.Column - 1}
+	segment.token = node.Name.Token
+
+	values := a.parameterValues(directive, node.Options, segmentParameters)
+	address := func(parameter string, max int64) int64 {
+		value, ok := values[parameter]
+		if !ok {
+			return -1
+		}
+		number, _ := value.Int()
+		if number < 0 || number > max {
+			a.addError(node.Options.Lookup(parameter).Name.Token, "Parameter '%s' is out of range ($0-$%X), got $%X", parameter, max, number)
+			return -1
+		}
+		return number
+	}
+	segment.Start = address("start", 0xFFFF)
+	segment.Min = address("min", 0xFFFF)
+	segment.Max = address("max", 0xFFFF)
+	if align := address("align", 0xFFFF); align > 0 {
+		segment.Align = align
+	}
+	if fillByte := address("fillByte", 0xFF); fillByte >= 0 {
+		segment.FillByte = fillByte
+	}
+	if startAfter, ok := values["startAfter"]; ok {
+		segment.StartAfter = startAfter.Text
+		a.segmentRefs = append(a.segmentRefs, segmentRef{name: startAfter.Text, token: node.Options.Lookup("startAfter").Name.Token})
+	}
+	if segments, ok := values["segments"]; ok {
+		a.referSegments(segments.Text, node.Options.Lookup("segments").Name.Token)
+	}
+	segment.Fill = values["fill"].Boolean
+	segment.Virtual = values["virtual"].Boolean
+	segment.AllowOverlap = values["allowOverlap"].Boolean
+
+	if segment.Start >= 0 && segment.StartAfter != "" {
+		a.addError(node.Name.Token, "Segment '%s' has both start and startAfter, only one of them can be given", name)
+	}
+	if segment.Min >= 0 && segment.Max >= 0 && segment.Min > segment.Max {
+		a.addError(node.Name.Token, "Segment '%s' has a min of $%04X above its max of $%04X", name, segment.Min, segment.Max)
+	}
+	if segment.Start >= 0 && segment.Min >= 0 && segment.Start < segment.Min {
+		a.addError(node.Name.Token, "Segment '%s' starts at $%04X, below its min of $%04X", name, segment.Start, segment.Min)
+	}
+	return segment
+}
+
+// enterSegment runs .segment: the segment continues where it was left, or starts a block at
+// its start address the first time
+func (a *SemanticAnalyzer) enterSegment(node *DirectiveStatement) {
+	name := node.Name.Value
+	segment := a.context.lookupSegment(name)
+	if node.Options != nil {
+		if segment != nil && segment.defined && segment.token != node.Name.Token {
+			a.addError(node.Options.Token, "Segment '%s' is already defined, .segment can only give parameters to a new segment", name)
+		} else {
+			segment = a.defineSegment(node, ".segment")
+		}
+	}
+	if segment == nil {
+		// It may be defined further down, else that is reported once Pass 1 is done
+		segment = newSegment(name)
+		a.context.Segments = append(a.context.Segments, segment)
+		a.segmentRefs = append(a.segmentRefs, segmentRef{name: name, token: node.Name.Token})
+	}
+
+	a.closeMemoryBlock()
+	a.context.currentSegment.pc = a.context.CurrentPC
+	a.context.currentSegment = segment
+	if !segment.entered {
+		segment.entered = true
+		segment.pc = a.segmentStart(segment, 0)
+		segment.assumed = segment.pc
+	}
+	a.context.CurrentPC = segment.pc
+	a.openMemoryBlock(descriptionText(node), node.Token, node.Description)
+}
+
+// checkFileDirective checks the parameters of .file and .segmentout
+func (a *SemanticAnalyzer) checkFileDirective(node *DirectiveStatement, directive string) {
+	known := fileParameters
+	if directive == ".segmentout" {
+		known = segmentOutParameters
+	}
+	values := a.parameterValues(directive, node.Options, known)
+	if segments, ok := values["segments"]; ok {
+		a.referSegments(segments.Text, node.Options.Lookup("segments").Name.Token)
+	}
+	if directive != ".file" {
+		return
+	}
+	if node.Options.Lookup("name") == nil {
+		a.addError(node.Token, ".file needs a name parameter: .file [name=\"file.prg\", ...]")
+	}
+	if fileType, ok := values["type"]; ok && fileType.Text != "prg" && fileType.Text != "bin" {
+		a.addError(node.Options.Lookup("type").Name.Token, "Unknown file type '%s', valid types are prg and bin", fileType.Text)
+	}
+}
+
+// parameterValues evaluates the parameters of a segment directive. Parameters the directive
+// doesn't have and values of the wrong type are reported, values that aren't known left out.
+func (a *SemanticAnalyzer) parameterValues(directive string, options *ParameterList, known map[string]parameterType) map[string]Value {
+	values := make(map[string]Value)
+	if options == nil {
+		return values
+	}
+	expected := map[parameterType]ValueKind{
+		numberParameter: ValueNumber,
+		stringParameter: ValueString,
+		flagParameter:   ValueBoolean,
+	}
+	for _, parameter := range options.Parameters {
+		name := parameter.Name.Value
+		kind, ok := known[name]
+		if !ok {
+			a.addWarning(parameter.Name.Token, "Unknown parameter '%s' for %s", name, directive)
+			continue
+		}
+		if _, seen := values[name]; seen {
+			a.addWarning(parameter.Name.Token, "Parameter '%s' is given more than once", name)
+		}
+		if parameter.Value == nil {
+			if kind == flagParameter || kind == anyParameter {
+				values[name] = Value{Kind: ValueBoolean, Boolean: true}
+			} else {
+				a.addError(parameter.Name.Token, "Parameter '%s' needs a value: %s=...", name, name)
+			}
+			continue
+		}
+
+		value := a.evaluateValue(parameter.Value)
+		a.reportValueError(value)
+		if !value.Known() {
+			continue
+		}
+		if want, typed := expected[kind]; typed && value.Kind != want {
+			a.addError(parameter.Name.Token, "Parameter '%s' must be a %s, got %s", name, Value{Kind: want}.TypeName(), value.TypeName())
+			continue
+		}
+		values[name] = value
+	}
+	return values
+}
+
+// referSegments records the segments of a comma separated list, like segments="Code,Data"
+func (a *SemanticAnalyzer) referSegments(list string, token Token) {
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			a.segmentRefs = append(a.segmentRefs, segmentRef{name: name, token: token})
+		}
+	}
+}
+
+// segmentStart returns the address a segment starts at: its start, the end of the segment it
+// starts after, its min or the default start address
+func (a *SemanticAnalyzer) segmentStart(segment *Segment, depth int) int64 {
+	start := int64(defaultStartAddress)
+	switch {
+	case segment.Start >= 0:
+		start = segment.Start
+	case segment.StartAfter != "":
+		if previous := a.context.lookupSegment(segment.StartAfter); previous != nil && depth < len(a.context.Segments) {
+			start = a.segmentEnd(previous, depth+1)
+		} else if segment.Min >= 0 {
+			start = segment.Min
+		}
+	case segment.Min >= 0:
+		start = segment.Min
+	}
+	if segment.Align > 0 && start%segment.Align != 0 {
+		start += segment.Align - start%segment.Align
+	}
+	return start
+}
+
+// segmentEnd returns the first address after the code of a segment
+func (a *SemanticAnalyzer) segmentEnd(segment *Segment, depth int) int64 {
+	if !segment.entered {
+		return a.segmentStart(segment, depth)
+	}
+	end := segment.pc
+	if segment == a.context.currentSegment {
+		end = a.context.CurrentPC
+	}
+	for _, block := range segment.Blocks {
+		end = max(end, block.End)
+	}
+	return end
+}
+
+// finishSegments ends Pass 1: segments that start after another one move to where that one
+// really ends, then the segments are checked against their bounds and for overlaps
+func (a *SemanticAnalyzer) finishSegments() {
+	a.closeMemoryBlock()
+	a.context.currentSegment.pc = a.context.CurrentPC
+
+	placed := make(map[*Segment]bool)
+	for _, segment := range a.context.Segments {
+		a.placeSegment(segment, placed, 0)
+	}
+
+	for _, ref := range a.segmentRefs {
+		if segment := a.context.lookupSegment(ref.name); segment == nil || (!segment.defined && segment.Name != defaultSegment) {
+			a.addError(ref.token, "Unknown segment '%s'", ref.name)
+		}
+	}
+
+	for _, segment := range a.context.Segments {
+		// Imported definitions are checked with their own document
+		if segment.defined && segment.URI == a.documentURI() {
+			a.checkSegmentCycle(segment)
+		}
+		a.checkSegmentBounds(segment)
+	}
+	a.checkMemoryOverlaps()
+}
+
+// placeSegment moves a segment that starts after another one, and its labels, to the end of
+// that segment. Pass 1 could only assume where it ends, code may be added to it further down.
+func (a *SemanticAnalyzer) placeSegment(segment *Segment, placed map[*Segment]bool, depth int) {
+	if placed[segment] || depth > len(a.context.Segments) {
+		return
+	}
+	placed[segment] = true
+	if !segment.entered || segment.StartAfter == "" || segment.Start >= 0 {
+		return
+	}
+	previous := a.context.lookupSegment(segment.StartAfter)
+	if previous == nil {
+		return
+	}
+	a.placeSegment(previous, placed, depth+1)
+
+	delta := a.segmentStart(segment, 0) - segment.assumed
+	if delta == 0 {
+		return
+	}
+	segment.assumed += delta
+	segment.pc += delta
+	for _, block := range segment.Blocks {
+		block.Start += delta
+		block.End += delta
+		for i := range block.emitted {
+			block.emitted[i].start += delta
+			block.emitted[i].end += delta
+		}
+	}
+	for _, label := range segment.labels {
+		label.Address += delta
+	}
+}
+
+// checkSegmentCycle reports a segment that starts after itself through startAfter
+func (a *SemanticAnalyzer) checkSegmentCycle(segment *Segment) {
+	current := segment
+	for i := 0; i < len(a.context.Segments) && current.StartAfter != ""; i++ {
+		current = a.context.lookupSegment(current.StartAfter)
+		if current == nil {
+			return
+		}
+		if current == segment {
+			a.addError(segment.token, "Segment '%s' starts after itself through startAfter", segment.Name)
+			return
+		}
+	}
+}
+
+// checkSegmentBounds reports a segment with code below its min or beyond its max, at the
+// directive that started the block
+func (a *SemanticAnalyzer) checkSegmentBounds(segment *Segment) {
+	for _, block := range segment.Blocks {
+		if block.End == block.Start {
+			continue
+		}
+		if segment.Min >= 0 && block.Start < segment.Min {
+			a.addError(block.token, "Segment '%s' starts at $%04X, below its min of $%04X", segment.Name, block.Start, segment.Min)
+			return
+		}
+		if segment.Max >= 0 && block.End-1 > segment.Max {
+			a.addError(block.token, "Segment '%s' exceeds its max of $%04X: the code ends at $%04X", segment.Name, segment.Max, block.End-1)
+			return
+		}
+		if block.End > 0x10000 {
+			a.addError(block.token, "Segment '%s' exceeds the 64K address space: the code ends at $%X", segment.Name, block.End-1)
+			return
+		}
+	}
+}
+
+// recordSegmentLabel remembers a label of the current segment, so it moves with the segment
+func (a *SemanticAnalyzer) recordSegmentLabel(symbol *Symbol) {
+	if a.context.currentSegment != nil {
+		a.context.currentSegment.labels = append(a.context.currentSegment.labels, symbol)
+	}
+}
+
+// importSegments makes the segment definitions of an imported file known. Its blocks stay
+// with the imported file.
+func (a *SemanticAnalyzer) importSegments(imported *AnalysisContext) {
+	for _, segment := range imported.Segments {
+		if !segment.defined || a.context.lookupSegment(segment.Name) != nil {
+			continue
+		}
+		definition := *segment
+		definition.Blocks = nil
+		definition.entered = false
+		definition.pc = 0
+		definition.assumed = 0
+		definition.labels = nil
+		a.context.Segments = append(a.context.Segments, &definition)
+	}
+}
+
+// includeImportedCode continues Pass 1 after the code of an #import'ed file, which was
+// analysed at the program counter of the #import. Its memory blocks are added to the current
+// segment as blocks of their own, attributed to the #import, so they are checked for
+// overlaps with the importing file's blocks. Its labels are copied, so they move with the
+// current segment without changing the indexed file; the copies are returned by original.
+func (a *SemanticAnalyzer) includeImportedCode(imported *AnalysisContext, token Token) map[*Symbol]*Symbol {
+	segment := imported.lookupSegment(defaultSegment)
+	if segment == nil || !segment.entered || a.inMacroOrFunction {
+		return nil
+	}
+	current := a.context.currentSegment
+	for _, block := range segment.Blocks {
+		if len(block.emitted) == 0 || current.Virtual {
+			continue
+		}
+		included := &SegmentBlock{
+			Segment:  current.Name,
+			Start:    block.Start,
+			End:      block.End,
+			Position: Position{Line: token.Line - 1, Character: token.Column - 1},
+			token:    token,
+		}
+		for _, e := range block.emitted {
+			included.emitted = append(included.emitted, emission{start: e.start, end: e.end, token: token})
+		}
+		current.Blocks = append(current.Blocks, included)
+	}
+
+	copies := make(map[*Symbol]*Symbol, len(segment.labels))
+	for _, label := range segment.labels {
+		copied := *label
+		copies[label] = &copied
+		a.recordSegmentLabel(&copied)
+	}
+	a.context.CurrentPC = segment.pc
+	return copies
+}
+
+// documentURI returns the URI of the document being analyzed
+func (a *SemanticAnalyzer) documentURI() string {
+	if a.scope == nil {
+		return ""
+	}
+	return a.scope.Uri
+}
+
+// memoryBlockSymbols returns the named memory blocks of a document as document symbols
+func memoryBlockSymbols(uri string) []DocumentSymbol {
+	symbolStore.RLock()
+	context := symbolStore.contexts[uri]
+	symbolStore.RUnlock()
+	if context == nil {
+		return nil
+	}
+
+	var symbols []DocumentSymbol
+	for _, segment := range context.Segments {
+		for _, block := range segment.Blocks {
+			if block.Name == "" {
+				continue
+			}
+			detail := fmt.Sprintf("$%04X-$%04X", block.Start, max(block.Start, block.End-1))
+			if block.End == block.Start {
+				detail = fmt.Sprintf("$%04X, empty", block.Start)
+			}
+			if segment.Name != defaultSegment {
+				detail += " in " + segment.Name
+			}
+			// The name is written with quotes
+			nameRange := Range{
+				Start: block.Position,
+				End:   Position{Line: block.Position.Line, Character: block.Position.Character + len(block.Name) + 2},
+			}
+			symbols = append(symbols, DocumentSymbol{
+				Name:           block.Name,
+				Detail:         detail,
+				Kind:           2, // Module
+				Range:          nameRange,
+				SelectionRange: nameRange,
+				Children:       []DocumentSymbol{},
+			})
+		}
+	}
+	return symbols
+}
@@ -0,0 +1,186 @@
+package lsp
+
+import "testing"
+
+// segmentTest is a document with the label addresses and errors its analysis must have.
+// Without errors listed, the document must have none.
+type segmentTest struct {
+	name   string
+	source string
+	labels map[string]int64
+	errors []string
+}
+
+// runSegmentTests analyses each test's source as main.asm, next to the given files
+func runSegmentTests(t *testing.T, tests []segmentTest, files map[string]string) {
+	t.Helper()
+	loadTestData(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			project := map[string]string{"main.asm": test.source}
+			for name, content := range files {
+				project[name] = content
+			}
+			context, diagnostics := analyzeTestFile(t, writeTestFiles(t, project), "main.asm")
+			for label, want := range test.labels {
+				if got := lookupTestLabel(t, context, label); got != want {
+					t.Errorf("%s = $%04X, want $%04X", label, got, want)
+				}
+			}
+			for _, want := range test.errors {
+				if !hasDiagnostic(diagnostics, want) {
+					t.Errorf("no diagnostic %q in %v", want, diagnostics)
+				}
+			}
+			if len(test.errors) == 0 {
+				for _, diagnostic := range diagnostics {
+					if diagnostic.Severity == SeverityError {
+						t.Errorf("unexpected error: %s", diagnostic.Message)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSegmentPlacement(t *testing.T) {
+	runSegmentTests(t, []segmentTest{
+		{
+			name: "startAfter moves the segment and its labels",
+			source: `.segmentdef Code [start=$0810]
+.segmentdef Data [startAfter="Code"]
+.segment Data
+table: .byte 1, 2
+.segment Code
+start: lda table
+    rts
+`,
+			labels: map[string]int64{"start": 0x0810, "table": 0x0814},
+		},
+		{
+			name: "startAfter with align",
+			source: `.segmentdef Code [start=$0810]
+.segmentdef Data [startAfter="Code", align=$100]
+.segment Code
+    jmp *
+.segment Data
+table: .byte 1
+`,
+			labels: map[string]int64{"table": 0x0900},
+		},
+		{
+			name: "chained startAfter",
+			source: `.segmentdef A [start=$1000]
+.segmentdef B [startAfter="A"]
+.segmentdef C [startAfter="B"]
+.segment C
+c: nop
+.segment B
+b: .word 0, 0
+.segment A
+a: .fill 16, 0
+`,
+			labels: map[string]int64{"a": 0x1000, "b": 0x1010, "c": 0x1014},
+		},
+		{
+			name: "each segment keeps its program counter",
+			source: `.segmentdef Code [start=$1000]
+.segmentdef Data [start=$2000]
+.segment Code
+one: nop
+.segment Data
+two: .byte 0
+.segment Code
+three: nop
+`,
+			labels: map[string]int64{"one": 0x1000, "two": 0x2000, "three": 0x1001},
+		},
+		{
+			name: "startAfter cycle",
+			source: `.segmentdef A [startAfter="B"]
+.segmentdef B [startAfter="A"]
+`,
+			errors: []string{"Segment 'A' starts after itself through startAfter"},
+		},
+		{
+			name:   "unknown segment",
+			source: ".segment Missing\n    nop\n",
+			errors: []string{"Unknown segment 'Missing'"},
+		},
+	}, nil)
+}
+
+func TestSegmentBounds(t *testing.T) {
+	runSegmentTests(t, []segmentTest{
+		{
+			name:   "code up to max",
+			source: ".segmentdef Code [start=$1000, max=$1003]\n.segment Code\n    jmp $1000\n    rts\n",
+		},
+		{
+			name:   "code beyond max",
+			source: ".segmentdef Code [start=$1000, max=$1002]\n.segment Code\n    jmp $1000\n    rts\n",
+			errors: []string{"Segment 'Code' exceeds its max of $1002: the code ends at $1003"},
+		},
+		{
+			name:   "data beyond max",
+			source: ".segmentdef Data [start=$1000, max=$1004]\n.segment Data\n.word 1, 2, 3\n",
+			errors: []string{"Segment 'Data' exceeds its max of $1004: the code ends at $1005"},
+		},
+		{
+			name:   "block below min",
+			source: ".segmentdef Code [start=$1000, min=$1000]\n.segment Code\n*=$0f00\n    nop\n",
+			errors: []string{"Segment 'Code' starts at $0F00, below its min of $1000"},
+		},
+		{
+			name:   "start below min",
+			source: ".segmentdef Code [start=$0f00, min=$1000]\n",
+			errors: []string{"Segment 'Code' starts at $0F00, below its min of $1000"},
+		},
+		{
+			name:   "min above max",
+			source: ".segmentdef Code [min=$2000, max=$1000]\n",
+			errors: []string{"Segment 'Code' has a min of $2000 above its max of $1000"},
+		},
+		{
+			name:   "start and startAfter",
+			source: ".segmentdef A [start=$1000]\n.segmentdef B [start=$2000, startAfter=\"A\"]\n",
+			errors: []string{"Segment 'B' has both start and startAfter, only one of them can be given"},
+		},
+	}, nil)
+}
+
+func TestSegmentFlags(t *testing.T) {
+	runSegmentTests(t, []segmentTest{
+		{
+			name: "virtual segments assemble no bytes",
+			source: `.segmentdef Vars [start=$1000, virtual]
+.segment Vars
+buffer: .fill 16, 0
+.segment Default
+*=$1000
+    nop
+`,
+			labels: map[string]int64{"buffer": 0x1000},
+		},
+		{
+			name: "allowOverlap lets blocks of a segment overlap",
+			source: `.segmentdef Patches [start=$1000, allowOverlap]
+.segment Patches
+    nop
+*=$1000
+    rts
+`,
+		},
+		{
+			name: "allowOverlap doesn't cover other segments",
+			source: `.segmentdef Patches [start=$1000, allowOverlap]
+.segment Patches
+    nop
+.segment Default
+*=$1000
+    rts
+`,
+			errors: []string{"Memory overlap: $1000 is also assembled in line 3"},
+		},
+	}, nil)
+}
@@ -13,12 +13,15 @@ func generateSemanticTokens(uri string, text string) []int {
 	// Get the symbol tree for context
 	symbolStore.RLock()
 	tree, exists := symbolStore.trees[uri]
+	analysis := symbolStore.contexts[uri]
 	symbolStore.RUnlock()
 
 	if !exists {
 		log.Debug("generateSemanticTokens: No symbol tree found, parsing document now")
 		// Parse document to get symbol tree
-		tree, context, _ := ParseDocument(uri, text)
+		var context *AnalysisContext
+		tree, context, _ = ParseDocument(uri, text)
+		analysis = context
 		// Store it for future use
 		symbolStore.Lock()
 		symbolStore.trees[uri] = tree
@@ -27,7 +30,7 @@ func generateSemanticTokens(uri string, text string) []int {
 	}
 	
 	// Create context-aware lexer to tokenize the text
-	lexer := NewContextAwareLexer(text, globalProcessorContext)
+	lexer := NewContextAwareLexer(text, GetProcessorContext())
 	tokens := []int{}
 
 	// Solution A: Dual Position Tracking (Single Pass)
@@ -64,6 +67,10 @@ func generateSemanticTokens(uri string, text string) []int {
 			// Skip this token - don't update lastEmitted positions
 			continue
 		}
+		// Code in an #if or .if branch that isn't assembled
+		if analysis.isInactive(Position{Line: line, Character: char}) {
+			modifiers |= 1 << SemanticTokenModifierInactive
+		}
 
 		// Special handling for hex/binary numbers with prefix ($d020, %10101010)
 		// Split into two tokens: prefix (operator) + number
@@ -76,7 +83,7 @@ func generateSemanticTokens(uri string, text string) []int {
 				if deltaLine == 0 {
 					deltaChar = char - lastEmittedChar
 				}
-				tokens = append(tokens, deltaLine, deltaChar, 1, SemanticTokenOperator, 0)
+				tokens = append(tokens, deltaLine, deltaChar, 1, SemanticTokenOperator, modifiers&(1<<SemanticTokenModifierInactive))
 				tokenCount++
 				lastEmittedLine = line
 				lastEmittedChar = char
@@ -177,7 +184,11 @@ func getSemanticTokenType(token Token, tree *Scope) (int, int) {
 		return SemanticTokenVariable, SemanticTokenModifierReadonly // Built-in constants
 
 	case TOKEN_HASH, TOKEN_LESS, TOKEN_GREATER, TOKEN_PLUS, TOKEN_MINUS,
-		 TOKEN_ASTERISK, TOKEN_SLASH, TOKEN_EQUAL:
+		 TOKEN_ASTERISK, TOKEN_SLASH, TOKEN_EQUAL,
+		 TOKEN_LEFT_SHIFT, TOKEN_RIGHT_SHIFT, TOKEN_BITWISE_AND, TOKEN_BITWISE_OR, TOKEN_BITWISE_XOR,
+		 TOKEN_MODULO, TOKEN_BITWISE_NOT, TOKEN_EQUAL_EQUAL, TOKEN_NOT_EQUAL, TOKEN_LESS_EQUAL,
+		 TOKEN_GREATER_EQUAL, TOKEN_LOGICAL_AND, TOKEN_LOGICAL_OR, TOKEN_BANG, TOKEN_INCREMENT,
+		 TOKEN_DECREMENT, TOKEN_PLUS_EQUAL, TOKEN_MINUS_EQUAL, TOKEN_TIMES_EQUAL, TOKEN_DIVIDE_EQUAL:
 		return SemanticTokenOperator, 0 // Operators
 
 	case TOKEN_LPAREN, TOKEN_RPAREN, TOKEN_LBRACKET, TOKEN_RBRACKET,
@@ -212,6 +223,7 @@ const (
 const (
 	SemanticTokenModifierDeclaration = iota
 	SemanticTokenModifierReadonly
+	SemanticTokenModifierInactive // code that isn't assembled
 )
 
 // encodeSemanticToken encodes a semantic token for LSP
@@ -287,3 +299,16 @@ func utf8ToUTF16Offset(text string, targetLine int, byteOffset int) int {
 
 	return 0
 }
+
+// utf16ToUTF8Offset converts a UTF-16 code unit offset on a line to a UTF-8 byte offset.
+// It is the inverse of utf8ToUTF16Offset; offsets past the end of the line are clamped.
+func utf16ToUTF8Offset(line string, utf16Offset int) int {
+	units := 0
+	for byteOffset, r := range line {
+		if units >= utf16Offset {
+			return byteOffset
+		}
+		units += utf16Length(string(r))
+	}
+	return len(line)
+}
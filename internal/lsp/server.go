@@ -2,6 +2,7 @@ package lsp
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -9,8 +10,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -105,19 +106,28 @@ type DocumentSymbol struct {
 	Children       []DocumentSymbol `json:"children,omitempty"`
 }
 
-// Global variable to store mnemonic data
-var mnemonics []Mnemonic
-var c64MemoryMap C64MemoryMap
+// Mnemonic, memory map and built-in data live in the published dataSnapshot (data_files.go)
 var kickassDirectives []KickassDirective
-var builtinFunctions []BuiltinFunction
-var builtinConstants []BuiltinConstant
 var warnUnusedLabelsEnabled bool
 
 // LSPConfiguration holds all configurable LSP settings
 type LSPConfiguration struct {
+	// Named profile applied before the other settings, see builtinProfiles
+	Profile string `json:"profile"`
+	// User-defined profiles by name, each may extend another profile
+	Profiles map[string]map[string]interface{} `json:"profiles"`
+
 	// General Analysis Settings
 	WarnUnusedLabels bool `json:"warnUnusedLabels"`
 
+	// Source Imports
+	LibraryDirs []string `json:"libraryDirs"` // Additional search paths for #import
+
+	// Preprocessor symbols of the build, like Kick Assembler's -define option
+	Defines       []string            `json:"defines"`       // Defined in every build variant
+	BuildVariants map[string][]string `json:"buildVariants"` // Variant name -> its defines
+	BuildVariant  string              `json:"buildVariant"`  // The variant to analyse
+
 	// 6502-Specific Features
 	ZeroPageOptimization struct {
 		Enabled   bool `json:"enabled"`
@@ -165,6 +175,31 @@ type LSPConfiguration struct {
 		DescriptiveLabels  bool `json:"descriptiveLabels"`
 	} `json:"styleGuideEnforcement"`
 
+	CycleBudgetValidation struct {
+		Enabled      bool `json:"enabled"`
+		ShowWarnings bool `json:"showWarnings"`
+	} `json:"cycleBudgetValidation"`
+
+	// Cycle count inlay hints
+	CycleHints struct {
+		Enabled          bool `json:"enabled"`
+		ShowRunningTotal bool `json:"showRunningTotal"`
+	} `json:"cycleHints"`
+
+	// Label addresses from the last Kick Assembler build (.sym, .vs, .dbg)
+	AssemblerSymbols struct {
+		Enabled        bool `json:"enabled"`
+		ShowMismatches bool `json:"showMismatches"`
+		AddressHints   bool `json:"addressHints"`
+	} `json:"assemblerSymbols"`
+
+	// Budget for analysing a single document, so pathological input can't stall the server
+	AnalysisLimits struct {
+		TimeoutMs         int `json:"timeoutMs"`         // 0 disables the time limit
+		MaxNestingDepth   int `json:"maxNestingDepth"`   // nested blocks and parentheses
+		MaxLoopIterations int `json:"maxLoopIterations"` // iterations of one .for/.while loop, 0 = unlimited
+	} `json:"analysisLimits"`
+
 	// Document Formatting
 	Formatting FormattingConfig `json:"formatting"`
 
@@ -255,6 +290,38 @@ var lspConfig = &LSPConfiguration{
 		UpperCaseConstants: true,
 		DescriptiveLabels:  true,
 	},
+	CycleBudgetValidation: struct {
+		Enabled      bool `json:"enabled"`
+		ShowWarnings bool `json:"showWarnings"`
+	}{
+		Enabled:      true,
+		ShowWarnings: true,
+	},
+	CycleHints: struct {
+		Enabled          bool `json:"enabled"`
+		ShowRunningTotal bool `json:"showRunningTotal"`
+	}{
+		Enabled:          true,
+		ShowRunningTotal: true,
+	},
+	AssemblerSymbols: struct {
+		Enabled        bool `json:"enabled"`
+		ShowMismatches bool `json:"showMismatches"`
+		AddressHints   bool `json:"addressHints"`
+	}{
+		Enabled:        true,
+		ShowMismatches: true,
+		AddressHints:   true,
+	},
+	AnalysisLimits: struct {
+		TimeoutMs         int `json:"timeoutMs"`
+		MaxNestingDepth   int `json:"maxNestingDepth"`
+		MaxLoopIterations int `json:"maxLoopIterations"`
+	}{
+		TimeoutMs:         5000,
+		MaxNestingDepth:   200,
+		MaxLoopIterations: 10000,
+	},
 
 	// Document Formatting - enabled by default with sensible defaults
 	Formatting: DefaultFormattingConfig(),
@@ -286,6 +353,10 @@ var lspConfig = &LSPConfiguration{
 // configMutex protects access to lspConfig
 var configMutex sync.RWMutex
 
+// editorSettingsReceived is set once the client sent settings, for showing where the
+// configuration comes from
+var editorSettingsReceived = false
+
 // GetLSPConfig returns a copy of the current configuration
 func GetLSPConfig() LSPConfiguration {
 	configMutex.RLock()
@@ -298,6 +369,29 @@ func UpdateLSPConfig(settings map[string]interface{}) {
 	configMutex.Lock()
 	defer configMutex.Unlock()
 
+	oldUseContextAware := lspConfig.ParserFeatureFlags.UseContextAware
+	applyLSPSettings(lspConfig, settings)
+	editorSettingsReceived = true
+
+	// Log significant parser mode changes
+	if oldUseContextAware != lspConfig.ParserFeatureFlags.UseContextAware {
+		if lspConfig.ParserFeatureFlags.UseContextAware {
+			log.Info("Switched to context-aware parser (experimental)")
+		} else {
+			log.Info("Switched to legacy parser")
+		}
+	}
+
+	if lspConfig.ParserFeatureFlags.DebugMode {
+		log.Debug("Parser debug mode enabled")
+	}
+
+	log.Debug("LSP Configuration updated")
+}
+
+// applyLSPSettings copies the settings found in a map into config. Missing or mistyped
+// values keep their current value.
+func applyLSPSettings(config *LSPConfiguration, settings map[string]interface{}) {
 	// Helper function to safely get bool from map
 	getBool := func(m map[string]interface{}, key string, defaultValue bool) bool {
 		if val, ok := m[key]; ok {
@@ -308,6 +402,16 @@ func UpdateLSPConfig(settings map[string]interface{}) {
 		return defaultValue
 	}
 
+	// Helper function to safely get a non-negative integer from map
+	getInt := func(m map[string]interface{}, key string, defaultValue int) int {
+		if val, ok := m[key]; ok {
+			if n, ok := val.(float64); ok && n >= 0 {
+				return int(n)
+			}
+		}
+		return defaultValue
+	}
+
 	// Helper function to safely get nested object
 	getObject := func(m map[string]interface{}, key string) map[string]interface{} {
 		if val, ok := m[key]; ok {
@@ -318,94 +422,167 @@ func UpdateLSPConfig(settings map[string]interface{}) {
 		return make(map[string]interface{})
 	}
 
+	// Helper function to safely get a list of strings from map
+	getStringList := func(m map[string]interface{}, key string, defaultValue []string) []string {
+		if val, ok := m[key]; ok {
+			if list, ok := val.([]interface{}); ok {
+				result := make([]string, 0, len(list))
+				for _, item := range list {
+					if str, ok := item.(string); ok {
+						result = append(result, str)
+					}
+				}
+				return result
+			}
+		}
+		return defaultValue
+	}
+
+	// Profiles defined here can be used here and in every settings layer above
+	if profiles := getObject(settings, "profiles"); len(profiles) > 0 {
+		merged := make(map[string]map[string]interface{}, len(config.Profiles)+len(profiles))
+		for name, profile := range config.Profiles {
+			merged[name] = profile
+		}
+		for name, profile := range profiles {
+			if profileSettings, ok := profile.(map[string]interface{}); ok && builtinProfiles[name] == nil {
+				merged[name] = profileSettings
+			}
+		}
+		config.Profiles = merged
+	}
+
+	// A profile comes first, the other settings next to it override it
+	if name, ok := settings["profile"].(string); ok && name != "" {
+		layers, err := profileLayers(name, config.Profiles, nil)
+		if err != nil {
+			log.Warn("Profile %q not applied: %v", name, err)
+		} else {
+			for _, layer := range layers {
+				applyLSPSettings(config, layer)
+			}
+			config.Profile = name
+		}
+	}
+
 	// Update general settings
-	lspConfig.WarnUnusedLabels = getBool(settings, "warnUnusedLabels", lspConfig.WarnUnusedLabels)
+	config.WarnUnusedLabels = getBool(settings, "warnUnusedLabels", config.WarnUnusedLabels)
+
+	// Update import search paths
+	config.LibraryDirs = getStringList(settings, "libraryDirs", config.LibraryDirs)
+
+	// Update build defines. Variants merge by name, so a project file can add variants to
+	// the ones from the editor settings.
+	config.Defines = getStringList(settings, "defines", config.Defines)
+	if variants := getObject(settings, "buildVariants"); len(variants) > 0 {
+		merged := make(map[string][]string, len(config.BuildVariants)+len(variants))
+		for name, defines := range config.BuildVariants {
+			merged[name] = defines
+		}
+		for name := range variants {
+			merged[name] = getStringList(variants, name, nil)
+		}
+		config.BuildVariants = merged
+	}
+	if name, ok := settings["buildVariant"].(string); ok {
+		config.BuildVariant = name
+	}
 
 	// Update zero page optimization
 	if zpo := getObject(settings, "zeroPageOptimization"); len(zpo) > 0 {
-		lspConfig.ZeroPageOptimization.Enabled = getBool(zpo, "enabled", lspConfig.ZeroPageOptimization.Enabled)
-		lspConfig.ZeroPageOptimization.ShowHints = getBool(zpo, "showHints", lspConfig.ZeroPageOptimization.ShowHints)
+		config.ZeroPageOptimization.Enabled = getBool(zpo, "enabled", config.ZeroPageOptimization.Enabled)
+		config.ZeroPageOptimization.ShowHints = getBool(zpo, "showHints", config.ZeroPageOptimization.ShowHints)
 	}
 
 	// Update branch distance validation
 	if bdv := getObject(settings, "branchDistanceValidation"); len(bdv) > 0 {
-		lspConfig.BranchDistanceValidation.Enabled = getBool(bdv, "enabled", lspConfig.BranchDistanceValidation.Enabled)
-		lspConfig.BranchDistanceValidation.ShowWarnings = getBool(bdv, "showWarnings", lspConfig.BranchDistanceValidation.ShowWarnings)
+		config.BranchDistanceValidation.Enabled = getBool(bdv, "enabled", config.BranchDistanceValidation.Enabled)
+		config.BranchDistanceValidation.ShowWarnings = getBool(bdv, "showWarnings", config.BranchDistanceValidation.ShowWarnings)
 	}
 
 	// Update illegal opcode detection
 	if iod := getObject(settings, "illegalOpcodeDetection"); len(iod) > 0 {
-		lspConfig.IllegalOpcodeDetection.Enabled = getBool(iod, "enabled", lspConfig.IllegalOpcodeDetection.Enabled)
-		lspConfig.IllegalOpcodeDetection.ShowWarnings = getBool(iod, "showWarnings", lspConfig.IllegalOpcodeDetection.ShowWarnings)
+		config.IllegalOpcodeDetection.Enabled = getBool(iod, "enabled", config.IllegalOpcodeDetection.Enabled)
+		config.IllegalOpcodeDetection.ShowWarnings = getBool(iod, "showWarnings", config.IllegalOpcodeDetection.ShowWarnings)
 	}
 
 	// Update hardware bug detection
 	if hbd := getObject(settings, "hardwareBugDetection"); len(hbd) > 0 {
-		lspConfig.HardwareBugDetection.Enabled = getBool(hbd, "enabled", lspConfig.HardwareBugDetection.Enabled)
-		lspConfig.HardwareBugDetection.ShowWarnings = getBool(hbd, "showWarnings", lspConfig.HardwareBugDetection.ShowWarnings)
-		lspConfig.HardwareBugDetection.JMPIndirectBug = getBool(hbd, "jmpIndirectBug", lspConfig.HardwareBugDetection.JMPIndirectBug)
+		config.HardwareBugDetection.Enabled = getBool(hbd, "enabled", config.HardwareBugDetection.Enabled)
+		config.HardwareBugDetection.ShowWarnings = getBool(hbd, "showWarnings", config.HardwareBugDetection.ShowWarnings)
+		config.HardwareBugDetection.JMPIndirectBug = getBool(hbd, "jmpIndirectBug", config.HardwareBugDetection.JMPIndirectBug)
 	}
 
 	// Update memory layout analysis
 	if mla := getObject(settings, "memoryLayoutAnalysis"); len(mla) > 0 {
-		lspConfig.MemoryLayoutAnalysis.Enabled = getBool(mla, "enabled", lspConfig.MemoryLayoutAnalysis.Enabled)
-		lspConfig.MemoryLayoutAnalysis.ShowIOAccess = getBool(mla, "showIOAccess", lspConfig.MemoryLayoutAnalysis.ShowIOAccess)
-		lspConfig.MemoryLayoutAnalysis.ShowStackWarnings = getBool(mla, "showStackWarnings", lspConfig.MemoryLayoutAnalysis.ShowStackWarnings)
-		lspConfig.MemoryLayoutAnalysis.ShowROMWriteWarnings = getBool(mla, "showROMWriteWarnings", lspConfig.MemoryLayoutAnalysis.ShowROMWriteWarnings)
+		config.MemoryLayoutAnalysis.Enabled = getBool(mla, "enabled", config.MemoryLayoutAnalysis.Enabled)
+		config.MemoryLayoutAnalysis.ShowIOAccess = getBool(mla, "showIOAccess", config.MemoryLayoutAnalysis.ShowIOAccess)
+		config.MemoryLayoutAnalysis.ShowStackWarnings = getBool(mla, "showStackWarnings", config.MemoryLayoutAnalysis.ShowStackWarnings)
+		config.MemoryLayoutAnalysis.ShowROMWriteWarnings = getBool(mla, "showROMWriteWarnings", config.MemoryLayoutAnalysis.ShowROMWriteWarnings)
 	}
 
 	// Update magic number detection
 	if mnd := getObject(settings, "magicNumberDetection"); len(mnd) > 0 {
-		lspConfig.MagicNumberDetection.Enabled = getBool(mnd, "enabled", lspConfig.MagicNumberDetection.Enabled)
-		lspConfig.MagicNumberDetection.ShowHints = getBool(mnd, "showHints", lspConfig.MagicNumberDetection.ShowHints)
-		lspConfig.MagicNumberDetection.C64Addresses = getBool(mnd, "c64Addresses", lspConfig.MagicNumberDetection.C64Addresses)
+		config.MagicNumberDetection.Enabled = getBool(mnd, "enabled", config.MagicNumberDetection.Enabled)
+		config.MagicNumberDetection.ShowHints = getBool(mnd, "showHints", config.MagicNumberDetection.ShowHints)
+		config.MagicNumberDetection.C64Addresses = getBool(mnd, "c64Addresses", config.MagicNumberDetection.C64Addresses)
 	}
 
 	// Update dead code detection
 	if dcd := getObject(settings, "deadCodeDetection"); len(dcd) > 0 {
-		lspConfig.DeadCodeDetection.Enabled = getBool(dcd, "enabled", lspConfig.DeadCodeDetection.Enabled)
-		lspConfig.DeadCodeDetection.ShowWarnings = getBool(dcd, "showWarnings", lspConfig.DeadCodeDetection.ShowWarnings)
+		config.DeadCodeDetection.Enabled = getBool(dcd, "enabled", config.DeadCodeDetection.Enabled)
+		config.DeadCodeDetection.ShowWarnings = getBool(dcd, "showWarnings", config.DeadCodeDetection.ShowWarnings)
 	}
 
 	// Update style guide enforcement
 	if sge := getObject(settings, "styleGuideEnforcement"); len(sge) > 0 {
-		lspConfig.StyleGuideEnforcement.Enabled = getBool(sge, "enabled", lspConfig.StyleGuideEnforcement.Enabled)
-		lspConfig.StyleGuideEnforcement.ShowHints = getBool(sge, "showHints", lspConfig.StyleGuideEnforcement.ShowHints)
-		lspConfig.StyleGuideEnforcement.UpperCaseConstants = getBool(sge, "upperCaseConstants", lspConfig.StyleGuideEnforcement.UpperCaseConstants)
-		lspConfig.StyleGuideEnforcement.DescriptiveLabels = getBool(sge, "descriptiveLabels", lspConfig.StyleGuideEnforcement.DescriptiveLabels)
+		config.StyleGuideEnforcement.Enabled = getBool(sge, "enabled", config.StyleGuideEnforcement.Enabled)
+		config.StyleGuideEnforcement.ShowHints = getBool(sge, "showHints", config.StyleGuideEnforcement.ShowHints)
+		config.StyleGuideEnforcement.UpperCaseConstants = getBool(sge, "upperCaseConstants", config.StyleGuideEnforcement.UpperCaseConstants)
+		config.StyleGuideEnforcement.DescriptiveLabels = getBool(sge, "descriptiveLabels", config.StyleGuideEnforcement.DescriptiveLabels)
+	}
+
+	// Update cycle budget validation
+	if cbv := getObject(settings, "cycleBudgetValidation"); len(cbv) > 0 {
+		config.CycleBudgetValidation.Enabled = getBool(cbv, "enabled", config.CycleBudgetValidation.Enabled)
+		config.CycleBudgetValidation.ShowWarnings = getBool(cbv, "showWarnings", config.CycleBudgetValidation.ShowWarnings)
+	}
+
+	// Update cycle count inlay hints
+	if ch := getObject(settings, "cycleHints"); len(ch) > 0 {
+		config.CycleHints.Enabled = getBool(ch, "enabled", config.CycleHints.Enabled)
+		config.CycleHints.ShowRunningTotal = getBool(ch, "showRunningTotal", config.CycleHints.ShowRunningTotal)
+	}
+
+	// Update assembler symbol file support
+	if as := getObject(settings, "assemblerSymbols"); len(as) > 0 {
+		config.AssemblerSymbols.Enabled = getBool(as, "enabled", config.AssemblerSymbols.Enabled)
+		config.AssemblerSymbols.ShowMismatches = getBool(as, "showMismatches", config.AssemblerSymbols.ShowMismatches)
+		config.AssemblerSymbols.AddressHints = getBool(as, "addressHints", config.AssemblerSymbols.AddressHints)
+	}
+
+	// Update analysis limits
+	if al := getObject(settings, "analysisLimits"); len(al) > 0 {
+		config.AnalysisLimits.TimeoutMs = getInt(al, "timeoutMs", config.AnalysisLimits.TimeoutMs)
+		config.AnalysisLimits.MaxNestingDepth = getInt(al, "maxNestingDepth", config.AnalysisLimits.MaxNestingDepth)
+		config.AnalysisLimits.MaxLoopIterations = getInt(al, "maxLoopIterations", config.AnalysisLimits.MaxLoopIterations)
 	}
 
 	// Update parser feature flags
 	if pff := getObject(settings, "parserFeatureFlags"); len(pff) > 0 {
 		// Main feature flags
-		oldUseContextAware := lspConfig.ParserFeatureFlags.UseContextAware
-		lspConfig.ParserFeatureFlags.UseContextAware = getBool(pff, "useContextAware", lspConfig.ParserFeatureFlags.UseContextAware)
-		lspConfig.ParserFeatureFlags.FallbackToOld = getBool(pff, "fallbackToOld", lspConfig.ParserFeatureFlags.FallbackToOld)
-		lspConfig.ParserFeatureFlags.DebugMode = getBool(pff, "debugMode", lspConfig.ParserFeatureFlags.DebugMode)
-		lspConfig.ParserFeatureFlags.EnableExperimental = getBool(pff, "enableExperimental", lspConfig.ParserFeatureFlags.EnableExperimental)
+		config.ParserFeatureFlags.UseContextAware = getBool(pff, "useContextAware", config.ParserFeatureFlags.UseContextAware)
+		config.ParserFeatureFlags.FallbackToOld = getBool(pff, "fallbackToOld", config.ParserFeatureFlags.FallbackToOld)
+		config.ParserFeatureFlags.DebugMode = getBool(pff, "debugMode", config.ParserFeatureFlags.DebugMode)
+		config.ParserFeatureFlags.EnableExperimental = getBool(pff, "enableExperimental", config.ParserFeatureFlags.EnableExperimental)
 
 		// Feature-specific flags
-		lspConfig.ParserFeatureFlags.ContextAwareLexer = getBool(pff, "contextAwareLexer", lspConfig.ParserFeatureFlags.ContextAwareLexer)
-		lspConfig.ParserFeatureFlags.EnhancedAST = getBool(pff, "enhancedAST", lspConfig.ParserFeatureFlags.EnhancedAST)
-		lspConfig.ParserFeatureFlags.SmartCompletion = getBool(pff, "smartCompletion", lspConfig.ParserFeatureFlags.SmartCompletion)
-		lspConfig.ParserFeatureFlags.SemanticValidation = getBool(pff, "semanticValidation", lspConfig.ParserFeatureFlags.SemanticValidation)
-		lspConfig.ParserFeatureFlags.PerformanceMode = getBool(pff, "performanceMode", lspConfig.ParserFeatureFlags.PerformanceMode)
-
-		// Log significant parser mode changes
-		if oldUseContextAware != lspConfig.ParserFeatureFlags.UseContextAware {
-			if lspConfig.ParserFeatureFlags.UseContextAware {
-				log.Info("Switched to context-aware parser (experimental)")
-			} else {
-				log.Info("Switched to legacy parser")
-			}
-		}
-
-		if lspConfig.ParserFeatureFlags.DebugMode {
-			log.Debug("Parser debug mode enabled")
-		}
+		config.ParserFeatureFlags.ContextAwareLexer = getBool(pff, "contextAwareLexer", config.ParserFeatureFlags.ContextAwareLexer)
+		config.ParserFeatureFlags.EnhancedAST = getBool(pff, "enhancedAST", config.ParserFeatureFlags.EnhancedAST)
+		config.ParserFeatureFlags.SmartCompletion = getBool(pff, "smartCompletion", config.ParserFeatureFlags.SmartCompletion)
+		config.ParserFeatureFlags.SemanticValidation = getBool(pff, "semanticValidation", config.ParserFeatureFlags.SemanticValidation)
+		config.ParserFeatureFlags.PerformanceMode = getBool(pff, "performanceMode", config.ParserFeatureFlags.PerformanceMode)
 	}
-
-	log.Debug("LSP Configuration updated")
 }
 
 // Feature flag helper functions for context-aware parser
@@ -466,12 +643,14 @@ func ShouldUseNewParser() bool {
 		lspConfig.ParserFeatureFlags.EnhancedAST
 }
 
-// documentStore holds the content of opened text documents.
+// documentStore holds the content and version of opened text documents.
 var documentStore = struct {
 	sync.RWMutex
 	documents map[string]string
+	versions  map[string]int
 }{
 	documents: make(map[string]string),
+	versions:  make(map[string]int),
 }
 
 // symbolStore holds the parsed symbol trees and analysis contexts for each document.
@@ -488,6 +667,7 @@ var symbolStore = struct {
 type DocumentCache struct {
 	Content      string
 	ContentHash  string
+	SymbolStamp  string // symbol file of the last build the analysis compared against
 	Scope        *Scope
 	Context      *AnalysisContext
 	Diagnostics  []Diagnostic
@@ -509,13 +689,14 @@ func calculateContentHash(content string) string {
 }
 
 // ParseDocumentCached parses a document with caching for unchanged content
-func ParseDocumentCached(uri string, text string) (*Scope, *AnalysisContext, []Diagnostic) {
+func ParseDocumentCached(ctx context.Context, uri string, text string) (*Scope, *AnalysisContext, []Diagnostic) {
 	contentHash := calculateContentHash(text)
+	symbolStamp := assemblerSymbolStamp(uri)
 
 	// Check cache first
 	parseCache.RLock()
 	if cached, exists := parseCache.cache[uri]; exists {
-		if cached.ContentHash == contentHash {
+		if cached.ContentHash == contentHash && cached.SymbolStamp == symbolStamp {
 			// Cache hit - return cached results
 			parseCache.RUnlock()
 			log.Debug("Cache hit for document %s", uri)
@@ -526,21 +707,27 @@ func ParseDocumentCached(uri string, text string) (*Scope, *AnalysisContext, []D
 
 	// Cache miss - parse document
 	log.Debug("Cache miss for document %s - parsing", uri)
-	scope, context, diagnostics := ParseDocument(uri, text)
+	scope, analysisContext, diagnostics := ParseDocumentContext(ctx, uri, text)
+
+	// A partial result is shown but parsed again next time
+	if analysisContext != nil && analysisContext.Incomplete {
+		return scope, analysisContext, diagnostics
+	}
 
 	// Update cache
 	parseCache.Lock()
 	parseCache.cache[uri] = &DocumentCache{
 		Content:      text,
 		ContentHash:  contentHash,
+		SymbolStamp:  symbolStamp,
 		Scope:        scope,
-		Context:      context,
+		Context:      analysisContext,
 		Diagnostics:  diagnostics,
 		LastModified: time.Now(),
 	}
 	parseCache.Unlock()
 
-	return scope, context, diagnostics
+	return scope, analysisContext, diagnostics
 }
 
 // ClearParseCache removes a document from the parse cache
@@ -555,8 +742,11 @@ func ClearParseCache(uri string) {
 type AnalysisJob struct {
 	URI     string
 	Content string
+	Version int // document version the content belongs to
 	Writer  *bufio.Writer
 	IsOpen  bool // true for didOpen, false for didChange
+	// true when re-analysis was triggered by a change in an imported file
+	IsDependent bool
 }
 
 // analysisQueue processes parsing jobs asynchronously
@@ -580,8 +770,21 @@ func startAnalysisWorker() {
 
 // processAnalysisJob processes a single analysis job
 func processAnalysisJob(job AnalysisJob) {
+	defer recoverAnalysisJob(job)
+
+	if isStaleAnalysisJob(job) {
+		log.Debug("Skipping analysis of %s version %d - document changed or closed", job.URI, job.Version)
+		return
+	}
+
 	// Parse document with caching
-	symbolTree, analysisContext, diagnostics := ParseDocumentCached(job.URI, job.Content)
+	symbolTree, analysisContext, diagnostics := ParseDocumentCached(context.Background(), job.URI, job.Content)
+
+	// A newer edit may have arrived while parsing - its job will publish instead
+	if isStaleAnalysisJob(job) {
+		log.Debug("Discarding stale analysis of %s version %d", job.URI, job.Version)
+		return
+	}
 
 	// Update symbol store
 	symbolStore.Lock()
@@ -598,19 +801,134 @@ func processAnalysisJob(job AnalysisJob) {
 	// Publish diagnostics
 	publishDiagnostics(job.Writer, job.URI, diagnostics)
 
+	// Documents importing this file may now resolve differently - re-analyze them.
+	// Dependent jobs don't cascade further to avoid ping-pong between circular imports.
+	if !job.IsDependent {
+		dependents := findImportingDocuments(job.URI)
+		invalidateIndexedFile(job.URI)
+		for _, dependentURI := range dependents {
+			documentStore.RLock()
+			content, isOpen := documentStore.documents[dependentURI]
+			version := documentStore.versions[dependentURI]
+			documentStore.RUnlock()
+			if !isOpen {
+				continue
+			}
+			log.Debug("Re-analyzing %s because imported file %s changed", dependentURI, job.URI)
+			ClearParseCache(dependentURI)
+			submitDependentAnalysisJob(dependentURI, content, version, job.Writer)
+		}
+	}
+
 	// Note: We don't return diagnostics to the pool here because they may be
 	// referenced in the cache. The pool is mainly for temporary diagnostic slices
 	// during analysis. The cache will eventually be evicted and GC will clean up.
 }
 
+// reanalyzeOpenDocuments drops all cached analysis results and analyzes every open document
+// again, e.g. after the configuration or the data files changed
+func reanalyzeOpenDocuments(writer *bufio.Writer) {
+	forgetProjectConfigs()
+	reanalyzeOpenDocumentsUnder(writer, "")
+}
+
+// reanalyzeOpenDocumentsUnder analyzes the open documents below dir again, e.g. after the
+// .kickass_ls.json there changed. An empty dir means all documents.
+func reanalyzeOpenDocumentsUnder(writer *bufio.Writer, dir string) {
+	affected := func(uri string) bool {
+		if dir == "" {
+			return true
+		}
+		relative, err := filepath.Rel(dir, uriToPath(uri))
+		return err == nil && !strings.HasPrefix(relative, "..")
+	}
+
+	parseCache.Lock()
+	for uri := range parseCache.cache {
+		if affected(uri) {
+			delete(parseCache.cache, uri)
+			log.Debug("Invalidated parse cache for %s", uri)
+		}
+	}
+	parseCache.Unlock()
+
+	// Imported files below dir are indexed with the old settings
+	workspaceIndex.Lock()
+	workspaceIndex.files = make(map[string]*IndexedFile)
+	workspaceIndex.Unlock()
+
+	// Submit outside the lock, a full queue analyzes synchronously
+	type openDocument struct {
+		uri, content string
+		version      int
+	}
+	var documents []openDocument
+	documentStore.RLock()
+	for uri, content := range documentStore.documents {
+		if affected(uri) {
+			documents = append(documents, openDocument{uri, content, documentStore.versions[uri]})
+		}
+	}
+	documentStore.RUnlock()
+
+	for _, document := range documents {
+		submitAnalysisJob(document.uri, document.content, document.version, writer, false)
+	}
+}
+
+// recoverAnalysisJob keeps the analysis worker alive when parsing or analysis panics. The
+// client gets a log message and a diagnostic instead of stale results.
+func recoverAnalysisJob(job AnalysisJob) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	log.Error("Analysis of %s panicked: %v\n%s", job.URI, recovered, debug.Stack())
+	ClearParseCache(job.URI)
+
+	message := fmt.Sprintf("Internal error while analyzing %s: %v", job.URI, recovered)
+	logMessage(job.Writer, MessageTypeError, message)
+	publishDiagnostics(job.Writer, job.URI, []Diagnostic{{
+		Severity: SeverityError,
+		Range:    Range{Start: Position{Line: 0, Character: 0}, End: Position{Line: 0, Character: 0}},
+		Message:  fmt.Sprintf("Internal error in the language server, analysis aborted: %v", recovered),
+		Source:   "kickass_ls",
+	}})
+}
+
+// isStaleAnalysisJob reports whether the document was closed or edited after the job was queued
+func isStaleAnalysisJob(job AnalysisJob) bool {
+	documentStore.RLock()
+	defer documentStore.RUnlock()
+	version, isOpen := documentStore.versions[job.URI]
+	return !isOpen || job.Version < version
+}
+
 // submitAnalysisJob submits a job to the analysis queue (non-blocking)
-func submitAnalysisJob(uri, content string, writer *bufio.Writer, isOpen bool) {
-	job := AnalysisJob{
+func submitAnalysisJob(uri, content string, version int, writer *bufio.Writer, isOpen bool) {
+	queueAnalysisJob(AnalysisJob{
 		URI:     uri,
 		Content: content,
+		Version: version,
 		Writer:  writer,
 		IsOpen:  isOpen,
-	}
+	})
+}
+
+// submitDependentAnalysisJob re-analyzes a document after one of its imported files changed
+func submitDependentAnalysisJob(uri, content string, version int, writer *bufio.Writer) {
+	queueAnalysisJob(AnalysisJob{
+		URI:         uri,
+		Content:     content,
+		Version:     version,
+		Writer:      writer,
+		IsDependent: true,
+	})
+}
+
+// queueAnalysisJob puts a job on the analysis queue, processing it synchronously if the queue is full
+func queueAnalysisJob(job AnalysisJob) {
+	uri := job.URI
 
 	select {
 	case analysisQueue <- job:
@@ -677,122 +995,32 @@ func Start() {
 		os.Exit(1)
 	}
 
+	// The data files are built in; the config directory only holds optional overrides
 	configDir := filepath.Join(homeDir, ".config", "kickass_ls")
 	if _, err := os.Stat(configDir); os.IsNotExist(err) {
-		log.Error("Configuration directory %s does not exist. Please create it and install the required JSON files.", configDir)
-		os.Exit(1)
+		log.Info("Configuration directory %s does not exist, using the built-in data files", configDir)
+	} else {
+		log.Info("Using configuration directory: %s", configDir)
 	}
 
-	log.Info("Using configuration directory: %s", configDir)
-
 	// Start the analysis worker
 	startAnalysisWorker()
 
-	// Load JSON Source of Truth files in parallel from config directory
-	var wg sync.WaitGroup
-	wg.Add(3)
-
-	// Load mnemonic data
-	go func() {
-		defer wg.Done()
-		mnemonicPath := filepath.Join(configDir, "mnemonic.json")
-		err := loadMnemonics(mnemonicPath)
-		if err != nil {
-			log.Error("Error loading mnemonics from %s: %v", mnemonicPath, err)
-		} else {
-			log.Info("Successfully loaded mnemonics from %s", mnemonicPath)
-		}
-
-		// Set mnemonic.json path for lexer
-		SetMnemonicJSONPath(mnemonicPath)
-	}()
-
-	// Load C64 memory map data
-	go func() {
-		defer wg.Done()
-		c64MemoryPath := filepath.Join(configDir, "c64memory.json")
-		err := loadC64MemoryMap(c64MemoryPath)
-		if err != nil {
-			log.Error("Could not load C64 memory map from %s: %v", c64MemoryPath, err)
-			log.Error("Memory address hover information will be limited.")
-		} else {
-			log.Info("Successfully loaded C64 memory map with %d regions from %s", len(c64MemoryMap.MemoryMap.Regions), c64MemoryPath)
-		}
-	}()
-
-	// Load kickass data
-	go func() {
-		defer wg.Done()
-		kickassPath := filepath.Join(configDir, "kickass.json")
-
-		// Load kickass directives from single file
-		var err error
-		builtinFunctions, builtinConstants, err = LoadBuiltins(kickassPath)
-		if err != nil {
-			log.Error("Failed to load kickass builtins from %s: %v", kickassPath, err)
-		} else {
-			log.Info("Successfully loaded %d built-in functions and %d built-in constants from %s", len(builtinFunctions), len(builtinConstants), kickassPath)
-		}
-
-		// Set kickass.json path for lexer
-		SetKickassJSONPath(kickassPath)
-	}()
-
-	// Wait for all JSON files to load
-	wg.Wait()
-	log.Info("All JSON Source of Truth files loaded successfully from %s", configDir)
-
-	// Initialize lexer token definitions AFTER all JSON files are loaded
-	InitTokenDefs()
-
-	// Initialize ProcessorContext (used by completion and context-aware parser)
-	mnemonicPath := filepath.Join(configDir, "mnemonic.json")
-	kickassPath := filepath.Join(configDir, "kickass.json")
-	c64MemoryPath := filepath.Join(configDir, "c64memory.json")
-
-	err = InitializeProcessorContext(configDir)
-	if err != nil {
-		log.Error("Failed to initialize ProcessorContext: %v", err)
-		log.Error("Context-aware features (completion, parsing) will fall back to legacy mode")
-	} else {
-		log.Info("Successfully initialized ProcessorContext from %s, %s, %s", mnemonicPath, kickassPath, c64MemoryPath)
-	}
+	loadDataFiles(configDir)
 
 	reader := bufio.NewReader(os.Stdin)
 	writer := bufio.NewWriter(os.Stdout)
 
+	startRequestWorkers()
+
 	for {
-		line, err := reader.ReadString('\n')
+		payload, err := readMessage(reader)
 		if err != nil {
 			if err == io.EOF {
 				log.Info("EOF received, exiting.")
 				break
 			}
-			log.Logger.Printf("Error reading header: %v\n", err)
-			return
-		}
-
-		if len(line) < 16 || line[:16] != "Content-Length: " {
-			continue
-		}
-
-		lengthStr := line[16 : len(line)-2]
-		contentLength, err := strconv.Atoi(lengthStr)
-		if err != nil {
-			log.Logger.Printf("Error parsing Content-Length: %v\n", err)
-			return
-		}
-
-		_, err = reader.ReadString('\n')
-		if err != nil {
-			log.Logger.Printf("Error reading empty line: %v\n", err)
-			return
-		}
-
-		payload := make([]byte, contentLength)
-		_, err = io.ReadFull(reader, payload)
-		if err != nil {
-			log.Logger.Printf("Error reading payload: %v\n", err)
+			log.Logger.Printf("Error reading message: %v\n", err)
 			return
 		}
 
@@ -804,293 +1032,380 @@ func Start() {
 			continue
 		}
 
-		method, ok := message["method"].(string)
-		if !ok {
-			log.Warn("Method not found or not a string.")
-			continue
-		}
+		dispatchMessage(writer, message)
+	}
+}
 
-		switch method {
-		case "initialize":
-			log.Debug("Handling initialize request.")
-			result := map[string]interface{}{
-				"jsonrpc": "2.0",
-				"id":      message["id"],
-				"result": map[string]interface{}{
-					"capabilities": map[string]interface{}{
-						"textDocumentSync": map[string]interface{}{
-							"openClose": true,
-							"change":    float64(1), // Full sync
-						},
-						"hoverProvider": true,
-						"completionProvider": map[string]interface{}{
-							"resolveProvider":   false,
-							"triggerCharacters": []string{" ", ".", "$"},
-						},
-						"definitionProvider":      true,
-						"referencesProvider":      true,
-						"documentSymbolProvider":  true,
-						"documentFormattingProvider":      true,
-						"documentRangeFormattingProvider": true,
-						"semanticTokensProvider": map[string]interface{}{
-							"legend": map[string]interface{}{
-								"tokenTypes": []string{
-									"keyword",       // 0
-									"variable",      // 1
-									"function",      // 2
-									"macro",         // 3
-									"pseudocommand", // 4
-									"number",        // 5
-									"comment",       // 6
-									"string",        // 7
-									"operator",      // 8
-									"mnemonic",      // 9
-									"directive",     // 10
-									"preprocessor",  // 11
-									"label",         // 12
-								},
-								"tokenModifiers": []string{
-									"declaration", "readonly",
-								},
+// handleMessage runs the handler for a method. request is nil for notifications.
+func handleMessage(writer *bufio.Writer, request *Request, method string, message map[string]interface{}) {
+	switch method {
+	case "initialize":
+		log.Debug("Handling initialize request.")
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			root, _ := params["rootUri"].(string)
+			if root == "" {
+				root, _ = params["rootPath"].(string)
+			}
+			if capabilities, ok := params["capabilities"].(map[string]interface{}); ok {
+				if workspace, ok := capabilities["workspace"].(map[string]interface{}); ok {
+					if watched, ok := workspace["didChangeWatchedFiles"].(map[string]interface{}); ok {
+						clientWatchesFiles, _ = watched["dynamicRegistration"].(bool)
+					}
+				}
+			}
+			if root != "" {
+				SetWorkspaceRoot(root)
+
+				// Project-specific data files in <root>/.kickass_ls/
+				if setWorkspaceDataDir(root) {
+					log.Info("Loading workspace data file overrides from %s", workspaceDataDir)
+					dataLayers.RLock()
+					configDir := dataLayers.userDir
+					dataLayers.RUnlock()
+					loadDataFiles(configDir)
+				}
+			}
+		}
+		result := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      message["id"],
+			"result": map[string]interface{}{
+				"capabilities": map[string]interface{}{
+					"textDocumentSync": map[string]interface{}{
+						"openClose": true,
+						"change":    float64(2), // Incremental sync
+					},
+					"hoverProvider": true,
+					"completionProvider": map[string]interface{}{
+						"resolveProvider":   false,
+						"triggerCharacters": []string{" ", ".", "$"},
+					},
+					"definitionProvider":      true,
+					"referencesProvider":      true,
+					"documentSymbolProvider":  true,
+					"renameProvider": map[string]interface{}{
+						"prepareProvider": true,
+					},
+					"codeActionProvider": map[string]interface{}{
+						"codeActionKinds": []string{"quickfix"},
+					},
+					"inlayHintProvider": true,
+					"executeCommandProvider": map[string]interface{}{
+						"commands": executeCommands,
+					},
+					"signatureHelpProvider": map[string]interface{}{
+						"triggerCharacters":   []string{"(", ","},
+						"retriggerCharacters": []string{":"},
+					},
+					"documentFormattingProvider":      true,
+					"documentRangeFormattingProvider": true,
+					"semanticTokensProvider": map[string]interface{}{
+						"legend": map[string]interface{}{
+							"tokenTypes": []string{
+								"keyword",       // 0
+								"variable",      // 1
+								"function",      // 2
+								"macro",         // 3
+								"pseudocommand", // 4
+								"number",        // 5
+								"comment",       // 6
+								"string",        // 7
+								"operator",      // 8
+								"mnemonic",      // 9
+								"directive",     // 10
+								"preprocessor",  // 11
+								"label",         // 12
 							},
-							"full": true,
-						},
-						"workspace": map[string]interface{}{
-							"workspaceFolders": map[string]interface{}{
-								"supported": true,
+							"tokenModifiers": []string{
+								"declaration", "readonly", "inactive",
 							},
 						},
+						"full": true,
 					},
-					"serverInfo": map[string]interface{}{
-						"name":    "kickass_ls",
-						"version": "1.0.4", // Version updated
+					"workspace": map[string]interface{}{
+						"workspaceFolders": map[string]interface{}{
+							"supported": true,
+						},
 					},
 				},
-			}
-			response, _ := json.Marshal(result)
-			writeResponse(writer, response)
-		case "initialized":
-			log.Debug("Handling initialized notification.")
-		case "shutdown":
-			log.Debug("Handling shutdown request.")
-			result := map[string]interface{}{
-				"jsonrpc": "2.0",
-				"id":      message["id"],
-				"result":  nil,
-			}
-			response, _ := json.Marshal(result)
-			writeResponse(writer, response)
-		case "exit":
-			log.Debug("Handling exit notification.")
-			os.Exit(0)
-		case "workspace/didChangeConfiguration":
-			log.Debug("Handling workspace/didChangeConfiguration notification.")
-			if params, ok := message["params"].(map[string]interface{}); ok {
-				if settings, ok := params["settings"].(map[string]interface{}); ok {
-					// Look for our specific LSP settings
-					if lspSettings, ok := settings["kickass_ls"].(map[string]interface{}); ok {
-						log.Debug("Updating LSP configuration")
-						UpdateLSPConfig(lspSettings)
-
-						// Initialize ProcessorContext if context-aware lexer is now enabled and not yet loaded
-						if IsContextAwareLexerEnabled() && GetProcessorContext() == nil {
-							homeDir, err := os.UserHomeDir()
-							if err == nil {
-								configDir := filepath.Join(homeDir, ".config", "kickass_ls")
-								err = InitializeProcessorContext(configDir)
-								if err != nil {
-									log.Error("Failed to initialize ProcessorContext: %v", err)
-								} else {
-									log.Info("Successfully initialized ProcessorContext after config update")
-								}
+				"serverInfo": map[string]interface{}{
+					"name":    "kickass_ls",
+					"version": "1.0.4", // Version updated
+				},
+			},
+		}
+		response, _ := json.Marshal(result)
+		request.reply(writer, response)
+	case "initialized":
+		log.Debug("Handling initialized notification.")
+		registerFileWatchers(writer)
+		go scanProjectConfigs(writer)
+	case "shutdown":
+		log.Debug("Handling shutdown request.")
+		result := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      message["id"],
+			"result":  nil,
+		}
+		response, _ := json.Marshal(result)
+		request.reply(writer, response)
+	case "exit":
+		log.Debug("Handling exit notification.")
+		os.Exit(0)
+	case "workspace/didChangeConfiguration":
+		log.Debug("Handling workspace/didChangeConfiguration notification.")
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			if settings, ok := params["settings"].(map[string]interface{}); ok {
+				// Look for our specific LSP settings
+				if lspSettings, ok := settings["kickass_ls"].(map[string]interface{}); ok {
+					log.Debug("Updating LSP configuration")
+					UpdateLSPConfig(lspSettings)
+
+					// Initialize ProcessorContext if context-aware lexer is now enabled and not yet loaded
+					if IsContextAwareLexerEnabled() && GetProcessorContext() == nil {
+						homeDir, err := os.UserHomeDir()
+						if err == nil {
+							configDir := filepath.Join(homeDir, ".config", "kickass_ls")
+							err = InitializeProcessorContext(configDir)
+							if err != nil {
+								log.Error("Failed to initialize ProcessorContext: %v", err)
+							} else {
+								log.Info("Successfully initialized ProcessorContext after config update")
 							}
 						}
+					}
 
-						// Invalidate all parse caches to trigger re-analysis with new settings
-						parseCache.Lock()
-						for uri := range parseCache.cache {
-							delete(parseCache.cache, uri)
-							log.Debug("Invalidated parse cache for %s due to config change", uri)
-						}
-						parseCache.Unlock()
+					// Re-analyze all open documents with new configuration
+					reanalyzeOpenDocuments(writer)
 
-						// Re-analyze all open documents with new configuration
-						documentStore.RLock()
-						for uri, content := range documentStore.documents {
-							submitAnalysisJob(uri, content, writer, false)
-						}
-						documentStore.RUnlock()
+					// Config files may use profiles from the editor settings
+					go scanProjectConfigs(writer)
 
-						log.Info("Configuration updated and documents re-analyzed")
-					} else {
-						log.Debug("No kickass_ls settings found in configuration update")
-					}
+					log.Info("Configuration updated and documents re-analyzed")
+				} else {
+					log.Debug("No kickass_ls settings found in configuration update")
 				}
 			}
-		case "textDocument/didOpen":
-			log.Debug("Handling textDocument/didOpen notification.")
-			if params, ok := message["params"].(map[string]interface{}); ok {
-				if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
-					if uri, ok := textDocument["uri"].(string); ok {
-						if text, ok := textDocument["text"].(string); ok {
-							documentStore.Lock()
-							documentStore.documents[uri] = text
-							documentStore.Unlock()
-							log.Info("Stored document %s", uri)
+		}
+	case "workspace/didChangeWatchedFiles":
+		log.Debug("Handling workspace/didChangeWatchedFiles notification.")
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			if changes, ok := params["changes"].([]interface{}); ok {
+				handleWatchedFilesChange(writer, changes)
+			}
+		}
+	case "textDocument/didOpen":
+		log.Debug("Handling textDocument/didOpen notification.")
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
+				if uri, ok := textDocument["uri"].(string); ok {
+					if text, ok := textDocument["text"].(string); ok {
+						version, _ := textDocument["version"].(float64)
+						documentStore.Lock()
+						documentStore.documents[uri] = text
+						documentStore.versions[uri] = int(version)
+						documentStore.Unlock()
+						log.Info("Stored document %s (version %d)", uri, int(version))
 
-							// Submit analysis job asynchronously
-							submitAnalysisJob(uri, text, writer, true)
-						}
+						// Submit analysis job asynchronously
+						submitAnalysisJob(uri, text, int(version), writer, true)
 					}
 				}
 			}
-		case "textDocument/didChange":
-			log.Debug("Handling textDocument/didChange notification.")
-			if params, ok := message["params"].(map[string]interface{}); ok {
-				if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
-					if uri, ok := textDocument["uri"].(string); ok {
-						if contentChanges, ok := params["contentChanges"].([]interface{}); ok && len(contentChanges) > 0 {
-							if change, ok := contentChanges[0].(map[string]interface{}); ok {
-								if newText, ok := change["text"].(string); ok {
-									documentStore.Lock()
-									documentStore.documents[uri] = newText
-									documentStore.Unlock()
-									log.Info("Updated document %s", uri)
-
-									// Submit analysis job asynchronously
-									submitAnalysisJob(uri, newText, writer, false)
-								}
-							}
+		}
+	case "textDocument/didChange":
+		log.Debug("Handling textDocument/didChange notification.")
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
+				if uri, ok := textDocument["uri"].(string); ok {
+					if contentChanges, ok := params["contentChanges"].([]interface{}); ok && len(contentChanges) > 0 {
+						documentStore.Lock()
+						version, hasVersion := textDocument["version"].(float64)
+						if !hasVersion {
+							// Clients must send a version; keep ordering intact if one doesn't
+							version = float64(documentStore.versions[uri] + 1)
+						}
+						newText, err := applyContentChanges(documentStore.documents[uri], contentChanges)
+						if err == nil {
+							documentStore.documents[uri] = newText
+							documentStore.versions[uri] = int(version)
+						}
+						documentStore.Unlock()
+
+						if err != nil {
+							log.Error("Failed to apply changes to %s: %v", uri, err)
+						} else {
+							log.Info("Updated document %s (version %d)", uri, int(version))
+
+							// Submit analysis job asynchronously
+							submitAnalysisJob(uri, newText, int(version), writer, false)
 						}
 					}
 				}
 			}
-		case "textDocument/didClose":
-			log.Debug("Handling textDocument/didClose notification.")
-			if params, ok := message["params"].(map[string]interface{}); ok {
-				if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
-					if uri, ok := textDocument["uri"].(string); ok {
-						documentStore.Lock()
-						delete(documentStore.documents, uri)
-						documentStore.Unlock()
+		}
+	case "textDocument/didClose":
+		log.Debug("Handling textDocument/didClose notification.")
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
+				if uri, ok := textDocument["uri"].(string); ok {
+					documentStore.Lock()
+					delete(documentStore.documents, uri)
+					delete(documentStore.versions, uri)
+					documentStore.Unlock()
 
-						symbolStore.Lock()
-						delete(symbolStore.trees, uri)
-						symbolStore.Unlock()
+					symbolStore.Lock()
+					delete(symbolStore.trees, uri)
+					symbolStore.Unlock()
 
-						// Clear parse cache for closed document
-						ClearParseCache(uri)
+					// Clear parse cache for closed document
+					ClearParseCache(uri)
 
-						log.Info("Removed document %s from stores.", uri)
+					// Imported copies of this file were built from unsaved editor content
+					invalidateIndexedFile(uri)
 
-						publishDiagnostics(writer, uri, []Diagnostic{}) // Clear diagnostics
-					}
+					log.Info("Removed document %s from stores.", uri)
+
+					publishDiagnostics(writer, uri, []Diagnostic{}) // Clear diagnostics
 				}
 			}
-		case "textDocument/hover":
-			log.Debug("Handling textDocument/hover request.")
-
-			var responseResult interface{} = nil
-
-			if params, ok := message["params"].(map[string]interface{}); ok {
-				if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
-					if uri, ok := textDocument["uri"].(string); ok {
-						if position, ok := params["position"].(map[string]interface{}); ok {
-							if lineNum, ok := position["line"].(float64); ok {
-								if charNum, ok := position["character"].(float64); ok {
-									documentStore.RLock()
-									text, docFound := documentStore.documents[uri]
-									documentStore.RUnlock()
-
-									symbolStore.RLock()
-									symbolTree, treeFound := symbolStore.trees[uri]
-									symbolStore.RUnlock()
-
-									if docFound && treeFound {
-										lines := strings.Split(text, "\n")
-										if int(lineNum) < len(lines) {
-											lineContent := lines[int(lineNum)]
-											word := getWordAtPosition(lineContent, int(charNum))
-											log.Logger.Printf("Hovering over: %s\n", word)
-
-											// Also try to extract memory address (priority over regular words)
-											memoryAddr := getMemoryAddressAtPosition(lineContent, int(charNum))
-											if memoryAddr != "" {
-												log.Logger.Printf("Memory address found: %s\n", memoryAddr)
-												word = memoryAddr // Use memory address instead of regular word
-											}
+		}
+	case "textDocument/hover":
+		log.Debug("Handling textDocument/hover request.")
+
+		var responseResult interface{} = nil
+
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
+				if uri, ok := textDocument["uri"].(string); ok {
+					if position, ok := params["position"].(map[string]interface{}); ok {
+						if lineNum, ok := position["line"].(float64); ok {
+							if charNum, ok := position["character"].(float64); ok {
+								documentStore.RLock()
+								text, docFound := documentStore.documents[uri]
+								documentStore.RUnlock()
+
+								symbolStore.RLock()
+								symbolTree, treeFound := symbolStore.trees[uri]
+								symbolStore.RUnlock()
+
+								if docFound && treeFound {
+									lines := strings.Split(text, "\n")
+									if int(lineNum) < len(lines) {
+										lineContent := lines[int(lineNum)]
+										word := getWordAtPosition(lineContent, int(charNum))
+										log.Logger.Printf("Hovering over: %s\n", word)
+
+										// Also try to extract memory address (priority over regular words)
+										memoryAddr := getMemoryAddressAtPosition(lineContent, int(charNum))
+										if memoryAddr != "" {
+											log.Logger.Printf("Memory address found: %s\n", memoryAddr)
+											word = memoryAddr // Use memory address instead of regular word
+										}
 
-											description := getOpcodeDescription(strings.ToUpper(word))
-											if description != "" {
+										description := getOpcodeDescription(strings.ToUpper(word))
+										if description != "" {
+											// Cycle timing of this particular instruction
+											if timing := instructionTimingAt(uri, int(lineNum)); timing != nil && strings.EqualFold(timing.Mnemonic, word) {
+												description = timing.timingDescription() + "\n\n" + description
+											}
+											responseResult = map[string]interface{}{
+												"contents": map[string]interface{}{
+													"kind":  "markdown",
+													"value": description,
+												},
+											}
+										} else {
+											directiveDescription := getDirectiveDescription(strings.ToLower(word))
+											if directiveDescription != "" {
 												responseResult = map[string]interface{}{
 													"contents": map[string]interface{}{
 														"kind":  "markdown",
-														"value": description,
+														"value": directiveDescription,
 													},
 												}
 											} else {
-												directiveDescription := getDirectiveDescription(strings.ToLower(word))
-												if directiveDescription != "" {
+												// Check for built-in functions
+												builtinFuncDescription := getBuiltinFunctionDescription(word)
+												if builtinFuncDescription != "" {
 													responseResult = map[string]interface{}{
 														"contents": map[string]interface{}{
 															"kind":  "markdown",
-															"value": directiveDescription,
+															"value": builtinFuncDescription,
 														},
 													}
 												} else {
-													// Check for built-in functions
-													builtinFuncDescription := getBuiltinFunctionDescription(word)
-													if builtinFuncDescription != "" {
+													// Check for built-in constants
+													builtinConstDescription := getBuiltinConstantDescription(word)
+													if builtinConstDescription != "" {
 														responseResult = map[string]interface{}{
 															"contents": map[string]interface{}{
 																"kind":  "markdown",
-																"value": builtinFuncDescription,
+																"value": builtinConstDescription,
 															},
 														}
 													} else {
-														// Check for built-in constants
-														builtinConstDescription := getBuiltinConstantDescription(word)
-														if builtinConstDescription != "" {
+														// Check for C64 memory address description
+														memoryDescription := getMemoryAddressDescription(word)
+														if memoryDescription != "" {
 															responseResult = map[string]interface{}{
 																"contents": map[string]interface{}{
 																	"kind":  "markdown",
-																	"value": builtinConstDescription,
+																	"value": memoryDescription,
 																},
 															}
 														} else {
-															// Check for C64 memory address description
-															memoryDescription := getMemoryAddressDescription(word)
-															if memoryDescription != "" {
+															searchSymbol := normalizeLabel(word)
+															if symbol, found := symbolTree.findInnermostScope(int(lineNum)).FindSymbol(searchSymbol); found {
+																var markdown string
+																if symbol.Signature != "" {
+																	markdown = fmt.Sprintf("(%s) **%s**", symbol.Kind.String(), symbol.Signature)
+																} else if value, evaluated := evaluatedSymbolValue(uri, symbol); evaluated {
+																	markdown = valueMarkdown(symbol, value)
+																} else if symbol.Value != "" {
+																	markdown = fmt.Sprintf("(%s) **%s** = `%s`", symbol.Kind.String(), symbol.Name, symbol.Value)
+																} else {
+																	markdown = fmt.Sprintf("(%s) **%s**", symbol.Kind.String(), symbol.Name)
+																}
+																if symbol.Kind == Label {
+																	markdown += labelAddressMarkdown(uri, symbol)
+																	markdown += repeatedLabelMarkdown(uri, symbol)
+																}
+																if symbol.Scope != nil && symbol.Scope.Uri != uri {
+																	markdown += fmt.Sprintf("\n\n*Imported from* `%s`", filepath.Base(uriToPath(symbol.Scope.Uri)))
+																}
 																responseResult = map[string]interface{}{
 																	"contents": map[string]interface{}{
 																		"kind":  "markdown",
-																		"value": memoryDescription,
+																		"value": markdown,
 																	},
 																}
-															} else {
-																searchSymbol := normalizeLabel(word)
-																if symbol, found := symbolTree.FindSymbol(searchSymbol); found {
-																	var markdown string
-																	if symbol.Signature != "" {
-																		markdown = fmt.Sprintf("(%s) **%s**", symbol.Kind.String(), symbol.Signature)
-																	} else if symbol.Value != "" {
-																		markdown = fmt.Sprintf("(%s) **%s** = `%s`", symbol.Kind.String(), symbol.Name, symbol.Value)
-																	} else {
-																		markdown = fmt.Sprintf("(%s) **%s**", symbol.Kind.String(), symbol.Name)
-																	}
-																	responseResult = map[string]interface{}{
-																		"contents": map[string]interface{}{
-																			"kind":  "markdown",
-																			"value": markdown,
-																		},
-																	}
-																}
 															}
 														}
 													}
 												}
 											}
 										}
+
+										// loop[2].label names a label of one loop iteration
+										if markdown := loopLabelHover(uri, lineContent, int(charNum)); markdown != "" {
+											responseResult = map[string]interface{}{
+												"contents": map[string]interface{}{
+													"kind":  "markdown",
+													"value": markdown,
+												},
+											}
+										}
+
+										// A string of a .text shows the bytes it is encoded to
+										if markdown := encodedTextHover(uri, int(lineNum), int(charNum)); markdown != "" {
+											responseResult = map[string]interface{}{
+												"contents": map[string]interface{}{
+													"kind":  "markdown",
+													"value": markdown,
+												},
+											}
+										}
 									}
 								}
 							}
@@ -1098,41 +1413,41 @@ func Start() {
 					}
 				}
 			}
+		}
 
-			finalResponse := map[string]interface{}{
-				"jsonrpc": "2.0",
-				"id":      message["id"],
-				"result":  responseResult,
-			}
-			responseBytes, _ := json.Marshal(finalResponse)
-			writeResponse(writer, responseBytes)
-		case "textDocument/completion":
-			log.Debug("Handling textDocument/completion request.")
-			completionItems := make([]map[string]interface{}, 0)
-			id := message["id"]
-
-			if params, ok := message["params"].(map[string]interface{}); ok {
-				if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
-					if uri, ok := textDocument["uri"].(string); ok {
-						if position, ok := params["position"].(map[string]interface{}); ok {
-							if lineNum, ok := position["line"].(float64); ok {
-								if charNum, ok := position["character"].(float64); ok {
-									documentStore.RLock()
-									text, docFound := documentStore.documents[uri]
-									documentStore.RUnlock()
-
-									symbolStore.RLock()
-									symbolTree, treeFound := symbolStore.trees[uri]
-									symbolStore.RUnlock()
-
-									if docFound && treeFound {
-										lines := strings.Split(text, "\n")
-										if int(lineNum) < len(lines) {
-											lineContent := lines[int(lineNum)]
-											contextType, wordToComplete := getCompletionContext(lineContent, int(charNum))
-											log.Debug("Completion context: contextType=%v, wordToComplete='%s'", contextType, wordToComplete)
-											completionItems = generateCompletions(symbolTree, int(lineNum), contextType, wordToComplete, lineContent, int(charNum), text)
-										}
+		finalResponse := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      message["id"],
+			"result":  responseResult,
+		}
+		responseBytes, _ := json.Marshal(finalResponse)
+		request.reply(writer, responseBytes)
+	case "textDocument/completion":
+		log.Debug("Handling textDocument/completion request.")
+		completionItems := make([]map[string]interface{}, 0)
+		id := message["id"]
+
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
+				if uri, ok := textDocument["uri"].(string); ok {
+					if position, ok := params["position"].(map[string]interface{}); ok {
+						if lineNum, ok := position["line"].(float64); ok {
+							if charNum, ok := position["character"].(float64); ok {
+								documentStore.RLock()
+								text, docFound := documentStore.documents[uri]
+								documentStore.RUnlock()
+
+								symbolStore.RLock()
+								symbolTree, treeFound := symbolStore.trees[uri]
+								symbolStore.RUnlock()
+
+								if docFound && treeFound {
+									lines := strings.Split(text, "\n")
+									if int(lineNum) < len(lines) {
+										lineContent := lines[int(lineNum)]
+										contextType, wordToComplete := getCompletionContext(lineContent, int(charNum))
+										log.Debug("Completion context: contextType=%v, wordToComplete='%s'", contextType, wordToComplete)
+										completionItems = generateCompletions(symbolTree, int(lineNum), contextType, wordToComplete, lineContent, int(charNum), text)
 									}
 								}
 							}
@@ -1140,197 +1455,197 @@ func Start() {
 					}
 				}
 			}
+		}
 
-			completionList := map[string]interface{}{
-				"isIncomplete": false,
-				"items":        completionItems,
-			}
-			result := map[string]interface{}{
-				"jsonrpc": "2.0",
-				"id":      id,
-				"result":  completionList,
-			}
-			response, err := json.Marshal(result)
-			if err != nil {
-				log.Error("Failed to marshal completion response: %v", err)
-				return
-			}
-			log.Debug("Sending completion response: %s", string(response))
-			writeResponse(writer, response)
-
-		case "textDocument/definition":
-			log.Info("=== Handling textDocument/definition request ===")
-			var responseResult interface{} = nil
-
-			if params, ok := message["params"].(map[string]interface{}); ok {
-				if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
-					if uri, ok := textDocument["uri"].(string); ok {
-						if position, ok := params["position"].(map[string]interface{}); ok {
-							if lineNum, ok := position["line"].(float64); ok {
-								if charNum, ok := position["character"].(float64); ok {
-									log.Info("GotoDefinition: uri=%s, line=%d, char=%d", uri, int(lineNum), int(charNum))
-									responseResult = handleGotoDefinition(uri, int(lineNum), int(charNum))
-									log.Info("GotoDefinition: responseResult=%+v", responseResult)
-								}
+		completionList := map[string]interface{}{
+			"isIncomplete": false,
+			"items":        completionItems,
+		}
+		result := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      id,
+			"result":  completionList,
+		}
+		response, err := json.Marshal(result)
+		if err != nil {
+			log.Error("Failed to marshal completion response: %v", err)
+			return
+		}
+		log.Debug("Sending completion response: %s", string(response))
+		request.reply(writer, response)
+
+	case "textDocument/definition":
+		log.Info("=== Handling textDocument/definition request ===")
+		var responseResult interface{} = nil
+
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
+				if uri, ok := textDocument["uri"].(string); ok {
+					if position, ok := params["position"].(map[string]interface{}); ok {
+						if lineNum, ok := position["line"].(float64); ok {
+							if charNum, ok := position["character"].(float64); ok {
+								log.Info("GotoDefinition: uri=%s, line=%d, char=%d", uri, int(lineNum), int(charNum))
+								responseResult = handleGotoDefinition(uri, int(lineNum), int(charNum))
+								log.Info("GotoDefinition: responseResult=%+v", responseResult)
 							}
 						}
 					}
 				}
 			}
+		}
 
-			finalResponse := map[string]interface{}{
-				"jsonrpc": "2.0",
-				"id":      message["id"],
-				"result":  responseResult,
-			}
-			responseBytes, _ := json.Marshal(finalResponse)
-			writeResponse(writer, responseBytes)
-
-		case "textDocument/references":
-			log.Debug("Handling textDocument/references request.")
-			var responseResult interface{} = nil
-
-			if params, ok := message["params"].(map[string]interface{}); ok {
-				if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
-					if uri, ok := textDocument["uri"].(string); ok {
-						if position, ok := params["position"].(map[string]interface{}); ok {
-							if lineNum, ok := position["line"].(float64); ok {
-								if charNum, ok := position["character"].(float64); ok {
-									// Get the context parameter for includeDeclaration
-									includeDeclaration := true
-									if context, ok := params["context"].(map[string]interface{}); ok {
-										if incDec, ok := context["includeDeclaration"].(bool); ok {
-											includeDeclaration = incDec
-										}
+		finalResponse := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      message["id"],
+			"result":  responseResult,
+		}
+		responseBytes, _ := json.Marshal(finalResponse)
+		request.reply(writer, responseBytes)
+
+	case "textDocument/references":
+		log.Debug("Handling textDocument/references request.")
+		var responseResult interface{} = nil
+
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
+				if uri, ok := textDocument["uri"].(string); ok {
+					if position, ok := params["position"].(map[string]interface{}); ok {
+						if lineNum, ok := position["line"].(float64); ok {
+							if charNum, ok := position["character"].(float64); ok {
+								// Get the context parameter for includeDeclaration
+								includeDeclaration := true
+								if context, ok := params["context"].(map[string]interface{}); ok {
+									if incDec, ok := context["includeDeclaration"].(bool); ok {
+										includeDeclaration = incDec
 									}
+								}
 
-									documentStore.RLock()
-									text, docFound := documentStore.documents[uri]
-									documentStore.RUnlock()
-
-									if docFound {
-										lines := strings.Split(text, "\n")
-										if int(lineNum) < len(lines) {
-											lineContent := lines[int(lineNum)]
-											// Use getTokenAtPosition to handle multi-labels (e.g., !loop-, !skip+)
-											token := getTokenAtPosition(lineContent, int(charNum))
-											log.Debug("textDocument/references: token='%s' at line=%d char=%d", token, int(lineNum), int(charNum))
-
-											if token != "" {
-												// Check if this is a multi-label (starts with !)
-												if strings.HasPrefix(token, "!") {
-													// Multi-label: strip the direction suffix to get the base name
-													labelName := strings.TrimPrefix(token, "!")
-													labelName = strings.TrimSuffix(labelName, "+")
-													labelName = strings.TrimSuffix(labelName, "-")
-													labelName = strings.TrimSuffix(labelName, ":")
-
-													log.Debug("textDocument/references: Multi-label detected, labelName='%s'", labelName)
-
-													// Get analysis context for this URI
-													symbolStore.RLock()
-													analysisContext, hasContext := symbolStore.contexts[uri]
-													symbolStore.RUnlock()
-
-													if hasContext {
-														// Get all instances of this multi-label
-														if instances, found := analysisContext.getAllMultiLabelInstances(normalizeLabel(labelName)); found {
-															log.Debug("textDocument/references: Found %d instances of multi-label '%s'", len(instances), labelName)
-
-															// Collect all references to this multi-label
-															references := []map[string]interface{}{}
-
-															// Search for all references in the document
-															// Pattern: !labelName followed by +, -, or :
-															for lineIdx, line := range lines {
-																// Find all occurrences of !labelName with suffix
-																searchPatterns := []string{
-																	"!" + labelName + "+", // Forward reference
-																	"!" + labelName + "-", // Backward reference
-																	"!" + labelName + ":", // Definition
-																}
+								documentStore.RLock()
+								text, docFound := documentStore.documents[uri]
+								documentStore.RUnlock()
+
+								if docFound {
+									lines := strings.Split(text, "\n")
+									if int(lineNum) < len(lines) {
+										lineContent := lines[int(lineNum)]
+										// Use getTokenAtPosition to handle multi-labels (e.g., !loop-, !skip+)
+										token := getTokenAtPosition(lineContent, int(charNum))
+										log.Debug("textDocument/references: token='%s' at line=%d char=%d", token, int(lineNum), int(charNum))
+
+										if token != "" {
+											// Check if this is a multi-label (starts with !)
+											if strings.HasPrefix(token, "!") {
+												// Multi-label: strip the direction suffix to get the base name
+												labelName := strings.TrimPrefix(token, "!")
+												labelName = strings.TrimSuffix(labelName, "+")
+												labelName = strings.TrimSuffix(labelName, "-")
+												labelName = strings.TrimSuffix(labelName, ":")
+
+												log.Debug("textDocument/references: Multi-label detected, labelName='%s'", labelName)
+
+												// Get analysis context for this URI
+												symbolStore.RLock()
+												analysisContext, hasContext := symbolStore.contexts[uri]
+												symbolStore.RUnlock()
+
+												if hasContext {
+													// Get all instances of this multi-label
+													if instances, found := analysisContext.getAllMultiLabelInstances(normalizeLabel(labelName)); found {
+														log.Debug("textDocument/references: Found %d instances of multi-label '%s'", len(instances), labelName)
+
+														// Collect all references to this multi-label
+														references := []map[string]interface{}{}
+
+														// Search for all references in the document
+														// Pattern: !labelName followed by +, -, or :
+														for lineIdx, line := range lines {
+															// Find all occurrences of !labelName with suffix
+															searchPatterns := []string{
+																"!" + labelName + "+", // Forward reference
+																"!" + labelName + "-", // Backward reference
+																"!" + labelName + ":", // Definition
+															}
 
-																for _, pattern := range searchPatterns {
-																	searchIndex := 0
-																	for {
-																		index := strings.Index(line[searchIndex:], pattern)
-																		if index == -1 {
-																			break
-																		}
+															for _, pattern := range searchPatterns {
+																searchIndex := 0
+																for {
+																	index := strings.Index(line[searchIndex:], pattern)
+																	if index == -1 {
+																		break
+																	}
 
-																		actualIndex := searchIndex + index
-
-																		// Create reference location
-																		reference := map[string]interface{}{
-																			"uri": uri,
-																			"range": map[string]interface{}{
-																				"start": map[string]interface{}{
-																					"line":      lineIdx,
-																					"character": actualIndex,
-																				},
-																				"end": map[string]interface{}{
-																					"line":      lineIdx,
-																					"character": actualIndex + len(pattern),
-																				},
-																			},
-																		}
-																		references = append(references, reference)
+																	actualIndex := searchIndex + index
 
-																		searchIndex = actualIndex + 1
+																	// Create reference location
+																	reference := map[string]interface{}{
+																		"uri": uri,
+																		"range": map[string]interface{}{
+																			"start": map[string]interface{}{
+																				"line":      lineIdx,
+																				"character": actualIndex,
+																			},
+																			"end": map[string]interface{}{
+																				"line":      lineIdx,
+																				"character": actualIndex + len(pattern),
+																			},
+																		},
 																	}
+																	references = append(references, reference)
+
+																	searchIndex = actualIndex + 1
 																}
 															}
-
-															log.Debug("textDocument/references: Found %d total references for multi-label '%s'", len(references), labelName)
-															responseResult = references
-														} else {
-															log.Debug("textDocument/references: Multi-label '%s' not found in analysis context", labelName)
 														}
+
+														log.Debug("textDocument/references: Found %d total references for multi-label '%s'", len(references), labelName)
+														responseResult = references
 													} else {
-														log.Debug("textDocument/references: No analysis context for URI %s", uri)
+														log.Debug("textDocument/references: Multi-label '%s' not found in analysis context", labelName)
 													}
 												} else {
-													// Regular symbol (not a multi-label)
-													symbolStore.RLock()
-													symbolTree, treeFound := symbolStore.trees[uri]
-													symbolStore.RUnlock()
-
-													if treeFound {
-														normalizedWord := normalizeLabel(token)
-														log.Debug("textDocument/references: Regular symbol, normalizedWord='%s'", normalizedWord)
-
-														// First check if the symbol exists
-														if symbol, found := symbolTree.FindSymbol(normalizedWord); found {
-															// Find all references to this symbol
-															references := symbolTree.FindAllReferences(normalizedWord, text, uri)
-
-															// If includeDeclaration is false, filter out the declaration
-															if !includeDeclaration && len(references) > 0 {
-																filteredReferences := []map[string]interface{}{}
-																for _, ref := range references {
-																	if refRange, ok := ref["range"].(map[string]interface{}); ok {
-																		if start, ok := refRange["start"].(map[string]interface{}); ok {
-																			if refLine, ok := start["line"].(float64); ok {
-																				if refChar, ok := start["character"].(float64); ok {
-																					// Skip if this is the declaration position
-																					if int(refLine) != symbol.Position.Line ||
-																						int(refChar) != symbol.Position.Character {
-																						filteredReferences = append(filteredReferences, ref)
-																					}
+													log.Debug("textDocument/references: No analysis context for URI %s", uri)
+												}
+											} else {
+												// Regular symbol (not a multi-label)
+												symbolStore.RLock()
+												symbolTree, treeFound := symbolStore.trees[uri]
+												symbolStore.RUnlock()
+
+												if treeFound {
+													normalizedWord := normalizeLabel(token)
+													log.Debug("textDocument/references: Regular symbol, normalizedWord='%s'", normalizedWord)
+
+													// First check if the symbol exists
+													if symbol, found := symbolTree.FindSymbol(normalizedWord); found {
+														// Find all references to this symbol
+														references := symbolTree.FindAllReferences(normalizedWord, text, uri)
+
+														// If includeDeclaration is false, filter out the declaration
+														if !includeDeclaration && len(references) > 0 {
+															filteredReferences := []map[string]interface{}{}
+															for _, ref := range references {
+																if refRange, ok := ref["range"].(map[string]interface{}); ok {
+																	if start, ok := refRange["start"].(map[string]interface{}); ok {
+																		if refLine, ok := start["line"].(float64); ok {
+																			if refChar, ok := start["character"].(float64); ok {
+																				// Skip if this is the declaration position
+																				if int(refLine) != symbol.Position.Line ||
+																					int(refChar) != symbol.Position.Character {
+																					filteredReferences = append(filteredReferences, ref)
 																				}
 																			}
 																		}
 																	}
 																}
-																responseResult = filteredReferences
-															} else {
-																responseResult = references
 															}
-
-															log.Debug("Found %d references for regular symbol '%s'", len(references), token)
+															responseResult = filteredReferences
 														} else {
-															log.Debug("Regular symbol '%s' not found for references", token)
+															responseResult = references
 														}
+
+														log.Debug("Found %d references for regular symbol '%s'", len(references), token)
+													} else {
+														log.Debug("Regular symbol '%s' not found for references", token)
 													}
 												}
 											}
@@ -1342,84 +1657,183 @@ func Start() {
 					}
 				}
 			}
+		}
+
+		finalResponse := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      message["id"],
+			"result":  responseResult,
+		}
+		responseBytes, _ := json.Marshal(finalResponse)
+		request.reply(writer, responseBytes)
+
+	case "textDocument/documentSymbol":
+		log.Debug("Handling textDocument/documentSymbol request.")
+		var responseResult interface{} = nil
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
+				if uri, ok := textDocument["uri"].(string); ok {
+					responseResult = generateDocumentSymbols(uri)
+				}
+			}
+		}
+		finalResponse := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      message["id"],
+			"result":  responseResult,
+		}
+		responseBytes, _ := json.Marshal(finalResponse)
+		request.reply(writer, responseBytes)
+
+	case "textDocument/semanticTokens/full":
+		log.Debug("Handling textDocument/semanticTokens/full request.")
+		var responseResult interface{} = nil
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
+				if uri, ok := textDocument["uri"].(string); ok {
+					documentStore.RLock()
+					text, _ := documentStore.documents[uri]
+					documentStore.RUnlock()
+					tokens := generateSemanticTokens(uri, text)
+					responseResult = map[string]interface{}{"data": tokens}
+				}
+			}
+		}
+		finalResponse := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      message["id"],
+			"result":  responseResult,
+		}
+		responseBytes, _ := json.Marshal(finalResponse)
+		request.reply(writer, responseBytes)
+
+	case "textDocument/prepareRename", "textDocument/rename":
+		log.Debug("Handling %s request.", method)
+		response := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      message["id"],
+		}
+		var result interface{}
+		err := fmt.Errorf("invalid %s request", method)
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			if method == "textDocument/prepareRename" {
+				result, err = handlePrepareRename(params)
+			} else {
+				result, err = handleRename(params)
+			}
+		}
+		if err != nil {
+			log.Debug("%s rejected: %v", method, err)
+			response["error"] = map[string]interface{}{
+				"code":    ErrorRequestFailed,
+				"message": err.Error(),
+			}
+		} else {
+			response["result"] = result
+		}
+		responseBytes, _ := json.Marshal(response)
+		request.reply(writer, responseBytes)
 
-			finalResponse := map[string]interface{}{
+	case "workspace/executeCommand":
+		log.Debug("Handling workspace/executeCommand request.")
+		response := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      message["id"],
+		}
+		var result interface{}
+		err := fmt.Errorf("invalid workspace/executeCommand request")
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			result, err = handleExecuteCommand(writer, params)
+		}
+		if err != nil {
+			log.Debug("workspace/executeCommand failed: %v", err)
+			response["error"] = map[string]interface{}{
+				"code":    ErrorRequestFailed,
+				"message": err.Error(),
+			}
+		} else {
+			response["result"] = result
+		}
+		responseBytes, _ := json.Marshal(response)
+		request.reply(writer, responseBytes)
+
+	case "kickass_ls/reloadData":
+		log.Debug("Handling kickass_ls/reloadData request.")
+		response := map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      message["id"],
+			"result":  reloadData(writer),
+		}
+		responseBytes, _ := json.Marshal(response)
+		request.reply(writer, responseBytes)
+
+	case "textDocument/inlayHint":
+		log.Debug("Handling textDocument/inlayHint request.")
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			result := handleInlayHint(params)
+			response := map[string]interface{}{
 				"jsonrpc": "2.0",
 				"id":      message["id"],
-				"result":  responseResult,
-			}
-			responseBytes, _ := json.Marshal(finalResponse)
-			writeResponse(writer, responseBytes)
-
-		case "textDocument/documentSymbol":
-			log.Debug("Handling textDocument/documentSymbol request.")
-			var responseResult interface{} = nil
-			if params, ok := message["params"].(map[string]interface{}); ok {
-				if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
-					if uri, ok := textDocument["uri"].(string); ok {
-						responseResult = generateDocumentSymbols(uri)
-					}
-				}
+				"result":  result,
 			}
-			finalResponse := map[string]interface{}{
+			responseBytes, _ := json.Marshal(response)
+			request.reply(writer, responseBytes)
+		}
+
+	case "textDocument/signatureHelp":
+		log.Debug("Handling textDocument/signatureHelp request.")
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			result := handleSignatureHelp(params)
+			response := map[string]interface{}{
 				"jsonrpc": "2.0",
 				"id":      message["id"],
-				"result":  responseResult,
-			}
-			responseBytes, _ := json.Marshal(finalResponse)
-			writeResponse(writer, responseBytes)
-
-		case "textDocument/semanticTokens/full":
-			log.Debug("Handling textDocument/semanticTokens/full request.")
-			var responseResult interface{} = nil
-			if params, ok := message["params"].(map[string]interface{}); ok {
-				if textDocument, ok := params["textDocument"].(map[string]interface{}); ok {
-					if uri, ok := textDocument["uri"].(string); ok {
-						documentStore.RLock()
-						text, _ := documentStore.documents[uri]
-						documentStore.RUnlock()
-						tokens := generateSemanticTokens(uri, text)
-						responseResult = map[string]interface{}{"data": tokens}
-					}
-				}
+				"result":  result,
 			}
-			finalResponse := map[string]interface{}{
+			responseBytes, _ := json.Marshal(response)
+			request.reply(writer, responseBytes)
+		}
+
+	case "textDocument/codeAction":
+		log.Debug("Handling textDocument/codeAction request.")
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			result := handleCodeAction(params)
+			response := map[string]interface{}{
 				"jsonrpc": "2.0",
 				"id":      message["id"],
-				"result":  responseResult,
-			}
-			responseBytes, _ := json.Marshal(finalResponse)
-			writeResponse(writer, responseBytes)
-
-		case "textDocument/formatting":
-			log.Debug("Handling textDocument/formatting request.")
-			if params, ok := message["params"].(map[string]interface{}); ok {
-				result := handleDocumentFormatting(params)
-				response := map[string]interface{}{
-					"jsonrpc": "2.0",
-					"id":      message["id"],
-					"result":  result,
-				}
-				responseBytes, _ := json.Marshal(response)
-				writeResponse(writer, responseBytes)
-			}
-
-		case "textDocument/rangeFormatting":
-			log.Debug("Handling textDocument/rangeFormatting request.")
-			if params, ok := message["params"].(map[string]interface{}); ok {
-				result := handleRangeFormatting(params)
-				response := map[string]interface{}{
-					"jsonrpc": "2.0",
-					"id":      message["id"],
-					"result":  result,
-				}
-				responseBytes, _ := json.Marshal(response)
-				writeResponse(writer, responseBytes)
+				"result":  result,
+			}
+			responseBytes, _ := json.Marshal(response)
+			request.reply(writer, responseBytes)
+		}
+
+	case "textDocument/formatting":
+		log.Debug("Handling textDocument/formatting request.")
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			result := handleDocumentFormatting(params)
+			response := map[string]interface{}{
+				"jsonrpc": "2.0",
+				"id":      message["id"],
+				"result":  result,
 			}
+			responseBytes, _ := json.Marshal(response)
+			request.reply(writer, responseBytes)
+		}
 
-		default:
-			log.Warn("Unhandled method: %s", method)
+	case "textDocument/rangeFormatting":
+		log.Debug("Handling textDocument/rangeFormatting request.")
+		if params, ok := message["params"].(map[string]interface{}); ok {
+			result := handleRangeFormatting(params)
+			response := map[string]interface{}{
+				"jsonrpc": "2.0",
+				"id":      message["id"],
+				"result":  result,
+			}
+			responseBytes, _ := json.Marshal(response)
+			request.reply(writer, responseBytes)
 		}
+
+	default:
+		handleUnknownMethod(writer, request, method)
 	}
 }
 
@@ -1427,12 +1841,7 @@ func Start() {
 func publishDiagnostics(writer *bufio.Writer, uri string, diagnostics []Diagnostic) {
 	lspDiagnostics := make([]map[string]interface{}, len(diagnostics))
 	for i, d := range diagnostics {
-		lspDiagnostics[i] = map[string]interface{}{
-			"range":    d.Range,
-			"severity": d.Severity,
-			"message":  d.Message,
-			"source":   d.Source,
-		}
+		lspDiagnostics[i] = lspDiagnostic(d)
 	}
 
 	note := map[string]interface{}{
@@ -1448,38 +1857,89 @@ func publishDiagnostics(writer *bufio.Writer, uri string, diagnostics []Diagnost
 	writeResponse(writer, response)
 }
 
+// lspDiagnostic converts a diagnostic to its LSP form
+func lspDiagnostic(d Diagnostic) map[string]interface{} {
+	diagnostic := map[string]interface{}{
+		"range":    d.Range,
+		"severity": d.Severity,
+		"message":  d.Message,
+		"source":   d.Source,
+	}
+	if d.Code != "" {
+		diagnostic["code"] = d.Code
+	}
+	if d.Data != nil {
+		diagnostic["data"] = d.Data
+	}
+	if len(d.Tags) > 0 {
+		diagnostic["tags"] = d.Tags
+	}
+	if len(d.RelatedInformation) > 0 {
+		related := make([]map[string]interface{}, len(d.RelatedInformation))
+		for j, info := range d.RelatedInformation {
+			related[j] = map[string]interface{}{
+				"location": map[string]interface{}{"uri": info.URI, "range": info.Range},
+				"message":  info.Message,
+			}
+		}
+		diagnostic["relatedInformation"] = related
+	}
+	return diagnostic
+}
+
 func writeResponse(writer *bufio.Writer, response []byte) {
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+
 	log.Logger.Printf("Sending response: %s\n", string(response))
 	fmt.Fprintf(writer, "Content-Length: %d\r\n\r\n", len(response))
 	writer.Write(response)
 	writer.Flush()
 }
 
-func loadMnemonics(path string) error {
-	file, err := os.ReadFile(path)
+func loadMnemonics(path string) ([]Mnemonic, error) {
+	file, err := readDataFile(path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var loaded []Mnemonic
+	if err := json.Unmarshal(file, &loaded); err != nil {
+		return nil, err
 	}
-	return json.Unmarshal(file, &mnemonics)
+	return loaded, nil
 }
 
 // LoadMnemonics is the exported version of loadMnemonics for test mode
 func LoadMnemonics(path string) error {
-	return loadMnemonics(path)
+	loaded, err := loadMnemonics(path)
+	if err != nil {
+		return err
+	}
+	updateData(func(data *dataSnapshot) { data.mnemonics = loaded })
+	return nil
 }
 
 // loadC64MemoryMap loads the C64 memory map from c64memory.json
-func loadC64MemoryMap(path string) error {
-	file, err := os.ReadFile(path)
+func loadC64MemoryMap(path string) (C64MemoryMap, error) {
+	file, err := readDataFile(path)
 	if err != nil {
-		return err
+		return C64MemoryMap{}, err
+	}
+	var loaded C64MemoryMap
+	if err := json.Unmarshal(file, &loaded); err != nil {
+		return C64MemoryMap{}, err
 	}
-	return json.Unmarshal(file, &c64MemoryMap)
+	return loaded, nil
 }
 
 // LoadC64MemoryMap is the exported version of loadC64MemoryMap for test mode
 func LoadC64MemoryMap(path string) error {
-	return loadC64MemoryMap(path)
+	loaded, err := loadC64MemoryMap(path)
+	if err != nil {
+		return err
+	}
+	updateData(func(data *dataSnapshot) { data.c64MemoryMap = loaded })
+	return nil
 }
 
 // GetCompletionContext is the exported version of getCompletionContext for test mode
@@ -1498,7 +1958,7 @@ func GenerateCompletionsWithContext(symbolTree *Scope, lineNum int, contextType
 }
 
 func getOpcodeDescription(mnemonic string) string {
-	for _, m := range mnemonics {
+	for _, m := range currentData().mnemonics {
 		if m.Mnemonic == mnemonic {
 			var builder strings.Builder
 
@@ -1661,7 +2121,7 @@ func getBuiltinFunctionDescription(function string) string {
 	}
 
 	// Fallback to old builtinFunctions array (legacy parser)
-	for _, f := range builtinFunctions {
+	for _, f := range currentData().builtinFunctions {
 		if strings.EqualFold(f.Name, function) {
 			var builder strings.Builder
 
@@ -1725,7 +2185,7 @@ func getBuiltinConstantDescription(constant string) string {
 	}
 
 	// Fallback to old builtinConstants array (legacy parser)
-	for _, c := range builtinConstants {
+	for _, c := range currentData().builtinConstants {
 		if strings.EqualFold(c.Name, constant) {
 			var builder strings.Builder
 
@@ -1773,7 +2233,7 @@ func getMemoryAddressDescription(word string) string {
 	}
 
 	// Check if we have information for this address in our memory map
-	if region, found := c64MemoryMap.MemoryMap.Regions[addressStr]; found {
+	if region, found := currentData().c64MemoryMap.MemoryMap.Regions[addressStr]; found {
 		var builder strings.Builder
 
 		// Header with register name and category
@@ -2005,11 +2465,27 @@ func handleGotoDefinition(uri string, lineNum int, charNum int) interface{} {
 		return nil
 	}
 
+	// A label of one loop iteration, loop[2].label
+	if _, symbol := loopLabelAt(uri, lineContent, charNum); symbol != nil {
+		return map[string]interface{}{
+			"uri": uri,
+			"range": map[string]interface{}{
+				"start": map[string]interface{}{"line": symbol.Position.Line, "character": symbol.Position.Character},
+				"end":   map[string]interface{}{"line": symbol.Position.Line, "character": symbol.Position.Character + len(normalizeLabel(symbol.Name))},
+			},
+		}
+	}
+
 	// Regular label - use existing logic
 	word := getWordAtPosition(lineContent, charNum)
-	if symbol, found := symbolTree.FindSymbol(normalizeLabel(word)); found {
+	if symbol, found := symbolTree.findInnermostScope(lineNum).FindSymbol(normalizeLabel(word)); found {
+		// Symbols from imported files live in their own document
+		targetURI := uri
+		if symbol.Scope != nil && symbol.Scope.Uri != "" {
+			targetURI = symbol.Scope.Uri
+		}
 		return map[string]interface{}{
-			"uri": uri,
+			"uri": targetURI,
 			"range": map[string]interface{}{
 				"start": map[string]interface{}{"line": symbol.Position.Line, "character": symbol.Position.Character},
 				"end":   map[string]interface{}{"line": symbol.Position.Line, "character": symbol.Position.Character + len(symbol.Name)},
@@ -2261,6 +2737,7 @@ func getPrecedingMnemonicOrDirective(lineContent string, cursorPos int) (string,
 
 func generateCompletions(symbolTree *Scope, lineNum int, contextType CompletionContextType, wordToComplete string, lineContent string, cursorPos int, documentText string) []map[string]interface{} {
 	items := []map[string]interface{}{}
+	data := currentData()
 
 	log.Debug("generateCompletions called: lineNum=%d, contextType=%v, wordToComplete='%s', lineContent='%s', cursorPos=%d",
 		lineNum, contextType, wordToComplete, lineContent, cursorPos)
@@ -2415,7 +2892,7 @@ func generateCompletions(symbolTree *Scope, lineNum int, contextType CompletionC
 		log.Debug("Memory address completion requested with prefix: '%s'", memoryPrefix)
 
 		// Add all memory registers that match the prefix
-		for address, region := range c64MemoryMap.MemoryMap.Regions {
+		for address, region := range data.c64MemoryMap.MemoryMap.Regions {
 			// Convert 0xD000 format to $D000 format for matching
 			addressHex := strings.TrimPrefix(address, "0x")
 			addressWithDollar := "$" + addressHex
@@ -2477,7 +2954,7 @@ func generateCompletions(symbolTree *Scope, lineNum int, contextType CompletionC
 		wordToComplete = strings.TrimPrefix(wordToComplete, "#")
 
 		// Add built-in constants
-		for _, const_ := range builtinConstants {
+		for _, const_ := range data.builtinConstants {
 			if strings.HasPrefix(strings.ToLower(const_.Name), strings.ToLower(wordToComplete)) {
 				item := map[string]interface{}{
 					"label":         const_.Name,
@@ -2523,6 +3000,10 @@ func generateCompletions(symbolTree *Scope, lineNum int, contextType CompletionC
 				partialSymbol = parts[1]
 			}
 			namespaceScope := symbolTree.FindNamespace(namespaceName)
+			if namespaceScope == nil {
+				// Namespace may be defined in an imported file
+				namespaceScope = symbolTree.FindImportedNamespace(namespaceName)
+			}
 			if namespaceScope != nil {
 				for _, symbol := range namespaceScope.Symbols {
 					if strings.HasPrefix(symbol.Name, partialSymbol) {
@@ -2551,7 +3032,7 @@ func generateCompletions(symbolTree *Scope, lineNum int, contextType CompletionC
 
 			// Add built-in functions (only if appropriate for context)
 			if offerBuiltins {
-				for _, fn := range builtinFunctions {
+				for _, fn := range data.builtinFunctions {
 					shouldInclude := useRelaxedMatching ||
 						strings.HasPrefix(strings.ToLower(fn.Name), strings.ToLower(wordToComplete))
 					if shouldInclude {
@@ -2572,7 +3053,7 @@ func generateCompletions(symbolTree *Scope, lineNum int, contextType CompletionC
 				}
 
 				// Add built-in constants
-				for _, const_ := range builtinConstants {
+				for _, const_ := range data.builtinConstants {
 					shouldInclude := useRelaxedMatching ||
 						strings.HasPrefix(strings.ToLower(const_.Name), strings.ToLower(wordToComplete))
 					if shouldInclude {
@@ -2774,7 +3255,7 @@ func generateCompletions(symbolTree *Scope, lineNum int, contextType CompletionC
 				}
 			} else {
 				// Fallback to old mnemonics array (legacy parser)
-				for _, m := range mnemonics {
+				for _, m := range data.mnemonics {
 					if strings.HasPrefix(strings.ToUpper(m.Mnemonic), strings.ToUpper(wordToComplete)) {
 						items = append(items, map[string]interface{}{
 							"label":         applyCase(wordToComplete, m.Mnemonic),
@@ -2791,7 +3272,7 @@ func generateCompletions(symbolTree *Scope, lineNum int, contextType CompletionC
 }
 
 func isMnemonic(word string) bool {
-	for _, m := range mnemonics {
+	for _, m := range currentData().mnemonics {
 		if strings.EqualFold(m.Mnemonic, word) {
 			return true
 		}
@@ -3076,18 +3557,17 @@ func applyCase(original, suggestion string) string {
 
 // LoadBuiltins loads built-in functions and constants from kickass.json
 func LoadBuiltins(filePath string) ([]BuiltinFunction, []BuiltinConstant, error) {
-	file, err := os.Open(filePath)
+	file, err := readDataFile(filePath)
 	if err != nil {
 		return nil, nil, err
 	}
-	defer file.Close()
 
 	var config struct {
 		BuiltinFunctions []BuiltinFunction `json:"builtinFunctions"`
 		BuiltinConstants []BuiltinConstant `json:"builtinConstants"`
 	}
 
-	if err := json.NewDecoder(file).Decode(&config); err != nil {
+	if err := json.Unmarshal(file, &config); err != nil {
 		return nil, nil, err
 	}
 
@@ -3096,8 +3576,10 @@ func LoadBuiltins(filePath string) ([]BuiltinFunction, []BuiltinConstant, error)
 
 // SetBuiltins sets the global built-in functions and constants
 func SetBuiltins(functions []BuiltinFunction, constants []BuiltinConstant) {
-	builtinFunctions = functions
-	builtinConstants = constants
+	updateData(func(data *dataSnapshot) {
+		data.builtinFunctions = functions
+		data.builtinConstants = constants
+	})
 }
 
 // GenerateHover generates hover information for a word at a specific position
@@ -3167,84 +3649,6 @@ func GenerateHover(symbolTree *Scope, line string, char int) (string, bool) {
 	return "", false
 }
 
-// GenerateSignatureHelp generates signature help for function calls at a specific position
-func GenerateSignatureHelp(symbolTree *Scope, line string, char int) (string, bool) {
-	// Debug: show what we're analyzing
-	if char > len(line) {
-		char = len(line)
-	}
-
-	// Find function call context - look backwards for opening parenthesis
-	openParen := -1
-	for i := char; i >= 0; i-- {
-		if line[i] == '(' {
-			openParen = i
-			break
-		} else if line[i] == ')' || line[i] == ';' {
-			// Found closing paren or comment before opening - not in function call
-			return "", false
-		}
-	}
-
-	if openParen == -1 {
-		return "", false
-	}
-
-	// Extract function name before the opening parenthesis
-	funcName := ""
-	for i := openParen - 1; i >= 0; i-- {
-		c := line[i]
-		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' {
-			funcName = string(c) + funcName
-		} else {
-			break
-		}
-	}
-
-	if funcName == "" {
-		return "", false
-	}
-
-	// Check built-in functions first
-
-	for _, fn := range builtinFunctions {
-		if strings.EqualFold(fn.Name, funcName) {
-			// Count current parameter position by counting commas
-			paramIndex := 0
-			for i := openParen + 1; i < char; i++ {
-				if line[i] == ',' {
-					paramIndex++
-				}
-			}
-
-			// Format signature with current parameter highlighted
-			signature := fmt.Sprintf("**%s**\n\n```kickassembler\n%s\n```\n\n%s", fn.Name, fn.Signature, fn.Description)
-
-			if len(fn.Examples) > 0 {
-				signature += fmt.Sprintf("\n\n**Example:**\n```kickassembler\n%s\n```", fn.Examples[0])
-			}
-
-			// Add parameter position info
-			signature += fmt.Sprintf("\n\n*Parameter %d*", paramIndex+1)
-
-			return signature, true
-		}
-	}
-
-	// Check user-defined functions/macros in symbol tree
-	if symbol, found := symbolTree.FindSymbol(normalizeLabel(funcName)); found {
-		if symbol.Kind == Function || symbol.Kind == Macro {
-			signature := fmt.Sprintf("**%s** (%s)", symbol.Name, symbol.Kind.String())
-			if symbol.Signature != "" {
-				signature += fmt.Sprintf("\n\n```kickassembler\n%s\n```", symbol.Signature)
-			}
-			return signature, true
-		}
-	}
-
-	return "", false
-}
-
 // ListSymbols returns all symbols in a scope with their metadata
 func ListSymbols(scope *Scope) []map[string]interface{} {
 	var symbols []map[string]interface{}
@@ -3292,16 +3696,18 @@ func addSymbolsFromScope(scope *Scope, symbols *[]map[string]interface{}) {
 
 // GetBuiltins returns the current built-in functions and constants
 func GetBuiltins() ([]BuiltinFunction, []BuiltinConstant) {
-	return builtinFunctions, builtinConstants
+	data := currentData()
+	return data.builtinFunctions, data.builtinConstants
 }
 
 // GetBuiltinFunctions returns the global builtin functions for validation
 func GetBuiltinFunctions() []BuiltinFunction {
-	return builtinFunctions
+	return currentData().builtinFunctions
 }
 
 // FindReferences finds all references to a symbol at a specific position
 func FindReferences(scope *Scope, line string, char int, lineNum int) ([]map[string]interface{}, string) {
+	data := currentData()
 	// Get word at position
 	word := getWordAtPosition(line, char)
 	if word == "" {
@@ -3309,7 +3715,7 @@ func FindReferences(scope *Scope, line string, char int, lineNum int) ([]map[str
 	}
 
 	// Check if it's a built-in
-	for _, fn := range builtinFunctions {
+	for _, fn := range data.builtinFunctions {
 		if strings.EqualFold(fn.Name, word) {
 			return []map[string]interface{}{
 				{
@@ -3320,7 +3726,7 @@ func FindReferences(scope *Scope, line string, char int, lineNum int) ([]map[str
 		}
 	}
 
-	for _, const_ := range builtinConstants {
+	for _, const_ := range data.builtinConstants {
 		if strings.EqualFold(const_.Name, word) {
 			return []map[string]interface{}{
 				{
@@ -3359,6 +3765,7 @@ func FindReferences(scope *Scope, line string, char int, lineNum int) ([]map[str
 
 // GotoDefinition finds the definition of a symbol at a specific position
 func GotoDefinition(scope *Scope, line string, char int) (map[string]interface{}, string, bool) {
+	data := currentData()
 	// Get word at position
 	word := getWordAtPosition(line, char)
 	if word == "" {
@@ -3366,7 +3773,7 @@ func GotoDefinition(scope *Scope, line string, char int) (map[string]interface{}
 	}
 
 	// Check if it's a built-in function
-	for _, fn := range builtinFunctions {
+	for _, fn := range data.builtinFunctions {
 		if strings.EqualFold(fn.Name, word) {
 			return map[string]interface{}{
 				"type": "built-in",
@@ -3376,7 +3783,7 @@ func GotoDefinition(scope *Scope, line string, char int) (map[string]interface{}
 	}
 
 	// Check if it's a built-in constant
-	for _, const_ := range builtinConstants {
+	for _, const_ := range data.builtinConstants {
 		if strings.EqualFold(const_.Name, word) {
 			return map[string]interface{}{
 				"type": "built-in",
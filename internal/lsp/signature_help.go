@@ -0,0 +1,401 @@
+package lsp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "c64.nvim/internal/log"
+)
+
+// SignatureHelp is the result of a textDocument/signatureHelp request
+type SignatureHelp struct {
+	Signatures      []SignatureInformation `json:"signatures"`
+	ActiveSignature int                    `json:"activeSignature"`
+	ActiveParameter int                    `json:"activeParameter"`
+}
+
+// SignatureInformation describes a single callable signature
+type SignatureInformation struct {
+	Label         string                 `json:"label"`
+	Documentation *MarkupContent         `json:"documentation,omitempty"`
+	Parameters    []ParameterInformation `json:"parameters"`
+}
+
+// ParameterInformation describes one parameter. Label holds the start and end offset
+// of the parameter inside the signature label.
+type ParameterInformation struct {
+	Label         [2]int         `json:"label"`
+	Documentation *MarkupContent `json:"documentation,omitempty"`
+}
+
+// MarkupContent is a markdown documentation string
+type MarkupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// paramCommentPattern matches a "// @param name description" doc comment line
+var paramCommentPattern = regexp.MustCompile(`^(?://+|;+|/?\*+)\s*@param\s+([A-Za-z_][A-Za-z0-9_]*)\s*[:-]?\s*(.*?)\s*(?:\*/)?$`)
+
+// pseudoCommandLinePattern matches an optional label in front of a pseudocommand name
+var pseudoCommandLinePattern = regexp.MustCompile(`^\s*(?:(?:![A-Za-z0-9_]*|[A-Za-z_][A-Za-z0-9_]*):\s*)?:?((?:[A-Za-z_][A-Za-z0-9_]*\.)?[A-Za-z_][A-Za-z0-9_]*)(\s+)`)
+
+// openCall is an unclosed '(' in front of the cursor
+type openCall struct {
+	nameStart int
+	nameEnd   int
+	commas    int
+}
+
+// handleSignatureHelp handles the textDocument/signatureHelp LSP request
+func handleSignatureHelp(params map[string]interface{}) interface{} {
+	uri, lineNum, char, ok := renamePosition(params)
+	if !ok {
+		log.Error("Invalid signatureHelp request")
+		return nil
+	}
+
+	documentStore.RLock()
+	text, exists := documentStore.documents[uri]
+	documentStore.RUnlock()
+	if !exists {
+		log.Warn("Document not found for signatureHelp: %s", uri)
+		return nil
+	}
+	lines := strings.Split(text, "\n")
+	if lineNum < 0 || lineNum >= len(lines) {
+		return nil
+	}
+
+	symbolStore.RLock()
+	tree := symbolStore.trees[uri]
+	symbolStore.RUnlock()
+
+	help, found := FindSignatureHelp(tree, lineNum, lines[lineNum], char)
+	if !found {
+		return nil
+	}
+	return help
+}
+
+// GenerateSignatureHelp generates signature help for function calls at a specific position
+// and renders it as markdown
+func GenerateSignatureHelp(symbolTree *Scope, lineNum int, line string, char int) (string, bool) {
+	help, found := FindSignatureHelp(symbolTree, lineNum, line, char)
+	if !found {
+		return "", false
+	}
+
+	signature := help.Signatures[help.ActiveSignature]
+	result := fmt.Sprintf("```kickassembler\n%s\n```", signature.Label)
+	if signature.Documentation != nil {
+		result += "\n\n" + signature.Documentation.Value
+	}
+	if help.ActiveParameter < len(signature.Parameters) {
+		parameter := signature.Parameters[help.ActiveParameter]
+		result += fmt.Sprintf("\n\n*Parameter %d*: `%s`", help.ActiveParameter+1,
+			signature.Label[parameter.Label[0]:parameter.Label[1]])
+		if parameter.Documentation != nil {
+			result += " - " + parameter.Documentation.Value
+		}
+	} else {
+		result += fmt.Sprintf("\n\n*Parameter %d*", help.ActiveParameter+1)
+	}
+	return result, true
+}
+
+// FindSignatureHelp determines the call surrounding the cursor and returns its signature.
+// Macro and function calls use parenthesised, comma separated arguments; pseudocommands
+// take colon separated arguments after the command name.
+func FindSignatureHelp(symbolTree *Scope, lineNum int, line string, char int) (*SignatureHelp, bool) {
+	if char > len(line) {
+		char = len(line)
+	}
+	if commentStart := findCommentStart(line); commentStart >= 0 && commentStart < char {
+		return nil, false
+	}
+
+	// Innermost call first - the argument of an outer call may itself be a call
+	calls := openCallsBefore(line, char)
+	for i := len(calls) - 1; i >= 0; i-- {
+		call := calls[i]
+		name := line[call.nameStart:call.nameEnd]
+		qualifier, isDirective := qualifierBefore(line, call.nameStart)
+		if isDirective {
+			continue
+		}
+
+		if qualifier == "" {
+			if fn, found := findBuiltinFunction(name); found {
+				return newSignatureHelp(builtinSignature(fn), call.commas), true
+			}
+		}
+		if symbol, found := resolveSymbolAt(symbolTree, lineNum, qualifier, name); found {
+			if symbol.Kind == Function || symbol.Kind == Macro {
+				return newSignatureHelp(userSignature(symbol), call.commas), true
+			}
+		}
+	}
+
+	// Pseudocommand: "name arg1 : arg2"
+	code := line[:char]
+	if match := pseudoCommandLinePattern.FindStringSubmatchIndex(code); match != nil {
+		name := code[match[2]:match[3]]
+		qualifier := ""
+		if dot := strings.LastIndex(name, "."); dot >= 0 {
+			qualifier, name = name[:dot], name[dot+1:]
+		}
+		if symbol, found := resolveSymbolAt(symbolTree, lineNum, qualifier, name); found && symbol.Kind == PseudoCommand {
+			return newSignatureHelp(userSignature(symbol), countArgumentSeparators(code[match[1]:], ':')), true
+		}
+	}
+
+	return nil, false
+}
+
+// newSignatureHelp wraps a single signature, clamping the active parameter to its last parameter
+func newSignatureHelp(signature SignatureInformation, activeParameter int) *SignatureHelp {
+	if len(signature.Parameters) > 0 && activeParameter >= len(signature.Parameters) {
+		activeParameter = len(signature.Parameters) - 1
+	}
+	return &SignatureHelp{
+		Signatures:      []SignatureInformation{signature},
+		ActiveSignature: 0,
+		ActiveParameter: activeParameter,
+	}
+}
+
+// openCallsBefore returns the calls whose '(' is still open at char, outermost first
+func openCallsBefore(line string, char int) []openCall {
+	var calls []openCall
+	var parens []bool // true for parentheses that belong to a call
+	inString := false
+	for i := 0; i < char; i++ {
+		c := line[i]
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+		case '(':
+			start, end := identifierBoundsAt(line, i)
+			isCall := end == i && start < end
+			parens = append(parens, isCall)
+			if isCall {
+				calls = append(calls, openCall{nameStart: start, nameEnd: end})
+			}
+		case ')':
+			if len(parens) > 0 {
+				if parens[len(parens)-1] {
+					calls = calls[:len(calls)-1]
+				}
+				parens = parens[:len(parens)-1]
+			}
+		case ',':
+			// Commas inside a grouping parenthesis do not separate call arguments
+			if len(calls) > 0 && len(parens) > 0 && parens[len(parens)-1] {
+				calls[len(calls)-1].commas++
+			}
+		}
+	}
+	return calls
+}
+
+// countArgumentSeparators counts separator characters outside of parentheses and strings
+func countArgumentSeparators(text string, separator byte) int {
+	count, depth := 0, 0
+	inString := false
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case inString:
+			if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth > 0 {
+				depth--
+			}
+		case c == separator && depth == 0:
+			count++
+		}
+	}
+	return count
+}
+
+// findBuiltinFunction looks up a kickass.json built-in function by name
+func findBuiltinFunction(name string) (BuiltinFunction, bool) {
+	for _, fn := range currentData().builtinFunctions {
+		if strings.EqualFold(fn.Name, name) {
+			return fn, true
+		}
+	}
+	return BuiltinFunction{}, false
+}
+
+// builtinSignature builds the SignatureInformation for a kickass.json built-in function
+func builtinSignature(fn BuiltinFunction) SignatureInformation {
+	label := fn.Signature
+	if label == "" {
+		label = fn.Name + "()"
+	}
+
+	documentation := fn.Description
+	if len(fn.Examples) > 0 {
+		documentation += fmt.Sprintf("\n\n**Example:**\n```kickassembler\n%s\n```", fn.Examples[0])
+	}
+
+	signature := SignatureInformation{
+		Label:      label,
+		Parameters: []ParameterInformation{},
+	}
+	if documentation != "" {
+		signature.Documentation = &MarkupContent{Kind: "markdown", Value: documentation}
+	}
+
+	open := strings.Index(label, "(")
+	if open < 0 {
+		return signature
+	}
+	for _, bounds := range splitParameterList(label, open+1, ',') {
+		signature.Parameters = append(signature.Parameters, ParameterInformation{Label: bounds})
+	}
+	return signature
+}
+
+// userSignature builds the SignatureInformation for a user defined macro, function or
+// pseudocommand, taking documentation from the comment block above the definition
+func userSignature(symbol *Symbol) SignatureInformation {
+	var label string
+	var parameterOffsets [][2]int
+	if symbol.Kind == PseudoCommand {
+		label = symbol.Name
+		for i, param := range symbol.Params {
+			if i == 0 {
+				label += " "
+			} else {
+				label += " : "
+			}
+			parameterOffsets = append(parameterOffsets, [2]int{len(label), len(label) + len(param)})
+			label += param
+		}
+	} else {
+		label = symbol.Name + "("
+		for i, param := range symbol.Params {
+			if i > 0 {
+				label += ", "
+			}
+			parameterOffsets = append(parameterOffsets, [2]int{len(label), len(label) + len(param)})
+			label += param
+		}
+		label += ")"
+	}
+
+	description, paramDocs := definitionDocumentation(symbol)
+
+	signature := SignatureInformation{
+		Label:      label,
+		Parameters: []ParameterInformation{},
+	}
+	if description != "" {
+		signature.Documentation = &MarkupContent{Kind: "markdown", Value: description}
+	}
+	for i, param := range symbol.Params {
+		parameter := ParameterInformation{Label: parameterOffsets[i]}
+		if doc, found := paramDocs[param]; found && doc != "" {
+			parameter.Documentation = &MarkupContent{Kind: "markdown", Value: doc}
+		}
+		signature.Parameters = append(signature.Parameters, parameter)
+	}
+	return signature
+}
+
+// splitParameterList returns the offsets of the separator delimited parameters in text,
+// starting at start and ending at the closing parenthesis
+func splitParameterList(text string, start int, separator byte) [][2]int {
+	var bounds [][2]int
+	depth := 0
+	paramStart := start
+	addParam := func(end int) {
+		s, e := paramStart, end
+		for s < e && text[s] == ' ' {
+			s++
+		}
+		for e > s && text[e-1] == ' ' {
+			e--
+		}
+		if s < e {
+			bounds = append(bounds, [2]int{s, e})
+		}
+	}
+
+	for i := start; i < len(text); i++ {
+		switch text[i] {
+		case '(', '[':
+			depth++
+		case ')', ']':
+			if depth == 0 {
+				addParam(i)
+				return bounds
+			}
+			depth--
+		case separator:
+			if depth == 0 {
+				addParam(i)
+				paramStart = i + 1
+			}
+		}
+	}
+	addParam(len(text))
+	return bounds
+}
+
+// definitionDocumentation reads the comment block directly above a symbol definition.
+// "@param name text" lines document parameters, all other lines form the description.
+func definitionDocumentation(symbol *Symbol) (string, map[string]string) {
+	paramDocs := make(map[string]string)
+	if symbol.Scope == nil || symbol.Scope.Uri == "" {
+		return "", paramDocs
+	}
+	doc, found := loadRenameDocument(symbol.Scope.Uri)
+	if !found {
+		return "", paramDocs
+	}
+	lines := strings.Split(doc.Text, "\n")
+	if symbol.Position.Line <= 0 || symbol.Position.Line > len(lines) {
+		return "", paramDocs
+	}
+
+	var description []string
+	for i := symbol.Position.Line - 1; i >= 0; i-- {
+		trimmed := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(trimmed, "//") && !strings.HasPrefix(trimmed, ";") &&
+			!strings.HasPrefix(trimmed, "/*") && !strings.HasPrefix(trimmed, "*") {
+			break
+		}
+
+		if match := paramCommentPattern.FindStringSubmatch(trimmed); match != nil {
+			paramDocs[match[1]] = match[2]
+			continue
+		}
+
+		text := strings.TrimLeft(trimmed, "/;*")
+		text = strings.TrimSpace(strings.TrimSuffix(text, "*/"))
+		if text != "" {
+			description = append([]string{text}, description...)
+		}
+	}
+	return strings.Join(description, "\n"), paramDocs
+}
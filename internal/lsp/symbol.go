@@ -66,6 +66,7 @@ type Symbol struct {
 	Address    int64      // Memory address of symbol (for labels, constants)
 	Size       int64      // Size in bytes (for data symbols)
 	CrossRefs  []Position // All usage positions for cross-references
+	Evaluated  *Value     // Value of a constant or variable; nil when only Address is known
 }
 
 // Scope represents a scope (e.g., a file, a namespace, or a function).
@@ -76,6 +77,7 @@ type Scope struct {
 	Symbols  map[string]*Symbol
 	Range    Range // The range this scope covers in the document
 	Uri      string
+	Imports  []*Scope // Root scopes of source files pulled in via #import (root scope only)
 }
 
 // Range represents a range in the code (start and end).
@@ -137,9 +139,64 @@ func (s *Scope) FindSymbol(name string) (*Symbol, bool) {
 		}
 	}
 
+	// Fall back to symbols from imported source files
+	root := s
+	for root.Parent != nil {
+		root = root.Parent
+	}
+	return root.findImportedSymbol(name, map[*Scope]bool{root: true})
+}
+
+// findImportedSymbol searches the root scopes of imported files, following nested imports.
+// The visited set guards against import cycles.
+func (s *Scope) findImportedSymbol(name string, visited map[*Scope]bool) (*Symbol, bool) {
+	parts := strings.Split(name, ".")
+
+	for _, imported := range s.Imports {
+		if imported == nil || visited[imported] {
+			continue
+		}
+		visited[imported] = true
+
+		if len(parts) > 1 {
+			if nsScope := imported.FindNamespace(normalizeLabel(parts[0])); nsScope != nil {
+				if symbol, ok := nsScope.Symbols[normalizeLabel(parts[1])]; ok {
+					return symbol, true
+				}
+			}
+		} else if symbol, ok := imported.Symbols[normalizeLabel(name)]; ok {
+			return symbol, true
+		}
+
+		if symbol, ok := imported.findImportedSymbol(name, visited); ok {
+			return symbol, true
+		}
+	}
+
 	return nil, false
 }
 
+// FindImportedNamespace searches the imported files for a namespace scope with the given name.
+func (s *Scope) FindImportedNamespace(name string) *Scope {
+	return s.findImportedNamespace(name, map[*Scope]bool{s: true})
+}
+
+func (s *Scope) findImportedNamespace(name string, visited map[*Scope]bool) *Scope {
+	for _, imported := range s.Imports {
+		if imported == nil || visited[imported] {
+			continue
+		}
+		visited[imported] = true
+		if nsScope := imported.FindNamespace(name); nsScope != nil {
+			return nsScope
+		}
+		if nsScope := imported.findImportedNamespace(name, visited); nsScope != nil {
+			return nsScope
+		}
+	}
+	return nil
+}
+
 // FindNamespace searches for a namespace scope with the given name.
 func (s *Scope) FindNamespace(name string) *Scope {
 	for _, child := range s.Children {
@@ -150,6 +207,16 @@ func (s *Scope) FindNamespace(name string) *Scope {
 	return nil
 }
 
+// findChildScopeAt returns the child scope whose range starts at the given position
+func (s *Scope) findChildScopeAt(start Position) *Scope {
+	for _, child := range s.Children {
+		if child.Range.Start == start {
+			return child
+		}
+	}
+	return nil
+}
+
 // FindAllVisibleSymbols collects all symbols that are visible from a specific point in the code.
 func (s *Scope) FindAllVisibleSymbols(lineNumber int) []*Symbol {
 	var visibleSymbols []*Symbol
@@ -164,9 +231,28 @@ func (s *Scope) FindAllVisibleSymbols(lineNumber int) []*Symbol {
 		}
 	}
 
+	// Symbols from imported files are visible everywhere in the importing file
+	visibleSymbols = append(visibleSymbols, s.collectImportedSymbols(map[*Scope]bool{s: true})...)
+
 	return visibleSymbols
 }
 
+// collectImportedSymbols returns the root-level symbols of all (transitively) imported files.
+func (s *Scope) collectImportedSymbols(visited map[*Scope]bool) []*Symbol {
+	var symbols []*Symbol
+	for _, imported := range s.Imports {
+		if imported == nil || visited[imported] {
+			continue
+		}
+		visited[imported] = true
+		for _, symbol := range imported.Symbols {
+			symbols = append(symbols, symbol)
+		}
+		symbols = append(symbols, imported.collectImportedSymbols(visited)...)
+	}
+	return symbols
+}
+
 // findInnermostScope finds the most specific scope for a given line number.
 func (s *Scope) findInnermostScope(lineNumber int) *Scope {
 	for _, child := range s.Children {
@@ -0,0 +1,77 @@
+package lsp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// applyContentChanges applies the contentChanges of a didChange notification in order.
+// A change without a range replaces the whole document (full sync); a change with a range
+// replaces that range, given in UTF-16 line/character positions.
+func applyContentChanges(text string, contentChanges []interface{}) (string, error) {
+	for i, rawChange := range contentChanges {
+		change, ok := rawChange.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("content change %d is not an object", i)
+		}
+		newText, ok := change["text"].(string)
+		if !ok {
+			return "", fmt.Errorf("content change %d has no text", i)
+		}
+
+		changeRange, hasRange := change["range"].(map[string]interface{})
+		if !hasRange {
+			text = newText
+			continue
+		}
+
+		start, okStart := changePosition(changeRange, "start")
+		end, okEnd := changePosition(changeRange, "end")
+		if !okStart || !okEnd {
+			return "", fmt.Errorf("content change %d has an invalid range", i)
+		}
+
+		startOffset := positionToOffset(text, start)
+		endOffset := positionToOffset(text, end)
+		if endOffset < startOffset {
+			return "", fmt.Errorf("content change %d has an inverted range", i)
+		}
+		text = text[:startOffset] + newText + text[endOffset:]
+	}
+	return text, nil
+}
+
+// changePosition reads the "start" or "end" position of an LSP range
+func changePosition(changeRange map[string]interface{}, key string) (Position, bool) {
+	position, ok := changeRange[key].(map[string]interface{})
+	if !ok {
+		return Position{}, false
+	}
+	line, okLine := position["line"].(float64)
+	character, okChar := position["character"].(float64)
+	if !okLine || !okChar {
+		return Position{}, false
+	}
+	return Position{Line: int(line), Character: int(character)}, true
+}
+
+// positionToOffset converts an LSP position (UTF-16 character offset) to a byte offset in text.
+// Positions past the end of a line or the document are clamped, as required by the protocol.
+func positionToOffset(text string, position Position) int {
+	lineStart := 0
+	for line := 0; line < position.Line; line++ {
+		next := strings.IndexByte(text[lineStart:], '\n')
+		if next < 0 {
+			return len(text)
+		}
+		lineStart += next + 1
+	}
+
+	lineEnd := strings.IndexByte(text[lineStart:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(text)
+	} else {
+		lineEnd += lineStart
+	}
+	return lineStart + utf16ToUTF8Offset(text[lineStart:lineEnd], position.Character)
+}
@@ -0,0 +1,557 @@
+package lsp
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// InstructionTiming records the cycle timing of one instruction, collected in Pass 1
+type InstructionTiming struct {
+	Line        int    // 0-based source line
+	Character   int    // 0-based column of the mnemonic
+	Mnemonic    string // upper case
+	Mode        string // addressing mode as named in mnemonic.json ("Absolute,X", ...)
+	PC          int64  // address of the instruction, -1 inside macro/function templates
+	StartsBlock bool   // first instruction after a label
+
+	BaseCycles  int   // cycles without penalties (not-taken cycles for branches)
+	PageCross   bool  // +1 cycle if the indexed access may cross a page
+	BaseAddress int64 // base address of an indexed operand, -1 if unknown
+
+	// Branch target, resolved after Pass 2
+	TargetName      string
+	TargetMulti     bool
+	TargetDirection rune
+	TargetAddress   int64 // -1 if unknown
+	Namespace       string
+
+	MinCycles int
+	MaxCycles int
+
+	// Assembly data, used by the emulator
+	Opcode  int   // -1 if the mode has no opcode
+	Length  int   // instruction length in bytes
+	Operand int64 // resolved operand value (immediate value or address), -1 if unknown
+	operand Expression
+}
+
+// pageCrossingMnemonics are the read instructions that take an extra cycle when an
+// indexed access crosses a page boundary
+var pageCrossingMnemonics = map[string]bool{
+	"ADC": true, "AND": true, "CMP": true, "EOR": true, "LDA": true, "LDX": true,
+	"LDY": true, "ORA": true, "SBC": true, "LAX": true, "LAS": true, "NOP": true,
+}
+
+// mnemonicSuffixModes maps Kick Assembler's mnemonic extensions (lda.abs, ldx.zpy, ...) to the
+// addressing mode they force. "zeropage" and "absolute" only pick the operand size.
+var mnemonicSuffixModes = map[string]string{
+	"im": "Immediate", "imm": "Immediate",
+	"z": "zeropage", "zp": "zeropage",
+	"zx": "Zeropage,X", "zpx": "Zeropage,X",
+	"zy": "Zeropage,Y", "zpy": "Zeropage,Y",
+	"izx": "Indexed-indirect", "izy": "Indirect-indexed",
+	"a": "absolute", "abs": "absolute",
+	"ax": "Absolute,X", "absx": "Absolute,X",
+	"ay": "Absolute,Y", "absy": "Absolute,Y",
+	"i": "Indirect", "ind": "Indirect",
+	"r": "Relative", "rel": "Relative",
+}
+
+// addressingMode determines the addressing mode of an instruction, using the mode names
+// from mnemonic.json. A mnemonic extension overrides the mode derived from the operand.
+func (a *SemanticAnalyzer) addressingMode(info *EnhancedMnemonicInfo, node *InstructionStatement) string {
+	mode := a.operandAddressingMode(info, node)
+	switch forced := mnemonicSuffixModes[strings.ToLower(node.Suffix)]; forced {
+	case "":
+		return mode
+	case "zeropage":
+		return strings.Replace(mode, "Absolute", "Zeropage", 1)
+	case "absolute":
+		return strings.Replace(mode, "Zeropage", "Absolute", 1)
+	default:
+		return forced
+	}
+}
+
+// instructionMode returns the addressing mode chosen for an instruction in Pass 1. Like Kick
+// Assembler, the choice between zero page and absolute is not revised in later passes, so an
+// operand referring to a symbol defined further down stays absolute. In a macro the mode
+// depends on the arguments, so every expansion chooses its own.
+func (a *SemanticAnalyzer) instructionMode(info *EnhancedMnemonicInfo, node *InstructionStatement) string {
+	if a.expansion != nil {
+		return a.addressingMode(info, node)
+	}
+	if mode, chosen := a.instructionModes[node]; chosen {
+		return mode
+	}
+	mode := a.addressingMode(info, node)
+	if a.instructionModes == nil {
+		a.instructionModes = make(map[*InstructionStatement]string)
+	}
+	a.instructionModes[node] = mode
+	return mode
+}
+
+// operandAddressingMode derives the addressing mode from the operand
+func (a *SemanticAnalyzer) operandAddressingMode(info *EnhancedMnemonicInfo, node *InstructionStatement) string {
+	if info.Type == "Branch" {
+		return "Relative"
+	}
+
+	hasMode := func(mode string) bool {
+		return hasAddressingMode(info, mode)
+	}
+
+	// The parser drops grouping parentheses, so indirect modes are taken from the source text
+	switch indirectOperandForm(a.operandText(node)) {
+	case "Indirect":
+		return "Indirect"
+	case "Indexed-indirect":
+		return "Indexed-indirect"
+	case "Indirect-indexed":
+		return "Indirect-indexed"
+	}
+
+	// An operand whose value is not known yet is assumed to be absolute, unless it is a
+	// byte expression (<x, >x) or the mnemonic only has the zero-page mode
+	zeroPageOr := func(operand Expression, zeroPage, absolute string) string {
+		if !hasMode(zeroPage) {
+			return absolute
+		}
+		value := a.evaluateExpression(operand)
+		if value >= 0 && value <= 0xFF {
+			return zeroPage
+		}
+		if value == -1 && (isByteExpression(operand) || !hasMode(absolute)) {
+			return zeroPage
+		}
+		return absolute
+	}
+
+	operand := node.Operand
+	switch op := operand.(type) {
+	case nil:
+		if hasMode("Accumulator") && !hasMode("Implied") {
+			return "Accumulator"
+		}
+		return "Implied"
+	case *Identifier:
+		if strings.EqualFold(op.Value, "a") {
+			// "inc a" is the accumulator unless a symbol named "a" exists
+			if _, isLabel := a.context.lookupLabel(op.Value); hasMode("Accumulator") || !isLabel {
+				return "Accumulator"
+			}
+		}
+	case *PrefixExpression:
+		if op.Operator == "#" {
+			return "Immediate"
+		}
+	case *InfixExpression:
+		if op.Operator == "," {
+			register := ""
+			if ident, ok := op.Right.(*Identifier); ok {
+				register = strings.ToUpper(ident.Value)
+			}
+			return zeroPageOr(op.Left, "Zeropage,"+register, "Absolute,"+register)
+		}
+	}
+
+	return zeroPageOr(operand, "Zeropage", "Absolute")
+}
+
+// isByteExpression reports whether an operand always yields a byte (low or high byte of a value)
+func isByteExpression(operand Expression) bool {
+	prefix, ok := operand.(*PrefixExpression)
+	return ok && (prefix.Operator == "<" || prefix.Operator == ">")
+}
+
+// hasAddressingMode reports whether mnemonic.json lists the mode for the mnemonic
+func hasAddressingMode(info *EnhancedMnemonicInfo, mode string) bool {
+	for _, m := range info.AddressingModes {
+		if m.Mode == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// operandText returns the source text of an instruction operand, without a trailing comment
+func (a *SemanticAnalyzer) operandText(node *InstructionStatement) string {
+	lineIndex := node.Token.Line - 1
+	if lineIndex < 0 || lineIndex >= len(a.documentLines) {
+		return ""
+	}
+	line := a.documentLines[lineIndex]
+	if commentStart := findCommentStart(line); commentStart >= 0 {
+		line = line[:commentStart]
+	}
+	start := node.Token.Column - 1 + len(node.Token.Literal)
+	if node.Suffix != "" {
+		start += len(node.Suffix) + 1
+	}
+	if start < 0 || start > len(line) {
+		return ""
+	}
+	return strings.TrimSpace(line[start:])
+}
+
+// indirectOperandForm classifies an operand wrapped in parentheses: "(nn)" is Indirect,
+// "(nn,x)" Indexed-indirect and "(nn),y" Indirect-indexed. Other operands yield "".
+func indirectOperandForm(operand string) string {
+	if !strings.HasPrefix(operand, "(") {
+		return ""
+	}
+
+	depth, closing, topLevelComma := 0, -1, -1
+	for i := 0; i < len(operand) && closing < 0; i++ {
+		switch operand[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				closing = i
+			}
+		case ',':
+			if depth == 1 {
+				topLevelComma = i
+			}
+		}
+	}
+	if closing < 0 {
+		return ""
+	}
+
+	rest := strings.ToLower(strings.ReplaceAll(operand[closing+1:], " ", ""))
+	switch {
+	case rest == "" && topLevelComma >= 0 &&
+		strings.EqualFold(strings.TrimSpace(operand[topLevelComma+1:closing]), "x"):
+		return "Indexed-indirect"
+	case rest == "":
+		return "Indirect"
+	case rest == ",y":
+		return "Indirect-indexed"
+	}
+	return ""
+}
+
+// recordInstructionTiming collects the cycle data of an instruction during Pass 1
+func (a *SemanticAnalyzer) recordInstructionTiming(node *InstructionStatement, mnemonic string) {
+	ctx := GetProcessorContext()
+	if ctx == nil {
+		return
+	}
+	info := ctx.GetMnemonicInfo(mnemonic)
+	if info == nil {
+		return
+	}
+
+	timing := InstructionTiming{
+		Line:          node.Token.Line - 1,
+		Character:     node.Token.Column - 1,
+		Mnemonic:      mnemonic,
+		Mode:          a.instructionMode(info, node),
+		PC:            a.context.CurrentPC,
+		StartsBlock:   a.pendingTimingBlock,
+		BaseAddress:   -1,
+		TargetAddress: -1,
+		Namespace:     a.context.CurrentNamespace,
+		Opcode:        -1,
+		Operand:       -1,
+		operand:       node.Operand,
+	}
+	a.pendingTimingBlock = false
+	if a.inMacroOrFunction {
+		timing.PC = -1
+	}
+
+	var cycles string
+	for _, mode := range info.AddressingModes {
+		if mode.Mode == timing.Mode {
+			cycles = mode.Cycles
+			timing.Length = mode.Length
+			if opcode, err := parseInt(mode.Opcode, 16); err == nil {
+				timing.Opcode = int(opcode)
+			}
+			break
+		}
+	}
+	if cycles == "" {
+		return // Unknown mode or no cycle data - nothing to show
+	}
+	// "2/3/4" for branches (not taken/taken/taken across page), "4*" for page-crossing penalty
+	base := strings.TrimSuffix(strings.SplitN(cycles, "/", 2)[0], "*")
+	baseCycles, err := strconv.Atoi(base)
+	if err != nil {
+		return
+	}
+	timing.BaseCycles = baseCycles
+
+	switch timing.Mode {
+	case "Absolute,X", "Absolute,Y", "Indirect-indexed":
+		timing.PageCross = strings.HasSuffix(cycles, "*") || pageCrossingMnemonics[mnemonic]
+		if infix, ok := node.Operand.(*InfixExpression); ok && timing.Mode != "Indirect-indexed" {
+			timing.BaseAddress = a.evaluateExpression(infix.Left)
+		}
+	case "Relative":
+		switch target := node.Operand.(type) {
+		case *Identifier:
+			timing.TargetName = target.Value
+			if target.Token.Type == TOKEN_MULTILABEL_FWD {
+				timing.TargetMulti, timing.TargetDirection = true, '+'
+			} else if target.Token.Type == TOKEN_MULTILABEL_BACK {
+				timing.TargetMulti, timing.TargetDirection = true, '-'
+			}
+		default:
+			timing.TargetAddress = a.evaluateExpression(node.Operand)
+		}
+	}
+
+	a.context.Timings = append(a.context.Timings, timing)
+}
+
+// resolveInstructionTimings computes best and worst case cycles once all labels are known
+func (a *SemanticAnalyzer) resolveInstructionTimings() {
+	savedNamespace := a.context.CurrentNamespace
+	defer func() { a.context.CurrentNamespace = savedNamespace }()
+
+	for i := range a.context.Timings {
+		timing := &a.context.Timings[i]
+
+		if timing.TargetName != "" && timing.PC >= 0 {
+			a.context.CurrentNamespace = timing.Namespace
+			var symbol *Symbol
+			var found bool
+			if timing.TargetMulti {
+				symbol, found = a.context.lookupMultiLabel(normalizeLabel(timing.TargetName), timing.TargetDirection, timing.PC)
+			} else {
+				symbol, found = a.context.lookupLabel(normalizeLabel(timing.TargetName))
+			}
+			if found {
+				timing.TargetAddress = symbol.Address
+			}
+		}
+		a.context.CurrentNamespace = timing.Namespace
+		timing.Operand = a.instructionOperandValue(timing)
+		timing.operand = nil // don't keep the AST alive in the stored context
+
+		timing.MinCycles = timing.BaseCycles
+		timing.MaxCycles = timing.BaseCycles
+		switch {
+		case timing.Mode == "Relative":
+			// Taken branches cost one cycle more, two if the target is on another page
+			timing.MaxCycles = timing.BaseCycles + 2
+			if timing.TargetAddress >= 0 && timing.PC >= 0 {
+				if (timing.PC+2)&0xFF00 == timing.TargetAddress&0xFF00 {
+					timing.MaxCycles = timing.BaseCycles + 1
+				}
+			}
+		case timing.PageCross:
+			// A page-aligned base address can't cross a page with an 8-bit index
+			if timing.BaseAddress < 0 || timing.BaseAddress&0xFF != 0 {
+				timing.MaxCycles = timing.BaseCycles + 1
+			}
+		}
+	}
+}
+
+// instructionOperandValue evaluates the operand of a recorded instruction: the value of an
+// immediate, the (base) address otherwise, the target address for branches
+func (a *SemanticAnalyzer) instructionOperandValue(timing *InstructionTiming) int64 {
+	switch op := timing.operand.(type) {
+	case nil:
+		return -1
+	case *PrefixExpression:
+		if op.Operator == "#" {
+			return a.evaluateExpression(op.Right)
+		}
+	case *InfixExpression:
+		if op.Operator == "," {
+			return a.evaluateExpression(op.Left)
+		}
+	}
+	if timing.Mode == "Relative" {
+		return timing.TargetAddress
+	}
+	return a.evaluateExpression(timing.operand)
+}
+
+// instructionTimingAt returns the timing of the instruction on a line of an analyzed document
+func instructionTimingAt(uri string, line int) *InstructionTiming {
+	symbolStore.RLock()
+	context := symbolStore.contexts[uri]
+	symbolStore.RUnlock()
+	if context == nil {
+		return nil
+	}
+	for i := range context.Timings {
+		if context.Timings[i].Line == line {
+			return &context.Timings[i]
+		}
+	}
+	return nil
+}
+
+// formatCycles renders a cycle range as "4" or "4-5"
+func formatCycles(min, max int) string {
+	if min == max {
+		return strconv.Itoa(min)
+	}
+	return fmt.Sprintf("%d-%d", min, max)
+}
+
+// cycleLabel renders the cycles of a single instruction; branches show "not taken/taken"
+func (t *InstructionTiming) cycleLabel() string {
+	if t.Mode == "Relative" {
+		taken := formatCycles(t.BaseCycles+1, t.MaxCycles)
+		if t.TargetAddress >= 0 && t.PC >= 0 {
+			taken = formatCycles(t.MaxCycles, t.MaxCycles)
+		}
+		return fmt.Sprintf("%d/%s", t.MinCycles, taken)
+	}
+	return formatCycles(t.MinCycles, t.MaxCycles)
+}
+
+// timingDescription explains the cycle count of an instruction for hover
+func (t *InstructionTiming) timingDescription() string {
+	description := fmt.Sprintf("**Cycles:** %s (%s)", t.cycleLabel(), t.Mode)
+	switch {
+	case t.Mode == "Relative":
+		description += " - not taken / taken"
+		if t.TargetAddress >= 0 && t.PC >= 0 {
+			if t.MaxCycles > t.BaseCycles+1 {
+				description += fmt.Sprintf(", target $%04X is on another page", t.TargetAddress)
+			} else {
+				description += fmt.Sprintf(", target $%04X is on the same page", t.TargetAddress)
+			}
+		} else {
+			description += ", +1 if the target is on another page"
+		}
+	case t.MaxCycles > t.MinCycles:
+		description += " - +1 if a page boundary is crossed"
+	case t.PageCross:
+		description += " - page-aligned base, no page crossing"
+	}
+	return description
+}
+
+// cycleBudgetPattern matches the "@cycles N", "@cycles-max N" and "@end-cycles" comment pragmas
+var cycleBudgetPattern = regexp.MustCompile(`@(cycles-max|cycles|end-cycles)\b(?:\s+(\$[0-9A-Fa-f]+|[0-9]+))?`)
+
+// cycleBudget is a region marked with a cycle budget pragma
+type cycleBudget struct {
+	Line      int // line of the pragma
+	Column    int // byte column of the pragma
+	Length    int
+	Budget    int
+	MaxOnly   bool // @cycles-max only limits the worst case; @cycles also expects stable timing
+	EndLine   int  // first line after the region
+	Directive string
+}
+
+// findCycleBudgets collects the cycle budget regions of the document. A region starts at its
+// pragma and ends at "@end-cycles", the next budget pragma or the end of the file.
+func (a *SemanticAnalyzer) findCycleBudgets() []cycleBudget {
+	var budgets []cycleBudget
+	closeOpen := func(line int) {
+		if len(budgets) > 0 && budgets[len(budgets)-1].EndLine < 0 {
+			budgets[len(budgets)-1].EndLine = line
+		}
+	}
+
+	for lineNum, line := range a.documentLines {
+		commentStart := findCommentStart(line)
+		if commentStart < 0 {
+			continue
+		}
+		match := cycleBudgetPattern.FindStringSubmatchIndex(line[commentStart:])
+		if match == nil {
+			continue
+		}
+		directive := line[commentStart+match[2] : commentStart+match[3]]
+		closeOpen(lineNum)
+		if directive == "end-cycles" {
+			continue
+		}
+
+		pragma := line[commentStart+match[0] : commentStart+match[1]]
+		if match[4] < 0 {
+			a.diagnostics = append(a.diagnostics, Diagnostic{
+				Severity: SeverityWarning,
+				Range: Range{
+					Start: Position{Line: lineNum, Character: commentStart + match[0]},
+					End:   Position{Line: lineNum, Character: commentStart + match[1]},
+				},
+				Message: fmt.Sprintf("Missing cycle count for @%s", directive),
+				Source:  "enhanced-analyzer",
+			})
+			continue
+		}
+		value := line[commentStart+match[4] : commentStart+match[5]]
+		var budget int64
+		var err error
+		if strings.HasPrefix(value, "$") {
+			budget, err = parseInt(value[1:], 16)
+		} else {
+			budget, err = parseInt(value, 10)
+		}
+		if err != nil {
+			continue
+		}
+
+		budgets = append(budgets, cycleBudget{
+			Line:      lineNum,
+			Column:    commentStart + match[0],
+			Length:    len(pragma),
+			Budget:    int(budget),
+			MaxOnly:   directive == "cycles-max",
+			EndLine:   -1,
+			Directive: directive,
+		})
+	}
+	closeOpen(len(a.documentLines))
+	return budgets
+}
+
+// checkCycleBudgets sums the best and worst case cycles of the instructions in each budget
+// region and warns when the worst case exceeds the budget. Loops are not followed: every
+// instruction is counted once, branches with their not taken/taken cost.
+func (a *SemanticAnalyzer) checkCycleBudgets() {
+	config := a.config
+	if !config.CycleBudgetValidation.Enabled || !config.CycleBudgetValidation.ShowWarnings {
+		return
+	}
+
+	for _, budget := range a.findCycleBudgets() {
+		best, worst := 0, 0
+		for _, timing := range a.context.Timings {
+			if timing.Line > budget.Line && timing.Line < budget.EndLine {
+				best += timing.MinCycles
+				worst += timing.MaxCycles
+			}
+		}
+
+		diagnostic := Diagnostic{
+			Range: Range{
+				Start: Position{Line: budget.Line, Character: budget.Column},
+				End:   Position{Line: budget.Line, Character: budget.Column + budget.Length},
+			},
+			Source: "enhanced-analyzer",
+		}
+		switch {
+		case worst > budget.Budget:
+			diagnostic.Severity = SeverityWarning
+			diagnostic.Message = fmt.Sprintf("Cycle budget exceeded: %s cycles > %d (@%s)",
+				formatCycles(best, worst), budget.Budget, budget.Directive)
+		case !budget.MaxOnly && best != worst:
+			diagnostic.Severity = SeverityInfo
+			diagnostic.Message = fmt.Sprintf("Timing is not stable: %s cycles within @cycles %d (page crossings or branches)",
+				formatCycles(best, worst), budget.Budget)
+		default:
+			continue
+		}
+		a.diagnostics = append(a.diagnostics, diagnostic)
+	}
+}
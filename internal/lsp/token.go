@@ -66,6 +66,22 @@ const (
 	TOKEN_BITWISE_OR  // |
 	TOKEN_BITWISE_XOR // ^
 	TOKEN_MODULO      // %
+	TOKEN_BITWISE_NOT // ~
+
+	// Comparison, logical and assignment operators
+	TOKEN_EQUAL_EQUAL   // ==
+	TOKEN_NOT_EQUAL     // !=
+	TOKEN_LESS_EQUAL    // <=
+	TOKEN_GREATER_EQUAL // >=
+	TOKEN_LOGICAL_AND   // &&
+	TOKEN_LOGICAL_OR    // ||
+	TOKEN_BANG          // !
+	TOKEN_INCREMENT     // ++
+	TOKEN_DECREMENT     // --
+	TOKEN_PLUS_EQUAL    // +=
+	TOKEN_MINUS_EQUAL   // -=
+	TOKEN_TIMES_EQUAL   // *=
+	TOKEN_DIVIDE_EQUAL  // /=
 
 	// Built-in Functions
 	TOKEN_BUILTIN_MATH_FUNC
@@ -131,6 +147,20 @@ var tokenNames = map[TokenType]string{
 	TOKEN_BITWISE_OR:          "BITWISE_OR",
 	TOKEN_BITWISE_XOR:         "BITWISE_XOR",
 	TOKEN_MODULO:              "MODULO",
+	TOKEN_BITWISE_NOT:         "BITWISE_NOT",
+	TOKEN_EQUAL_EQUAL:         "EQUAL_EQUAL",
+	TOKEN_NOT_EQUAL:           "NOT_EQUAL",
+	TOKEN_LESS_EQUAL:          "LESS_EQUAL",
+	TOKEN_GREATER_EQUAL:       "GREATER_EQUAL",
+	TOKEN_LOGICAL_AND:         "LOGICAL_AND",
+	TOKEN_LOGICAL_OR:          "LOGICAL_OR",
+	TOKEN_BANG:                "BANG",
+	TOKEN_INCREMENT:           "INCREMENT",
+	TOKEN_DECREMENT:           "DECREMENT",
+	TOKEN_PLUS_EQUAL:          "PLUS_EQUAL",
+	TOKEN_MINUS_EQUAL:         "MINUS_EQUAL",
+	TOKEN_TIMES_EQUAL:         "TIMES_EQUAL",
+	TOKEN_DIVIDE_EQUAL:        "DIVIDE_EQUAL",
 	TOKEN_BUILTIN_MATH_FUNC:   "BUILTIN_MATH_FUNC",
 	TOKEN_BUILTIN_STRING_FUNC: "BUILTIN_STRING_FUNC",
 	TOKEN_BUILTIN_FILE_FUNC:   "BUILTIN_FILE_FUNC",
@@ -205,20 +235,18 @@ type BuiltinConstant struct {
 func loadMnemonicsFromJSON() map[TokenType]*regexp.Regexp {
 	jsonPath := mnemonicJSONPath
 	if jsonPath == "" {
-		log.Error("FATAL: mnemonicJSONPath not set - must be initialized from $HOME/.config/6510lsp")
-		os.Exit(1)
+		jsonPath = MnemonicDataFile // built-in copy and workspace override only
 	}
 
-	file, err := os.Open(jsonPath)
+	file, err := readDataFile(jsonPath)
 	if err != nil {
 		log.Error("FATAL: Failed to open mnemonic.json at '%s': %v", jsonPath, err)
-		log.Error("mnemonic.json is the Source of Truth and MUST be available at $HOME/.config/6510lsp")
+		log.Error("mnemonic.json is the Source of Truth and MUST be available")
 		os.Exit(1)
 	}
-	defer file.Close()
 
 	var mnemonics []MnemonicInfo
-	if err := json.NewDecoder(file).Decode(&mnemonics); err != nil {
+	if err := json.Unmarshal(file, &mnemonics); err != nil {
 		log.Error("FATAL: Failed to parse mnemonic.json at '%s': %v", jsonPath, err)
 		log.Error("mnemonic.json must contain valid JSON data")
 		os.Exit(1)
@@ -269,24 +297,23 @@ var kickassJSONPath string
 // mnemonicJSONPath is set by the server to provide the correct path for mnemonic.json
 var mnemonicJSONPath string
 
-// SetKickassJSONPath sets the path to kickass.json for lexer initialization
+// SetKickassJSONPath sets the path to kickass.json for lexer initialization.
+// The token definitions are rebuilt from it by the next InitTokenDefs.
 func SetKickassJSONPath(path string) {
 	kickassJSONPath = path
-	// Force re-initialization of token definitions when path changes
-	tokenDefs = nil
 }
 
-// SetMnemonicJSONPath sets the path to mnemonic.json for lexer initialization
+// SetMnemonicJSONPath sets the path to mnemonic.json for lexer initialization.
+// The token definitions are rebuilt from it by the next InitTokenDefs.
 func SetMnemonicJSONPath(path string) {
 	mnemonicJSONPath = path
-	// Force re-initialization of token definitions when path changes
-	tokenDefs = nil
 }
 
 // InitTokenDefs initializes token definitions after all JSON files are loaded
 // MUST be called after SetMnemonicJSONPath and SetKickassJSONPath
 func InitTokenDefs() {
-	initTokenDefs()
+	defs := buildTokenDefs()
+	updateData(func(data *dataSnapshot) { data.tokenDefs = defs })
 }
 
 // loadDirectivesFromJSON loads directives, functions and constants from kickass.json and creates regex patterns
@@ -296,15 +323,14 @@ func loadDirectivesFromJSON() map[TokenType]*regexp.Regexp {
 		jsonPath = "kickass.json" // fallback
 	}
 
-	file, err := os.Open(jsonPath)
+	file, err := readDataFile(jsonPath)
 	if err != nil {
 		log.Error("Failed to open kickass.json at %s: %v", jsonPath, err)
 		return createFallbackDirectiveRegexes()
 	}
-	defer file.Close()
 
 	var config KickAssConfig
-	if err := json.NewDecoder(file).Decode(&config); err != nil {
+	if err := json.Unmarshal(file, &config); err != nil {
 		log.Error("Failed to parse kickass.json: %v", err)
 		return createFallbackDirectiveRegexes()
 	}
@@ -441,15 +467,13 @@ type tokenDefinition struct {
 	regex     *regexp.Regexp
 }
 
-// The order of these definitions is important for correct matching.
-var tokenDefs []tokenDefinition
-
-// initTokenDefs initializes tokenDefs with mnemonic and directive regexes loaded from JSON
-func initTokenDefs() {
+// buildTokenDefs builds the token definitions with mnemonic and directive regexes loaded
+// from JSON. The order of these definitions is important for correct matching.
+func buildTokenDefs() []tokenDefinition {
 	mnemonicRegexes := loadMnemonicsFromJSON()
 	directiveRegexes := loadDirectivesFromJSON()
 
-	tokenDefs = []tokenDefinition{
+	tokenDefs := []tokenDefinition{
 		// Comments first - highest priority
 		{TOKEN_COMMENT, regexp.MustCompile(`^//.*`)},
 		{TOKEN_COMMENT, regexp.MustCompile(`^/\*.*?\*/`)},
@@ -562,6 +586,7 @@ func initTokenDefs() {
 		{TOKEN_AT, regexp.MustCompile(`^@`)},
 		{TOKEN_SEMICOLON, regexp.MustCompile(`^;`)},
 	}...)
+	return tokenDefs
 }
 
 // Lexer holds the state of the lexical analysis.
@@ -0,0 +1,313 @@
+package lsp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "c64.nvim/internal/log"
+)
+
+// JSON-RPC and LSP error codes
+const (
+	ErrorMethodNotFound   = -32601
+	ErrorInternalError    = -32603
+	ErrorRequestCancelled = -32800
+	ErrorRequestFailed    = -32803
+)
+
+// window/logMessage message types
+const (
+	MessageTypeError   = 1
+	MessageTypeWarning = 2
+	MessageTypeInfo    = 3
+	MessageTypeLog     = 4
+)
+
+// orderedRequests are handled on the main loop, all other requests run on the worker pool
+var orderedRequests = map[string]bool{
+	"initialize":            true,
+	"shutdown":              true,
+	"kickass_ls/reloadData": true, // like a configuration change, ordered with document edits
+}
+
+// writeMutex serialises messages written by the main loop, the request workers and the
+// analysis worker, so frames never interleave on stdout
+var writeMutex sync.Mutex
+
+// readMessage reads one framed message. Header names are case-insensitive, headers other
+// than Content-Length (e.g. Content-Type) are ignored.
+func readMessage(reader *bufio.Reader) ([]byte, error) {
+	contentLength := -1
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if contentLength >= 0 {
+				break
+			}
+			// Blank lines before the headers are tolerated
+			continue
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			log.Warn("readMessage: ignoring malformed header %q", line)
+			continue
+		}
+		if strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			contentLength, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || contentLength < 0 {
+				return nil, fmt.Errorf("invalid Content-Length %q", value)
+			}
+		}
+	}
+
+	payload := make([]byte, contentLength)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Request is a client request in flight
+type Request struct {
+	ID     interface{}
+	Method string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	replied bool
+}
+
+// pendingRequests holds the requests that have not been answered yet, keyed by requestKey
+var pendingRequests = struct {
+	sync.Mutex
+	requests map[string]*Request
+}{
+	requests: make(map[string]*Request),
+}
+
+// requestKey keeps numeric and string ids apart (1 and "1" are different requests)
+func requestKey(id interface{}) string {
+	return fmt.Sprintf("%T:%v", id, id)
+}
+
+// newRequest registers a request so it can be cancelled until it is answered
+func newRequest(id interface{}, method string) *Request {
+	ctx, cancel := context.WithCancel(context.Background())
+	request := &Request{ID: id, Method: method, ctx: ctx, cancel: cancel}
+
+	pendingRequests.Lock()
+	pendingRequests.requests[requestKey(id)] = request
+	pendingRequests.Unlock()
+	return request
+}
+
+// cancelRequest handles $/cancelRequest. Unknown or finished ids are ignored.
+func cancelRequest(params map[string]interface{}) {
+	id, ok := params["id"]
+	if !ok {
+		return
+	}
+	pendingRequests.Lock()
+	request, found := pendingRequests.requests[requestKey(id)]
+	pendingRequests.Unlock()
+	if found {
+		log.Debug("Cancelling %s request %v", request.Method, id)
+		request.cancel()
+	}
+}
+
+// Cancelled reports whether the client cancelled the request
+func (r *Request) Cancelled() bool {
+	return r != nil && r.ctx.Err() != nil
+}
+
+// reply sends a response built by a handler. Once a request is cancelled the result is
+// replaced by a RequestCancelled error; only the first reply is sent.
+func (r *Request) reply(writer *bufio.Writer, response []byte) {
+	if r.Cancelled() {
+		r.replyError(writer, ErrorRequestCancelled, "request cancelled")
+		return
+	}
+	if r.markReplied() {
+		writeResponse(writer, response)
+	}
+}
+
+// replyError sends an error response
+func (r *Request) replyError(writer *bufio.Writer, code int, message string) {
+	if !r.markReplied() {
+		return
+	}
+	response, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      r.ID,
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+		},
+	})
+	writeResponse(writer, response)
+}
+
+// markReplied records the reply and reports whether this is the first one
+func (r *Request) markReplied() bool {
+	if r == nil {
+		// Notifications sent for a request method get no response
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.replied {
+		return false
+	}
+	r.replied = true
+	return true
+}
+
+// finish makes sure every request is answered exactly once and unregisters it
+func (r *Request) finish(writer *bufio.Writer) {
+	pendingRequests.Lock()
+	delete(pendingRequests.requests, requestKey(r.ID))
+	pendingRequests.Unlock()
+	r.cancel()
+
+	// Handlers skip the response when the params are unusable
+	r.replyError(writer, ErrorInternalError, fmt.Sprintf("%s produced no result", r.Method))
+}
+
+// requestJob is a request waiting for a worker
+type requestJob struct {
+	request *Request
+	message map[string]interface{}
+	writer  *bufio.Writer
+}
+
+// requestQueue feeds the request workers
+var requestQueue = make(chan requestJob, 64)
+var requestWorkersStarted = false
+
+// startRequestWorkers starts the pool that handles requests, so a slow request doesn't hold
+// up the others. Notifications stay on the main loop to keep document edits in order.
+func startRequestWorkers() {
+	if requestWorkersStarted {
+		return
+	}
+	requestWorkersStarted = true
+
+	workers := runtime.NumCPU()
+	if workers < 2 {
+		workers = 2
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range requestQueue {
+				runRequest(job)
+			}
+		}()
+	}
+	log.Debug("Started %d request workers", workers)
+}
+
+// runRequest handles a queued request unless it was cancelled while waiting
+func runRequest(job requestJob) {
+	defer job.request.finish(job.writer)
+	defer recoverHandler(job.writer, job.request, job.request.Method)
+	if job.request.Cancelled() {
+		log.Debug("Skipping cancelled %s request %v", job.request.Method, job.request.ID)
+		job.request.replyError(job.writer, ErrorRequestCancelled, "request cancelled")
+		return
+	}
+	handleMessage(job.writer, job.request, job.request.Method, job.message)
+}
+
+// dispatchMessage routes a decoded message: cancellations are applied immediately,
+// notifications and ordered requests run in place, other requests go to the worker pool
+func dispatchMessage(writer *bufio.Writer, message map[string]interface{}) {
+	method, ok := message["method"].(string)
+	if !ok {
+		// Responses to server-initiated requests (client/registerCapability) are not used
+		if responseError, failed := message["error"]; failed {
+			log.Warn("Request %v failed: %v", message["id"], responseError)
+		} else if _, isResponse := message["result"]; !isResponse {
+			log.Warn("Method not found or not a string.")
+		}
+		return
+	}
+
+	id, isRequest := message["id"]
+	if !isRequest {
+		if method == "$/cancelRequest" {
+			if params, ok := message["params"].(map[string]interface{}); ok {
+				cancelRequest(params)
+			}
+			return
+		}
+		func() {
+			defer recoverHandler(writer, nil, method)
+			handleMessage(writer, nil, method, message)
+		}()
+		return
+	}
+
+	request := newRequest(id, method)
+	if orderedRequests[method] {
+		runRequest(requestJob{request: request, message: message, writer: writer})
+		return
+	}
+	requestQueue <- requestJob{request: request, message: message, writer: writer}
+}
+
+// handleUnknownMethod answers requests for methods the server doesn't implement. Unknown
+// notifications are dropped, as the protocol requires for "$/" methods.
+func handleUnknownMethod(writer *bufio.Writer, request *Request, method string) {
+	if request == nil {
+		if !strings.HasPrefix(method, "$/") {
+			log.Warn("Unhandled notification: %s", method)
+		}
+		return
+	}
+	log.Warn("Unhandled method: %s", method)
+	request.replyError(writer, ErrorMethodNotFound, fmt.Sprintf("method not found: %s", method))
+}
+
+// recoverHandler turns a panic in a handler into an InternalError response (for requests) and
+// a window/logMessage, so one bad document doesn't take the server down
+func recoverHandler(writer *bufio.Writer, request *Request, method string) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	log.Error("Handler for %s panicked: %v\n%s", method, recovered, debug.Stack())
+
+	message := fmt.Sprintf("Internal error in %s: %v", method, recovered)
+	request.replyError(writer, ErrorInternalError, message)
+	logMessage(writer, MessageTypeError, message)
+}
+
+// logMessage shows a message in the client's log via window/logMessage
+func logMessage(writer *bufio.Writer, messageType int, message string) {
+	notification, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "window/logMessage",
+		"params": map[string]interface{}{
+			"type":    messageType,
+			"message": message,
+		},
+	})
+	writeResponse(writer, notification)
+}
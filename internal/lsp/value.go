@@ -0,0 +1,1013 @@
+package lsp
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValueKind is the type of a value in Kick Assembler's script language
+type ValueKind int
+
+const (
+	ValueUnknown ValueKind = iota // not known (yet), e.g. a label defined further down
+	ValueNumber
+	ValueBoolean
+	ValueString
+	ValueList
+	ValueHashtable
+	ValueNull
+	ValueInvalid // a type error, reported where the value is used
+)
+
+// maxListSize bounds the lists the analyzer builds; larger ones become unknown
+const maxListSize = 1 << 16
+
+// maxValueText limits how many list or hashtable entries String shows
+const maxValueText = 16
+
+// Value is the result of evaluating an expression. Lists and hashtables are shared like in
+// Kick Assembler, so .eval list.add(x) changes the list for every reference to it.
+type Value struct {
+	Kind    ValueKind
+	Number  float64
+	Boolean bool
+	Text    string
+
+	list  *valueList
+	table *valueTable
+	err   *valueError
+}
+
+type valueList struct {
+	items []Value
+}
+
+type valueTable struct {
+	keys    []Value
+	entries map[string]Value
+
+	incomplete bool // a value was put under an unknown key
+}
+
+type valueError struct {
+	token   Token
+	message string
+}
+
+func unknownValue() Value           { return Value{Kind: ValueUnknown} }
+func nullValue() Value              { return Value{Kind: ValueNull} }
+func numberValue(n float64) Value   { return Value{Kind: ValueNumber, Number: n} }
+func booleanValue(b bool) Value     { return Value{Kind: ValueBoolean, Boolean: b} }
+func stringValue(text string) Value { return Value{Kind: ValueString, Text: text} }
+func listValue(items []Value) Value { return Value{Kind: ValueList, list: &valueList{items: items}} }
+func hashtableValue() Value {
+	return Value{Kind: ValueHashtable, table: &valueTable{entries: make(map[string]Value)}}
+}
+
+// invalidValue is a type error at token
+func invalidValue(token Token, format string, args ...interface{}) Value {
+	return Value{Kind: ValueInvalid, err: &valueError{token: token, message: fmt.Sprintf(format, args...)}}
+}
+
+// Known reports whether the value is known and not a type error
+func (v Value) Known() bool {
+	return v.Kind != ValueUnknown && v.Kind != ValueInvalid
+}
+
+// Int returns a number truncated to an integer
+func (v Value) Int() (int64, bool) {
+	if v.Kind != ValueNumber || math.IsNaN(v.Number) || math.IsInf(v.Number, 0) {
+		return 0, false
+	}
+	return int64(v.Number), true
+}
+
+// TypeName returns Kick Assembler's name of the value's type
+func (v Value) TypeName() string {
+	switch v.Kind {
+	case ValueNumber:
+		return "Number"
+	case ValueBoolean:
+		return "Boolean"
+	case ValueString:
+		return "String"
+	case ValueList:
+		return "List"
+	case ValueHashtable:
+		return "Hashtable"
+	case ValueNull:
+		return "Null"
+	}
+	return "unknown"
+}
+
+// String formats the value the way it is written in source. Long lists and hashtables are
+// shortened.
+func (v Value) String() string {
+	switch v.Kind {
+	case ValueNumber:
+		return formatNumber(v.Number)
+	case ValueBoolean:
+		return strconv.FormatBool(v.Boolean)
+	case ValueString:
+		return strconv.Quote(v.Text)
+	case ValueNull:
+		return "null"
+	case ValueList:
+		parts := make([]string, 0, min(len(v.list.items), maxValueText))
+		for i, item := range v.list.items {
+			if i == maxValueText {
+				parts = append(parts, fmt.Sprintf("... %d more", len(v.list.items)-i))
+				break
+			}
+			parts = append(parts, item.String())
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	case ValueHashtable:
+		parts := make([]string, 0, min(len(v.table.keys), maxValueText))
+		for i, key := range v.table.keys {
+			if i == maxValueText {
+				parts = append(parts, fmt.Sprintf("... %d more", len(v.table.keys)-i))
+				break
+			}
+			parts = append(parts, key.String()+": "+v.table.entries[key.key()].String())
+		}
+		return "{" + strings.Join(parts, ", ") + "}"
+	case ValueInvalid:
+		return "error: " + v.err.message
+	}
+	return "unknown"
+}
+
+// text is the value as it appears when concatenated to a string
+func (v Value) text() string {
+	if v.Kind == ValueString {
+		return v.Text
+	}
+	return v.String()
+}
+
+func formatNumber(n float64) string {
+	if n == math.Trunc(n) && math.Abs(n) < 1e15 {
+		return strconv.FormatInt(int64(n), 10)
+	}
+	return strconv.FormatFloat(n, 'g', -1, 64)
+}
+
+// key identifies a hashtable key; 1 and "1" are different keys
+func (v Value) key() string {
+	return v.TypeName() + ":" + v.text()
+}
+
+// equals compares values like Kick Assembler's == operator
+func (v Value) equals(other Value) bool {
+	if v.Kind != other.Kind {
+		return false
+	}
+	switch v.Kind {
+	case ValueNumber:
+		return v.Number == other.Number
+	case ValueBoolean:
+		return v.Boolean == other.Boolean
+	case ValueString:
+		return v.Text == other.Text
+	case ValueNull:
+		return true
+	case ValueList:
+		if len(v.list.items) != len(other.list.items) {
+			return false
+		}
+		for i := range v.list.items {
+			if !v.list.items[i].equals(other.list.items[i]) {
+				return false
+			}
+		}
+		return true
+	case ValueHashtable:
+		return v.table == other.table
+	}
+	return false
+}
+
+// clone copies lists and hashtables, so changing the copy leaves the original alone
+func (v Value) clone() Value {
+	switch v.Kind {
+	case ValueList:
+		items := make([]Value, len(v.list.items))
+		for i, item := range v.list.items {
+			items[i] = item.clone()
+		}
+		return listValue(items)
+	case ValueHashtable:
+		copied := hashtableValue()
+		copied.table.incomplete = v.table.incomplete
+		for _, key := range v.table.keys {
+			copied.table.put(key, v.table.entries[key.key()].clone())
+		}
+		return copied
+	}
+	return v
+}
+
+func (t *valueTable) put(key, value Value) {
+	if _, exists := t.entries[key.key()]; !exists {
+		t.keys = append(t.keys, key)
+	}
+	t.entries[key.key()] = value
+}
+
+func (t *valueTable) remove(key Value) {
+	if _, exists := t.entries[key.key()]; !exists {
+		return
+	}
+	delete(t.entries, key.key())
+	for i, existing := range t.keys {
+		if existing.key() == key.key() {
+			t.keys = append(t.keys[:i], t.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// evaluateValue evaluates an expression with Kick Assembler's types. Values that depend on
+// symbols not defined yet are unknown; type errors give an invalid value carrying the message.
+func (a *SemanticAnalyzer) evaluateValue(expr Expression) Value {
+	if expr == nil || a.context == nil {
+		return unknownValue()
+	}
+
+	switch e := expr.(type) {
+	case *IntegerLiteral:
+		if e == nil {
+			break
+		}
+		// The parser keeps the integer part of 1.5, the literal has the rest
+		if e.Token.Type == TOKEN_NUMBER_DEC && strings.Contains(e.Token.Literal, ".") {
+			if number, err := parseFloat(strings.TrimPrefix(e.Token.Literal, "#")); err == nil {
+				return numberValue(number)
+			}
+		}
+		return numberValue(float64(e.Value))
+	case *StringLiteral:
+		if e != nil {
+			return stringValue(e.Value)
+		}
+	case *ProgramCounterExpression:
+		return numberValue(float64(a.context.CurrentPC))
+	case *GroupedExpression:
+		if e != nil {
+			return a.evaluateValue(e.Expression)
+		}
+	case *Identifier:
+		if e != nil {
+			return a.identifierValue(e)
+		}
+	case *PrefixExpression:
+		if e != nil {
+			return a.prefixValue(e)
+		}
+	case *InfixExpression:
+		if e != nil {
+			return a.infixValue(e)
+		}
+	case *CallExpression:
+		if e != nil {
+			return a.callValue(e)
+		}
+	}
+	return unknownValue()
+}
+
+// identifierValue resolves true/false/null, symbols and built-in constants
+func (a *SemanticAnalyzer) identifierValue(ident *Identifier) Value {
+	switch ident.Value {
+	case "true":
+		return booleanValue(true)
+	case "false":
+		return booleanValue(false)
+	case "null":
+		return nullValue()
+	}
+
+	name := normalizeLabel(ident.Value)
+	switch ident.Token.Type {
+	case TOKEN_MULTILABEL_FWD, TOKEN_MULTILABEL_BACK:
+		direction := '+'
+		if ident.Token.Type == TOKEN_MULTILABEL_BACK {
+			direction = '-'
+		}
+		if symbol, found := a.context.lookupMultiLabel(name, direction, a.context.CurrentPC); found {
+			return numberValue(float64(symbol.Address))
+		}
+		return unknownValue()
+	}
+
+	if symbol, found := a.context.lookupLabel(name); found {
+		return a.symbolValue(symbol)
+	}
+	if value, found := builtinConstantValue(ident.Value); found {
+		return value
+	}
+	return unknownValue()
+}
+
+// symbolValue is the value of a constant or variable, or the address of a label
+func (a *SemanticAnalyzer) symbolValue(symbol *Symbol) Value {
+	if symbol.Evaluated == nil {
+		return numberValue(float64(symbol.Address))
+	}
+	value := *symbol.Evaluated
+	// Lists of imported files are shared with their cached analysis, changes stay here
+	if (value.Kind == ValueList || value.Kind == ValueHashtable) && a.context.isImportedLabel(symbol) {
+		value = value.clone()
+	}
+	return value
+}
+
+// builtinConstantValue looks up PI, E and the color constants from kickass.json
+func builtinConstantValue(name string) (Value, bool) {
+	_, constants := GetBuiltins()
+	for _, constant := range constants {
+		if constant.Name == name {
+			if number, err := strconv.ParseFloat(constant.Value, 64); err == nil {
+				return numberValue(number), true
+			}
+			return unknownValue(), true
+		}
+	}
+	return Value{}, false
+}
+
+func (a *SemanticAnalyzer) prefixValue(e *PrefixExpression) Value {
+	switch e.Operator {
+	case "-", "+", "<", ">", "~", "!":
+	default:
+		// '#' marks an immediate operand, not a value that is an address
+		return unknownValue()
+	}
+
+	right := a.evaluateValue(e.Right)
+	if !right.Known() {
+		return right
+	}
+	if e.Operator == "!" {
+		if right.Kind != ValueBoolean {
+			return invalidValue(e.Token, "Operator '!' can't be used on a %s", right.TypeName())
+		}
+		return booleanValue(!right.Boolean)
+	}
+	if right.Kind != ValueNumber {
+		return invalidValue(e.Token, "Operator '%s' can't be used on a %s", e.Operator, right.TypeName())
+	}
+
+	switch e.Operator {
+	case "-":
+		return numberValue(-right.Number)
+	case "<":
+		return numberValue(float64(int64(right.Number) & 0xFF))
+	case ">":
+		return numberValue(float64((int64(right.Number) >> 8) & 0xFF))
+	case "~":
+		return numberValue(float64(^int64(right.Number)))
+	}
+	return right
+}
+
+// assignmentOperators are only evaluated by .eval, see evaluateAssignment
+var assignmentOperators = map[string]string{
+	"=":  "",
+	"+=": "+",
+	"-=": "-",
+	"*=": "*",
+	"/=": "/",
+	"++": "+",
+	"--": "-",
+}
+
+func (a *SemanticAnalyzer) infixValue(e *InfixExpression) Value {
+	if _, isAssignment := assignmentOperators[e.Operator]; isAssignment {
+		return unknownValue()
+	}
+	switch e.Operator {
+	case ".":
+		// A label of a loop iteration, loop[2].label
+		if name, ok := a.loopLabelName(e); ok {
+			if symbol, found := a.context.lookupLabel(name); found {
+				return a.symbolValue(symbol)
+			}
+		}
+		// Member access without a call
+		return unknownValue()
+	case ",":
+		// Indexed addressing
+		return unknownValue()
+	case "&&", "||":
+		return a.logicalValue(e)
+	}
+	return binaryValue(e.Operator, e.Token, a.evaluateValue(e.Left), a.evaluateValue(e.Right))
+}
+
+// logicalValue evaluates && and || without evaluating the right side when the left decides
+func (a *SemanticAnalyzer) logicalValue(e *InfixExpression) Value {
+	left := a.evaluateValue(e.Left)
+	if left.Kind == ValueInvalid {
+		return left
+	}
+	if left.Known() && left.Kind != ValueBoolean {
+		return invalidValue(e.Token, "Operator '%s' can't be used on a %s", e.Operator, left.TypeName())
+	}
+	if left.Known() && left.Boolean == (e.Operator == "||") {
+		return left
+	}
+
+	right := a.evaluateValue(e.Right)
+	if right.Kind == ValueInvalid {
+		return right
+	}
+	if right.Known() && right.Kind != ValueBoolean {
+		return invalidValue(e.Token, "Operator '%s' can't be used on a %s", e.Operator, right.TypeName())
+	}
+	if !left.Known() || !right.Known() {
+		return unknownValue()
+	}
+	return right
+}
+
+// binaryValue applies an arithmetic, bitwise or comparison operator
+func binaryValue(operator string, token Token, left, right Value) Value {
+	if left.Kind == ValueInvalid {
+		return left
+	}
+	if right.Kind == ValueInvalid {
+		return right
+	}
+	if !left.Known() || !right.Known() {
+		return unknownValue()
+	}
+
+	switch operator {
+	case "==":
+		return booleanValue(left.equals(right))
+	case "!=":
+		return booleanValue(!left.equals(right))
+	case "+":
+		if left.Kind == ValueString || right.Kind == ValueString {
+			return stringValue(left.text() + right.text())
+		}
+	}
+
+	if left.Kind != ValueNumber || right.Kind != ValueNumber {
+		return invalidValue(token, "Operator '%s' can't be used on %s and %s", operator, left.TypeName(), right.TypeName())
+	}
+	l, r := left.Number, right.Number
+	switch operator {
+	case "+":
+		return numberValue(l + r)
+	case "-":
+		return numberValue(l - r)
+	case "*":
+		return numberValue(l * r)
+	case "/":
+		if r == 0 {
+			return invalidValue(token, "Division by zero")
+		}
+		return numberValue(l / r)
+	case "%":
+		if r == 0 {
+			return invalidValue(token, "Division by zero")
+		}
+		return numberValue(math.Mod(l, r))
+	case "<":
+		return booleanValue(l < r)
+	case ">":
+		return booleanValue(l > r)
+	case "<=":
+		return booleanValue(l <= r)
+	case ">=":
+		return booleanValue(l >= r)
+	}
+
+	li, ri := int64(l), int64(r)
+	switch operator {
+	case "<<":
+		if ri < 0 || ri > 63 {
+			return invalidValue(token, "Shift by %d is out of range", ri)
+		}
+		return numberValue(float64(li << uint(ri)))
+	case ">>":
+		if ri < 0 || ri > 63 {
+			return invalidValue(token, "Shift by %d is out of range", ri)
+		}
+		return numberValue(float64(li >> uint(ri)))
+	case "&":
+		return numberValue(float64(li & ri))
+	case "|":
+		return numberValue(float64(li | ri))
+	case "^":
+		return numberValue(float64(li ^ ri))
+	}
+	return unknownValue()
+}
+
+// callValue evaluates built-in functions, List()/Hashtable() and the methods of strings, lists
+// and hashtables. User-defined functions are unknown.
+func (a *SemanticAnalyzer) callValue(e *CallExpression) Value {
+	switch function := e.Function.(type) {
+	case *Identifier:
+		name := function.Value
+		if a.isUserFunction(name) {
+			return unknownValue()
+		}
+		// The lexer keeps member access in the identifier: list.add
+		if dot := strings.LastIndex(name, "."); dot > 0 {
+			receiver := a.identifierValue(&Identifier{Token: function.Token, Value: name[:dot]})
+			return a.methodValue(receiver, name[dot+1:], e.Arguments, function.Token)
+		}
+		return a.builtinFunctionValue(name, e.Arguments, function.Token)
+	case *InfixExpression:
+		if method, ok := function.Right.(*Identifier); ok && function.Operator == "." {
+			return a.methodValue(a.evaluateValue(function.Left), method.Value, e.Arguments, method.Token)
+		}
+	}
+	return unknownValue()
+}
+
+// isUserFunction reports whether name is a .function, .macro or .pseudocommand of the document
+func (a *SemanticAnalyzer) isUserFunction(name string) bool {
+	if a.scope == nil {
+		return false
+	}
+	symbol, found := a.scope.FindSymbol(name)
+	return found && (symbol.Kind == Function || symbol.Kind == Macro || symbol.Kind == PseudoCommand)
+}
+
+// evaluateArguments evaluates call arguments. The second result is the first invalid or
+// unknown argument, the call's value is then that argument's.
+func (a *SemanticAnalyzer) evaluateArguments(args []Expression) ([]Value, *Value) {
+	values := make([]Value, len(args))
+	var unknown *Value
+	for i, arg := range args {
+		values[i] = a.evaluateValue(arg)
+		if values[i].Kind == ValueInvalid {
+			return nil, &values[i]
+		}
+		if values[i].Kind == ValueUnknown && unknown == nil {
+			unknown = &values[i]
+		}
+	}
+	return values, unknown
+}
+
+// mathFunctions are the built-in functions from Java's Math that take numbers
+var mathFunctions = map[string]func(args []float64) float64{
+	"abs":           func(x []float64) float64 { return math.Abs(x[0]) },
+	"acos":          func(x []float64) float64 { return math.Acos(x[0]) },
+	"asin":          func(x []float64) float64 { return math.Asin(x[0]) },
+	"atan":          func(x []float64) float64 { return math.Atan(x[0]) },
+	"atan2":         func(x []float64) float64 { return math.Atan2(x[0], x[1]) },
+	"cbrt":          func(x []float64) float64 { return math.Cbrt(x[0]) },
+	"ceil":          func(x []float64) float64 { return math.Ceil(x[0]) },
+	"cos":           func(x []float64) float64 { return math.Cos(x[0]) },
+	"cosh":          func(x []float64) float64 { return math.Cosh(x[0]) },
+	"exp":           func(x []float64) float64 { return math.Exp(x[0]) },
+	"expm1":         func(x []float64) float64 { return math.Expm1(x[0]) },
+	"floor":         func(x []float64) float64 { return math.Floor(x[0]) },
+	"hypot":         func(x []float64) float64 { return math.Hypot(x[0], x[1]) },
+	"IEEEremainder": func(x []float64) float64 { return math.Remainder(x[0], x[1]) },
+	"log":           func(x []float64) float64 { return math.Log(x[0]) },
+	"log10":         func(x []float64) float64 { return math.Log10(x[0]) },
+	"log1p":         func(x []float64) float64 { return math.Log1p(x[0]) },
+	"max":           func(x []float64) float64 { return math.Max(x[0], x[1]) },
+	"min":           func(x []float64) float64 { return math.Min(x[0], x[1]) },
+	"mod":           func(x []float64) float64 { return float64(int64(x[0]) % int64(x[1])) },
+	"pow":           func(x []float64) float64 { return math.Pow(x[0], x[1]) },
+	"round":         func(x []float64) float64 { return math.Floor(x[0] + 0.5) },
+	"signum":        func(x []float64) float64 { return signum(x[0]) },
+	"sin":           func(x []float64) float64 { return math.Sin(x[0]) },
+	"sinh":          func(x []float64) float64 { return math.Sinh(x[0]) },
+	"sqrt":          func(x []float64) float64 { return math.Sqrt(x[0]) },
+	"tan":           func(x []float64) float64 { return math.Tan(x[0]) },
+	"tanh":          func(x []float64) float64 { return math.Tanh(x[0]) },
+	"toDegrees":     func(x []float64) float64 { return x[0] * 180 / math.Pi },
+	"toRadians":     func(x []float64) float64 { return x[0] * math.Pi / 180 },
+}
+
+// numberStringBases are the functions that format a number as a string
+var numberStringBases = map[string]int{"toIntString": 10, "toHexString": 16, "toBinaryString": 2, "toOctalString": 8}
+
+// mathFunctionArity is the number of arguments of the two-argument math functions
+var mathFunctionArity = map[string]int{"atan2": 2, "hypot": 2, "IEEEremainder": 2, "max": 2, "min": 2, "mod": 2, "pow": 2}
+
+func signum(x float64) float64 {
+	switch {
+	case x > 0:
+		return 1
+	case x < 0:
+		return -1
+	}
+	return x
+}
+
+// builtinFunctionValue evaluates a call of a built-in function
+func (a *SemanticAnalyzer) builtinFunctionValue(name string, args []Expression, token Token) Value {
+	switch name {
+	case "List":
+		// List(n) is n nulls, the elements are added with add()
+		if len(args) > 1 {
+			return invalidValue(token, "List() takes a size, got %d arguments; add the elements with List().add()", len(args))
+		}
+		values, unknown := a.evaluateArguments(args)
+		if unknown != nil {
+			return *unknown
+		}
+		size := int64(0)
+		if len(values) == 1 {
+			n, ok := values[0].Int()
+			if !ok || n < 0 {
+				return invalidValue(token, "List() needs a size that is a positive Number, got %s", values[0].String())
+			}
+			size = n
+		}
+		if size > maxListSize {
+			return unknownValue()
+		}
+		items := make([]Value, size)
+		for i := range items {
+			items[i] = nullValue()
+		}
+		return listValue(items)
+	case "Hashtable":
+		if len(args) > 0 {
+			return unknownValue()
+		}
+		return hashtableValue()
+	}
+
+	function, isMath := mathFunctions[name]
+	base, isString := numberStringBases[name]
+	if !isMath && !isString {
+		// random(), file loading and 3D functions have no value the analyzer can know
+		return unknownValue()
+	}
+	arity := mathFunctionArity[name]
+	if arity == 0 {
+		arity = 1
+	}
+	if isString && len(args) == 2 {
+		arity = 2 // toIntString(value, minDigits)
+	}
+	if len(args) != arity {
+		// validateBuiltinFunctionCall reports the argument count
+		return unknownValue()
+	}
+
+	values, unknown := a.evaluateArguments(args)
+	if unknown != nil {
+		return *unknown
+	}
+	numbers := make([]float64, len(values))
+	for i, value := range values {
+		if value.Kind != ValueNumber {
+			return invalidValue(token, "%s() needs a Number, got %s", name, value.TypeName())
+		}
+		numbers[i] = value.Number
+	}
+
+	if isString {
+		return stringValue(numberString(base, numbers))
+	}
+	if name == "mod" && int64(numbers[1]) == 0 {
+		return invalidValue(token, "Division by zero")
+	}
+	return numberValue(function(numbers))
+}
+
+// numberString implements toIntString, toHexString, toBinaryString and toOctalString; the
+// optional second number is the minimum number of digits
+func numberString(base int, numbers []float64) string {
+	text := strconv.FormatInt(int64(numbers[0]), base)
+	if len(numbers) == 2 {
+		negative := strings.HasPrefix(text, "-")
+		digits := strings.TrimPrefix(text, "-")
+		if padding := int(numbers[1]) - len(digits); padding > 0 {
+			digits = strings.Repeat("0", padding) + digits
+		}
+		if negative {
+			digits = "-" + digits
+		}
+		text = digits
+	}
+	return text
+}
+
+// methodValue calls a method of a string, list or hashtable
+func (a *SemanticAnalyzer) methodValue(receiver Value, method string, args []Expression, token Token) Value {
+	if !receiver.Known() {
+		return receiver
+	}
+	values, unknown := a.evaluateArguments(args)
+	if unknown != nil && unknown.Kind == ValueInvalid {
+		return *unknown
+	}
+
+	switch receiver.Kind {
+	case ValueString:
+		return stringMethod(receiver.Text, method, values, unknown != nil, token)
+	case ValueList:
+		return listMethod(receiver, method, values, token)
+	case ValueHashtable:
+		return hashtableMethod(receiver, method, values, token)
+	}
+	return invalidValue(token, "A %s has no method '%s'", receiver.TypeName(), method)
+}
+
+// wantArguments checks the argument count of a method
+func wantArguments(method string, values []Value, count int, token Token) (Value, bool) {
+	if len(values) != count {
+		return invalidValue(token, "%s() takes %d argument(s), got %d", method, count, len(values)), false
+	}
+	return Value{}, true
+}
+
+// indexArgument checks a list or string index
+func indexArgument(method string, index Value, size int, token Token) (int, Value, bool) {
+	if index.Kind == ValueUnknown {
+		return 0, unknownValue(), false
+	}
+	n, ok := index.Int()
+	if !ok {
+		return 0, invalidValue(token, "%s() needs a Number as index, got %s", method, index.TypeName()), false
+	}
+	if n < 0 || n >= int64(size) {
+		return 0, invalidValue(token, "Index %d is out of range (size %d)", n, size), false
+	}
+	return int(n), Value{}, true
+}
+
+func stringMethod(text, method string, values []Value, anyUnknown bool, token Token) Value {
+	switch method {
+	case "size", "length":
+		if result, ok := wantArguments(method, values, 0, token); !ok {
+			return result
+		}
+		return numberValue(float64(len(text)))
+	case "toUpperCase", "toLowerCase", "asNumber", "asBoolean":
+		if len(values) > 1 || (len(values) == 1 && method != "asNumber") {
+			return invalidValue(token, "%s() takes no arguments, got %d", method, len(values))
+		}
+	case "charAt":
+		if result, ok := wantArguments(method, values, 1, token); !ok {
+			return result
+		}
+	case "substring":
+		if len(values) != 1 && len(values) != 2 {
+			return invalidValue(token, "substring() takes 1 or 2 arguments, got %d", len(values))
+		}
+	default:
+		return invalidValue(token, "A String has no method '%s'", method)
+	}
+	if anyUnknown {
+		return unknownValue()
+	}
+
+	switch method {
+	case "toUpperCase":
+		return stringValue(strings.ToUpper(text))
+	case "toLowerCase":
+		return stringValue(strings.ToLower(text))
+	case "asNumber":
+		base := int64(10)
+		if len(values) == 1 {
+			base, _ = values[0].Int()
+		}
+		if base == 10 {
+			if number, err := strconv.ParseFloat(strings.TrimSpace(text), 64); err == nil {
+				return numberValue(number)
+			}
+		} else if base >= 2 && base <= 36 {
+			if number, err := strconv.ParseInt(strings.TrimSpace(text), int(base), 64); err == nil {
+				return numberValue(float64(number))
+			}
+		}
+		return invalidValue(token, "Can't convert %s to a Number", strconv.Quote(text))
+	case "asBoolean":
+		switch strings.ToLower(strings.TrimSpace(text)) {
+		case "true":
+			return booleanValue(true)
+		case "false":
+			return booleanValue(false)
+		}
+		return invalidValue(token, "Can't convert %s to a Boolean", strconv.Quote(text))
+	case "charAt":
+		index, result, ok := indexArgument(method, values[0], len(text), token)
+		if !ok {
+			return result
+		}
+		return stringValue(text[index : index+1])
+	case "substring":
+		start, result, ok := indexArgument(method, values[0], len(text)+1, token)
+		if !ok {
+			return result
+		}
+		end := len(text)
+		if len(values) == 2 {
+			if end, result, ok = indexArgument(method, values[1], len(text)+1, token); !ok {
+				return result
+			}
+		}
+		if end < start {
+			return invalidValue(token, "substring() end %d is before start %d", end, start)
+		}
+		return stringValue(text[start:end])
+	}
+	return unknownValue()
+}
+
+func listMethod(receiver Value, method string, values []Value, token Token) Value {
+	list := receiver.list
+	switch method {
+	case "add":
+		if len(list.items)+len(values) > maxListSize {
+			return unknownValue()
+		}
+		list.items = append(list.items, values...)
+		return receiver
+	case "addAll":
+		if result, ok := wantArguments(method, values, 1, token); !ok {
+			return result
+		}
+		if values[0].Kind == ValueUnknown {
+			return unknownValue()
+		}
+		if values[0].Kind != ValueList {
+			return invalidValue(token, "addAll() needs a List, got %s", values[0].TypeName())
+		}
+		list.items = append(list.items, values[0].clone().list.items...)
+		return receiver
+	case "get":
+		if result, ok := wantArguments(method, values, 1, token); !ok {
+			return result
+		}
+		index, result, ok := indexArgument(method, values[0], len(list.items), token)
+		if !ok {
+			return result
+		}
+		return list.items[index]
+	case "set":
+		if result, ok := wantArguments(method, values, 2, token); !ok {
+			return result
+		}
+		index, result, ok := indexArgument(method, values[0], len(list.items), token)
+		if !ok {
+			return result
+		}
+		list.items[index] = values[1]
+		return values[1]
+	case "remove":
+		if result, ok := wantArguments(method, values, 1, token); !ok {
+			return result
+		}
+		index, result, ok := indexArgument(method, values[0], len(list.items), token)
+		if !ok {
+			return result
+		}
+		removed := list.items[index]
+		list.items = append(list.items[:index], list.items[index+1:]...)
+		return removed
+	case "size":
+		if result, ok := wantArguments(method, values, 0, token); !ok {
+			return result
+		}
+		return numberValue(float64(len(list.items)))
+	case "reverse":
+		for i, j := 0, len(list.items)-1; i < j; i, j = i+1, j-1 {
+			list.items[i], list.items[j] = list.items[j], list.items[i]
+		}
+		return receiver
+	case "sort":
+		sort.SliceStable(list.items, func(i, j int) bool {
+			left, right := list.items[i], list.items[j]
+			if left.Kind == ValueString && right.Kind == ValueString {
+				return left.Text < right.Text
+			}
+			return left.Number < right.Number
+		})
+		return receiver
+	case "shuffle":
+		// The order is random, the elements stay
+		for i := range list.items {
+			list.items[i] = unknownValue()
+		}
+		return receiver
+	case "lock":
+		return receiver
+	}
+	return invalidValue(token, "A List has no method '%s'", method)
+}
+
+func hashtableMethod(receiver Value, method string, values []Value, token Token) Value {
+	table := receiver.table
+	for _, value := range values {
+		if value.Kind == ValueUnknown && method != "put" {
+			return unknownValue()
+		}
+	}
+
+	switch method {
+	case "put":
+		if len(values) == 0 || len(values)%2 != 0 {
+			return invalidValue(token, "put() takes key/value pairs, got %d argument(s)", len(values))
+		}
+		for i := 0; i < len(values); i += 2 {
+			if values[i].Kind == ValueUnknown {
+				table.incomplete = true
+				continue
+			}
+			table.put(values[i], values[i+1])
+		}
+		return receiver
+	}
+	if table.incomplete {
+		return unknownValue()
+	}
+
+	switch method {
+	case "get":
+		if result, ok := wantArguments(method, values, 1, token); !ok {
+			return result
+		}
+		if value, found := table.entries[values[0].key()]; found {
+			return value
+		}
+		return nullValue()
+	case "containsKey":
+		if result, ok := wantArguments(method, values, 1, token); !ok {
+			return result
+		}
+		_, found := table.entries[values[0].key()]
+		return booleanValue(found)
+	case "remove":
+		if result, ok := wantArguments(method, values, 1, token); !ok {
+			return result
+		}
+		removed, found := table.entries[values[0].key()]
+		if !found {
+			return nullValue()
+		}
+		table.remove(values[0])
+		return removed
+	case "keys":
+		if result, ok := wantArguments(method, values, 0, token); !ok {
+			return result
+		}
+		keys := make([]Value, len(table.keys))
+		copy(keys, table.keys)
+		return listValue(keys)
+	case "lock":
+		return receiver
+	}
+	return invalidValue(token, "A Hashtable has no method '%s'", method)
+}
+
+// evaluatedSymbolValue returns the value the analyzer computed for a constant or variable
+// of the scope tree, for hover
+func evaluatedSymbolValue(uri string, symbol *Symbol) (Value, bool) {
+	if symbol == nil || (symbol.Kind != Constant && symbol.Kind != Variable) {
+		return Value{}, false
+	}
+	symbolStore.RLock()
+	context := symbolStore.contexts[uri]
+	symbolStore.RUnlock()
+	if context == nil {
+		return Value{}, false
+	}
+
+	labels := context.DefinedLabels
+	if symbol.Scope != nil && symbol.Scope.Uri != "" && symbol.Scope.Uri != uri {
+		labels = context.ImportedLabels
+	}
+	for qualifiedName, candidate := range labels {
+		if isLaterIteration(qualifiedName) || context.inMacroExpansion(qualifiedName) {
+			continue
+		}
+		if candidate.Kind == symbol.Kind && candidate.Position == symbol.Position && normalizeLabel(candidate.Name) == normalizeLabel(symbol.Name) {
+			if candidate.Evaluated == nil || !candidate.Evaluated.Known() {
+				return Value{}, false
+			}
+			return *candidate.Evaluated, true
+		}
+	}
+	return Value{}, false
+}
+
+// valueMarkdown formats a constant or variable with its value and type for hover
+func valueMarkdown(symbol *Symbol, value Value) string {
+	markdown := fmt.Sprintf("(%s) **%s** = `%s`\n\n**Type:** %s", symbol.Kind.String(), symbol.Name, value.String(), value.TypeName())
+	if addr, ok := value.Int(); ok && addr >= 0 && float64(addr) == value.Number {
+		markdown += fmt.Sprintf(" (`$%X`)", addr)
+	}
+	return markdown
+}
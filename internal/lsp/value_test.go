@@ -0,0 +1,90 @@
+package lsp
+
+import "testing"
+
+// evaluateTestExpression evaluates an expression as the value of a .const
+func evaluateTestExpression(t *testing.T, expression string) (Value, []Diagnostic) {
+	t.Helper()
+	_, context, diagnostics := ParseDocument("file:///value_test.asm", ".const result = "+expression+"\n")
+	if context == nil {
+		t.Fatalf("%s was not analysed: %v", expression, diagnostics)
+	}
+	symbol, found := context.lookupLabel("result")
+	if !found || symbol.Evaluated == nil {
+		t.Fatalf("%s has no value", expression)
+	}
+	return *symbol.Evaluated, diagnostics
+}
+
+func TestEvaluateValue(t *testing.T) {
+	loadTestData(t)
+	tests := []struct {
+		expression string
+		want       Value
+	}{
+		{"7/2", numberValue(3.5)},
+		{"1/3*3", numberValue(1)},
+		{"2-5", numberValue(-3)},
+		{"-$10+4", numberValue(-12)},
+		{"<$1234", numberValue(0x34)},
+		{">$1234", numberValue(0x12)},
+		{">$123456", numberValue(0x34)},
+		{"<-1", numberValue(0xff)},
+		{"$f0 | %1010 & 7", numberValue(0xf2)},
+		{"1 << 4 >> 2", numberValue(4)},
+		{"true && !false", booleanValue(true)},
+		{"3 > 2 && 1 == 2", booleanValue(false)},
+		{"!(1 < 2) || 2 != 3", booleanValue(true)},
+		{"\"sprite\" + 3", stringValue("sprite3")},
+		{"1 + \"st\"", stringValue("1st")},
+		{"\"a\" + \"b\" == \"ab\"", booleanValue(true)},
+		{"List().add(1, 2, 3).get(2)", numberValue(3)},
+		{"\"hello\".charAt(1)", stringValue("e")},
+	}
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			got, diagnostics := evaluateTestExpression(t, test.expression)
+			if !got.equals(test.want) || got.Kind != test.want.Kind {
+				t.Errorf("= %s (%s), want %s (%s)", got, got.TypeName(), test.want, test.want.TypeName())
+			}
+			for _, diagnostic := range diagnostics {
+				if diagnostic.Severity == SeverityError {
+					t.Errorf("unexpected error: %s", diagnostic.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluateValueErrors(t *testing.T) {
+	loadTestData(t)
+	tests := []struct {
+		expression string
+		error      string
+	}{
+		{"1/0", "Division by zero"},
+		{"5 % 0", "Division by zero"},
+		{"List().add(1, 2).get(5)", "Index 5 is out of range (size 2)"},
+		{"List().get(-1)", "Index -1 is out of range (size 0)"},
+		{"List(2).get(-1)", "Index -1 is out of range (size 2)"},
+		{"List(2).remove(9)", "Index 9 is out of range (size 2)"},
+		{"List(2).set(2, 0)", "Index 2 is out of range (size 2)"},
+		{"List(1, 2).get(5)", "List() takes a size, got 2 arguments"},
+		{"\"abc\".charAt(3)", "Index 3 is out of range (size 3)"},
+		{"!1", "Operator '!' can't be used on a Number"},
+		{"1 && true", "Operator '&&' can't be used on a Number"},
+		{"\"a\" - 1", "Operator '-' can't be used on String and Number"},
+		{"1 << 64", "Shift by 64 is out of range"},
+	}
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			got, diagnostics := evaluateTestExpression(t, test.expression)
+			if got.Kind != ValueInvalid {
+				t.Errorf("= %s, want an invalid value", got)
+			}
+			if !hasDiagnostic(diagnostics, test.error) {
+				t.Errorf("no diagnostic %q in %v", test.error, diagnostics)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package lsp
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "c64.nvim/internal/log"
+)
+
+// IndexedFile represents a source file that was parsed because another file #import's it
+type IndexedFile struct {
+	URI         string
+	Path        string
+	ContentHash string
+	ModTime     time.Time
+	FromEditor  bool  // true if the content came from an open document instead of disk
+	StartPC     int64 // Program counter of the #import the file was analysed at
+	Scope       *Scope
+	Context     *AnalysisContext
+
+	// Files the analysis had already included before this one, see includedFiles.key, and
+	// the files it included itself
+	IncludedBefore string
+	Included       []*IndexedFile
+}
+
+// includedFiles records the files a root analysis has assembled so far. It is shared with
+// the analyses of its imported files, so a file with #importonce is only included once.
+type includedFiles struct {
+	files map[string]*IndexedFile // First inclusion of each file, by URI
+	order []*IndexedFile
+}
+
+func newIncludedFiles() *includedFiles {
+	return &includedFiles{files: make(map[string]*IndexedFile)}
+}
+
+// add records the inclusion of a file, keeping the first one
+func (f *includedFiles) add(file *IndexedFile) {
+	if _, exists := f.files[file.URI]; exists {
+		return
+	}
+	f.files[file.URI] = file
+	f.order = append(f.order, file)
+}
+
+// lookup returns the first inclusion of a file, or nil
+func (f *includedFiles) lookup(uri string) *IndexedFile {
+	return f.files[uri]
+}
+
+// key identifies the included files with the address and content they were included with.
+// An imported file's analysis depends on it through the #importonce files it skips.
+func (f *includedFiles) key() string {
+	keys := make([]string, 0, len(f.order))
+	for _, file := range f.order {
+		keys = append(keys, fmt.Sprintf("%s@%d#%s", file.URI, file.StartPC, file.ContentHash))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "\n")
+}
+
+// workspaceIndex holds parsed #import targets, keyed by URI, plus the workspace root
+var workspaceIndex = struct {
+	sync.RWMutex
+	root  string
+	files map[string]*IndexedFile
+}{
+	files: make(map[string]*IndexedFile),
+}
+
+// SetWorkspaceRoot sets the directory that relative library dirs are resolved against
+func SetWorkspaceRoot(root string) {
+	workspaceIndex.Lock()
+	workspaceIndex.root = uriToPath(root)
+	workspaceIndex.Unlock()
+	log.Info("Workspace root set to %s", uriToPath(root))
+}
+
+// uriToPath converts a file:// URI to a filesystem path. Plain paths are returned unchanged.
+func uriToPath(uri string) string {
+	if !strings.HasPrefix(uri, "file://") {
+		return uri
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return strings.TrimPrefix(uri, "file://")
+	}
+	path := parsed.Path
+	// Windows: file:///C:/foo -> C:/foo
+	if len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return filepath.FromSlash(path)
+}
+
+// pathToURI converts a filesystem path to a file:// URI
+func pathToURI(path string) string {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		absPath = path
+	}
+	slashed := filepath.ToSlash(absPath)
+	if !strings.HasPrefix(slashed, "/") {
+		slashed = "/" + slashed
+	}
+	return (&url.URL{Scheme: "file", Path: slashed}).String()
+}
+
+// sameFile reports whether two URIs (or plain paths) refer to the same file
+func sameFile(a, b string) bool {
+	pathA, errA := filepath.Abs(uriToPath(a))
+	pathB, errB := filepath.Abs(uriToPath(b))
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return pathA == pathB
+}
+
+// importSearchDirs returns the directories searched for an #import, in priority order:
+// the directory of the importing file, then the configured library dirs
+func importSearchDirs(importingURI string) []string {
+	dirs := []string{filepath.Dir(uriToPath(importingURI))}
+
+	workspaceIndex.RLock()
+	root := workspaceIndex.root
+	workspaceIndex.RUnlock()
+
+	config := GetDocumentConfig(importingURI)
+	for _, dir := range config.LibraryDirs {
+		if dir == "" {
+			continue
+		}
+		if strings.HasPrefix(dir, "~") {
+			if homeDir, err := os.UserHomeDir(); err == nil {
+				dir = filepath.Join(homeDir, strings.TrimPrefix(dir, "~"))
+			}
+		}
+		if !filepath.IsAbs(dir) && root != "" {
+			dir = filepath.Join(root, dir)
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// resolveImportPath finds the file referenced by an #import relative to the importing file
+// or one of the configured library dirs
+func resolveImportPath(importingURI, filename string) (string, bool) {
+	if filepath.IsAbs(filename) {
+		if info, err := os.Stat(filename); err == nil && !info.IsDir() {
+			return filename, true
+		}
+		return "", false
+	}
+
+	for _, dir := range importSearchDirs(importingURI) {
+		candidate := filepath.Join(dir, filename)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// openDocumentText returns the editor content for a file if it is currently open
+func openDocumentText(path string) (string, bool) {
+	documentStore.RLock()
+	defer documentStore.RUnlock()
+	for uri, text := range documentStore.documents {
+		if sameFile(uri, path) {
+			return text, true
+		}
+	}
+	return "", false
+}
+
+// loadImportedFile returns the parsed form of an imported file, using the index when the
+// file is unchanged and was analysed at the same startPC after the same included files.
+// importChain holds the URIs currently being imported; a file that is already on the chain
+// is an #import cycle and yields nil. The file and the files it includes are added to
+// included. ctx is the importing document's analysis budget.
+func loadImportedFile(ctx context.Context, path string, importChain []string, startPC int64, included *includedFiles) *IndexedFile {
+	uri := pathToURI(path)
+	for _, chainURI := range importChain {
+		if sameFile(chainURI, uri) {
+			log.Debug("loadImportedFile: skipping circular import of %s", uri)
+			return nil
+		}
+	}
+
+	// Prefer unsaved editor content over the file on disk
+	text, fromEditor := openDocumentText(path)
+	var modTime time.Time
+	if !fromEditor {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Warn("loadImportedFile: cannot stat %s: %v", path, err)
+			return nil
+		}
+		modTime = info.ModTime()
+
+		workspaceIndex.RLock()
+		cached, exists := workspaceIndex.files[uri]
+		workspaceIndex.RUnlock()
+		if exists && !cached.FromEditor && cached.ModTime.Equal(modTime) && cached.StartPC == startPC &&
+			cached.IncludedBefore == included.key() {
+			return includeCachedFile(cached, included)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Warn("loadImportedFile: cannot read %s: %v", path, err)
+			return nil
+		}
+		text = string(data)
+	}
+
+	contentHash := calculateContentHash(text)
+	workspaceIndex.RLock()
+	cached, exists := workspaceIndex.files[uri]
+	workspaceIndex.RUnlock()
+	includedBefore := included.key()
+	if exists && cached.ContentHash == contentHash && cached.StartPC == startPC && cached.IncludedBefore == includedBefore {
+		return includeCachedFile(cached, included)
+	}
+
+	// Parse outside the lock - imported files may import further files
+	log.Debug("loadImportedFile: indexing %s", uri)
+	before := len(included.order)
+	scope, context, _ := parseDocumentWithImports(ctx, uri, text, importChain, startPC, included)
+
+	file := &IndexedFile{
+		URI:            uri,
+		Path:           path,
+		ContentHash:    contentHash,
+		ModTime:        modTime,
+		FromEditor:     fromEditor,
+		StartPC:        startPC,
+		Scope:          scope,
+		Context:        context,
+		IncludedBefore: includedBefore,
+		Included:       append([]*IndexedFile{}, included.order[before:]...),
+	}
+	included.add(file)
+
+	// A partial analysis (out of time) is used once but not indexed
+	if context != nil && context.Incomplete {
+		return file
+	}
+
+	workspaceIndex.Lock()
+	workspaceIndex.files[uri] = file
+	workspaceIndex.Unlock()
+
+	return file
+}
+
+// includeCachedFile records an indexed file and the files its analysis included, as if it
+// had been analysed again
+func includeCachedFile(file *IndexedFile, included *includedFiles) *IndexedFile {
+	for _, nested := range file.Included {
+		included.add(nested)
+	}
+	included.add(file)
+	return file
+}
+
+// invalidateIndexedFile drops a file and every indexed file that (transitively) imports it
+func invalidateIndexedFile(uri string) {
+	workspaceIndex.Lock()
+	defer workspaceIndex.Unlock()
+
+	invalid := []string{}
+	for indexedURI := range workspaceIndex.files {
+		if sameFile(indexedURI, uri) {
+			invalid = append(invalid, indexedURI)
+		}
+	}
+	if len(invalid) == 0 {
+		invalid = append(invalid, uri)
+	}
+
+	for len(invalid) > 0 {
+		current := invalid[0]
+		invalid = invalid[1:]
+		delete(workspaceIndex.files, current)
+
+		for indexedURI, file := range workspaceIndex.files {
+			if file.Context != nil && containsFile(file.Context.ImportedFiles, current) {
+				invalid = append(invalid, indexedURI)
+			}
+		}
+	}
+}
+
+// containsFile reports whether uri refers to one of the given files
+func containsFile(uris []string, uri string) bool {
+	for _, candidate := range uris {
+		if sameFile(candidate, uri) {
+			return true
+		}
+	}
+	return false
+}
+
+// importsFile reports whether an analysis context (transitively) imports the given file
+func importsFile(context *AnalysisContext, uri string) bool {
+	return importsFileVisited(context, uri, make(map[string]bool))
+}
+
+func importsFileVisited(context *AnalysisContext, uri string, visited map[string]bool) bool {
+	if context == nil {
+		return false
+	}
+	for _, imported := range context.ImportedFiles {
+		if sameFile(imported, uri) {
+			return true
+		}
+		if visited[imported] {
+			continue
+		}
+		visited[imported] = true
+
+		workspaceIndex.RLock()
+		file, exists := workspaceIndex.files[imported]
+		workspaceIndex.RUnlock()
+		if exists && importsFileVisited(file.Context, uri, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// findImportingDocuments returns the open documents whose analysis depends on the given file
+func findImportingDocuments(uri string) []string {
+	symbolStore.RLock()
+	defer symbolStore.RUnlock()
+
+	dependents := []string{}
+	for docURI, context := range symbolStore.contexts {
+		if docURI != uri && importsFile(context, uri) {
+			dependents = append(dependents, docURI)
+		}
+	}
+	return dependents
+}
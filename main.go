@@ -1,6 +1,7 @@
 package main
 
 import (
+	"embed"
 	"flag"
 	"fmt"
 	"os"
@@ -12,8 +13,15 @@ import (
 	lsp "c64.nvim/internal/lsp"
 )
 
+// defaultData holds the JSON Source of Truth files built into the binary. Files in
+// ~/.config/kickass_ls and <workspace>/.kickass_ls override them.
+//
+//go:embed mnemonic.json kickass.json c64memory.json
+var defaultData embed.FS
+
 func main() {
 	// Log file management is handled by internal/log package
+	lsp.SetEmbeddedData(defaultData)
 
 	// Parse command line flags
 	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
@@ -68,6 +76,12 @@ func main() {
 		return
 	}
 
+	// Check for the assemble subcommand: kickass_ls assemble file.asm -o out.prg
+	if args := flag.CommandLine.Args(); len(args) > 0 && args[0] == "assemble" {
+		runAssembleMode(args[1:])
+		return
+	}
+
 	// Check for LSP feature testing modes
 	if *testCompletion != "" {
 		runCompletionTest(*testCompletion, mnemonicPath, kickassDir)
@@ -185,6 +199,64 @@ func runTestMode(filename, mnemonicPath, kickassDir string) {
 	}
 }
 
+// runAssembleMode assembles a source file and writes a .prg with load address
+func runAssembleMode(args []string) {
+	flags := flag.NewFlagSet("assemble", flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	output := flags.String("o", "", "Output .prg file (default: source file with .prg extension)")
+
+	// Accept the source file before or after the flags
+	filename := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		filename, args = args[0], args[1:]
+	}
+	if err := flags.Parse(args); err != nil {
+		os.Exit(1)
+	}
+	if filename == "" {
+		filename = flags.Arg(0)
+	}
+	if filename == "" {
+		fmt.Fprintln(os.Stderr, "Usage: kickass_ls assemble <file.asm> [-o out.prg]")
+		os.Exit(1)
+	}
+	if *output == "" {
+		*output = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".prg"
+	}
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading file %s: %v\n", filename, err)
+		os.Exit(3)
+	}
+	if err := initTestMode(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing: %v\n", err)
+		os.Exit(3)
+	}
+
+	program, errors := lsp.Assemble(filename, string(content))
+	for _, assemblyError := range errors {
+		fmt.Fprintf(os.Stderr, "%s:%d:%d: error: %s\n", assemblyError.File, assemblyError.Line, assemblyError.Column, assemblyError.Message)
+	}
+	if len(errors) > 0 {
+		fmt.Fprintf(os.Stderr, "\nAssembly failed with %d errors\n", len(errors))
+		os.Exit(2)
+	}
+
+	prg, err := program.PRG()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	if err := os.WriteFile(*output, prg, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", *output, err)
+		os.Exit(3)
+	}
+
+	loadAddress := int(prg[0]) | int(prg[1])<<8
+	fmt.Printf("Wrote %s: $%04X-$%04X (%d bytes)\n", *output, loadAddress, loadAddress+len(prg)-3, len(prg)-2)
+}
+
 // initTestMode initializes LSP components for test modes using config directory
 func initTestMode() error {
 	// Get config directory
@@ -225,6 +297,11 @@ func initTestMode() error {
 	// Initialize lexer token definitions AFTER all JSON files are loaded
 	lsp.InitTokenDefs()
 
+	// Initialize ProcessorContext (used by the context-aware parser)
+	if err := lsp.InitializeProcessorContext(configDir); err != nil {
+		return fmt.Errorf("error initializing processor context: %v", err)
+	}
+
 	return nil
 }
 
@@ -450,7 +527,7 @@ func runSignatureTest(filePos, mnemonicPath, kickassDir string) {
 	}
 
 	// Generate signature help
-	signature, found := lsp.GenerateSignatureHelp(scope, currentLine, char)
+	signature, found := lsp.GenerateSignatureHelp(scope, line, currentLine, char)
 
 	// Output results
 	fmt.Printf("Signature help at %s:%d:%d:\n", file, line+1, char+1)